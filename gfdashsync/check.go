@@ -0,0 +1,121 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// Check is the outcome of a single check of ModeCheck.
+type Check struct {
+	Name string
+	// Detail describes what was found if the check succeeded.
+	Detail string
+	Err    error
+}
+
+// runChecks verifies that Grafana and all Git projects are accessible and
+// that the history can be read, without fetching or committing anything.
+func runChecks(ctx context.Context, opt *Options, transport http.RoundTripper) []Check {
+	var checks []Check
+
+	c := Check{Name: "grafana", Detail: "dashboards can be listed"}
+	gf, err := NewGrafana(ctx, opt.GrafanaAPI, opt.GrafanaToken, opt.GrafanaUser, opt.GrafanaPassword, opt.GrafanaRPS, opt.grafanaTransport(transport))
+	if err == nil {
+		err = gf.checkAccess()
+	}
+	c.Err = err
+	checks = append(checks, c)
+
+	for _, pid := range opt.GitPIDs {
+		checks = append(checks, checkProject(ctx, opt, pid, transport)...)
+	}
+
+	return checks
+}
+
+// checkProject checks the access to the project, its branches and their
+// history. The later checks are skipped if the project is not accessible.
+func checkProject(ctx context.Context, opt *Options, pid int, transport http.RoundTripper) []Check {
+	client, err := newGitlabClient(opt.GitAPI, opt.GitAuth, opt.GitToken, transport)
+	if err != nil {
+		return []Check{{Name: fmt.Sprintf("project %d", pid), Err: err}}
+	}
+
+	g := &Gitlab{
+		ctx:           ctx,
+		client:        client,
+		pid:           pid,
+		history:       make(History),
+		historyAction: gitlab.FileUpdate,
+		instance:      opt.Instance,
+	}
+
+	checks := []Check{{Name: fmt.Sprintf("project %d", pid), Detail: "accessible", Err: g.checkProject()}}
+	if checks[0].Err != nil {
+		return checks
+	}
+
+	branches := opt.gitBranches()
+	for _, b := range branches {
+		name := fmt.Sprintf("project %d", pid)
+		if len(branches) > 1 {
+			name = fmt.Sprintf("project %d branch %q", pid, b)
+		}
+		g.branch = b
+		g.history = make(History)
+		checks = append(checks, checkBranch(ctx, opt, g, name, transport)...)
+	}
+
+	return checks
+}
+
+// checkBranch checks the branch of the project and its history. The name of
+// the history check is prefixed with name.
+func checkBranch(ctx context.Context, opt *Options, g *Gitlab, name string, transport http.RoundTripper) []Check {
+	var checks []Check
+	pid := g.pid
+
+	if opt.GitTarget == TargetRepo {
+		branch := Check{Name: fmt.Sprintf("project %d branch %q", pid, g.branch), Detail: "exists"}
+		if branch.Err = g.checkBranch(""); branch.Err != nil && opt.GitCreateBranch {
+			// A missing branch is created from the start branch, which
+			// holds the history until then.
+			g.branch = opt.GitStartBranch
+			if err := g.checkBranch(""); err == nil {
+				branch.Err = nil
+				branch.Detail = fmt.Sprintf("will be created from %q", opt.GitStartBranch)
+			}
+		}
+		checks = append(checks, branch)
+		if branch.Err != nil {
+			return checks
+		}
+	}
+
+	history := Check{Name: name + " history"}
+	var n int
+	if opt.GitTarget == TargetWiki {
+		var w *Wiki
+		if w, history.Err = NewWiki(ctx, opt.GitAPI, opt.GitAuth, opt.GitToken, pid, transport); history.Err == nil {
+			n = len(w.history)
+		}
+	} else {
+		if history.Err = g.parseHistory(); history.Err != nil {
+			history.Err = fmt.Errorf("gitlab: error parsing history: %w", history.Err)
+		}
+		n = len(g.history)
+	}
+	history.Detail = fmt.Sprintf("%d files tracked", n)
+	if n == 0 {
+		history.Detail = "no history, all files will be created"
+	}
+
+	return append(checks, history)
+}
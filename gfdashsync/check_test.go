@@ -0,0 +1,57 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestRunCheck(t *testing.T) {
+	server, mux := MustRunServer(t)
+	mux.HandleFunc("/api/v4/projects/2", http.NotFound)
+
+	committed := false
+	mux.HandleFunc("/api/v4/projects/1/repository/commits", func(w http.ResponseWriter, r *http.Request) {
+		committed = true
+	})
+
+	res, err := Run(context.Background(), Options{
+		GrafanaAPI:   server.URL,
+		GrafanaToken: "token",
+		GitAPI:       server.URL,
+		GitToken:     "token",
+		GitPIDs:      []int{1, 2},
+		Mode:         ModeCheck,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]bool{
+		"grafana":                 true,
+		"project 1":               true,
+		`project 1 branch "main"`: true,
+		"project 1 history":       true,
+		"project 2":               false,
+	}
+	if len(res.Checks) != len(want) {
+		t.Fatalf("want %d checks, got %+v", len(want), res.Checks)
+	}
+	for _, c := range res.Checks {
+		ok, found := want[c.Name]
+		if !found {
+			t.Fatalf("unexpected check %q", c.Name)
+		}
+		if ok != (c.Err == nil) {
+			t.Errorf("%s: want ok %t, got error %v", c.Name, ok, c.Err)
+		}
+	}
+
+	if committed || res.Fetched != 0 {
+		t.Fatal("expected nothing to be fetched or committed")
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+)
+
+// codeownersKey and codeownersPath are the history key and the path of the
+// CODEOWNERS file.
+const (
+	codeownersKey  = "codeowners"
+	codeownersPath = "/CODEOWNERS"
+)
+
+// DefaultCodeownersTag is the default prefix of the tags naming the owners
+// of a dashboard.
+const DefaultCodeownersTag = "owner:"
+
+// codeownersFile returns a CODEOWNERS file assigning the file of each
+// dashboard to the owners named by its tags with the given prefix, e.g.
+// owner:@ops. Owners without @ are taken as user names. Dashboards without
+// owner tags are not listed. pathOf returns the repository path of the file
+// of a dashboard.
+func codeownersFile(dashboards []gapi.FolderDashboardSearchResponse, tagPrefix string, pathOf func(d gapi.FolderDashboardSearchResponse) (string, error)) (*File, error) {
+	var lines []string
+	for _, d := range dashboards {
+		var owners []string
+		for _, t := range d.Tags {
+			if !strings.HasPrefix(t, tagPrefix) {
+				continue
+			}
+			o := strings.TrimSpace(strings.TrimPrefix(t, tagPrefix))
+			if o == "" || strings.ContainsAny(o, " \t") {
+				continue
+			}
+			if !strings.Contains(o, "@") {
+				o = "@" + o
+			}
+			owners = append(owners, o)
+		}
+		if len(owners) == 0 {
+			continue
+		}
+
+		p, err := pathOf(d)
+		if err != nil {
+			log.Printf("error building path of dashboard %q with ID %d, not listing its owners: %v", d.Title, d.ID, err)
+			continue
+		}
+		lines = append(lines, codeownersPattern(p)+" "+strings.Join(owners, " "))
+	}
+	sort.Strings(lines)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Generated by gfdashsync from the %s tags of the dashboards.\n", tagPrefix)
+	for _, l := range lines {
+		buf.WriteString(l + "\n")
+	}
+
+	data := buf.Bytes()
+	return &File{
+		UID:         codeownersKey,
+		Path:        codeownersPath,
+		SHA256:      hash(data),
+		content:     data,
+		contentType: contentTypeText,
+	}, nil
+}
+
+// codeownersPattern returns the CODEOWNERS pattern matching the path p
+// relative to the repository root, with spaces and # escaped.
+func codeownersPattern(p string) string {
+	p = "/" + strings.TrimPrefix(p, "/")
+	p = strings.ReplaceAll(p, `\`, `\\`)
+	p = strings.ReplaceAll(p, " ", `\ `)
+	return strings.ReplaceAll(p, "#", `\#`)
+}
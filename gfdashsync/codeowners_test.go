@@ -0,0 +1,86 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+)
+
+func TestCodeownersFile(t *testing.T) {
+	dashboards := []gapi.FolderDashboardSearchResponse{
+		{UID: "b", Title: "Traffic #1", FolderTitle: "Ops", Tags: []string{"owner:@ops", "owner:alice", "prod"}},
+		{UID: "a", Title: "Overview", FolderTitle: "Dev Team", Tags: []string{"owner:dev@example.com"}},
+		{UID: "c", Title: "Home", FolderTitle: "General", Tags: []string{"prod"}},
+		{UID: "d", Title: "Broken", FolderTitle: "Ops", Tags: []string{"owner:@ops"}},
+	}
+
+	f, err := codeownersFile(dashboards, DefaultCodeownersTag, func(d gapi.FolderDashboardSearchResponse) (string, error) {
+		if d.UID == "d" {
+			return "", errors.New("broken")
+		}
+		return "/" + d.FolderTitle + "/" + d.Title + ".json", nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# Generated by gfdashsync from the owner: tags of the dashboards.
+/Dev\ Team/Overview.json dev@example.com
+/Ops/Traffic\ \#1.json @ops @alice
+`
+	if got := string(f.content); want != got {
+		t.Fatalf("want\n%s\ngot\n%s", want, got)
+	}
+	if f.Path != "/CODEOWNERS" || f.UID != codeownersKey {
+		t.Fatalf("unexpected file %q with key %q", f.Path, f.UID)
+	}
+}
+
+func TestRunCodeowners(t *testing.T) {
+	_, mux := MustRunServer(t)
+	commits := mustCommits(t, mux)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/search" {
+			w.Write([]byte(`[{"uid":"go1","title":"Overview","folderTitle":"Ops","tags":["team:@ops"]}]`))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	_, err := Run(context.Background(), Options{
+		GrafanaAPI:    server.URL,
+		GrafanaToken:  "token",
+		GitAPI:        server.URL,
+		GitToken:      "token",
+		GitPIDs:       []int{1},
+		Codeowners:    true,
+		CodeownersTag: "team:",
+		Gzip:          true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*commits) != 1 {
+		t.Fatalf("want 1 commit, got %d", len(*commits))
+	}
+	for _, a := range (*commits)[0].Actions {
+		if *a.FilePath == codeownersPath {
+			if want := "/Ops/Overview.json.gz @ops\n"; !strings.HasSuffix(*a.Content, want) {
+				t.Fatalf("want CODEOWNERS ending with %q, got %q", want, *a.Content)
+			}
+			return
+		}
+	}
+	t.Fatal("expected the CODEOWNERS file to be committed")
+}
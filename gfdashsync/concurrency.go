@@ -0,0 +1,69 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// readHead records the head of the branch, against which the changes are
+// computed. The history must be read after.
+func (g *Gitlab) readHead() error {
+	b, _, err := g.client.Branches.GetBranch(g.pid, g.branch, gitlab.WithContext(g.ctx))
+	if err != nil {
+		return fmt.Errorf("gitlab: error getting head of branch %q: %w", g.branch, err)
+	}
+	if b.Commit == nil {
+		return fmt.Errorf("gitlab: branch %q has no commit", g.branch)
+	}
+	g.head = b.Commit.ID
+	return nil
+}
+
+// stampLastCommitIDs sets the last commit ID of each update, move and
+// delete action to the last commit changing its file up to the recorded
+// head. Gitlab rejects the commit if any of the files, including the
+// history, was changed since.
+func (g *Gitlab) stampLastCommitIDs(actions []*gitlab.CommitActionOptions) error {
+	for _, a := range actions {
+		if a.LastCommitID != nil {
+			continue
+		}
+
+		p := *a.FilePath
+		switch *a.Action {
+		case gitlab.FileMove:
+			p = *a.PreviousPath
+		case gitlab.FileUpdate, gitlab.FileDelete:
+		default:
+			continue
+		}
+
+		f, resp, err := g.client.RepositoryFiles.GetFileMetaData(g.pid, strings.TrimPrefix(p, "/"), &gitlab.GetFileMetaDataOptions{
+			Ref: gitlab.String(g.head),
+		}, gitlab.WithContext(g.ctx))
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("gitlab: error getting last commit of %q: %w", p, err)
+		}
+		a.LastCommitID = gitlab.String(f.LastCommitID)
+	}
+
+	return nil
+}
+
+// changedSince reports whether the commit failed since a file was changed
+// after its last commit ID.
+func changedSince(err error) bool {
+	var e *gitlab.ErrorResponse
+	return errors.As(err, &e) && strings.Contains(e.Message, "changed since")
+}
@@ -0,0 +1,70 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestGitlabLastCommitIDs(t *testing.T) {
+	history := MustHistoryHandler(t, `{"go1":{"uid":"go1","path":"/Ops/Overview.json","sha256":"a"}}`)
+	files := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			if ref := r.URL.Query().Get("ref"); ref != "h1" {
+				t.Errorf("expected the files to be read at the head, got %s", ref)
+			}
+			p := strings.TrimPrefix(r.URL.Path, "/api/v4/projects/1/repository/files/")
+			w.Header().Set("X-Gitlab-Last-Commit-Id", "c-"+p)
+			return
+		}
+		history(w, r)
+	}
+
+	t.Run("stamped", func(t *testing.T) {
+		git, mux := MustGitlab(t, files)
+		commits := mustCommits(t, mux)
+		git.lastCommitIDs = true
+		git.head = "h1"
+
+		git.Add(&File{UID: "go1", Path: "/Ops/Overview.json", SHA256: "b", content: []byte("{}")})
+		git.Add(&File{UID: "go2", Path: "/Ops/New.json", SHA256: "c", content: []byte("{}")})
+		if err := git.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		want := map[string]string{
+			"/Ops/Overview.json": "c-Ops/Overview.json",
+			"/Ops/New.json":      "",
+			"history.json":       "c-history.json",
+		}
+		for _, a := range (*commits)[0].Actions {
+			got := ""
+			if a.LastCommitID != nil {
+				got = *a.LastCommitID
+			}
+			if got != want[*a.FilePath] {
+				t.Errorf("%s: want last commit ID %q, got %q", *a.FilePath, want[*a.FilePath], got)
+			}
+		}
+	})
+
+	t.Run("changed", func(t *testing.T) {
+		git, mux := MustGitlab(t, files)
+		mux.HandleFunc("/api/v4/projects/1/repository/commits", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"message":"You are attempting to update a file that has changed since you started editing it."}`))
+		})
+		git.lastCommitIDs = true
+		git.head = "h1"
+
+		git.Add(&File{UID: "go1", Path: "/Ops/Overview.json", SHA256: "b", content: []byte("{}")})
+		err := git.Commit()
+		if err == nil || !strings.Contains(err.Error(), "changed during the run") {
+			t.Fatalf("expected a conflict error, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,163 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"fmt"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change.
+const diffContext = 3
+
+// maxDiffCells limits the size of the table used to compute a diff. Larger
+// changes are shown as a removal of all old and an addition of all new lines.
+const maxDiffCells = 4 << 20
+
+// diffOp is a line of a diff prefixed with ' ', '-' or '+'.
+type diffOp struct {
+	kind byte
+	line string
+}
+
+// unifiedDiff returns the unified diff of the lines of a and b or an empty
+// string if they are equal.
+func unifiedDiff(oldName, newName string, a, b []byte) string {
+	if string(a) == string(b) {
+		return ""
+	}
+
+	ops := diffLines(splitLines(a), splitLines(b))
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "--- %s\n+++ %s\n", oldName, newName)
+
+	// Line numbers of the start of ops[i] in a and b.
+	ai, bi := make([]int, len(ops)+1), make([]int, len(ops)+1)
+	for i, op := range ops {
+		ai[i+1], bi[i+1] = ai[i], bi[i]
+		if op.kind != '+' {
+			ai[i+1]++
+		}
+		if op.kind != '-' {
+			bi[i+1]++
+		}
+	}
+
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+
+		// Extend the hunk until the next change is more than twice the
+		// context away.
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].kind != ' ' {
+				end = j + 1
+				continue
+			}
+			if j-end >= 2*diffContext {
+				break
+			}
+		}
+		end += diffContext
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		fmt.Fprintf(&sb, "@@ -%d,%d +%d,%d @@\n", ai[start]+1, ai[end]-ai[start], bi[start]+1, bi[end]-bi[start])
+		for _, op := range ops[start:end] {
+			sb.WriteByte(op.kind)
+			sb.WriteString(op.line)
+			sb.WriteByte('\n')
+		}
+		i = end
+	}
+
+	return sb.String()
+}
+
+func splitLines(b []byte) []string {
+	s := strings.TrimSuffix(string(b), "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// diffLines returns the operations transforming a into b. Common prefixes and
+// suffixes are skipped before computing the longest common subsequence of the
+// remaining lines.
+func diffLines(a, b []string) []diffOp {
+	var pre, suf []diffOp
+	for len(a) > 0 && len(b) > 0 && a[0] == b[0] {
+		pre = append(pre, diffOp{' ', a[0]})
+		a, b = a[1:], b[1:]
+	}
+	for len(a) > 0 && len(b) > 0 && a[len(a)-1] == b[len(b)-1] {
+		suf = append([]diffOp{{' ', a[len(a)-1]}}, suf...)
+		a, b = a[:len(a)-1], b[:len(b)-1]
+	}
+
+	ops := pre
+	if (len(a)+1)*(len(b)+1) > maxDiffCells {
+		for _, l := range a {
+			ops = append(ops, diffOp{'-', l})
+		}
+		for _, l := range b {
+			ops = append(ops, diffOp{'+', l})
+		}
+		return append(ops, suf...)
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and
+	// b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, diffOp{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{'-', a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		ops = append(ops, diffOp{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		ops = append(ops, diffOp{'+', b[j]})
+	}
+
+	return append(ops, suf...)
+}
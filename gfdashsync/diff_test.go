@@ -0,0 +1,91 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	a := "{\n\t\"a\": 1,\n\t\"b\": 2,\n\t\"c\": 3,\n\t\"d\": 4,\n\t\"e\": 5,\n\t\"f\": 6,\n\t\"g\": 7,\n\t\"h\": 8,\n\t\"i\": 9\n}"
+	b := "{\n\t\"a\": 1,\n\t\"b\": 20,\n\t\"c\": 3,\n\t\"d\": 4,\n\t\"e\": 5,\n\t\"f\": 6,\n\t\"g\": 7,\n\t\"h\": 8,\n\t\"i\": 9,\n\t\"j\": 10\n}"
+
+	// The changes are close enough to be in a single hunk.
+	want := `--- /a.json
++++ /b.json
+@@ -1,11 +1,12 @@
+ {
+ 	"a": 1,
+-	"b": 2,
++	"b": 20,
+ 	"c": 3,
+ 	"d": 4,
+ 	"e": 5,
+ 	"f": 6,
+ 	"g": 7,
+ 	"h": 8,
+-	"i": 9
++	"i": 9,
++	"j": 10
+ }
+`
+
+	if got := unifiedDiff("/a.json", "/b.json", []byte(a), []byte(b)); got != want {
+		t.Fatalf("want:\n%s\ngot:\n%s", want, got)
+	}
+
+	// Changes further apart are in separate hunks.
+	long := strings.Repeat("x\n", 20)
+	changed := "y\n" + strings.Repeat("x\n", 18) + "y\n"
+	if got := unifiedDiff("/a.json", "/a.json", []byte(long), []byte(changed)); strings.Count(got, "@@ -") != 2 {
+		t.Fatalf("expected two hunks, got:\n%s", got)
+	}
+
+	if got := unifiedDiff("/a.json", "/a.json", []byte(a), []byte(a)); got != "" {
+		t.Fatalf("expected no diff, got:\n%s", got)
+	}
+}
+
+func TestGitlabDiff(t *testing.T) {
+	history := MustHistoryHandler(t, `{"go1":{"uid":"go1","path":"/dev/null.json","sha256":"12345"}}`)
+	file := MustHistoryHandler(t, "{\n\t\"title\": \"old\"\n}")
+	hf := func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "null.json") {
+			file(w, r)
+			return
+		}
+		history(w, r)
+	}
+
+	git, _ := MustGitlab(t, hf)
+	git.diff = true
+
+	git.Add(&File{
+		UID:     "go1",
+		Path:    "/dev/null.json",
+		SHA256:  "67890",
+		content: []byte("{\n\t\"title\": \"new\"\n}"),
+	})
+
+	if len(git.Diffs()) != 1 {
+		t.Fatalf("expected one diff, got %d", len(git.Diffs()))
+	}
+
+	msg, err := git.commitMessage(time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(msg, "-\t\"title\": \"old\"\n+\t\"title\": \"new\"\n") {
+		t.Fatalf("expected the diff in the commit message, got %q", msg)
+	}
+
+	if !strings.HasSuffix(msg, "Synced-At: 2022-01-02T03:04:05Z") {
+		t.Fatalf("expected the trailers at the end, got %q", msg)
+	}
+}
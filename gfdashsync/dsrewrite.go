@@ -0,0 +1,127 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// dsFallback is the key of the datasource rewrite file mapping all
+// references without a mapping of their own.
+const dsFallback = "*"
+
+// builtinDatasources are the UIDs and names of the datasources of every
+// Grafana, which are never rewritten.
+var builtinDatasources = map[string]bool{
+	"grafana":         true,
+	"-- Grafana --":   true,
+	"-- Mixed --":     true,
+	"-- Dashboard --": true,
+}
+
+// dsRewriter rewrites the datasource references of dashboards, so they can be
+// restored to a Grafana whose datasources have other UIDs.
+type dsRewriter struct {
+	uids     map[string]string
+	fallback string
+}
+
+// loadDSRewriter reads the mapping from old to new datasource UIDs or names
+// from the JSON object in the given file. The key "*" maps all other
+// references. An empty filename returns nil, which rewrites nothing.
+func loadDSRewriter(filename string) (*dsRewriter, error) {
+	if filename == "" {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading datasource rewrite: %w", err)
+	}
+
+	var m map[string]string
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("error parsing datasource rewrite %s: %w", filename, err)
+	}
+
+	r := &dsRewriter{uids: m, fallback: m[dsFallback]}
+	delete(r.uids, dsFallback)
+	return r, nil
+}
+
+// apply returns v converted to a generic JSON value with all datasource
+// references rewritten. A nil rewriter returns v unchanged.
+func (r *dsRewriter) apply(v interface{}) (interface{}, error) {
+	if r == nil {
+		return v, nil
+	}
+
+	c, err := genericJSON(v)
+	if err != nil {
+		return nil, err
+	}
+	r.walk(c)
+	return c, nil
+}
+
+// walk rewrites the values of all datasource fields in v, both references
+// by UID like {"type":"influxdb","uid":"abc"} and by name.
+func (r *dsRewriter) walk(v interface{}) {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for k, e := range x {
+			if k != "datasource" {
+				r.walk(e)
+				continue
+			}
+
+			switch ds := e.(type) {
+			case string:
+				x[k] = r.rewrite(ds)
+			case map[string]interface{}:
+				if uid, ok := ds["uid"].(string); ok {
+					ds["uid"] = r.rewrite(uid)
+				}
+			}
+		}
+	case []interface{}:
+		for _, e := range x {
+			r.walk(e)
+		}
+	}
+}
+
+// rewrite returns the new reference of the datasource ref. Builtin
+// datasources and variables like ${DS_INFLUX} are kept.
+func (r *dsRewriter) rewrite(ref string) string {
+	if to, ok := r.uids[ref]; ok {
+		return to
+	}
+	if ref == "" || r.fallback == "" || builtinDatasources[ref] || strings.HasPrefix(ref, "$") {
+		return ref
+	}
+	return r.fallback
+}
+
+// RewriteDatasources rewrites the datasource references of the dashboard
+// data with the mapping in the given file, see Options.DatasourceRewrite.
+func RewriteDatasources(data []byte, filename string) ([]byte, error) {
+	r, err := loadDSRewriter(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var v interface{}
+	if err := decodeJSON(data, &v); err != nil {
+		return nil, err
+	}
+	if v, err = r.apply(v); err != nil {
+		return nil, err
+	}
+	return fileJSON(v)
+}
@@ -0,0 +1,128 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func mustDSRewriteFile(t *testing.T, mapping string) string {
+	t.Helper()
+
+	filename := filepath.Join(t.TempDir(), "datasources.json")
+	if err := os.WriteFile(filename, []byte(mapping), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestDSRewriter(t *testing.T) {
+	const dashboard = `{
+		"panels": [
+			{"datasource": {"type": "influxdb", "uid": "old1"}, "targets": [{"datasource": {"uid": "other"}}]},
+			{"datasource": "Influx"},
+			{"datasource": "-- Mixed --", "targets": [{"datasource": {"uid": "grafana"}}, {"datasource": "${DS_INFLUX}"}]},
+			{"datasource": null}
+		]
+	}`
+
+	tests := []struct {
+		name    string
+		mapping string
+		want    []string
+	}{
+		{"mapped", `{"old1":"new1","Influx":"Influx Prod"}`, []string{"new1", "other", "Influx Prod", "-- Mixed --", "grafana", "${DS_INFLUX}"}},
+		{"fallback", `{"old1":"new1","*":"fb"}`, []string{"new1", "fb", "fb", "-- Mixed --", "grafana", "${DS_INFLUX}"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := loadDSRewriter(mustDSRewriteFile(t, tt.mapping))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var v interface{}
+			if err := decodeJSON([]byte(dashboard), &v); err != nil {
+				t.Fatal(err)
+			}
+			v, err = r.apply(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			panels := v.(map[string]interface{})["panels"].([]interface{})
+			ref := func(p interface{}) string {
+				switch ds := p.(map[string]interface{})["datasource"].(type) {
+				case string:
+					return ds
+				case map[string]interface{}:
+					return ds["uid"].(string)
+				}
+				return "<nil>"
+			}
+			target := func(p interface{}, i int) interface{} {
+				return p.(map[string]interface{})["targets"].([]interface{})[i]
+			}
+
+			got := []string{
+				ref(panels[0]), ref(target(panels[0], 0)), ref(panels[1]),
+				ref(panels[2]), ref(target(panels[2], 0)), ref(target(panels[2], 1)),
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("want %v, got %v", tt.want, got)
+			}
+			if ref(panels[3]) != "<nil>" {
+				t.Fatal("expected the default datasource to be kept")
+			}
+		})
+	}
+}
+
+func TestLoadDSRewriter(t *testing.T) {
+	if r, err := loadDSRewriter(""); r != nil || err != nil {
+		t.Fatalf("expected no rewriter, got %v, %v", r, err)
+	}
+	if _, err := loadDSRewriter(mustDSRewriteFile(t, `{"a":1}`)); err == nil {
+		t.Fatal("expected an error for a non-string UID")
+	}
+}
+
+func TestRunExportDSRewrite(t *testing.T) {
+	_, mux := MustRunServer(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/dashboards/uid/go1" {
+			w.Write([]byte(`{"dashboard":{"uid":"go1","title":"Overview","panels":[{"id":1,"datasource":{"uid":"old1"}}]},"meta":{"folderTitle":"Ops"}}`))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	dir := t.TempDir()
+
+	if _, err := Run(context.Background(), Options{
+		GrafanaAPI:        server.URL,
+		GrafanaToken:      "token",
+		Mode:              ModeExport,
+		OutputDir:         dir,
+		DatasourceRewrite: mustDSRewriteFile(t, `{"old1":"new1"}`),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "Ops", "Overview.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"uid": "new1"`) {
+		t.Fatalf("expected the datasource to be rewritten, got %s", b)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Names of the files of an exploded dashboard.
+const (
+	explodedDashboard = "dashboard.json"
+	explodedPanels    = "panels"
+)
+
+// panelsKey returns the prefix of the history keys of the panels of the
+// exploded dashboard with the given key.
+func panelsKey(key string) string {
+	return key + "/panels/"
+}
+
+// explodeFiles splits the dashboard file f with the content v into a
+// directory with the dashboard without its panels and a file per panel. The
+// panels of the dashboard are replaced with references to the panel files in
+// their order. Panels are named by their ID, or by their index if the ID is
+// missing or not unique.
+func explodeFiles(f *File, v interface{}) ([]*File, error) {
+	c, err := genericJSON(v)
+	if err != nil {
+		return nil, err
+	}
+
+	root, ok := c.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("dashboard is not an object")
+	}
+	model := root
+	if m, ok := root["dashboard"].(map[string]interface{}); ok {
+		model = m
+	}
+
+	dir := strings.TrimSuffix(f.Path, path.Ext(f.Path))
+	panels, _ := model["panels"].([]interface{})
+
+	seen := make(map[string]bool)
+	refs := make([]interface{}, 0, len(panels))
+	files := make([]*File, 0, len(panels)+1)
+	for i, p := range panels {
+		name := panelName(p, i, seen)
+		refs = append(refs, explodedPanels+"/"+name+".json")
+
+		pf, err := newFile(panelsKey(f.UID)+name, dir+"/"+explodedPanels+"/"+name+".json", p)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, pf)
+	}
+	if panels != nil {
+		model["panels"] = refs
+	}
+
+	df, err := newFile(f.UID, dir+"/"+explodedDashboard, root)
+	if err != nil {
+		return nil, err
+	}
+	df.Version = f.Version
+
+	return append([]*File{df}, files...), nil
+}
+
+// panelName returns the file name of the i-th panel p without extension.
+func panelName(p interface{}, i int, seen map[string]bool) string {
+	name := fmt.Sprintf("index-%d", i)
+	if m, ok := p.(map[string]interface{}); ok {
+		if id, ok := m["id"].(json.Number); ok {
+			if _, err := id.Int64(); err == nil && !seen[id.String()] {
+				name = id.String()
+			}
+		}
+	}
+	seen[name] = true
+	return name
+}
+
+// Implode reassembles the dashboard exploded into the directory dir, so it
+// can be restored to Grafana. Files stored with Gzip are decompressed.
+func Implode(dir string) ([]byte, error) {
+	data, err := readMaybeGzip(filepath.Join(dir, explodedDashboard))
+	if err != nil {
+		return nil, err
+	}
+
+	return implodeDashboard(data, func(ref string) ([]byte, error) {
+		return readMaybeGzip(filepath.Join(dir, filepath.FromSlash(path.Clean("/"+ref))))
+	})
+}
+
+// readMaybeGzip returns the content of the file with the given name or, if
+// it does not exist, the decompressed content of the file with the ".gz"
+// extension.
+func readMaybeGzip(name string) ([]byte, error) {
+	data, err := os.ReadFile(name)
+	if !errors.Is(err, fs.ErrNotExist) {
+		return data, err
+	}
+
+	gz, gzErr := os.ReadFile(name + ".gz")
+	if gzErr != nil {
+		return nil, err
+	}
+	return gunzip(gz)
+}
+
+// implodeDashboard replaces the panel references of the exploded dashboard
+// data with the panels returned by readPanel.
+func implodeDashboard(data []byte, readPanel func(ref string) ([]byte, error)) ([]byte, error) {
+	var root map[string]interface{}
+	if err := decodeJSON(data, &root); err != nil {
+		return nil, fmt.Errorf("error decoding %s: %w", explodedDashboard, err)
+	}
+	model := root
+	if m, ok := root["dashboard"].(map[string]interface{}); ok {
+		model = m
+	}
+
+	refs, _ := model["panels"].([]interface{})
+	for i, r := range refs {
+		ref, ok := r.(string)
+		if !ok {
+			continue
+		}
+
+		b, err := readPanel(ref)
+		if err != nil {
+			return nil, fmt.Errorf("error reading panel %q: %w", ref, err)
+		}
+		var p interface{}
+		if err := decodeJSON(b, &p); err != nil {
+			return nil, fmt.Errorf("error decoding panel %q: %w", ref, err)
+		}
+		refs[i] = p
+	}
+
+	return fileJSON(root)
+}
+
+// LibraryPanelRefs returns the sorted UIDs of the library panels referenced
+// by the dashboard data, including the panels of collapsed rows. When
+// restoring, they must be created from library-panels/<uid>.json before the
+// dashboard is imported, as Grafana rejects dashboards referencing unknown
+// library panels.
+func LibraryPanelRefs(data []byte) ([]string, error) {
+	var root map[string]interface{}
+	if err := decodeJSON(data, &root); err != nil {
+		return nil, err
+	}
+	model := root
+	if m, ok := root["dashboard"].(map[string]interface{}); ok {
+		model = m
+	}
+
+	seen := make(map[string]bool)
+	var walk func(panels []interface{})
+	walk = func(panels []interface{}) {
+		for _, p := range panels {
+			m, ok := p.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if lp, ok := m["libraryPanel"].(map[string]interface{}); ok {
+				if uid, ok := lp["uid"].(string); ok && uid != "" {
+					seen[uid] = true
+				}
+			}
+			nested, _ := m["panels"].([]interface{})
+			walk(nested)
+		}
+	}
+	panels, _ := model["panels"].([]interface{})
+	walk(panels)
+
+	uids := make([]string, 0, len(seen))
+	for uid := range seen {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+	return uids, nil
+}
+
+// decodeJSON decodes data into v keeping numbers as they are.
+func decodeJSON(data []byte, v interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	return d.Decode(v)
+}
@@ -0,0 +1,165 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExplodeFiles(t *testing.T) {
+	const dashboard = `{"dashboard":{"uid":"go1","title":"Overview","panels":[{"id":2,"type":"graph"},{"id":2,"type":"stat"},{"type":"text"}]},"meta":{}}`
+
+	var v interface{}
+	if err := decodeJSON([]byte(dashboard), &v); err != nil {
+		t.Fatal(err)
+	}
+	f, err := newFile("go1", "/Ops/Overview.json", v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Version = 3
+
+	files, err := explodeFiles(f, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"go1":                "/Ops/Overview/dashboard.json",
+		"go1/panels/2":       "/Ops/Overview/panels/2.json",
+		"go1/panels/index-1": "/Ops/Overview/panels/index-1.json",
+		"go1/panels/index-2": "/Ops/Overview/panels/index-2.json",
+	}
+	got := make(map[string]string)
+	contents := make(map[string][]byte)
+	for _, e := range files {
+		got[e.UID] = e.Path
+		contents[strings.TrimPrefix(e.Path, "/Ops/Overview/")] = e.content
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+	if files[0].Version != 3 {
+		t.Fatalf("expected the version of the dashboard, got %d", files[0].Version)
+	}
+	if !strings.Contains(string(contents["dashboard.json"]), `"panels/index-1.json"`) {
+		t.Fatalf("expected panel references, got %s", contents["dashboard.json"])
+	}
+
+	b, err := implodeDashboard(contents["dashboard.json"], func(ref string) ([]byte, error) {
+		return contents[ref], nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != string(f.content) {
+		t.Fatalf("want reassembled dashboard\n%s\ngot\n%s", f.content, b)
+	}
+}
+
+func TestImplode(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "panels"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "dashboard.json"), []byte(`{"panels":["panels/1.json"],"uid":"go1"}`), 0o644)
+	os.WriteFile(filepath.Join(dir, "panels", "1.json"), []byte(`{"id":1,"max":1.50}`), 0o644)
+
+	b, err := Implode(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"max": 1.5`) || strings.Contains(string(b), `"max": 1.50`) {
+		t.Fatalf("expected the panel with its numbers in the form of the synced files, got %s", b)
+	}
+
+	// The files of a tree stored with gzip are decompressed.
+	gzDir := t.TempDir()
+	os.MkdirAll(filepath.Join(gzDir, "panels"), 0o755)
+	for name, content := range map[string]string{
+		"dashboard.json.gz": `{"panels":["panels/1.json"],"uid":"go1"}`,
+		"panels/1.json.gz":  `{"id":1,"max":1.50}`,
+	} {
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write([]byte(content))
+		w.Close()
+		os.WriteFile(filepath.Join(gzDir, filepath.FromSlash(name)), buf.Bytes(), 0o644)
+	}
+	gb, err := Implode(gzDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(gb) != string(b) {
+		t.Fatalf("want the gzip tree reassembled like the plain one, got %s", gb)
+	}
+
+	os.Remove(filepath.Join(dir, "panels", "1.json"))
+	if _, err := Implode(dir); err == nil {
+		t.Fatal("expected an error for a missing panel")
+	}
+}
+
+func TestLibraryPanelRefs(t *testing.T) {
+	data := []byte(`{"dashboard":{"panels":[
+		{"id":1,"libraryPanel":{"uid":"lp2","name":"CPU"}},
+		{"id":2,"type":"row","panels":[
+			{"id":3,"libraryPanel":{"uid":"lp1"}},
+			{"id":4,"libraryPanel":{"uid":"lp2"}}
+		]},
+		{"id":5,"type":"graph"}
+	]}}`)
+
+	got, err := LibraryPanelRefs(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"lp1", "lp2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+}
+
+func TestRunExplode(t *testing.T) {
+	_, mux := MustRunServer(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/dashboards/uid/go1" {
+			w.Write([]byte(`{"dashboard":{"uid":"go1","title":"Overview","version":1,"panels":[{"id":1},{"id":4}]},"meta":{"folderTitle":"Ops"}}`))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	res, err := Run(context.Background(), Options{
+		GrafanaAPI:   server.URL,
+		GrafanaToken: "token",
+		GitAPI:       server.URL,
+		GitToken:     "token",
+		GitPIDs:      []int{1},
+		Mode:         ModeVerify,
+		Explode:      true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, a := range res.Drift {
+		got = append(got, *a.FilePath)
+	}
+	want := []string{"/Ops/Overview/dashboard.json", "/Ops/Overview/panels/1.json", "/Ops/Overview/panels/4.json"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+}
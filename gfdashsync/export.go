@@ -0,0 +1,98 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// Export is a backend writing the files to a local directory with the same
+// layout as the repository. It keeps no history, so all files are written
+// on every run and files of deleted dashboards are left in the directory.
+type Export struct {
+	dir string
+	// instance is the name of the Grafana instance, whose files are written
+	// to a directory of that name.
+	instance string
+	// gzip enables writing the JSON files gzip compressed.
+	gzip bool
+
+	files []*File
+}
+
+// NewExport returns a backend exporting the files to dir.
+func NewExport(dir, instance string, gzip bool) *Export {
+	return &Export{dir: dir, instance: instance, gzip: gzip}
+}
+
+// Add adds the file to be written.
+func (e *Export) Add(in *File) {
+	if e.instance != "" {
+		in.Path = "/" + e.instance + in.Path
+	}
+
+	if e.gzip && path.Ext(in.Path) == ".json" {
+		c, err := in.compressed()
+		if err != nil {
+			log.Printf("export: error compressing %q: %v", in.Path, err)
+			return
+		}
+		in = c
+	}
+
+	e.files = append(e.files, in)
+}
+
+// Keep does nothing, since files are never deleted.
+func (e *Export) Keep(uid string) {}
+
+// KeepPrefix does nothing, since files are never deleted.
+func (e *Export) KeepPrefix(prefix string) {}
+
+// Drift returns an action creating each file.
+func (e *Export) Drift() []*gitlab.CommitActionOptions {
+	var actions []*gitlab.CommitActionOptions
+	for _, f := range e.files {
+		actions = append(actions, &gitlab.CommitActionOptions{
+			Action:   gitlab.FileAction(gitlab.FileCreate),
+			FilePath: gitlab.String(f.Path),
+		})
+	}
+	return actions
+}
+
+// Commit writes all files to the directory, replacing existing files.
+func (e *Export) Commit() error {
+	for _, f := range e.files {
+		if f.content == nil && f.load != nil {
+			data, err := f.load()
+			if err != nil {
+				log.Printf("export: error loading %q, skipping it: %v", f.Path, err)
+				continue
+			}
+			f.content = data
+		}
+
+		p, err := worktreePath(e.dir, f.Path)
+		if err != nil {
+			return fmt.Errorf("export: %w", err)
+		}
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			return fmt.Errorf("export: %w", err)
+		}
+		if err := os.WriteFile(p, f.content, 0o644); err != nil {
+			return fmt.Errorf("export: %w", err)
+		}
+	}
+	e.files = nil
+
+	return nil
+}
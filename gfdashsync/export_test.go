@@ -0,0 +1,86 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExport(t *testing.T) {
+	dir := t.TempDir()
+	e := NewExport(dir, "prod", false)
+
+	f, err := newFile("go1", "/Ops/Overview.json", map[string]int{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Add(f)
+	e.Add(&File{UID: "index", Path: "/INDEX.md", load: func() ([]byte, error) { return []byte("# Index\n"), nil }})
+
+	if n := len(e.Drift()); n != 2 {
+		t.Fatalf("expected 2 actions, got %d", n)
+	}
+	if err := e.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	for p, want := range map[string]string{
+		"prod/Ops/Overview.json": string(f.content),
+		"prod/INDEX.md":          "# Index\n",
+	} {
+		got, err := os.ReadFile(filepath.Join(dir, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Errorf("%s: want %q, got %q", p, want, got)
+		}
+	}
+}
+
+func TestRunExport(t *testing.T) {
+	server, _ := MustRunServer(t)
+	dir := t.TempDir()
+
+	res, err := Run(context.Background(), Options{
+		GrafanaAPI:   server.URL,
+		GrafanaToken: "token",
+		Mode:         ModeExport,
+		OutputDir:    dir,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.Drift) == 0 {
+		t.Fatal("expected the dashboards to be exported")
+	}
+	for _, a := range res.Drift {
+		if _, err := os.Stat(filepath.Join(dir, *a.FilePath)); err != nil {
+			t.Errorf("expected %s to be written: %v", *a.FilePath, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "history.json")); err == nil {
+		t.Fatal("expected no history to be written")
+	}
+
+	// Options of the repository are rejected instead of being ignored.
+	for name, set := range map[string]func(*Options){
+		"conflict": func(o *Options) { o.Conflict = ConflictSkip },
+		"lock":     func(o *Options) { o.Lock = true },
+		"git":      func(o *Options) { o.GitPIDs = []int{1} },
+		"branch":   func(o *Options) { o.GitBranch = "prod" },
+		"history":  func(o *Options) { o.CompactHistory = true },
+	} {
+		opt := Options{GrafanaAPI: server.URL, GrafanaToken: "token", Mode: ModeExport, OutputDir: dir}
+		set(&opt)
+		if _, err := Run(context.Background(), opt); err == nil {
+			t.Errorf("%s: expected an error in export mode", name)
+		}
+	}
+}
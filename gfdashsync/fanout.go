@@ -0,0 +1,150 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// ParsePIDs parses a comma separated list of project IDs.
+func ParsePIDs(s string) ([]int, error) {
+	var pids []int
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+
+		pid, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid project ID %q", p)
+		}
+		pids = append(pids, pid)
+	}
+
+	return pids, nil
+}
+
+// fanoutTarget is a backend of a single project or branch of a project.
+type fanoutTarget struct {
+	pid    int
+	branch string
+	Backend
+}
+
+func (t fanoutTarget) String() string {
+	if t.branch == "" {
+		return fmt.Sprintf("project %d", t.pid)
+	}
+	return fmt.Sprintf("project %d branch %q", t.pid, t.branch)
+}
+
+// fanout syncs the same files to the backends of several projects or
+// branches. Each backend keeps its own history.
+type fanout []fanoutTarget
+
+// Add adds a copy of the file to each backend, since backends record the
+// added files in their history.
+func (fo fanout) Add(f *File) {
+	for _, t := range fo {
+		c := *f
+		t.Add(&c)
+	}
+}
+
+func (fo fanout) Keep(uid string) {
+	for _, t := range fo {
+		t.Keep(uid)
+	}
+}
+
+func (fo fanout) KeepPrefix(prefix string) {
+	for _, t := range fo {
+		t.KeepPrefix(prefix)
+	}
+}
+
+// Drift returns the pending actions of all backends. Since all backends
+// receive the same files, an action pending in several backends is returned
+// once, so a changed dashboard counts as a single change.
+func (fo fanout) Drift() []*gitlab.CommitActionOptions {
+	var actions []*gitlab.CommitActionOptions
+	seen := make(map[string]bool)
+	for _, t := range fo {
+		for _, a := range t.Drift() {
+			k := fmt.Sprintf("%v %s", *a.Action, *a.FilePath)
+			if a.PreviousPath != nil {
+				k += " " + *a.PreviousPath
+			}
+			if seen[k] {
+				continue
+			}
+			seen[k] = true
+			actions = append(actions, a)
+		}
+	}
+	return actions
+}
+
+// Commit commits the pending actions of each backend. A failing backend does
+// not prevent the commit to the others, the returned error lists all failed
+// projects and branches.
+func (fo fanout) Commit() error {
+	var errs []string
+	for _, t := range fo {
+		if err := t.Commit(); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", t, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%d of %d targets failed: %s", len(errs), len(fo), strings.Join(errs, "; "))
+	}
+
+	return nil
+}
+
+// syncedVersion returns the synced version only if all backends synced the
+// same version, so a backend which is behind gets the dashboard.
+func (fo fanout) syncedVersion(uid string) int64 {
+	var version int64
+	for i, t := range fo {
+		v, ok := t.Backend.(versioner)
+		if !ok {
+			return 0
+		}
+		if i == 0 {
+			version = v.syncedVersion(uid)
+		} else if v.syncedVersion(uid) != version {
+			return 0
+		}
+	}
+	return version
+}
+
+// lastCommit returns the commit of the first target which created one.
+func (fo fanout) lastCommit() *gitlab.Commit {
+	for _, t := range fo {
+		if c, ok := t.Backend.(committer); ok && c.lastCommit() != nil {
+			return c.lastCommit()
+		}
+	}
+	return nil
+}
+
+// Diffs returns the diffs of the first target, since all targets receive the
+// same files.
+func (fo fanout) Diffs() []string {
+	for _, t := range fo {
+		if d, ok := t.Backend.(differ); ok {
+			return d.Diffs()
+		}
+	}
+	return nil
+}
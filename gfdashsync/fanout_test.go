@@ -0,0 +1,116 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestParsePIDs(t *testing.T) {
+	testCases := []struct {
+		in      string
+		want    []int
+		wantErr bool
+	}{
+		{"1", []int{1}, false},
+		{"1, 2,3", []int{1, 2, 3}, false},
+		{"1,,2", []int{1, 2}, false},
+		{"1,a", nil, true},
+	}
+
+	for _, tc := range testCases {
+		got, err := ParsePIDs(tc.in)
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("%q: unexpected error: %v", tc.in, err)
+		}
+
+		if len(got) != len(tc.want) {
+			t.Fatalf("%q: want %v, got %v", tc.in, tc.want, got)
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Fatalf("%q: want %v, got %v", tc.in, tc.want, got)
+			}
+		}
+	}
+}
+
+func TestFanout(t *testing.T) {
+	primary, pmux := MustGitlab(t, MustHistoryHandler(t, `{}`))
+	pmux.HandleFunc("/api/v4/projects/1/", commitHandler(t, http.StatusBadRequest))
+
+	dr, dmux := MustGitlab(t, MustHistoryHandler(t, `{}`))
+	committed := false
+	dmux.HandleFunc("/api/v4/projects/1/", func(w http.ResponseWriter, r *http.Request) {
+		committed = true
+		w.Write([]byte("{}"))
+	})
+
+	fo := fanout{
+		{pid: 1, Backend: primary},
+		{pid: 2, Backend: dr},
+	}
+
+	f, err := newFile("go1", "/dev/null.json", map[string]string{"a": "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fo.Add(f)
+
+	if primary.history["go1"] == dr.history["go1"] {
+		t.Fatal("expected each project to record its own copy of the file")
+	}
+	if got := len(fo.Drift()); got != 1 {
+		t.Fatalf("expected the change of both projects to be reported once, got %d", got)
+	}
+
+	err = fo.Commit()
+	if err == nil {
+		t.Fatal("expected an error from the primary project")
+	}
+
+	if !strings.Contains(err.Error(), "project 1") || strings.Contains(err.Error(), "project 2") {
+		t.Fatalf("expected only project 1 to fail, got %v", err)
+	}
+
+	if !committed {
+		t.Fatal("expected the commit to the second project to be attempted")
+	}
+}
+
+func TestFanoutBranches(t *testing.T) {
+	prod, pmux := MustGitlab(t, MustHistoryHandler(t, `{}`))
+	pmux.HandleFunc("/api/v4/projects/1/", commitHandler(t, http.StatusOK))
+
+	stage, smux := MustGitlab(t, MustHistoryHandler(t, `{"go1":{"uid":"go1","path":"/dev/null.json","sha256":"12345"}}`))
+	smux.HandleFunc("/api/v4/projects/1/", commitHandler(t, http.StatusBadRequest))
+
+	fo := fanout{
+		{pid: 1, branch: "env/prod", Backend: prod},
+		{pid: 1, branch: "env/stage", Backend: stage},
+	}
+
+	f, err := newFile("go1", "/dev/null.json", map[string]string{"a": "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fo.Add(f)
+
+	if *prod.actions[0].Action != gitlab.FileCreate || *stage.actions[0].Action != gitlab.FileUpdate {
+		t.Fatal("expected each branch to compare with its own history")
+	}
+	if got := len(fo.Drift()); got != 2 {
+		t.Fatalf("expected the different changes of the branches to be reported, got %d", got)
+	}
+
+	err = fo.Commit()
+	if err == nil || !strings.Contains(err.Error(), `project 1 branch "env/stage"`) || strings.Contains(err.Error(), "env/prod") {
+		t.Fatalf("expected only the stage branch to fail, got %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+)
+
+// globPrefix marks an ignore list entry as a glob pattern on the dashboard
+// title instead of a UID.
+const globPrefix = "glob:"
+
+// DefaultSkipTag is the default tag of dashboards which should not be synced.
+const DefaultSkipTag = "gfdashsync:skip"
+
+// ignoreList matches dashboards which should not be synced, either by UID, by
+// a glob pattern on their title or by a tag.
+type ignoreList struct {
+	uids  map[string]bool
+	globs []string
+
+	// skipTag is the tag of dashboards to ignore. If empty tags are not
+	// considered.
+	skipTag string
+}
+
+// parseIgnoreList parses a comma separated list of UIDs and title glob
+// patterns prefixed with "glob:".
+func parseIgnoreList(s string) (*ignoreList, error) {
+	l := &ignoreList{uids: make(map[string]bool)}
+
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(e, globPrefix) {
+			l.uids[e] = true
+			continue
+		}
+
+		g := strings.TrimPrefix(e, globPrefix)
+		if _, err := path.Match(g, ""); err != nil {
+			return nil, fmt.Errorf("invalid ignore pattern %q: %w", g, err)
+		}
+		l.globs = append(l.globs, g)
+	}
+
+	return l, nil
+}
+
+// match reports whether the dashboard with the given UID and title is ignored.
+func (l *ignoreList) match(uid, title string) bool {
+	if l.uids[uid] {
+		return true
+	}
+
+	for _, g := range l.globs {
+		if ok, _ := path.Match(g, title); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tagged reports whether the tags contain the skip tag.
+func (l *ignoreList) tagged(tags []string) bool {
+	if l.skipTag == "" {
+		return false
+	}
+
+	for _, t := range tags {
+		if t == l.skipTag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// folderFilter selects the dashboards in the given folders, named by title or
+// UID, and if recursive also those in their descendant folders.
+type folderFilter struct {
+	names     map[string]bool
+	recursive bool
+
+	// parents returns the parent folders of the folder with the given UID,
+	// which are resolved once per folder.
+	parents func(uid string) ([]*Folder, error)
+	matched map[string]bool
+}
+
+// parseFolderFilter parses a comma separated list of folder titles and UIDs.
+// An empty list returns nil, which matches all dashboards.
+func parseFolderFilter(s string, recursive bool) *folderFilter {
+	f := &folderFilter{
+		names:     make(map[string]bool),
+		recursive: recursive,
+		matched:   make(map[string]bool),
+	}
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			f.names[e] = true
+		}
+	}
+	if len(f.names) == 0 {
+		return nil
+	}
+	return f
+}
+
+// match reports whether the dashboard is in one of the folders or, if
+// recursive, in one of their descendants. If the parents of a folder cannot
+// be resolved only the folder itself is matched.
+func (f *folderFilter) match(d gapi.FolderDashboardSearchResponse) bool {
+	if f == nil {
+		return true
+	}
+	if f.names[d.FolderTitle] || (d.FolderUID != "" && f.names[d.FolderUID]) {
+		return true
+	}
+	if !f.recursive || d.FolderUID == "" || f.parents == nil {
+		return false
+	}
+
+	if m, ok := f.matched[d.FolderUID]; ok {
+		return m
+	}
+
+	parents, err := f.parents(d.FolderUID)
+	if err != nil {
+		log.Printf("warning cannot resolve parents of folder %q, matching only the folder itself: %v", d.FolderTitle, err)
+	}
+	m := false
+	for _, p := range parents {
+		if f.names[p.Title] || f.names[p.UID] {
+			m = true
+			break
+		}
+	}
+	f.matched[d.FolderUID] = m
+
+	return m
+}
@@ -0,0 +1,118 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"errors"
+	"testing"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+)
+
+func TestIgnoreList(t *testing.T) {
+	l, err := parseIgnoreList("abc, glob:tmp-*,glob:*[Ee]xperiment*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		uid   string
+		title string
+		want  bool
+	}{
+		{"abc", "Production", true},
+		{"abcd", "Production", false},
+		{"xyz", "tmp-test", true},
+		{"xyz", "my tmp-test", false},
+		{"xyz", "An experiment", true},
+		{"xyz", "Experimental", true},
+		{"xyz", "Overview", false},
+	}
+
+	for _, tc := range testCases {
+		if got := l.match(tc.uid, tc.title); got != tc.want {
+			t.Errorf("match(%q, %q): want %v, got %v", tc.uid, tc.title, tc.want, got)
+		}
+	}
+}
+
+func TestIgnoreListTagged(t *testing.T) {
+	l, err := parseIgnoreList("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags := []string{"ops", DefaultSkipTag}
+	if l.tagged(tags) {
+		t.Fatal("expected tags to be ignored without skip tag")
+	}
+
+	l.skipTag = DefaultSkipTag
+	if !l.tagged(tags) {
+		t.Fatal("expected the tagged dashboard to be skipped")
+	}
+	if l.tagged([]string{"ops", "gfdashsync:skipped"}) {
+		t.Fatal("expected only the exact tag to match")
+	}
+}
+
+func TestIgnoreListInvalidPattern(t *testing.T) {
+	if _, err := parseIgnoreList("glob:[a"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestFolderFilter(t *testing.T) {
+	if f := parseFolderFilter(" , ", true); f != nil || !f.match(gapi.FolderDashboardSearchResponse{FolderTitle: "Ops"}) {
+		t.Fatal("expected an empty filter to match all dashboards")
+	}
+
+	parents := map[string][]*Folder{
+		"net": {{UID: "plat", Title: "Platform"}},
+		"dns": {{UID: "plat", Title: "Platform"}, {UID: "net", Title: "Networking"}},
+		"ops": nil,
+	}
+	requests := 0
+	resolve := func(uid string) ([]*Folder, error) {
+		requests++
+		p, ok := parents[uid]
+		if !ok {
+			return nil, errors.New("status: 403")
+		}
+		return p, nil
+	}
+
+	testCases := []struct {
+		d         gapi.FolderDashboardSearchResponse
+		flat, rec bool
+	}{
+		{gapi.FolderDashboardSearchResponse{FolderUID: "plat", FolderTitle: "Platform"}, true, true},
+		{gapi.FolderDashboardSearchResponse{FolderUID: "net", FolderTitle: "Networking"}, false, true},
+		{gapi.FolderDashboardSearchResponse{FolderUID: "dns", FolderTitle: "DNS"}, false, true},
+		{gapi.FolderDashboardSearchResponse{FolderUID: "dns", FolderTitle: "DNS"}, false, true},
+		{gapi.FolderDashboardSearchResponse{FolderUID: "ops", FolderTitle: "Ops"}, false, false},
+		{gapi.FolderDashboardSearchResponse{FolderUID: "secret", FolderTitle: "Secret"}, false, false},
+		{gapi.FolderDashboardSearchResponse{FolderUID: "gen", FolderTitle: "General"}, true, true},
+	}
+
+	for _, recursive := range []bool{false, true} {
+		f := parseFolderFilter("Platform, gen", recursive)
+		f.parents = resolve
+		for _, tc := range testCases {
+			want := tc.flat
+			if recursive {
+				want = tc.rec
+			}
+			if got := f.match(tc.d); got != want {
+				t.Errorf("recursive %v: folder %s: want %v, got %v", recursive, tc.d.FolderUID, want, got)
+			}
+		}
+	}
+
+	// The parents of each folder are resolved once.
+	if requests != 4 {
+		t.Fatalf("want 4 requests, got %d", requests)
+	}
+}
@@ -0,0 +1,441 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"code.gitea.io/sdk/gitea"
+	"github.com/xanzy/go-gitlab"
+)
+
+// Git service providers.
+const (
+	ProviderGitlab = "gitlab" // Gitlab, the default
+	ProviderGitea  = "gitea"  // Gitea and Forgejo
+)
+
+// Gitea syncs the files to a branch of a Gitea or Forgejo repository. The
+// file API of Gitea changes one file per commit, so unlike a Gitlab commit
+// the changes are not atomic. The history is written last and only records
+// the files which were changed successfully.
+type Gitea struct {
+	ctx    context.Context
+	client *gitea.Client
+	owner  string
+	repo   string
+	branch string
+
+	history     History
+	historyFile string
+	// historySHA is the blob SHA of the history file, which is required to
+	// update it. It is empty if the history file does not exist.
+	historySHA     string
+	compactHistory bool
+	// historyData is the history file as read from the repository.
+	historyData []byte
+
+	changes []*giteaChange
+
+	// historyChanged is set if the history changed without a file change.
+	historyChanged bool
+
+	// maxChanges is the maximum number of changes of a run. Zero means
+	// unlimited.
+	maxChanges int
+
+	// pruneGrace is the duration a file must be missing before it is
+	// deleted.
+	pruneGrace time.Duration
+
+	// authorName and authorEmail are the commit author. If empty the owner
+	// of the token is the author.
+	authorName  string
+	authorEmail string
+
+	// signoff appends a Signed-off-by trailer of the committer to the commit
+	// messages.
+	signoff bool
+}
+
+// giteaChange is a pending change of a repository file.
+type giteaChange struct {
+	action   gitlab.FileActionValue
+	uid      string
+	path     string
+	prevPath string
+	file     *File
+}
+
+// NewGitea returns a backend for the branch of the repository with the given
+// name "owner/repo" of the Gitea instance at baseURL.
+func NewGitea(ctx context.Context, baseURL, token, name, branch string, transport http.RoundTripper) (*Gitea, error) {
+	owner, repo, ok := strings.Cut(name, "/")
+	if !ok || owner == "" || repo == "" || strings.Contains(repo, "/") {
+		return nil, fmt.Errorf("gitea: invalid repository %q, expected owner/name", name)
+	}
+
+	c, err := gitea.NewClient(normalizeGiteaURL(baseURL),
+		gitea.SetToken(token),
+		gitea.SetHTTPClient(&http.Client{Transport: transport}),
+		gitea.SetContext(ctx),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("gitea: error creating client: %w", err)
+	}
+
+	g := &Gitea{
+		ctx:         ctx,
+		client:      c,
+		owner:       owner,
+		repo:        repo,
+		branch:      branch,
+		history:     make(History),
+		historyFile: historyFileName(HistoryFormatJSON),
+	}
+
+	if _, _, err := c.GetRepoBranch(owner, repo, branch); err != nil {
+		return nil, fmt.Errorf("gitea: error getting branch %q of repository %q: %w", branch, name, err)
+	}
+
+	if err := g.parseHistory(); err != nil {
+		return nil, fmt.Errorf("gitea: error parsing history: %w", err)
+	}
+
+	return g, nil
+}
+
+// normalizeGiteaURL returns the base URL of the Gitea instance, which may be
+// given with the API path.
+func normalizeGiteaURL(s string) string {
+	s = strings.TrimSuffix(s, "/")
+	return strings.TrimSuffix(s, "/api/v1")
+}
+
+// parseHistory reads the history file from the branch.
+func (g *Gitea) parseHistory() error {
+	c, resp, err := g.client.GetContents(g.owner, g.repo, g.branch, g.historyFile)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		return err
+	}
+	if c.Content == nil {
+		return fmt.Errorf("%q is not a file", g.historyFile)
+	}
+	g.historySHA = c.SHA
+
+	data, err := base64.StdEncoding.DecodeString(*c.Content)
+	if err != nil {
+		return err
+	}
+	g.historyData = data
+	g.history, err = decodeHistoryFile(g.historyFile, data)
+	return err
+}
+
+// setCompactHistory sets whether the history is written in the compact
+// format. A JSON history file in the other format is rewritten with the next
+// commit, even if no file changed.
+func (g *Gitea) setCompactHistory(compact bool) {
+	g.compactHistory = compact
+	if g.historyData != nil && path.Ext(g.historyFile) != ".ndjson" && isCompactHistory(g.historyData) != compact {
+		g.historyChanged = true
+	}
+}
+
+// Add adds the file to be committed.
+func (g *Gitea) Add(in *File) {
+	hf, ok := g.history[in.UID]
+	if !ok {
+		g.add(gitlab.FileCreate, in, "")
+		return
+	}
+	hf.processed = true
+
+	if hf.MissingSince != nil {
+		hf.MissingSince = nil
+		g.historyChanged = true
+	}
+
+	switch {
+	case in.moved(hf):
+		in.logVersion(hf)
+		g.add(gitlab.FileMove, in, hf.Path)
+
+	case in.modified(hf):
+		in.logVersion(hf)
+		g.add(gitlab.FileUpdate, in, "")
+	}
+}
+
+func (g *Gitea) add(action gitlab.FileActionValue, f *File, prevPath string) {
+	f.processed = true
+	g.changes = append(g.changes, &giteaChange{
+		action:   action,
+		uid:      f.UID,
+		path:     f.Path,
+		prevPath: prevPath,
+		file:     f,
+	})
+}
+
+// Keep marks the file with the given UID as processed without changing it.
+func (g *Gitea) Keep(uid string) {
+	if hf, ok := g.history[uid]; ok {
+		hf.processed = true
+	}
+}
+
+// KeepPrefix keeps all files whose UID starts with the given prefix.
+func (g *Gitea) KeepPrefix(prefix string) {
+	for uid, hf := range g.history {
+		if strings.HasPrefix(uid, prefix) {
+			hf.processed = true
+		}
+	}
+}
+
+// syncedVersion returns the dashboard version of the file in the history.
+func (g *Gitea) syncedVersion(uid string) int64 {
+	if hf, ok := g.history[uid]; ok {
+		return hf.Version
+	}
+	return 0
+}
+
+func (g *Gitea) deleteOrphans() {
+	now := time.Now()
+	for _, f := range g.history {
+		if f.processed {
+			continue
+		}
+		f.processed = true
+
+		if f.MissingSince == nil && g.pruneGrace > 0 {
+			g.historyChanged = true
+		}
+		if !f.pruneDue(now, g.pruneGrace) {
+			continue
+		}
+
+		g.changes = append(g.changes, &giteaChange{
+			action: gitlab.FileDelete,
+			uid:    f.UID,
+			path:   f.Path,
+		})
+	}
+}
+
+// Drift returns the pending changes as commit actions, without applying them.
+func (g *Gitea) Drift() []*gitlab.CommitActionOptions {
+	g.deleteOrphans()
+
+	var actions []*gitlab.CommitActionOptions
+	for _, c := range g.changes {
+		a := &gitlab.CommitActionOptions{
+			Action:   gitlab.FileAction(c.action),
+			FilePath: gitlab.String(c.path),
+		}
+		if c.prevPath != "" {
+			a.PreviousPath = gitlab.String(c.prevPath)
+		}
+		actions = append(actions, a)
+	}
+
+	return actions
+}
+
+// Commit applies all pending changes, each in a commit of its own, and then
+// commits the history. Changes which fail are logged and skipped, the
+// history is written for all successful changes.
+func (g *Gitea) Commit() error {
+	g.deleteOrphans()
+
+	// nothing to commit
+	if len(g.changes) == 0 && !g.historyChanged {
+		return nil
+	}
+
+	if g.maxChanges > 0 && len(g.changes) > g.maxChanges {
+		return fmt.Errorf("gitea: %d pending changes exceed the maximum of %d", len(g.changes), g.maxChanges)
+	}
+
+	now := time.Now()
+	var errs []string
+	for _, c := range g.changes {
+		if err := g.apply(c, now); err != nil {
+			log.Printf("gitea: error applying %s of %q: %v", c.action, c.path, err)
+			errs = append(errs, c.path)
+		}
+	}
+
+	if err := g.updateHistory(now); err != nil {
+		return fmt.Errorf("gitea: error writing history: %w", err)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("gitea: %d of %d changes failed: %s", len(errs), len(g.changes), strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+// apply commits a single change and records it in the history.
+func (g *Gitea) apply(c *giteaChange, t time.Time) error {
+	p := strings.TrimPrefix(c.path, "/")
+	subject := fmt.Sprintf("ʕ◔ϖ◔ʔ: %s %s", c.action, p)
+
+	switch c.action {
+	case gitlab.FileCreate:
+		content, err := giteaContent(c.file)
+		if err != nil {
+			return err
+		}
+		if _, _, err := g.client.CreateFile(g.owner, g.repo, p, gitea.CreateFileOptions{
+			FileOptions: g.fileOptions(subject, t),
+			Content:     content,
+		}); err != nil {
+			return err
+		}
+
+	case gitlab.FileUpdate, gitlab.FileMove:
+		from := p
+		if c.prevPath != "" {
+			from = strings.TrimPrefix(c.prevPath, "/")
+			subject = fmt.Sprintf("ʕ◔ϖ◔ʔ: move %s to %s", from, p)
+		}
+		sha, err := g.blobSHA(from)
+		if err != nil {
+			return err
+		}
+		content, err := giteaContent(c.file)
+		if err != nil {
+			return err
+		}
+
+		opt := gitea.UpdateFileOptions{
+			FileOptions: g.fileOptions(subject, t),
+			SHA:         sha,
+			Content:     content,
+		}
+		if c.prevPath != "" {
+			opt.FromPath = from
+		}
+		if _, _, err := g.client.UpdateFile(g.owner, g.repo, p, opt); err != nil {
+			return err
+		}
+
+	case gitlab.FileDelete:
+		sha, err := g.blobSHA(p)
+		if errors.Is(err, errNotFound) {
+			delete(g.history, c.uid)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := g.client.DeleteFile(g.owner, g.repo, p, gitea.DeleteFileOptions{
+			FileOptions: g.fileOptions(subject, t),
+			SHA:         sha,
+		}); err != nil {
+			return err
+		}
+		delete(g.history, c.uid)
+		return nil
+
+	default:
+		return errors.New("unsupported action")
+	}
+
+	g.history[c.uid] = c.file
+	return nil
+}
+
+// giteaContent returns the base64 encoded content of the file, which is
+// loaded first if needed.
+func giteaContent(f *File) (string, error) {
+	if f.content == nil && f.load != nil {
+		data, err := f.load()
+		if err != nil {
+			return "", err
+		}
+		f.content = data
+	}
+	return base64.StdEncoding.EncodeToString(f.content), nil
+}
+
+// blobSHA returns the blob SHA of the file with the given path in the
+// branch, which is required to change it.
+func (g *Gitea) blobSHA(p string) (string, error) {
+	c, resp, err := g.client.GetContents(g.owner, g.repo, g.branch, p)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return "", errNotFound
+		}
+		return "", err
+	}
+	return c.SHA, nil
+}
+
+// fileOptions returns the options of a commit with the given subject.
+func (g *Gitea) fileOptions(subject string, t time.Time) gitea.FileOptions {
+	return gitea.FileOptions{
+		Message:    fmt.Sprintf("%s\n\nSynced-By: gfdashsync %s\nSynced-At: %s", subject, Version, t.Format(time.RFC3339)),
+		BranchName: g.branch,
+		Author:     gitea.Identity{Name: g.authorName, Email: g.authorEmail},
+		Signoff:    g.signoff,
+	}
+}
+
+// updateHistory commits the history file.
+func (g *Gitea) updateHistory(t time.Time) error {
+	data, err := g.history.encode(g.compactHistory)
+	if err != nil {
+		return err
+	}
+
+	subject := "ʕ◔ϖ◔ʔ: update history"
+	content := base64.StdEncoding.EncodeToString(data)
+	if g.historySHA == "" {
+		r, _, err := g.client.CreateFile(g.owner, g.repo, g.historyFile, gitea.CreateFileOptions{
+			FileOptions: g.fileOptions(subject, t),
+			Content:     content,
+		})
+		if err != nil {
+			return err
+		}
+		g.setHistorySHA(r)
+		return nil
+	}
+
+	r, _, err := g.client.UpdateFile(g.owner, g.repo, g.historyFile, gitea.UpdateFileOptions{
+		FileOptions: g.fileOptions(subject, t),
+		SHA:         g.historySHA,
+		Content:     content,
+	})
+	if err != nil {
+		return err
+	}
+	g.setHistorySHA(r)
+	return nil
+}
+
+// setHistorySHA records the blob SHA of the committed history file, so it can
+// be committed again.
+func (g *Gitea) setHistorySHA(r *gitea.FileResponse) {
+	if r != nil && r.Content != nil {
+		g.historySHA = r.Content.SHA
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// MustGitea returns a Gitea backend of the branch main of the repository o/r
+// on a test server serving the given history. The requests changing files
+// are recorded as "METHOD path".
+func MustGitea(t *testing.T, history string) (*Gitea, *[]string) {
+	t.Helper()
+
+	var requests []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/version", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"version":"1.17.0"}`))
+	})
+	mux.HandleFunc("/api/v1/repos/o/r/branches/main", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"name":"main"}`))
+	})
+	mux.HandleFunc("/api/v1/repos/o/r/contents/", func(w http.ResponseWriter, r *http.Request) {
+		p := strings.TrimPrefix(r.URL.Path, "/api/v1/repos/o/r/contents/")
+		if r.Method != http.MethodGet {
+			var opt struct {
+				Branch   string `json:"branch"`
+				SHA      string `json:"sha"`
+				FromPath string `json:"from_path"`
+			}
+			b, _ := io.ReadAll(r.Body)
+			json.Unmarshal(b, &opt)
+			if opt.Branch != "main" {
+				t.Errorf("%s %s: expected branch main, got %q", r.Method, p, opt.Branch)
+			}
+			req := fmt.Sprintf("%s %s", r.Method, p)
+			if opt.FromPath != "" {
+				req += " from " + opt.FromPath
+			}
+			requests = append(requests, req)
+			fmt.Fprintf(w, `{"content":{"path":%q,"sha":"new-%s"}}`, p, p)
+			return
+		}
+
+		switch {
+		case p == "history.json" && history != "":
+			fmt.Fprintf(w, `{"type":"file","sha":"h1","content":%q}`, base64.StdEncoding.EncodeToString([]byte(history)))
+		case p != "history.json" && strings.HasPrefix(p, "Ops/"):
+			fmt.Fprintf(w, `{"type":"file","sha":"sha-%s","content":""}`, p)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"not found"}`))
+		}
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	g, err := NewGitea(context.Background(), server.URL+"/api/v1/", "token", "o/r", "main", http.DefaultTransport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g, &requests
+}
+
+func TestGitea(t *testing.T) {
+	t.Run("commit", func(t *testing.T) {
+		git, requests := MustGitea(t, `{
+			"go1":{"uid":"go1","path":"/Ops/Overview.json","sha256":"a"},
+			"go2":{"uid":"go2","path":"/Ops/Removed.json","sha256":"b"},
+			"go4":{"uid":"go4","path":"/Ops/Same.json","sha256":"d"}
+		}`)
+
+		git.Add(&File{UID: "go1", Path: "/Dev/Overview.json", SHA256: "a", content: []byte("{}")})
+		git.Add(&File{UID: "go3", Path: "/Ops/New.json", SHA256: "c", content: []byte("{}")})
+		git.Add(&File{UID: "go4", Path: "/Ops/Same.json", SHA256: "d", content: []byte("{}")})
+
+		if n := len(git.Drift()); n != 3 {
+			t.Fatalf("want 3 changes, got %d", n)
+		}
+		if err := git.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{
+			"PUT Dev/Overview.json from Ops/Overview.json",
+			"POST Ops/New.json",
+			"DELETE Ops/Removed.json",
+			"PUT history.json",
+		}
+		if !reflect.DeepEqual(*requests, want) {
+			t.Fatalf("want requests %v, got %v", want, *requests)
+		}
+
+		if _, ok := git.history["go2"]; ok {
+			t.Fatal("expected the removed file to be deleted from the history")
+		}
+		if git.history["go1"].Path != "/Dev/Overview.json" || git.history["go3"] == nil {
+			t.Fatalf("expected the history to record the changes, got %+v", git.history)
+		}
+		if git.historySHA != "new-history.json" {
+			t.Fatalf("expected the SHA of the committed history, got %q", git.historySHA)
+		}
+	})
+
+	t.Run("nothing", func(t *testing.T) {
+		git, requests := MustGitea(t, `{"go1":{"uid":"go1","path":"/Ops/Overview.json","sha256":"a"}}`)
+
+		git.Add(&File{UID: "go1", Path: "/Ops/Overview.json", SHA256: "a"})
+		if err := git.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if len(*requests) != 0 {
+			t.Fatalf("expected no requests, got %v", *requests)
+		}
+	})
+
+	t.Run("newHistory", func(t *testing.T) {
+		git, requests := MustGitea(t, "")
+
+		git.Add(&File{UID: "go1", Path: "/Dev/Overview.json", SHA256: "a", content: []byte("{}")})
+		if err := git.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{"POST Dev/Overview.json", "POST history.json"}
+		if !reflect.DeepEqual(*requests, want) {
+			t.Fatalf("want requests %v, got %v", want, *requests)
+		}
+	})
+}
+
+func TestNewGiteaInvalidRepo(t *testing.T) {
+	for _, name := range []string{"", "o", "o/", "/r", "o/r/x"} {
+		if _, err := NewGitea(context.Background(), "http://localhost", "token", name, "main", http.DefaultTransport); err == nil {
+			t.Errorf("%q: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,1025 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// Gitlab syncs the files to a branch of a Gitlab repository. All changes of a
+// run are committed at once together with the history file.
+type Gitlab struct {
+	ctx    context.Context
+	client *gitlab.Client
+	pid    int
+
+	// commitClient creates the commits. It does not retry failed requests
+	// itself, since a retried commit must be checked for having landed.
+	commitClient *gitlab.Client
+
+	branch string
+
+	history        History
+	historyFile    string
+	historyAction  gitlab.FileActionValue
+	compactHistory bool
+
+	// historyFormat is the format the history is written in. If the history
+	// file has a different format it is replaced. If it is empty the format
+	// of the history file is kept.
+	historyFormat string
+
+	// historyChanged is set if the history changed without a file action.
+	historyChanged bool
+
+	// historyData is the history file as read from the repository.
+	historyData []byte
+
+	// historyKeep is the number of previous history files kept as
+	// <history>.1 to <history>.N, the newest first.
+	historyKeep int
+
+	// commitHistory commits the history if its content differs from
+	// historyData, even if no file changed.
+	commitHistory bool
+
+	actions []*gitlab.CommitActionOptions
+
+	// diff enables recording the diffs of modified files.
+	diff  bool
+	diffs []string
+
+	// commit is the commit created by Commit.
+	commit *gitlab.Commit
+
+	// maxChanges is the maximum number of actions allowed in a single commit.
+	// Zero means unlimited.
+	maxChanges int
+
+	// conflict is the conflict mode. If empty no conflict detection is done.
+	conflict string
+
+	// repoClean enables the deletion of untracked JSON files.
+	repoClean bool
+
+	// pruneGrace is the duration a file must be missing before it is
+	// deleted.
+	pruneGrace time.Duration
+
+	// gzip enables storing the files gzip compressed.
+	gzip bool
+
+	// authorName and authorEmail are the commit author. If empty the owner
+	// of the token is the author.
+	authorName  string
+	authorEmail string
+
+	// signoff appends a Signed-off-by trailer of the author to the commit
+	// message.
+	signoff bool
+	// triggerUser is the user who triggered the run as "Name <email>". If
+	// set a Co-authored-by trailer is appended to the commit messages.
+	triggerUser string
+
+	// message is the commit message template. If nil the default message
+	// is used.
+	message *template.Template
+
+	// fileMessage is the template of the commit subjects in CommitPerFile
+	// mode. If nil the default subject is used.
+	fileMessage *template.Template
+
+	// tag is the template of the name of the tag created for the commit of
+	// the run. If nil no tag is created. tagForce replaces an existing tag.
+	tag      *template.Template
+	tagForce bool
+
+	// stagingFile is the local file where the commit is staged before it is
+	// sent. If empty no staging file is written.
+	stagingFile string
+
+	// instance is the name of the Grafana instance. If set all files and
+	// the history are kept in a directory of that name.
+	instance string
+
+	// archiveDeleted moves deleted files to the archive directory instead of
+	// deleting them.
+	archiveDeleted bool
+
+	// commitMode is CommitPerFile to commit each file on its own. Otherwise
+	// all changes are committed at once.
+	commitMode string
+
+	// startSHA is the parent of the next commit instead of the head of the
+	// branch. If force is set the branch is reset to the new commit, even if
+	// the commit is not a descendant of the head. Both only apply to the
+	// first commit of a run.
+	startSHA string
+	force    bool
+
+	// separateHistory commits the history in a commit of its own after the
+	// commit of the files.
+	separateHistory bool
+
+	// tree caches the tree and the read files of the branch if it is not
+	// nil.
+	tree *treeCache
+
+	// lockFile is the path of the lock file if the lock is held, lockedAt
+	// the time written to it.
+	lockFile string
+	lockedAt time.Time
+
+	// push creates the commits with git push instead of the commits API if
+	// it is not nil.
+	push *gitPush
+
+	// lastCommitIDs enables stamping the actions with the last commit IDs
+	// of their files up to head, the head of the branch when the history
+	// was read, so changes pushed meanwhile are not overwritten.
+	lastCommitIDs bool
+	head          string
+}
+
+// Conflict modes for files which were changed in the repository.
+const (
+	ConflictSkip      = "skip"
+	ConflictOverwrite = "overwrite"
+)
+
+// Commit modes.
+const (
+	CommitSingle  = "single"
+	CommitPerFile = "per-file"
+)
+
+// Gitlab authentication modes.
+const (
+	AuthPAT   = "pat"   // personal, project or group access token
+	AuthOAuth = "oauth" // OAuth2 token
+	AuthJob   = "job"   // CI job token
+)
+
+// NewGitlab returns a new Gitlab client committing to the given branch of the
+// project with the given ID, authenticating with a token of the given
+// authentication mode. If the branch does not exist it is created from
+// startBranch, unless startBranch is empty in which case an error is returned.
+// If transport is nil http.DefaultTransport is used.
+func NewGitlab(ctx context.Context, baseURL, auth, token, branch, startBranch string, pid int, transport http.RoundTripper) (*Gitlab, error) {
+	c, err := newGitlabClient(baseURL, auth, token, transport)
+	if err != nil {
+		return nil, err
+	}
+
+	cc, err := newGitlabClient(baseURL, auth, token, transport, gitlab.WithoutRetries())
+	if err != nil {
+		return nil, err
+	}
+
+	g := &Gitlab{
+		ctx:           ctx,
+		client:        c,
+		commitClient:  cc,
+		pid:           pid,
+		branch:        branch,
+		history:       make(History),
+		historyFile:   "history.json",
+		historyAction: gitlab.FileUpdate,
+	}
+
+	if err := g.checkProject(); err != nil {
+		return nil, err
+	}
+
+	if err := g.checkBranch(startBranch); err != nil {
+		return nil, err
+	}
+
+	if err := g.parseHistory(); err != nil {
+		return nil, fmt.Errorf("gitlab: error parsing history: %w", err)
+	}
+
+	return g, nil
+}
+
+// newGitlabClient returns a Gitlab API client for the given authentication
+// mode sending the requests with the given transport and the given options.
+func newGitlabClient(baseURL, auth, token string, transport http.RoundTripper, options ...gitlab.ClientOptionFunc) (*gitlab.Client, error) {
+	newClient := gitlab.NewClient
+	switch auth {
+	case AuthOAuth:
+		newClient = gitlab.NewOAuthClient
+	case AuthJob:
+		newClient = gitlab.NewJobClient
+	}
+
+	opts := []gitlab.ClientOptionFunc{gitlab.WithBaseURL(normalizeGitlabURL(baseURL))}
+	if transport != nil {
+		opts = append(opts, gitlab.WithHTTPClient(&http.Client{Transport: transport}))
+	}
+
+	c, err := newClient(token, append(opts, options...)...)
+	if err != nil {
+		return nil, fmt.Errorf("gitlab: error creating client: %w", err)
+	}
+	return c, nil
+}
+
+// normalizeGitlabURL strips a trailing slash and the API path from the given
+// URL, since the client appends the API path itself.
+func normalizeGitlabURL(baseURL string) string {
+	u := strings.TrimRight(baseURL, "/")
+	u = strings.TrimSuffix(u, "/api/v4")
+	return strings.TrimSuffix(u, "/api")
+}
+
+// checkProject verifies that the project is reachable with the given token,
+// so a misconfiguration fails before any work is done.
+func (g *Gitlab) checkProject() error {
+	_, _, err := g.client.Projects.GetProject(g.pid, nil, gitlab.WithContext(g.ctx))
+	if err != nil {
+		return fmt.Errorf("gitlab: cannot access project %d at %s, check -git.api, -git.token and -git.pid: %w", g.pid, g.client.BaseURL(), err)
+	}
+	return nil
+}
+
+// checkBranch verifies that the branch exists. A missing branch is created
+// from startBranch if it is not empty.
+func (g *Gitlab) checkBranch(startBranch string) error {
+	_, resp, err := g.client.Branches.GetBranch(g.pid, g.branch, gitlab.WithContext(g.ctx))
+	if err == nil {
+		return nil
+	}
+	if resp == nil || resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("gitlab: error getting branch %q: %w", g.branch, err)
+	}
+
+	if startBranch == "" {
+		return fmt.Errorf("gitlab: branch %q does not exist in project %d", g.branch, g.pid)
+	}
+
+	_, _, err = g.client.Branches.CreateBranch(g.pid, &gitlab.CreateBranchOptions{
+		Branch: gitlab.String(g.branch),
+		Ref:    gitlab.String(startBranch),
+	}, gitlab.WithContext(g.ctx))
+	if err != nil {
+		return fmt.Errorf("gitlab: error creating branch %q from %q: %w", g.branch, startBranch, err)
+	}
+
+	return nil
+}
+
+// parseHistory reads "history.json" or, if it does not exist,
+// "history.ndjson" from the repository.
+func (g *Gitlab) parseHistory() error {
+	for _, format := range []string{HistoryFormatJSON, HistoryFormatNDJSON} {
+		name := g.historyPath(format)
+		data, err := g.readFile(name)
+		if errors.Is(err, errNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		g.historyFile = name
+		g.historyData = data
+		g.history, err = decodeHistoryFile(name, data)
+		return err
+	}
+
+	// If no history file is found we will assume there is no history and
+	// proceed without error but setting the action to create a new history
+	// file.
+	g.historyFile = g.historyPath(HistoryFormatJSON)
+	g.historyAction = gitlab.FileCreate
+	return nil
+}
+
+// historyPath returns the path of the history file in the given format,
+// which is in the directory of the instance, if any.
+func (g *Gitlab) historyPath(format string) string {
+	return path.Join(g.instance, historyFileName(format))
+}
+
+// setInstance sets the name of the Grafana instance, whose files and history
+// are kept in a directory of that name. The history is read again from
+// there. Other directories are never touched.
+func (g *Gitlab) setInstance(name string) error {
+	g.instance = name
+	g.history = make(History)
+	g.historyAction = gitlab.FileUpdate
+	if err := g.parseHistory(); err != nil {
+		return fmt.Errorf("gitlab: error parsing history: %w", err)
+	}
+	return nil
+}
+
+// errNotFound is returned by readFile if the file does not exist.
+var errNotFound = errors.New("file not found")
+
+// readFile returns the content of the file with the given path in the branch.
+func (g *Gitlab) readFile(path string) ([]byte, error) {
+	if g.tree != nil {
+		return g.readCached(path)
+	}
+	return g.readFileAt(path, g.branch)
+}
+
+// readFileAt returns the content of the file with the given path in the
+// given commit, branch or tag.
+func (g *Gitlab) readFileAt(path, ref string) ([]byte, error) {
+	f, resp, err := g.client.RepositoryFiles.GetFile(g.pid, path, &gitlab.GetFileOptions{
+		Ref: gitlab.String(ref),
+	}, gitlab.WithContext(g.ctx))
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return nil, errNotFound
+		}
+		return nil, err
+	}
+
+	return base64.StdEncoding.DecodeString(f.Content)
+}
+
+// Add adds the file to be committed.
+func (g *Gitlab) Add(in *File) {
+	if g.instance != "" {
+		in.Path = "/" + g.instance + in.Path
+	}
+
+	// Only the JSON files are compressed, so the index stays readable.
+	if g.gzip && path.Ext(in.Path) == ".json" {
+		c, err := in.compressed()
+		if err != nil {
+			log.Printf("gitlab: error compressing %q: %v", in.Path, err)
+			g.Keep(in.UID)
+			return
+		}
+		in = c
+	}
+
+	hf, ok := g.history[in.UID]
+	if !ok {
+		g.add(in, gitlab.FileCreate, "")
+		return
+	}
+
+	switch {
+	case in.moved(hf):
+		if g.conflicting(in, hf) {
+			return
+		}
+		in.logVersion(hf)
+		g.addDiff(in, hf)
+		g.add(in, gitlab.FileMove, hf.Path)
+
+	case in.modified(hf):
+		if g.conflicting(in, hf) {
+			return
+		}
+		in.logVersion(hf)
+		g.addDiff(in, hf)
+		g.add(in, gitlab.FileUpdate, "")
+
+	default:
+		// If no action is preformed set the processed flag anyway.
+		hf.processed = true
+
+		// The version changes on every save, even if the content does not.
+		// If the committed file contains the version, it is kept, so the
+		// history still describes the committed file.
+		if in.Version != 0 && in.SHA256 == hf.SHA256 {
+			hf.Version = in.Version
+		}
+
+		if hf.MissingSince != nil {
+			hf.MissingSince = nil
+			g.historyChanged = true
+		}
+	}
+}
+
+// conflicting reports whether the repository file of hf was changed outside
+// of gfdashsync, so it differs from both the history and the new file. If the
+// conflict mode is skip the file is left untouched.
+func (g *Gitlab) conflicting(in, hf *File) bool {
+	// The hash of compressed files in the repository cannot be compared with
+	// the hash of the uncompressed content, neither can the hash of loaded
+	// files, which is the hash of their source.
+	if g.conflict == "" || in.contentType == contentTypeGzip || in.load != nil || in.meta {
+		return false
+	}
+
+	sha, err := g.fileSHA256(hf.Path, in.semantic)
+	if err != nil {
+		log.Printf("gitlab: error checking %q for conflicts: %v", hf.Path, err)
+		return false
+	}
+
+	if sha == hf.SHA256 || sha == in.SHA256 {
+		return false
+	}
+
+	if g.conflict == ConflictOverwrite {
+		log.Printf("gitlab: overwriting %q which was changed in the repository", hf.Path)
+		return false
+	}
+
+	log.Printf("gitlab: skipping %q which was changed in the repository", hf.Path)
+	hf.processed = true
+	return true
+}
+
+// fileSHA256 returns the SHA256 hash of the content of the repository file
+// with the given path. If semantic is set the content is hashed semantically
+// like the files of a run with SemanticDiff.
+func (g *Gitlab) fileSHA256(p string, semantic bool) (string, error) {
+	if semantic {
+		data, err := g.readFile(p)
+		if err != nil {
+			return "", err
+		}
+		return semanticHash(data)
+	}
+
+	if g.tree != nil {
+		data, err := g.readCached(p)
+		if err != nil {
+			return "", err
+		}
+		return hash(data), nil
+	}
+
+	f, _, err := g.client.RepositoryFiles.GetFileMetaData(g.pid, p, &gitlab.GetFileMetaDataOptions{
+		Ref: gitlab.String(g.branch),
+	}, gitlab.WithContext(g.ctx))
+	if err != nil {
+		return "", err
+	}
+	return f.SHA256, nil
+}
+
+// addDiff records the diff of the repository file of hf and the new file, if
+// diffs are enabled.
+func (g *Gitlab) addDiff(in, hf *File) {
+	if !g.diff || in.binary() {
+		return
+	}
+
+	old, err := g.readFile(hf.Path)
+	if err != nil {
+		log.Printf("gitlab: error reading %q for diff: %v", hf.Path, err)
+		return
+	}
+
+	if d := unifiedDiff(hf.Path, in.Path, old, in.content); d != "" {
+		g.diffs = append(g.diffs, d)
+	}
+}
+
+// Keep marks the file with the given UID as processed without changing it, so
+// it is neither modified nor deleted.
+func (g *Gitlab) Keep(uid string) {
+	if hf, ok := g.history[uid]; ok {
+		hf.processed = true
+	}
+}
+
+// syncedVersion returns the dashboard version of the file in the history.
+func (g *Gitlab) syncedVersion(uid string) int64 {
+	if hf, ok := g.history[uid]; ok {
+		return hf.Version
+	}
+	return 0
+}
+
+// KeepPrefix keeps all files whose UID starts with the given prefix.
+func (g *Gitlab) KeepPrefix(prefix string) {
+	for uid, hf := range g.history {
+		if strings.HasPrefix(uid, prefix) {
+			hf.processed = true
+		}
+	}
+}
+
+func (g *Gitlab) add(in *File, action gitlab.FileActionValue, prevPath string) {
+	if in.content == nil && in.load != nil {
+		data, err := in.load()
+		if err != nil {
+			log.Printf("gitlab: error loading %q, leaving it untouched: %v", in.Path, err)
+			g.Keep(in.UID)
+			return
+		}
+		in.content = data
+	}
+	in.processed = true
+
+	opt := fileAction(in, action)
+	if prevPath != "" {
+		opt.PreviousPath = gitlab.String(prevPath)
+	}
+
+	g.actions = append(g.actions, opt)
+	g.history[in.UID] = in
+}
+
+// fileAction returns the action with the given type and the content of the
+// file, which is base64 encoded if it is binary.
+func fileAction(in *File, action gitlab.FileActionValue) *gitlab.CommitActionOptions {
+	opt := &gitlab.CommitActionOptions{
+		Action:   gitlab.FileAction(action),
+		FilePath: gitlab.String(in.Path),
+		Content:  gitlab.String(string(in.content)),
+	}
+
+	if in.binary() {
+		opt.Content = gitlab.String(base64.StdEncoding.EncodeToString(in.content))
+		opt.Encoding = gitlab.String("base64")
+	}
+	return opt
+}
+
+// setCompactHistory sets whether the history is written in the compact
+// format. A JSON history file in the other format is rewritten with the next
+// commit, even if no file changed.
+func (g *Gitlab) setCompactHistory(compact bool) {
+	g.compactHistory = compact
+	if g.historyData != nil && path.Ext(g.historyFile) != ".ndjson" && isCompactHistory(g.historyData) != compact {
+		g.historyChanged = true
+	}
+}
+
+// setHistoryFormat sets the format the history is written in. A history file
+// in another format is replaced with the next commit.
+func (g *Gitlab) setHistoryFormat(format string) {
+	g.historyFormat = format
+	if format != "" && g.historyPath(format) != g.historyFile && len(g.history) > 0 {
+		g.historyChanged = true
+	}
+}
+
+func (g *Gitlab) updateHistory() error {
+	if len(g.history) == 0 {
+		return nil
+	}
+
+	if err := g.rotateHistory(); err != nil {
+		return err
+	}
+
+	// Replace a history file in another format.
+	if name := g.historyPath(g.historyFormat); g.historyFormat != "" && name != g.historyFile {
+		if g.historyAction == gitlab.FileUpdate {
+			g.actions = append(g.actions, &gitlab.CommitActionOptions{
+				Action:   gitlab.FileAction(gitlab.FileDelete),
+				FilePath: gitlab.String(g.historyFile),
+			})
+		}
+		g.historyFile = name
+		g.historyAction = gitlab.FileCreate
+	}
+
+	data, err := g.encodeHistory(g.history)
+	if err != nil {
+		return err
+	}
+
+	opt := &gitlab.CommitActionOptions{
+		Action:   gitlab.FileAction(g.historyAction),
+		FilePath: gitlab.String(g.historyFile),
+		Content:  gitlab.String(string(data)),
+	}
+
+	g.actions = append(g.actions, opt)
+	return nil
+}
+
+// rotateHistory keeps the history file read from the repository as
+// <history>.1 before it is overwritten, shifting the older copies up to
+// <history>.N, where N is historyKeep. The oldest copy is overwritten.
+func (g *Gitlab) rotateHistory() error {
+	if g.historyKeep <= 0 || g.historyAction != gitlab.FileUpdate || g.historyData == nil {
+		return nil
+	}
+
+	data := g.historyData
+	for i := 1; i <= g.historyKeep; i++ {
+		name := fmt.Sprintf("%s.%d", g.historyFile, i)
+		old, err := g.readFile(name)
+		action := gitlab.FileUpdate
+		if errors.Is(err, errNotFound) {
+			action = gitlab.FileCreate
+		} else if err != nil {
+			return fmt.Errorf("gitlab: error reading %q: %w", name, err)
+		}
+
+		g.actions = append(g.actions, &gitlab.CommitActionOptions{
+			Action:   gitlab.FileAction(action),
+			FilePath: gitlab.String(name),
+			Content:  gitlab.String(string(data)),
+		})
+
+		// There are no older copies to shift.
+		if action == gitlab.FileCreate {
+			return nil
+		}
+		data = old
+	}
+
+	return nil
+}
+
+// encodeHistory encodes the history h in the format of the history file.
+func (g *Gitlab) encodeHistory(h History) ([]byte, error) {
+	if path.Ext(g.historyFile) == ".ndjson" {
+		return h.encodeNDJSON()
+	}
+	return h.encode(g.compactHistory)
+}
+
+// historyDiffers reports whether the content of the history differs from the
+// history file read from the repository, e.g. since the versions of unchanged
+// dashboards were recorded. The formatting of the file is ignored.
+func (g *Gitlab) historyDiffers() (bool, error) {
+	if g.historyAction == gitlab.FileCreate || len(g.history) == 0 {
+		return false, nil
+	}
+
+	read, err := decodeHistoryFile(g.historyFile, g.historyData)
+	if err != nil {
+		return false, err
+	}
+	old, err := g.encodeHistory(read)
+	if err != nil {
+		return false, err
+	}
+	cur, err := g.encodeHistory(g.history)
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Equal(old, cur), nil
+}
+
+func (g *Gitlab) deleteOrphans() {
+	now := time.Now()
+	for _, f := range g.history {
+		if f.processed || strings.HasPrefix(f.UID, archivePrefix) {
+			continue
+		}
+
+		if f.MissingSince == nil && g.pruneGrace > 0 {
+			g.historyChanged = true
+		}
+		if !f.pruneDue(now, g.pruneGrace) {
+			continue
+		}
+
+		delete(g.history, f.UID)
+
+		if g.archiveDeleted {
+			g.archive(f, now)
+			continue
+		}
+
+		g.actions = append(g.actions, &gitlab.CommitActionOptions{
+			Action:   gitlab.FileAction(gitlab.FileDelete),
+			FilePath: gitlab.String(f.Path),
+		})
+	}
+}
+
+// archivePrefix is the prefix of the history keys and the directory of
+// archived files.
+const archivePrefix = "_archive/"
+
+// archive moves the deleted file to the archive directory of the given day,
+// which is in the directory of the instance, if any. The archived file is
+// tracked in the history with its own key, so it is never deleted.
+func (g *Gitlab) archive(f *File, now time.Time) {
+	day := now.UTC().Format("2006-01-02")
+
+	p := strings.TrimPrefix(f.Path, "/")
+	if g.instance != "" {
+		p = strings.TrimPrefix(p, g.instance+"/")
+	}
+	p = "/" + path.Join(g.instance, archivePrefix, day, p)
+
+	g.actions = append(g.actions, &gitlab.CommitActionOptions{
+		Action:       gitlab.FileAction(gitlab.FileMove),
+		FilePath:     gitlab.String(p),
+		PreviousPath: gitlab.String(f.Path),
+	})
+
+	a := *f
+	a.UID = archivePrefix + day + "/" + f.UID
+	a.Path = p
+	a.MissingSince = nil
+	a.processed = true
+	g.history[a.UID] = &a
+}
+
+// listTree returns all files and directories of the repository.
+func (g *Gitlab) listTree() ([]*gitlab.TreeNode, error) {
+	if g.tree != nil {
+		return g.tree.nodes, nil
+	}
+
+	opt := &gitlab.ListTreeOptions{
+		ListOptions: gitlab.ListOptions{PerPage: 100},
+		Ref:         gitlab.String(g.branch),
+		Recursive:   gitlab.Bool(true),
+	}
+	if g.instance != "" {
+		opt.Path = gitlab.String(g.instance)
+	}
+
+	var tree []*gitlab.TreeNode
+	for {
+		nodes, resp, err := g.client.Repositories.ListTree(g.pid, opt, gitlab.WithContext(g.ctx))
+		if err != nil {
+			return nil, err
+		}
+		tree = append(tree, nodes...)
+
+		if resp.NextPage == 0 {
+			return tree, nil
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+// cleanRepo deletes all JSON files from the repository which are neither
+// tracked in the history, nor affected by a pending action, nor part of a
+// snapshot. It must be called after the orphans have been deleted.
+func (g *Gitlab) cleanRepo() error {
+	tree, err := g.listTree()
+	if err != nil {
+		return fmt.Errorf("gitlab: error listing repository: %w", err)
+	}
+
+	known := map[string]bool{g.historyFile: true}
+	for _, f := range g.history {
+		known[strings.TrimPrefix(f.Path, "/")] = true
+	}
+	for _, a := range g.actions {
+		known[strings.TrimPrefix(*a.FilePath, "/")] = true
+		if a.PreviousPath != nil {
+			known[strings.TrimPrefix(*a.PreviousPath, "/")] = true
+		}
+	}
+
+	for _, n := range tree {
+		isJSON := strings.HasSuffix(n.Path, ".json") || strings.HasSuffix(n.Path, ".json.gz")
+		if n.Type != "blob" || !isJSON || known[n.Path] || isSnapshotPath(n.Path, g.instance) {
+			continue
+		}
+
+		log.Printf("gitlab: deleting untracked file %q", n.Path)
+		g.actions = append(g.actions, &gitlab.CommitActionOptions{
+			Action:   gitlab.FileAction(gitlab.FileDelete),
+			FilePath: gitlab.String(n.Path),
+		})
+	}
+
+	return nil
+}
+
+// Drift returns the actions which are needed to bring the repository in sync,
+// without committing them.
+func (g *Gitlab) Drift() []*gitlab.CommitActionOptions {
+	g.deleteOrphans()
+	return g.actions
+}
+
+// Commit commits all pending commits to the repository and tags the commit,
+// if enabled.
+func (g *Gitlab) Commit() error {
+	if err := g.commitChanges(); err != nil {
+		return err
+	}
+	return g.createTag()
+}
+
+// commitChanges commits all pending actions and the history.
+func (g *Gitlab) commitChanges() error {
+	g.deleteOrphans()
+
+	if g.repoClean {
+		if err := g.cleanRepo(); err != nil {
+			return err
+		}
+	}
+
+	if len(g.actions) == 0 && !g.historyChanged && g.commitHistory {
+		changed, err := g.historyDiffers()
+		if err != nil {
+			return fmt.Errorf("gitlab: error comparing history: %w", err)
+		}
+		g.historyChanged = changed
+	}
+
+	// nothing to commit
+	if len(g.actions) == 0 && !g.historyChanged {
+		return nil
+	}
+
+	if g.maxChanges > 0 && len(g.actions) > g.maxChanges {
+		c := countActions(g.actions)
+		return fmt.Errorf("gitlab: %d pending changes exceed the maximum of %d (create: %d, update: %d, move: %d, delete: %d)",
+			len(g.actions), g.maxChanges, c[gitlab.FileCreate], c[gitlab.FileUpdate], c[gitlab.FileMove], c[gitlab.FileDelete])
+	}
+
+	// In per file mode each file is committed on its own and the history
+	// is committed at the end.
+	files := len(g.actions)
+	if err := g.updateHistory(); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if g.commitMode == CommitPerFile {
+		for _, a := range g.actions[:files] {
+			if err := g.commitActions(g.fileCommitMessage(a, now), []*gitlab.CommitActionOptions{a}); err != nil {
+				return err
+			}
+		}
+	}
+
+	msg, err := g.commitMessage(now)
+	if err != nil {
+		return err
+	}
+
+	if g.separateHistory && g.commitMode != CommitPerFile {
+		return g.commitSeparateHistory(msg, files, now)
+	}
+
+	actions := g.actions
+	if g.commitMode == CommitPerFile {
+		actions = g.actions[files:]
+	}
+	return g.commitActions(msg, actions)
+}
+
+// commitSeparateHistory commits the first n actions, which change the files,
+// with the given message and then the history in a commit of its own. The
+// reported commit is that of the files. If the history commit fails after
+// the files were committed, the staged history commit can be resumed.
+// Otherwise the next run repeats the changes, which are then already in the
+// repository.
+func (g *Gitlab) commitSeparateHistory(msg string, n int, t time.Time) error {
+	if n > 0 {
+		if err := g.commitActions(msg, g.actions[:n]); err != nil {
+			return err
+		}
+	}
+	files := g.commit
+
+	if err := g.commitActions(g.historyCommitMessage(t), g.actions[n:]); err != nil {
+		if files == nil {
+			return err
+		}
+		hint := "the next run repeats the changes"
+		if g.stagingFile != "" {
+			hint = "resume the run to commit the history"
+		}
+		return fmt.Errorf("gitlab: the files were committed in %s, but the history was not, %s: %w", files.ID, hint, err)
+	}
+
+	if files != nil {
+		g.commit = files
+	}
+	return nil
+}
+
+// commitActions commits the actions with the given message.
+func (g *Gitlab) commitActions(msg string, actions []*gitlab.CommitActionOptions) error {
+	opt := &gitlab.CreateCommitOptions{
+		Branch:        gitlab.String(g.branch),
+		CommitMessage: gitlab.String(msg),
+		Actions:       actions,
+	}
+	if g.authorName != "" {
+		opt.AuthorName = gitlab.String(g.authorName)
+	}
+	if g.authorEmail != "" {
+		opt.AuthorEmail = gitlab.String(g.authorEmail)
+	}
+	if g.startSHA != "" {
+		opt.StartSHA = gitlab.String(g.startSHA)
+		opt.Force = gitlab.Bool(g.force)
+	}
+
+	if g.lastCommitIDs {
+		if err := g.stampLastCommitIDs(actions); err != nil {
+			return err
+		}
+	}
+
+	if err := g.stage(opt); err != nil {
+		return err
+	}
+
+	c, err := g.createCommit(opt)
+	if err != nil && alreadyExists(err) {
+		// The repository was seeded without a history, so files which
+		// should be created already exist.
+		var n int
+		if n, err = g.createToUpdate(); err != nil {
+			return err
+		}
+		log.Printf("gitlab: %d files to create already exist, updating them instead", n)
+
+		if g.lastCommitIDs {
+			if err := g.stampLastCommitIDs(actions); err != nil {
+				return err
+			}
+		}
+		if err := g.stage(opt); err != nil {
+			return err
+		}
+		c, err = g.createCommit(opt)
+	}
+	if err != nil && g.lastCommitIDs && changedSince(err) {
+		return fmt.Errorf("gitlab: branch %q of project %d changed during the run, nothing was overwritten, run again to sync against the new state: %w", g.branch, g.pid, err)
+	}
+	if err != nil {
+		return fmt.Errorf("gitlab: commit error: %w", err)
+	}
+	g.commit = c
+	log.Printf("gitlab: created commit %s in project %d: %s", c.ID, g.pid, c.WebURL)
+
+	// Further commits of the run build on this one.
+	g.startSHA = ""
+	g.force = false
+
+	return g.unstage()
+}
+
+// alreadyExists reports whether the commit failed since a file to create
+// already exists.
+func alreadyExists(err error) bool {
+	var e *gitlab.ErrorResponse
+	return errors.As(err, &e) && strings.Contains(e.Message, "already exists")
+}
+
+// createToUpdate changes the create actions of files which exist in the
+// repository to updates and returns their number.
+func (g *Gitlab) createToUpdate() (int, error) {
+	tree, err := g.listTree()
+	if err != nil {
+		return 0, fmt.Errorf("gitlab: error listing repository: %w", err)
+	}
+
+	exists := make(map[string]bool)
+	for _, n := range tree {
+		if n.Type == "blob" {
+			exists[n.Path] = true
+		}
+	}
+
+	n := 0
+	for _, a := range g.actions {
+		if *a.Action == gitlab.FileCreate && exists[strings.TrimPrefix(*a.FilePath, "/")] {
+			a.Action = gitlab.FileAction(gitlab.FileUpdate)
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// Diffs returns the unified diffs of all modified files.
+func (g *Gitlab) Diffs() []string {
+	return g.diffs
+}
+
+// lastCommit returns the commit created by Commit or nil if no commit was
+// created.
+func (g *Gitlab) lastCommit() *gitlab.Commit {
+	return g.commit
+}
+
+// countActions returns the number of actions per action type.
+func countActions(actions []*gitlab.CommitActionOptions) map[gitlab.FileActionValue]int {
+	c := make(map[gitlab.FileActionValue]int)
+	for _, a := range actions {
+		c[*a.Action]++
+	}
+	return c
+}
@@ -0,0 +1,1078 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestGitlabAdd(t *testing.T) {
+	t.Run("create", func(t *testing.T) {
+		git, _ := MustGitlab(t, http.NotFound)
+
+		f := &File{
+			UID:    "go1",
+			Path:   "/dev/null.json",
+			SHA256: "12345",
+		}
+
+		git.Add(f)
+
+		if len(git.actions) != 1 {
+			t.Fatal("expected only one action")
+		}
+
+		if want, got := gitlab.FileCreate, *git.actions[0].Action; want != got {
+			t.Fatalf("want %v, got %v", want, got)
+		}
+	})
+
+	t.Run("move", func(t *testing.T) {
+		hf := MustHistoryHandler(t, `{"go1":{"uid":"go1","path":"/dev/null.json","sha256":"12345"}}`)
+		git, _ := MustGitlab(t, hf)
+
+		f := &File{
+			UID:    "go1",
+			Path:   "null.json",
+			SHA256: "54321",
+		}
+
+		git.Add(f)
+
+		if len(git.history) == 0 {
+			t.Fatal("expected history")
+		}
+
+		if len(git.actions) != 1 {
+			t.Fatal("expected one only action")
+		}
+
+		if want, got := gitlab.FileMove, *git.actions[0].Action; want != got {
+			t.Fatalf("want %v, got %v", want, got)
+		}
+	})
+
+	t.Run("moveModified", func(t *testing.T) {
+		hf := MustHistoryHandler(t, `{"go1":{"uid":"go1","path":"/Ops/Overview.json","sha256":"12345"}}`)
+		git, mux := MustGitlab(t, hf)
+		commits := mustCommits(t, mux)
+
+		f, err := newFile("go1", "/Dev/Renamed.json", map[string]string{"title": "Renamed"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		git.Add(f)
+
+		if len(git.actions) != 1 {
+			t.Fatal("expected one only action")
+		}
+		a := git.actions[0]
+		if *a.Action != gitlab.FileMove || *a.PreviousPath != "/Ops/Overview.json" || *a.FilePath != "/Dev/Renamed.json" || *a.Content != string(f.content) {
+			t.Fatalf("expected a move carrying the new content, got %+v", a)
+		}
+		if h := git.history["go1"]; h.Path != "/Dev/Renamed.json" || h.SHA256 != f.SHA256 {
+			t.Fatalf("expected the new path and hash in the history, got %+v", h)
+		}
+
+		if err := git.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if len(*commits) != 1 || len((*commits)[0].Actions) != 2 || *(*commits)[0].Actions[1].FilePath != "history.json" {
+			t.Fatal("expected the move and the history in a single commit")
+		}
+	})
+
+	t.Run("moveOnly", func(t *testing.T) {
+		hf := MustHistoryHandler(t, `{"go1":{"uid":"go1","path":"/dev/null.json","sha256":"12345"}}`)
+		git, _ := MustGitlab(t, hf)
+
+		git.Add(&File{UID: "go1", Path: "/null.json", SHA256: "12345"})
+
+		if len(git.actions) != 1 || *git.actions[0].Action != gitlab.FileMove {
+			t.Fatal("expected a move of the unchanged file")
+		}
+	})
+
+	t.Run("modified", func(t *testing.T) {
+		hf := MustHistoryHandler(t, `{"go1":{"uid":"go1","path":"/dev/null.json","sha256":"12345"}}`)
+		git, _ := MustGitlab(t, hf)
+
+		f := &File{
+			UID:    "go1",
+			Path:   "/dev/null.json",
+			SHA256: "54321",
+		}
+
+		git.Add(f)
+
+		if len(git.history) == 0 {
+			t.Fatal("expected history")
+		}
+
+		if len(git.actions) != 1 {
+			t.Fatal("expected one only action")
+		}
+
+		if want, got := gitlab.FileUpdate, *git.actions[0].Action; want != got {
+			t.Fatalf("want %v, got %v", want, got)
+		}
+	})
+
+	t.Run("nothing", func(t *testing.T) {
+		hf := MustHistoryHandler(t, `{"go1":{"uid":"go1","path":"/dev/null.json","sha256":"12345"}}`)
+		git, _ := MustGitlab(t, hf)
+
+		f := &File{
+			UID:    "go1",
+			Path:   "/dev/null.json",
+			SHA256: "12345",
+		}
+
+		git.Add(f)
+
+		if len(git.history) == 0 {
+			t.Fatal("expected history")
+		}
+
+		if len(git.actions) != 0 {
+			t.Fatal("expected no action")
+		}
+	})
+
+}
+
+func TestGitlabCommit(t *testing.T) {
+	t.Run("allEmpty", func(t *testing.T) {
+		git, _ := MustGitlab(t, http.NotFound)
+		if err := git.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("noChangesNoCommit", func(t *testing.T) {
+		hf := MustHistoryHandler(t, `{
+			"go1": {
+				"uid": "go1",
+				"path": "/dev/null.json",
+				"sha256": "12345"
+			}
+		}`)
+
+		git, _ := MustGitlab(t, hf)
+
+		f := &File{
+			UID:    "go1",
+			Path:   "/dev/null.json",
+			SHA256: "12345",
+		}
+
+		git.Add(f)
+
+		if len(git.actions) != 0 {
+			t.Fatal("expected no action")
+		}
+
+		if err := git.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("historyChanges", func(t *testing.T) {
+		hf := MustHistoryHandler(t, `{"go1":{"uid":"go1","path":"/dev/null.json","sha256":"12345","version":1}}`)
+
+		for _, version := range []int64{1, 2} {
+			git, mux := MustGitlab(t, hf)
+			commits := mustCommits(t, mux)
+			git.commitHistory = true
+
+			git.Add(&File{UID: "go1", Path: "/dev/null.json", SHA256: "12345", Version: version})
+			if err := git.Commit(); err != nil {
+				t.Fatal(err)
+			}
+
+			want := 0
+			if version != 1 {
+				want = 1
+			}
+			if len(*commits) != want {
+				t.Fatalf("version %d: want %d commits, got %d", version, want, len(*commits))
+			}
+			if want == 1 && git.history["go1"].Version != version {
+				t.Fatalf("expected the version to be recorded, got %d", git.history["go1"].Version)
+			}
+		}
+	})
+
+	t.Run("historyKeep", func(t *testing.T) {
+		in := `{"go1":{"uid":"go1","path":"/dev/null.json","sha256":"12345"}}`
+		files := map[string]string{
+			"history.json":   in,
+			"history.json.1": "old",
+		}
+		git, mux := MustGitlab(t, func(w http.ResponseWriter, r *http.Request) {
+			name := path.Base(r.URL.Path)
+			c, ok := files[name]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(&gitlab.File{FileName: name, Content: base64.StdEncoding.EncodeToString([]byte(c))})
+		})
+		commits := mustCommits(t, mux)
+		git.historyKeep = 3
+
+		git.Add(&File{UID: "go1", Path: "/dev/null.json", SHA256: "54321"})
+		if err := git.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		if len(*commits) != 1 {
+			t.Fatalf("want 1 commit, got %d", len(*commits))
+		}
+
+		want := map[string]string{
+			"history.json.1": string(gitlab.FileUpdate) + " " + in,
+			"history.json.2": string(gitlab.FileCreate) + " old",
+		}
+		got := make(map[string]string)
+		for _, a := range (*commits)[0].Actions {
+			if strings.HasPrefix(*a.FilePath, "history.json.") {
+				got[*a.FilePath] = string(*a.Action) + " " + *a.Content
+			}
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("rotated history: got %v, want %v", got, want)
+		}
+	})
+
+	t.Run("oneFileChangeTwoActions", func(t *testing.T) {
+		hf := MustHistoryHandler(t, `{
+			"go1": {
+				"uid": "go1",
+				"path": "/dev/null.json",
+				"sha256": "12345"
+			}
+		}`)
+
+		git, mux := MustGitlab(t, hf)
+		mux.HandleFunc("/api/v4/projects/1/", commitHandler(t, http.StatusOK))
+
+		f := &File{
+			UID:    "go1",
+			Path:   "/dev/null.json",
+			SHA256: "54321",
+		}
+
+		git.Add(f)
+
+		if err := git.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(git.actions) != 2 {
+			t.Fatal("expected two action, one for the file one for the history.")
+		}
+	})
+
+	t.Run("multipleChanges", func(t *testing.T) {
+		hf := MustHistoryHandler(t, `{
+			"1": {
+				"uid": "1",
+				"path": "/dev/null1.json",
+				"sha256": "12345"
+			}
+		}`)
+
+		git, mux := MustGitlab(t, hf)
+		mux.HandleFunc("/api/v4/projects/1/", commitHandler(t, http.StatusOK))
+
+		inSize := 4
+		for i := 1; i <= inSize; i++ {
+			f := &File{
+				UID:    fmt.Sprintf("%d", i),
+				Path:   fmt.Sprintf("/dev/null%d.json", i),
+				SHA256: "54321",
+			}
+
+			git.Add(f)
+		}
+
+		if err := git.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(git.actions) != (inSize + 1) {
+			t.Fatal("expected five actions (4 files, 1 history).")
+		}
+	})
+
+	t.Run("maxChangesExceeded", func(t *testing.T) {
+		hf := MustHistoryHandler(t, `{
+			"1": {
+				"uid": "1",
+				"path": "/dev/null1.json",
+				"sha256": "12345"
+			},
+			"2": {
+				"uid": "2",
+				"path": "/dev/null2.json",
+				"sha256": "12345"
+			}
+		}`)
+
+		git, mux := MustGitlab(t, hf)
+		mux.HandleFunc("/api/v4/projects/1/", func(w http.ResponseWriter, r *http.Request) {
+			t.Error("expected no commit")
+		})
+		git.maxChanges = 1
+
+		// Both files are missing and would be deleted.
+		if err := git.Commit(); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+
+	t.Run("repoClean", func(t *testing.T) {
+		hf := MustHistoryHandler(t, `{
+			"go1": {
+				"uid": "go1",
+				"path": "/dev/null.json",
+				"sha256": "12345"
+			}
+		}`)
+
+		git, mux := MustGitlab(t, hf)
+		mux.HandleFunc("/api/v4/projects/1/", commitHandler(t, http.StatusOK))
+		mux.HandleFunc("/api/v4/projects/1/repository/tree", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`[
+				{"type": "tree", "path": "dev"},
+				{"type": "blob", "path": "dev/null.json"},
+				{"type": "blob", "path": "dev/stray.json"},
+				{"type": "blob", "path": "history.json"},
+				{"type": "blob", "path": "README.md"}
+			]`))
+		})
+		git.repoClean = true
+
+		git.Add(&File{
+			UID:    "go1",
+			Path:   "/dev/null.json",
+			SHA256: "12345",
+		})
+
+		if err := git.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(git.actions) != 2 {
+			t.Fatal("expected two actions, one for the stray file one for the history.")
+		}
+
+		if want, got := "dev/stray.json", *git.actions[0].FilePath; want != got {
+			t.Fatalf("want %v, got %v", want, got)
+		}
+	})
+
+	t.Run("createExisting", func(t *testing.T) {
+		git, mux := MustGitlab(t, http.NotFound)
+		mux.HandleFunc("/api/v4/projects/1/repository/tree", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`[{"type": "blob", "path": "dev/null.json"}]`))
+		})
+
+		var commits []*gitlab.CreateCommitOptions
+		mux.HandleFunc("/api/v4/projects/1/repository/commits", func(w http.ResponseWriter, r *http.Request) {
+			var opt gitlab.CreateCommitOptions
+			json.NewDecoder(r.Body).Decode(&opt)
+			commits = append(commits, &opt)
+
+			for _, a := range opt.Actions {
+				if *a.Action == gitlab.FileCreate && *a.FilePath == "/dev/null.json" {
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte(`{"message":"A file with this name already exists"}`))
+					return
+				}
+			}
+			w.Write([]byte(`{"id":"abc123"}`))
+		})
+
+		git.Add(&File{
+			UID:    "go1",
+			Path:   "/dev/null.json",
+			SHA256: "12345",
+		})
+
+		if err := git.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(commits) != 2 {
+			t.Fatalf("expected the commit to be retried, got %d commits", len(commits))
+		}
+
+		if want, got := gitlab.FileUpdate, *commits[1].Actions[0].Action; want != got {
+			t.Fatalf("want %v, got %v", want, got)
+		}
+	})
+}
+
+func TestGitlabCommitPerFile(t *testing.T) {
+	git, mux := MustGitlab(t, http.NotFound)
+	git.commitMode = CommitPerFile
+
+	var commits []gitlab.CreateCommitOptions
+	mux.HandleFunc("/api/v4/projects/1/repository/commits", func(w http.ResponseWriter, r *http.Request) {
+		var opt gitlab.CreateCommitOptions
+		json.NewDecoder(r.Body).Decode(&opt)
+		commits = append(commits, opt)
+		fmt.Fprintf(w, `{"id":"c%d"}`, len(commits))
+	})
+
+	for _, uid := range []string{"go1", "go2"} {
+		git.Add(&File{UID: uid, Path: "/Ops/" + uid + ".json", SHA256: uid, content: []byte("{}")})
+	}
+
+	if err := git.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(commits) != 3 {
+		t.Fatalf("want a commit per file and one of the history, got %d commits", len(commits))
+	}
+
+	for i, uid := range []string{"go1", "go2"} {
+		c := commits[i]
+		if len(c.Actions) != 1 || *c.Actions[0].FilePath != "/Ops/"+uid+".json" {
+			t.Fatalf("%d: expected only %s to be committed, got %d actions", i, uid, len(c.Actions))
+		}
+		if want := "ʕ◔ϖ◔ʔ: create Ops/" + uid + ".json"; !strings.HasPrefix(*c.CommitMessage, want+"\n") {
+			t.Fatalf("%d: want message starting with %q, got %q", i, want, *c.CommitMessage)
+		}
+	}
+
+	last := commits[2]
+	if len(last.Actions) != 1 || *last.Actions[0].FilePath != "history.json" {
+		t.Fatalf("expected only the history in the last commit, got %d actions", len(last.Actions))
+	}
+
+	if git.lastCommit().ID != "c3" {
+		t.Fatalf("expected the last commit to be reported, got %s", git.lastCommit().ID)
+	}
+}
+
+func TestGitlabSeparateHistory(t *testing.T) {
+	git, mux := MustGitlab(t, http.NotFound)
+	git.separateHistory = true
+
+	var commits []gitlab.CreateCommitOptions
+	mux.HandleFunc("/api/v4/projects/1/repository/commits", func(w http.ResponseWriter, r *http.Request) {
+		var opt gitlab.CreateCommitOptions
+		json.NewDecoder(r.Body).Decode(&opt)
+		commits = append(commits, opt)
+		if len(commits) == 2 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"message":"rejected"}`))
+			return
+		}
+		fmt.Fprintf(w, `{"id":"c%d"}`, len(commits))
+	})
+
+	for _, uid := range []string{"go1", "go2"} {
+		git.Add(&File{UID: uid, Path: "/Ops/" + uid + ".json", SHA256: uid, content: []byte("{}")})
+	}
+
+	err := git.Commit()
+	if err == nil || !strings.Contains(err.Error(), "committed in c1") {
+		t.Fatalf("expected the failed history commit to be reported, got %v", err)
+	}
+
+	if len(commits) != 2 || len(commits[0].Actions) != 2 {
+		t.Fatalf("expected the files in the first commit, got %d commits", len(commits))
+	}
+	for _, a := range commits[0].Actions {
+		if *a.FilePath == "history.json" {
+			t.Fatal("expected the history not to be in the commit of the files")
+		}
+	}
+
+	h := commits[1]
+	if len(h.Actions) != 1 || *h.Actions[0].FilePath != "history.json" || !strings.HasPrefix(*h.CommitMessage, "ʕ◔ϖ◔ʔ: update history\n") {
+		t.Fatalf("expected only the history in the second commit, got %d actions", len(h.Actions))
+	}
+}
+
+func TestGitlabStartSHA(t *testing.T) {
+	git, mux := MustGitlab(t, http.NotFound)
+	git.commitMode = CommitPerFile
+	sha := "0123456789abcdef0123456789abcdef01234567"
+	git.startSHA = sha
+	git.force = true
+
+	var commits []gitlab.CreateCommitOptions
+	mux.HandleFunc("/api/v4/projects/1/repository/commits", func(w http.ResponseWriter, r *http.Request) {
+		var opt gitlab.CreateCommitOptions
+		json.NewDecoder(r.Body).Decode(&opt)
+		commits = append(commits, opt)
+		fmt.Fprintf(w, `{"id":"c%d"}`, len(commits))
+	})
+
+	git.Add(&File{UID: "go1", Path: "/Ops/go1.json", SHA256: "go1", content: []byte("{}")})
+
+	if err := git.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(commits) != 2 {
+		t.Fatalf("want 2 commits, got %d", len(commits))
+	}
+	if c := commits[0]; c.StartSHA == nil || *c.StartSHA != sha || c.Force == nil || !*c.Force {
+		t.Fatalf("expected the first commit to be based on the start SHA with force, got %+v", c)
+	}
+	if c := commits[1]; c.StartSHA != nil || c.Force != nil {
+		t.Fatal("expected the second commit to be based on the first")
+	}
+}
+
+func TestGitlabConflict(t *testing.T) {
+	history := MustHistoryHandler(t, `{"go1":{"uid":"go1","path":"/dev/null.json","sha256":"12345"}}`)
+	hf := func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.Header().Set("X-Gitlab-Content-Sha256", "99999")
+			return
+		}
+		history(w, r)
+	}
+
+	testCases := map[string]int{
+		"":          1,
+		"skip":      0,
+		"overwrite": 1,
+	}
+
+	for mode, want := range testCases {
+		t.Run(mode, func(t *testing.T) {
+			git, _ := MustGitlab(t, hf)
+			git.conflict = mode
+
+			git.Add(&File{
+				UID:    "go1",
+				Path:   "/dev/null.json",
+				SHA256: "54321",
+			})
+
+			if got := len(git.Drift()); got != want {
+				t.Fatalf("want %d pending changes, got %d", want, got)
+			}
+		})
+	}
+}
+
+func TestRunSemanticConflict(t *testing.T) {
+	var bump int
+	var changed bool
+	mux := mustFixedDashboards(t, &bump)
+	repo := mustRepo(t, mux)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if changed && r.URL.Path == "/api/dashboards/uid/go1" {
+			w.Write([]byte(`{"meta":{"slug":"go1","url":"/d/go1/go1"},"dashboard":{"uid":"go1","title":"go1","version":8,"refresh":"1m","panels":[]}}`))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	opt := Options{
+		GrafanaAPI:   server.URL,
+		GrafanaToken: "token",
+		GitAPI:       server.URL,
+		GitToken:     "token",
+		GitPIDs:      []int{1},
+		SemanticDiff: true,
+		Conflict:     ConflictSkip,
+	}
+	if _, err := Run(context.Background(), opt); err != nil {
+		t.Fatal(err)
+	}
+	if len(repo) == 0 {
+		t.Fatal("expected the first run to commit")
+	}
+
+	// The repository files are unchanged, so the changed dashboard is no
+	// conflict.
+	changed = true
+	res, err := Run(context.Background(), opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Drift) != 1 || *res.Drift[0].Action != gitlab.FileUpdate || !res.Committed {
+		t.Fatalf("expected the changed dashboard to be committed, got %d actions", len(res.Drift))
+	}
+}
+
+func TestGitlabGzip(t *testing.T) {
+	git, _ := MustGitlab(t, http.NotFound)
+	git.gzip = true
+
+	content := []byte(`{"title":"go"}`)
+	git.Add(&File{
+		UID:     "go1",
+		Path:    "/dev/null.json",
+		SHA256:  hash(content),
+		content: content,
+	})
+
+	if len(git.actions) != 1 {
+		t.Fatal("expected only one action")
+	}
+
+	a := git.actions[0]
+	if want, got := "/dev/null.json.gz", *a.FilePath; want != got {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+
+	if a.Encoding == nil || *a.Encoding != "base64" {
+		t.Fatal("expected base64 encoding")
+	}
+
+	b, err := base64.StdEncoding.DecodeString(*a.Content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(content) != string(got) {
+		t.Fatalf("want %s, got %s", content, got)
+	}
+
+	if want, got := hash(content), git.history["go1"].SHA256; want != got {
+		t.Fatal("expected hash of the uncompressed content")
+	}
+}
+
+func TestGitlabHistoryFormat(t *testing.T) {
+	// The history is only found in the original format.
+	history := MustHistoryHandler(t, `{"go1":{"uid":"go1","path":"/dev/null.json","sha256":"12345"}}`)
+	git, _ := MustGitlab(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "history.json") {
+			history(w, r)
+			return
+		}
+		http.NotFound(w, r)
+	})
+
+	if git.historyFile != "history.json" || git.history["go1"] == nil {
+		t.Fatalf("expected the history to be read from history.json, got %q", git.historyFile)
+	}
+
+	git.setHistoryFormat(HistoryFormatNDJSON)
+	git.Keep("go1")
+	if err := git.updateHistory(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(git.actions) != 2 {
+		t.Fatalf("expected the history file to be replaced, got %d actions", len(git.actions))
+	}
+
+	del, create := git.actions[0], git.actions[1]
+	if *del.Action != gitlab.FileDelete || *del.FilePath != "history.json" {
+		t.Fatalf("expected history.json to be deleted, got %s %s", *del.Action, *del.FilePath)
+	}
+	if *create.Action != gitlab.FileCreate || *create.FilePath != "history.ndjson" {
+		t.Fatalf("expected history.ndjson to be created, got %s %s", *create.Action, *create.FilePath)
+	}
+
+	want := `{"uid":"go1","path":"/dev/null.json","sha256":"12345"}` + "\n"
+	if got := *create.Content; want != got {
+		t.Fatalf("want %s, got %s", want, got)
+	}
+}
+
+func TestGitlabInstance(t *testing.T) {
+	root := MustHistoryHandler(t, `{"go1":{"uid":"go1","path":"/Ops/go1.json","sha256":"12345"}}`)
+	prod := MustHistoryHandler(t, `{"go2":{"uid":"go2","path":"/prod/Ops/go2.json","sha256":"12345"}}`)
+	git, mux := MustGitlab(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/prod/history.json"):
+			prod(w, r)
+		case strings.HasSuffix(r.URL.Path, "/history.json"):
+			root(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	var treePath string
+	mux.HandleFunc("/api/v4/projects/1/repository/tree", func(w http.ResponseWriter, r *http.Request) {
+		treePath = r.URL.Query().Get("path")
+		w.Write([]byte(`[{"type":"blob","path":"prod/Ops/stale.json"}]`))
+	})
+
+	if err := git.setInstance("prod"); err != nil {
+		t.Fatal(err)
+	}
+	if git.historyFile != "prod/history.json" || git.history["go2"] == nil || git.history["go1"] != nil {
+		t.Fatalf("expected the history of the instance, got %q with %v", git.historyFile, git.history)
+	}
+
+	git.repoClean = true
+	git.Add(&File{UID: "go3", Path: "/Ops/go3.json", SHA256: "67890", content: []byte("{}")})
+	git.deleteOrphans()
+	if err := git.cleanRepo(); err != nil {
+		t.Fatal(err)
+	}
+	if err := git.updateHistory(); err != nil {
+		t.Fatal(err)
+	}
+
+	if treePath != "prod" {
+		t.Fatalf("expected the tree of the instance to be listed, got %q", treePath)
+	}
+
+	var got []string
+	for _, a := range git.actions {
+		got = append(got, fmt.Sprintf("%s %s", *a.Action, *a.FilePath))
+	}
+	want := []string{
+		"create /prod/Ops/go3.json",
+		"delete /prod/Ops/go2.json",
+		"delete prod/Ops/stale.json",
+		"update prod/history.json",
+	}
+	if strings.Join(want, "\n") != strings.Join(got, "\n") {
+		t.Fatalf("want actions\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestGitlabContentType(t *testing.T) {
+	git, _ := MustGitlab(t, http.NotFound)
+
+	png := []byte("\x89PNG\r\n\x1a\n\x00")
+	git.Add(&File{UID: "json", Path: "/a.json", SHA256: "1", content: []byte("{}"), contentType: contentTypeJSON})
+	git.Add(&File{UID: "md", Path: "/INDEX.md", SHA256: "2", content: []byte("# Dashboards"), contentType: contentTypeMarkdown})
+	git.Add(&File{UID: "png", Path: "/a.png", SHA256: "3", content: png, contentType: contentTypePNG})
+
+	if len(git.actions) != 3 {
+		t.Fatalf("want 3 actions, got %d", len(git.actions))
+	}
+
+	for _, a := range git.actions[:2] {
+		if a.Encoding != nil {
+			t.Fatalf("%s: expected text content, got encoding %s", *a.FilePath, *a.Encoding)
+		}
+	}
+
+	a := git.actions[2]
+	if a.Encoding == nil || *a.Encoding != "base64" {
+		t.Fatal("expected base64 encoding of the binary file")
+	}
+	if want, got := base64.StdEncoding.EncodeToString(png), *a.Content; want != got {
+		t.Fatalf("want %s, got %s", want, got)
+	}
+}
+
+func TestGitlabLoad(t *testing.T) {
+	hf := MustHistoryHandler(t, `{
+		"thumbnails/go1": {"uid": "thumbnails/go1", "path": "/thumbnails/go1.png", "sha256": "12345"},
+		"thumbnails/go2": {"uid": "thumbnails/go2", "path": "/thumbnails/go2.png", "sha256": "12345"}
+	}`)
+	git, _ := MustGitlab(t, hf)
+
+	loaded := make(map[string]bool)
+	load := func(uid string, err error) func() ([]byte, error) {
+		return func() ([]byte, error) {
+			loaded[uid] = true
+			return []byte("png"), err
+		}
+	}
+
+	// Unchanged, changed but failing and new.
+	git.Add(&File{UID: "thumbnails/go1", Path: "/thumbnails/go1.png", SHA256: "12345", contentType: contentTypePNG, load: load("go1", nil)})
+	git.Add(&File{UID: "thumbnails/go2", Path: "/thumbnails/go2.png", SHA256: "67890", contentType: contentTypePNG, load: load("go2", errors.New("no renderer"))})
+	git.Add(&File{UID: "thumbnails/go3", Path: "/thumbnails/go3.png", SHA256: "67890", contentType: contentTypePNG, load: load("go3", nil)})
+
+	if loaded["go1"] || !loaded["go2"] || !loaded["go3"] {
+		t.Fatalf("expected only changed files to be loaded, got %v", loaded)
+	}
+
+	drift := git.Drift()
+	if len(drift) != 1 || *drift[0].FilePath != "/thumbnails/go3.png" {
+		t.Fatalf("expected only the new file to be created and the failed one to be kept, got %v", drift)
+	}
+}
+
+func TestGitlabPruneGrace(t *testing.T) {
+	t.Run("firstMissing", func(t *testing.T) {
+		hf := MustHistoryHandler(t, `{"go1":{"uid":"go1","path":"/dev/null.json","sha256":"12345"}}`)
+		git, mux := MustGitlab(t, hf)
+		mux.HandleFunc("/api/v4/projects/1/", commitHandler(t, http.StatusOK))
+		git.pruneGrace = time.Hour
+
+		if err := git.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(git.actions) != 1 || *git.actions[0].FilePath != "history.json" {
+			t.Fatal("expected only the history to be committed")
+		}
+
+		if git.history["go1"].MissingSince == nil {
+			t.Fatal("expected missingSince to be recorded")
+		}
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		since := time.Now().Add(-2 * time.Hour).Format(time.RFC3339)
+		hf := MustHistoryHandler(t, `{"go1":{"uid":"go1","path":"/dev/null.json","sha256":"12345","missingSince":"`+since+`"}}`)
+		git, _ := MustGitlab(t, hf)
+		git.pruneGrace = time.Hour
+
+		drift := git.Drift()
+		if len(drift) != 1 || *drift[0].Action != gitlab.FileDelete {
+			t.Fatal("expected the file to be deleted")
+		}
+	})
+
+	t.Run("reappeared", func(t *testing.T) {
+		since := time.Now().Add(-30 * time.Minute).Format(time.RFC3339)
+		hf := MustHistoryHandler(t, `{"go1":{"uid":"go1","path":"/dev/null.json","sha256":"12345","missingSince":"`+since+`"}}`)
+		git, _ := MustGitlab(t, hf)
+		git.pruneGrace = time.Hour
+
+		git.Add(&File{
+			UID:    "go1",
+			Path:   "/dev/null.json",
+			SHA256: "12345",
+		})
+
+		if git.history["go1"].MissingSince != nil {
+			t.Fatal("expected missingSince to be cleared")
+		}
+
+		if !git.historyChanged {
+			t.Fatal("expected the history to be changed")
+		}
+	})
+}
+
+func TestGitlabArchiveDeleted(t *testing.T) {
+	hf := MustHistoryHandler(t, `{"go1":{"uid":"go1","path":"/Ops/Overview.json","sha256":"12345"},"_archive/2022-01-01/go2":{"uid":"_archive/2022-01-01/go2","path":"/_archive/2022-01-01/Ops/Old.json","sha256":"6789"}}`)
+	git, _ := MustGitlab(t, hf)
+	git.archiveDeleted = true
+
+	day := time.Now().UTC().Format("2006-01-02")
+	want := "/_archive/" + day + "/Ops/Overview.json"
+
+	drift := git.Drift()
+	if len(drift) != 1 {
+		t.Fatalf("expected only the deleted file to be moved, got %d changes", len(drift))
+	}
+	if a := drift[0]; *a.Action != gitlab.FileMove || *a.PreviousPath != "/Ops/Overview.json" || *a.FilePath != want {
+		t.Fatalf("expected a move to %s, got %s %s", want, *a.Action, *a.FilePath)
+	}
+
+	if _, ok := git.history["go1"]; ok {
+		t.Fatal("expected the dashboard to be removed from the history")
+	}
+	if f, ok := git.history["_archive/"+day+"/go1"]; !ok || f.Path != want {
+		t.Fatal("expected the archived file to be recorded in the history")
+	}
+
+	if drift := git.Drift(); len(drift) != 1 {
+		t.Fatalf("expected the archived file to be kept, got %d changes", len(drift))
+	}
+}
+
+func TestGitlabKeep(t *testing.T) {
+	hf := MustHistoryHandler(t, `{"go1":{"uid":"go1","path":"/dev/null.json","sha256":"12345"}}`)
+	git, _ := MustGitlab(t, hf)
+
+	git.Keep("go1")
+
+	if drift := git.Drift(); len(drift) != 0 {
+		t.Fatalf("expected no pending changes, got %d", len(drift))
+	}
+}
+
+func TestGitlabKeepPrefix(t *testing.T) {
+	hf := MustHistoryHandler(t, `{
+		"snapshots/a": {"uid": "snapshots/a", "path": "/snapshots/a.json", "sha256": "12345"},
+		"snapshots/b": {"uid": "snapshots/b", "path": "/snapshots/b.json", "sha256": "12345"},
+		"go1": {"uid": "go1", "path": "/dev/null.json", "sha256": "12345"}
+	}`)
+	git, _ := MustGitlab(t, hf)
+
+	git.KeepPrefix("snapshots/")
+
+	drift := git.Drift()
+	if len(drift) != 1 || *drift[0].FilePath != "/dev/null.json" {
+		t.Fatalf("expected only the dashboard to be deleted, got %v", drift)
+	}
+}
+
+func TestGitlabDrift(t *testing.T) {
+	hf := MustHistoryHandler(t, `{
+		"go1": {
+			"uid": "go1",
+			"path": "/dev/null1.json",
+			"sha256": "12345"
+		},
+		"go2": {
+			"uid": "go2",
+			"path": "/dev/null2.json",
+			"sha256": "12345"
+		}
+	}`)
+
+	git, _ := MustGitlab(t, hf)
+	git.Add(&File{
+		UID:    "go1",
+		Path:   "/dev/null1.json",
+		SHA256: "12345",
+	})
+
+	drift := git.Drift()
+	if len(drift) != 1 {
+		t.Fatalf("expected one pending change, got %d", len(drift))
+	}
+
+	if want, got := gitlab.FileDelete, *drift[0].Action; want != got {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+}
+
+func TestGitlabBranch(t *testing.T) {
+	t.Run("missing", func(t *testing.T) {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/api/v4/projects/1", projectHandler)
+		mux.HandleFunc("/api/v4/projects/1/repository/branches/test", http.NotFound)
+		server := httptest.NewServer(mux)
+		t.Cleanup(server.Close)
+
+		if _, err := NewGitlab(context.Background(), server.URL, AuthPAT, "", "test", "", 1, nil); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+
+	t.Run("create", func(t *testing.T) {
+		created := false
+
+		mux := http.NewServeMux()
+		mux.HandleFunc("/api/v4/projects/1", projectHandler)
+		mux.HandleFunc("/api/v4/projects/1/repository/branches/test", http.NotFound)
+		mux.HandleFunc("/api/v4/projects/1/repository/branches", func(w http.ResponseWriter, r *http.Request) {
+			created = true
+			w.Write([]byte(`{"name":"test"}`))
+		})
+		mux.HandleFunc("/api/v4/projects/1/repository/files/", http.NotFound)
+		server := httptest.NewServer(mux)
+		t.Cleanup(server.Close)
+
+		if _, err := NewGitlab(context.Background(), server.URL, AuthPAT, "", "test", "main", 1, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		if !created {
+			t.Fatal("expected branch to be created")
+		}
+	})
+}
+
+func TestNormalizeGitlabURL(t *testing.T) {
+	for _, in := range []string{
+		"https://gitlab.example.com",
+		"https://gitlab.example.com/",
+		"https://gitlab.example.com/api",
+		"https://gitlab.example.com/api/v4",
+		"https://gitlab.example.com/api/v4/",
+	} {
+		if want, got := "https://gitlab.example.com", normalizeGitlabURL(in); want != got {
+			t.Errorf("%s: want %s, got %s", in, want, got)
+		}
+	}
+}
+
+func TestGitlabUnreachableProject(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(server.Close)
+
+	if _, err := NewGitlab(context.Background(), server.URL, AuthPAT, "", "test", "", 1, nil); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func projectHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(`{"id":1}`))
+}
+
+func commitHandler(t *testing.T, status int) http.HandlerFunc {
+	t.Helper()
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte("{}"))
+	}
+}
+
+func MustHistoryHandler(t *testing.T, in string) http.HandlerFunc {
+	t.Helper()
+
+	gf := &gitlab.File{
+		FileName: "history.json",
+		Content:  base64.StdEncoding.EncodeToString([]byte(in)),
+	}
+
+	j, err := json.Marshal(gf)
+	if err != nil {
+		panic(err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Write(j)
+	}
+}
+
+func MustGitlab(t *testing.T, historyHandler http.HandlerFunc) (*Gitlab, *http.ServeMux) {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/projects/1", projectHandler)
+	mux.HandleFunc("/api/v4/projects/1/repository/files/", historyHandler)
+	mux.HandleFunc("/api/v4/projects/1/repository/branches/test", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"name":"test"}`))
+	})
+
+	server := httptest.NewServer(mux)
+
+	gl, err := NewGitlab(context.Background(), server.URL, AuthPAT, "", "test", "", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return gl, mux
+}
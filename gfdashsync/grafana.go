@@ -0,0 +1,662 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+	"golang.org/x/time/rate"
+)
+
+// Grafana wraps the Grafana API client and adds the API calls which are not
+// provided by it.
+type Grafana struct {
+	*gapi.Client
+
+	baseURL url.URL
+	token   string
+	user    *url.Userinfo
+	client  *http.Client
+}
+
+// NewGrafana returns a new Grafana client authenticating with the API token
+// or, if it is empty, with basic auth of the given user. All requests are
+// cancelled when ctx is done. If rps is greater than zero the requests are
+// limited to rps requests per second. If transport is nil
+// http.DefaultTransport is used.
+func NewGrafana(ctx context.Context, baseURL, token, user, password string, rps float64, transport http.RoundTripper) (*Grafana, error) {
+	if token == "" && user == "" {
+		return nil, errors.New("grafana: missing API token or basic auth user")
+	}
+
+	var basicAuth *url.Userinfo
+	if token == "" {
+		basicAuth = url.UserPassword(user, password)
+	}
+
+	baseURL = normalizeGrafanaURL(baseURL)
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, fmt.Errorf("grafana: error parsing URL: %w", err)
+	}
+
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+
+	limit := rate.Inf
+	if rps > 0 {
+		limit = rate.Limit(rps)
+	}
+
+	client := &http.Client{
+		Transport: &contextTransport{
+			ctx: ctx,
+			next: &rateLimitTransport{
+				limiter: rate.NewLimiter(limit, 1),
+				next:    transport,
+			},
+		},
+	}
+
+	c, err := gapi.New(baseURL, gapi.Config{APIKey: token, BasicAuth: basicAuth, Client: client})
+	if err != nil {
+		return nil, fmt.Errorf("grafana: error creating client: %w", err)
+	}
+
+	return &Grafana{
+		Client:  c,
+		baseURL: *u,
+		token:   token,
+		user:    basicAuth,
+		client:  client,
+	}, nil
+}
+
+// normalizeGrafanaURL strips a trailing slash and the API path from the
+// given URL, since the API paths are appended to it.
+func normalizeGrafanaURL(baseURL string) string {
+	return strings.TrimSuffix(strings.TrimRight(baseURL, "/"), "/api")
+}
+
+// checkAccess verifies that dashboards can be listed with the given
+// credentials, so a wrong URL or token fails before any work is done.
+func (g *Grafana) checkAccess() error {
+	const p = "/api/search"
+	if _, err := g.getRaw(p, url.Values{"type": {"dash-db"}, "limit": {"1"}}); err != nil {
+		u := g.baseURL
+		u.Path = path.Join(u.Path, p)
+		return fmt.Errorf("grafana: cannot list dashboards at %s, check -grafana.api and the credentials: %w", u.Redacted(), err)
+	}
+	return nil
+}
+
+// get performs a GET request on the given API path and decodes the JSON
+// response into v.
+func (g *Grafana) get(p string, v interface{}) error {
+	body, err := g.getRaw(p, nil)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
+
+// getRaw performs a GET request on the given path with the given query and
+// returns the response body.
+func (g *Grafana) getRaw(p string, query url.Values) ([]byte, error) {
+	u := g.baseURL
+	u.Path = path.Join(u.Path, p)
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if g.token != "" {
+		req.Header.Set("Authorization", "Bearer "+g.token)
+	}
+	if g.user != nil {
+		p, _ := g.user.Password()
+		req.SetBasicAuth(g.user.Username(), p)
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("status: %d, body: %s", resp.StatusCode, body)
+	}
+
+	return body, nil
+}
+
+// Thumbnail width and height in pixels.
+const (
+	thumbnailWidth  = 1000
+	thumbnailHeight = 500
+)
+
+// RenderDashboard returns the dashboard with the given UID rendered as PNG.
+// It requires the image renderer plugin.
+func (g *Grafana) RenderDashboard(uid string) ([]byte, error) {
+	data, err := g.getRaw("/render/d/"+url.PathEscape(uid), url.Values{
+		"width":  {strconv.Itoa(thumbnailWidth)},
+		"height": {strconv.Itoa(thumbnailHeight)},
+		"kiosk":  {"true"},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Without the renderer Grafana may respond with an error page.
+	if ct := http.DetectContentType(data); ct != contentTypePNG {
+		return nil, fmt.Errorf("expected a PNG image, got %s", ct)
+	}
+	return data, nil
+}
+
+// searchTypeDashboard is the type of dashboards in the search results.
+const searchTypeDashboard = "dash-db"
+
+// Dashboards returns the search results of all dashboards. The search is
+// limited to dashboards, but folders returned anyway, e.g. by proxies
+// dropping the type filter, are skipped, since they have no dashboard model.
+func (g *Grafana) Dashboards() ([]gapi.FolderDashboardSearchResponse, error) {
+	items, err := g.Client.Dashboards()
+	if err != nil {
+		return nil, err
+	}
+
+	var dashboards []gapi.FolderDashboardSearchResponse
+	for _, d := range items {
+		if d.Type != "" && d.Type != searchTypeDashboard {
+			continue
+		}
+		dashboards = append(dashboards, d)
+	}
+	return dashboards, nil
+}
+
+// Dashboard returns the dashboard of the given search result. Dashboards
+// without a UID are fetched by their slug.
+func (g *Grafana) Dashboard(d gapi.FolderDashboardSearchResponse) (*gapi.Dashboard, error) {
+	if d.UID != "" {
+		return g.DashboardByUID(d.UID)
+	}
+	return g.Client.Dashboard(strings.TrimPrefix(d.URI, "db/"))
+}
+
+// DashboardVersion returns the dashboard with the given UID at the given
+// version. The meta data is that of the current version.
+func (g *Grafana) DashboardVersion(uid string, version int64) (*gapi.Dashboard, error) {
+	d, err := g.DashboardByUID(uid)
+	if err != nil {
+		return nil, err
+	}
+
+	// The versions are addressed by their version number, not by the ID of
+	// the version in the list of versions.
+	var dv struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := g.get(fmt.Sprintf("/api/dashboards/uid/%s/versions/%d", url.PathEscape(uid), version), &dv); err != nil {
+		return nil, fmt.Errorf("error fetching version %d of dashboard %q: %w", version, uid, err)
+	}
+
+	d.Model = dv.Data
+	return d, nil
+}
+
+// LatestVersion returns the latest version of the dashboard with the given
+// UID, without fetching the dashboard itself.
+func (g *Grafana) LatestVersion(uid string) (int64, error) {
+	v, err := g.LatestVersionInfo(uid)
+	if err != nil {
+		return 0, err
+	}
+	return v.Version, nil
+}
+
+// versionWorkers is the number of concurrent requests of LatestVersions.
+const versionWorkers = 8
+
+// LatestVersions returns the latest versions of the dashboards with the given
+// UIDs and the errors of those whose version could not be looked up. Grafana
+// has no API returning the versions of several dashboards, so this is still
+// a request per dashboard, but a small one, and the requests are concurrent.
+func (g *Grafana) LatestVersions(uids []string) (map[string]int64, map[string]error) {
+	versions := make(map[string]int64, len(uids))
+	errs := make(map[string]error)
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	work := make(chan string)
+	for i := 0; i < versionWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for uid := range work {
+				v, err := g.LatestVersion(uid)
+				mu.Lock()
+				if err != nil {
+					errs[uid] = err
+				} else {
+					versions[uid] = v
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, uid := range uids {
+		work <- uid
+	}
+	close(work)
+	wg.Wait()
+
+	return versions, errs
+}
+
+// VersionInfo is a dashboard version as listed by Grafana.
+type VersionInfo struct {
+	Version   int64     `json:"version"`
+	Created   time.Time `json:"created"`
+	CreatedBy string    `json:"createdBy"`
+}
+
+// LatestVersionInfo returns the latest version of the dashboard with the
+// given UID and who saved it, without fetching the dashboard itself.
+func (g *Grafana) LatestVersionInfo(uid string) (*VersionInfo, error) {
+	body, err := g.getRaw(fmt.Sprintf("/api/dashboards/uid/%s/versions", uid), url.Values{"limit": {"1"}})
+	if err != nil {
+		return nil, err
+	}
+
+	var versions []*VersionInfo
+	if err := json.Unmarshal(body, &versions); err != nil {
+		return nil, err
+	}
+	if len(versions) == 0 {
+		return nil, fmt.Errorf("dashboard %q has no versions", uid)
+	}
+
+	return versions[0], nil
+}
+
+// dataSourceSecrets are the data source fields which could contain secrets.
+var dataSourceSecrets = []string{"password", "basicAuthPassword", "secureJsonData"}
+
+// DataSources returns the definitions of all data sources. Secrets are
+// removed from the returned definitions.
+func (g *Grafana) DataSources() ([]map[string]interface{}, error) {
+	var ds []map[string]interface{}
+	if err := g.get("/api/datasources", &ds); err != nil {
+		return nil, err
+	}
+
+	for _, d := range ds {
+		for _, k := range dataSourceSecrets {
+			delete(d, k)
+		}
+	}
+
+	return ds, nil
+}
+
+// Folder is the definition of a Grafana folder. ParentUID is only set for
+// nested folders.
+type Folder struct {
+	UID       string `json:"uid"`
+	Title     string `json:"title"`
+	ParentUID string `json:"parentUid,omitempty"`
+}
+
+// FolderDefinitions returns the definitions of all folders.
+func (g *Grafana) FolderDefinitions() ([]*Folder, error) {
+	var f []*Folder
+	if err := g.get("/api/folders", &f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// folderWithParents is a folder with its parent folders, starting with the
+// top level folder.
+type folderWithParents struct {
+	Folder
+	Parents []*Folder `json:"parents"`
+}
+
+// folder returns the folder with the given UID and its parents.
+func (g *Grafana) folder(uid string) (*folderWithParents, error) {
+	var f folderWithParents
+	if err := g.get("/api/folders/"+url.PathEscape(uid), &f); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// FolderPath returns the titles of the folder with the given UID and its
+// parent folders joined by "/", starting with the top level folder.
+func (g *Grafana) FolderPath(uid string) (string, error) {
+	f, err := g.folder(uid)
+	if err != nil {
+		return "", err
+	}
+
+	var titles []string
+	for _, p := range f.Parents {
+		titles = append(titles, p.Title)
+	}
+	return path.Join(append(titles, f.Title)...), nil
+}
+
+// FolderParents returns the parent folders of the folder with the given UID,
+// starting with the top level folder. Top level folders have none.
+func (g *Grafana) FolderParents(uid string) ([]*Folder, error) {
+	f, err := g.folder(uid)
+	if err != nil {
+		return nil, err
+	}
+	return f.Parents, nil
+}
+
+// libraryPanelsPerPage is the page size of the library panel requests.
+const libraryPanelsPerPage = 100
+
+// LibraryPanels returns all library panels. The meta data of the panels,
+// like the number of connected dashboards and the time of the last update,
+// is removed, since it changes without the panels being modified and is not
+// needed to recreate them.
+func (g *Grafana) LibraryPanels() ([]map[string]interface{}, error) {
+	var panels []map[string]interface{}
+	for page := 1; ; page++ {
+		body, err := g.getRaw("/api/library-elements", url.Values{
+			"kind":    {"1"}, // panels, as opposed to variables
+			"page":    {strconv.Itoa(page)},
+			"perPage": {strconv.Itoa(libraryPanelsPerPage)},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		var resp struct {
+			Result struct {
+				TotalCount int                      `json:"totalCount"`
+				Elements   []map[string]interface{} `json:"elements"`
+			} `json:"result"`
+		}
+		if err := json.Unmarshal(body, &resp); err != nil {
+			return nil, err
+		}
+
+		for _, e := range resp.Result.Elements {
+			delete(e, "meta")
+			panels = append(panels, e)
+		}
+		if len(resp.Result.Elements) < libraryPanelsPerPage || len(panels) >= resp.Result.TotalCount {
+			return panels, nil
+		}
+	}
+}
+
+// SnapshotInfo is a snapshot as listed by Grafana.
+type SnapshotInfo struct {
+	Key     string    `json:"key"`
+	Name    string    `json:"name"`
+	Expires time.Time `json:"expires"`
+}
+
+// Snapshots returns all snapshots.
+func (g *Grafana) Snapshots() ([]*SnapshotInfo, error) {
+	var s []*SnapshotInfo
+	if err := g.get("/api/dashboard/snapshots", &s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Snapshot returns the snapshot with the given key, consisting of the
+// dashboard with its data and the snapshot meta data.
+func (g *Grafana) Snapshot(key string) (map[string]interface{}, error) {
+	var s map[string]interface{}
+	if err := g.get("/api/snapshots/"+url.PathEscape(key), &s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// PlaylistInfo is a playlist as listed by Grafana.
+type PlaylistInfo struct {
+	ID   int64  `json:"id"`
+	UID  string `json:"uid"`
+	Name string `json:"name"`
+}
+
+// Key returns the UID of the playlist or its ID for versions of Grafana
+// before playlists had UIDs.
+func (p *PlaylistInfo) Key() string {
+	if p.UID != "" {
+		return p.UID
+	}
+	return strconv.FormatInt(p.ID, 10)
+}
+
+// Playlists returns all playlists.
+func (g *Grafana) Playlists() ([]*PlaylistInfo, error) {
+	var p []*PlaylistInfo
+	if err := g.get("/api/playlists", &p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Playlist returns the model of the playlist with the given key, including
+// the items referencing the dashboards by UID or tag.
+func (g *Grafana) Playlist(key string) (map[string]interface{}, error) {
+	var p map[string]interface{}
+	if err := g.get("/api/playlists/"+url.PathEscape(key), &p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// contextTransport is a http.RoundTripper which sends all requests with the
+// given context, since the Grafana client does not support contexts.
+type contextTransport struct {
+	ctx  context.Context
+	next http.RoundTripper
+}
+
+func (t *contextTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.next.RoundTrip(req.WithContext(t.ctx))
+}
+
+// DefaultGrafanaTimeout is the default timeout of each Grafana API request.
+const DefaultGrafanaTimeout = 30 * time.Second
+
+// orgHeader is the header selecting the organization of a Grafana request.
+const orgHeader = "X-Grafana-Org-Id"
+
+// orgTransport sets the organization of each request with the org header
+// instead of switching the current organization of the user, which would
+// change it for all other clients of the user at the same time. Requests
+// which already have the header are left alone.
+type orgTransport struct {
+	orgID int64
+	next  http.RoundTripper
+}
+
+func (t *orgTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get(orgHeader) != "" {
+		return t.next.RoundTrip(req)
+	}
+	r := req.Clone(req.Context())
+	r.Header.Set(orgHeader, strconv.FormatInt(t.orgID, 10))
+	return t.next.RoundTrip(r)
+}
+
+// timeoutTransport cancels each request which takes longer than timeout,
+// including reading the response body.
+type timeoutTransport struct {
+	timeout time.Duration
+	next    http.RoundTripper
+}
+
+func (t *timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelBody cancels the context of the request when the body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// permissionKey is used to sort permissions, so they hash stably.
+type permissionKey struct {
+	role       string
+	team, user int64
+	permission int64
+}
+
+func (a permissionKey) less(b permissionKey) bool {
+	switch {
+	case a.role != b.role:
+		return a.role < b.role
+	case a.team != b.team:
+		return a.team < b.team
+	case a.user != b.user:
+		return a.user < b.user
+	}
+	return a.permission < b.permission
+}
+
+// SortedDashboardPermissions returns the permissions of the dashboard with the
+// given ID sorted by role, team and user.
+func (g *Grafana) SortedDashboardPermissions(id int64) ([]*gapi.DashboardPermission, error) {
+	p, err := g.DashboardPermissions(id)
+	if err != nil {
+		return nil, err
+	}
+
+	key := func(p *gapi.DashboardPermission) permissionKey {
+		return permissionKey{p.Role, p.TeamID, p.UserID, p.Permission}
+	}
+	sort.SliceStable(p, func(i, j int) bool { return key(p[i]).less(key(p[j])) })
+
+	return p, nil
+}
+
+// SortedFolderPermissions returns the permissions of the folder with the given
+// UID sorted by role, team and user.
+func (g *Grafana) SortedFolderPermissions(uid string) ([]*gapi.FolderPermission, error) {
+	p, err := g.FolderPermissions(uid)
+	if err != nil {
+		return nil, err
+	}
+
+	key := func(p *gapi.FolderPermission) permissionKey {
+		return permissionKey{p.Role, p.TeamID, p.UserID, p.Permission}
+	}
+	sort.SliceStable(p, func(i, j int) bool { return key(p[i]).less(key(p[j])) })
+
+	return p, nil
+}
+
+// maxRateLimitRetries is the number of times a request rejected with
+// 429 Too Many Requests is retried.
+const maxRateLimitRetries = 3
+
+// rateLimitTransport is a http.RoundTripper which limits the rate of outgoing
+// requests and retries requests rejected with 429 Too Many Requests after the
+// duration given in the Retry-After header.
+type rateLimitTransport struct {
+	limiter *rate.Limiter
+	next    http.RoundTripper
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for i := 0; ; i++ {
+		if err := t.limiter.Wait(req.Context()); err != nil {
+			return nil, err
+		}
+
+		resp, err := t.next.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+			return resp, err
+		}
+
+		// Requests with a body cannot be replayed.
+		if i == maxRateLimitRetries || req.Body != nil {
+			return resp, nil
+		}
+
+		d, ok := retryAfter(resp.Header.Get("Retry-After"))
+		if !ok {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(d):
+		}
+	}
+}
+
+// retryAfter parses the value of a Retry-After header, which is either a
+// number of seconds or a HTTP date.
+func retryAfter(v string) (time.Duration, bool) {
+	if v == "" {
+		return 0, false
+	}
+
+	if s, err := strconv.Atoi(v); err == nil {
+		return time.Duration(s) * time.Second, true
+	}
+
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+
+	return time.Until(t), true
+}
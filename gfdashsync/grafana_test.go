@@ -0,0 +1,546 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGrafanaDataSources(t *testing.T) {
+	gf, mux := MustGrafana(t, 0)
+	mux.HandleFunc("/api/datasources", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"uid":"ds1","name":"influx","password":"secret","basicAuthPassword":"secret","secureJsonData":{"token":"secret"}}]`))
+	})
+
+	ds, err := gf.DataSources()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ds) != 1 {
+		t.Fatalf("expected one data source, got %d", len(ds))
+	}
+
+	if want, got := "influx", ds[0]["name"]; want != got {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+
+	for _, k := range dataSourceSecrets {
+		if _, ok := ds[0][k]; ok {
+			t.Fatalf("expected %q to be removed", k)
+		}
+	}
+}
+
+func TestGrafanaFolderDefinitions(t *testing.T) {
+	gf, mux := MustGrafana(t, 0)
+	mux.HandleFunc("/api/folders", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id":1,"uid":"ops","title":"Ops"},{"id":2,"uid":"db","title":"Databases","parentUid":"ops"}]`))
+	})
+
+	f, err := gf.FolderDefinitions()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Folder{{"ops", "Ops", ""}, {"db", "Databases", "ops"}}
+	if len(f) != len(want) {
+		t.Fatalf("want %d folders, got %d", len(want), len(f))
+	}
+	for i, w := range want {
+		if *f[i] != w {
+			t.Errorf("%d: want %+v, got %+v", i, w, *f[i])
+		}
+	}
+}
+
+func TestGrafanaFolderPath(t *testing.T) {
+	gf, mux := MustGrafana(t, 0)
+	mux.HandleFunc("/api/folders/db", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"uid":"db","title":"Databases","parents":[{"uid":"ops","title":"Ops"}]}`))
+	})
+	mux.HandleFunc("/api/folders/secret", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message":"access denied"}`, http.StatusForbidden)
+	})
+
+	got, err := gf.FolderPath("db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Ops/Databases"; want != got {
+		t.Fatalf("want %s, got %s", want, got)
+	}
+
+	if _, err := gf.FolderPath("secret"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestGrafanaSnapshots(t *testing.T) {
+	gf, mux := MustGrafana(t, 0)
+	mux.HandleFunc("/api/dashboard/snapshots", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id":1,"key":"abc","name":"Incident","expires":"2030-01-01T00:00:00Z"}]`))
+	})
+	mux.HandleFunc("/api/snapshots/abc", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"dashboard":{"title":"Incident"},"meta":{"isSnapshot":true}}`))
+	})
+
+	s, err := gf.Snapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s) != 1 || s[0].Key != "abc" || s[0].Name != "Incident" || s[0].Expires.Year() != 2030 {
+		t.Fatalf("unexpected snapshots %+v", s)
+	}
+
+	v, err := gf.Snapshot("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := v["dashboard"]; !ok {
+		t.Fatalf("expected the dashboard of the snapshot, got %v", v)
+	}
+}
+
+func TestGrafanaLibraryPanels(t *testing.T) {
+	gf, mux := MustGrafana(t, 0)
+	mux.HandleFunc("/api/library-elements", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("kind") != "1" {
+			t.Errorf("expected only panels to be listed, got %s", r.URL.RawQuery)
+		}
+
+		n := libraryPanelsPerPage
+		if r.URL.Query().Get("page") == "2" {
+			n = 1
+		}
+		var elements []string
+		for i := 0; i < n; i++ {
+			elements = append(elements, fmt.Sprintf(`{"uid":"lp%s-%d","name":"CPU","model":{"type":"graph"},"meta":{"connectedDashboards":3}}`, r.URL.Query().Get("page"), i))
+		}
+		fmt.Fprintf(w, `{"result":{"totalCount":%d,"elements":[%s]}}`, libraryPanelsPerPage+1, strings.Join(elements, ","))
+	})
+
+	p, err := gf.LibraryPanels()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p) != libraryPanelsPerPage+1 || p[0]["uid"] != "lp1-0" || p[libraryPanelsPerPage]["uid"] != "lp2-0" {
+		t.Fatalf("expected the panels of both pages, got %d", len(p))
+	}
+	if _, ok := p[0]["meta"]; ok {
+		t.Fatal("expected the meta data to be removed")
+	}
+	if _, ok := p[0]["model"]; !ok {
+		t.Fatal("expected the model to be kept")
+	}
+}
+
+func TestGrafanaPlaylists(t *testing.T) {
+	gf, mux := MustGrafana(t, 0)
+	mux.HandleFunc("/api/playlists", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id":1,"uid":"pl1","name":"Wall"},{"id":2,"name":"Legacy"}]`))
+	})
+	mux.HandleFunc("/api/playlists/pl1", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"uid":"pl1","name":"Wall","interval":"5m","items":[{"type":"dashboard_by_uid","value":"go1"}]}`))
+	})
+
+	p, err := gf.Playlists()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p) != 2 || p[0].Key() != "pl1" || p[1].Key() != "2" {
+		t.Fatalf("unexpected playlists %+v", p)
+	}
+
+	v, err := gf.Playlist("pl1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := v["items"]; !ok {
+		t.Fatalf("expected the items of the playlist, got %v", v)
+	}
+}
+
+func TestGrafanaRenderDashboard(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR")
+
+	gf, mux := MustGrafana(t, 0)
+	mux.HandleFunc("/render/d/go1", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("width") == "" {
+			t.Error("expected the width to be set")
+		}
+		w.Write(png)
+	})
+	mux.HandleFunc("/render/d/go2", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html>No image renderer available</html>"))
+	})
+
+	got, err := gf.RenderDashboard("go1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(png) != string(got) {
+		t.Fatalf("want %q, got %q", png, got)
+	}
+
+	if _, err := gf.RenderDashboard("go2"); err == nil {
+		t.Fatal("expected an error without image")
+	}
+}
+
+func TestGrafanaDashboards(t *testing.T) {
+	gf, mux := MustGrafana(t, 0)
+	mux.HandleFunc("/api/search", func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("type"); got != searchTypeDashboard {
+			t.Errorf("want type %q, got %q", searchTypeDashboard, got)
+		}
+		w.Write([]byte(`[
+			{"uid":"ops","title":"Ops","type":"dash-folder"},
+			{"uid":"go1","title":"Overview","type":"dash-db","folderUid":"ops","folderTitle":"Ops"},
+			{"uid":"go2","title":"Legacy"}
+		]`))
+	})
+
+	dashboards, err := gf.Dashboards()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(dashboards) != 2 || dashboards[0].UID != "go1" || dashboards[1].UID != "go2" {
+		t.Fatalf("expected the folder to be skipped, got %+v", dashboards)
+	}
+}
+
+func TestGrafanaDashboardVersion(t *testing.T) {
+	gf, mux := MustGrafana(t, 0)
+	mux.HandleFunc("/api/dashboards/uid/go1", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"dashboard":{"uid":"go1","title":"New","version":3},"meta":{"slug":"new"}}`))
+	})
+	// The versions are routed by their version number, which differs from
+	// their ID.
+	mux.HandleFunc("/api/dashboards/uid/go1/versions/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/dashboards/uid/go1/versions/2":
+			w.Write([]byte(`{"id":12,"version":2,"data":{"uid":"go1","title":"Old","version":2}}`))
+		case "/api/dashboards/uid/go1/versions/12":
+			w.Write([]byte(`{"id":22,"version":12,"data":{"uid":"go1","title":"Wrong","version":12}}`))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	d, err := gf.DashboardVersion("go1", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d.Model["title"] != "Old" || d.Meta.Slug != "new" {
+		t.Fatalf("unexpected dashboard %+v", d)
+	}
+
+	if _, err := gf.DashboardVersion("go1", 5); err == nil {
+		t.Fatal("expected an error for a missing version")
+	}
+}
+
+func TestGrafanaLatestVersion(t *testing.T) {
+	gf, mux := MustGrafana(t, 0)
+	mux.HandleFunc("/api/dashboards/uid/go1/versions", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("limit") != "1" {
+			t.Error("expected only the latest version to be requested")
+		}
+		w.Write([]byte(`[{"id":13,"version":3}]`))
+	})
+	mux.HandleFunc("/api/dashboards/uid/go2/versions", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	})
+
+	v, err := gf.LatestVersion("go1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 3 {
+		t.Fatalf("want version 3, got %d", v)
+	}
+
+	if _, err := gf.LatestVersion("go2"); err == nil {
+		t.Fatal("expected an error without versions")
+	}
+}
+
+func TestGrafanaSortedPermissions(t *testing.T) {
+	gf, mux := MustGrafana(t, 0)
+	mux.HandleFunc("/api/dashboards/id/1/permissions", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[
+			{"userId": 2, "permission": 1},
+			{"role": "Viewer", "permission": 1},
+			{"teamId": 1, "permission": 2},
+			{"role": "Editor", "permission": 2},
+			{"userId": 1, "permission": 4}
+		]`))
+	})
+
+	p, err := gf.SortedDashboardPermissions(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []permissionKey{
+		{"", 0, 1, 4},
+		{"", 0, 2, 1},
+		{"", 1, 0, 2},
+		{"Editor", 0, 0, 2},
+		{"Viewer", 0, 0, 1},
+	}
+
+	if len(p) != len(want) {
+		t.Fatalf("want %d permissions, got %d", len(want), len(p))
+	}
+
+	for i, w := range want {
+		if got := (permissionKey{p[i].Role, p[i].TeamID, p[i].UserID, p[i].Permission}); got != w {
+			t.Errorf("%d: want %v, got %v", i, w, got)
+		}
+	}
+}
+
+func TestGrafanaRateLimit(t *testing.T) {
+	t.Run("limit", func(t *testing.T) {
+		gf, mux := MustGrafana(t, 20)
+		mux.HandleFunc("/api/datasources", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`[]`))
+		})
+
+		n := 6
+		start := time.Now()
+		for i := 0; i < n; i++ {
+			if _, err := gf.DataSources(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// The first request is allowed immediately, all others have to wait
+		// for 1/20 of a second.
+		if want, got := time.Duration(n-1)*time.Second/20, time.Since(start); got < want {
+			t.Fatalf("want at least %v, got %v", want, got)
+		}
+	})
+
+	t.Run("retryAfter", func(t *testing.T) {
+		gf, mux := MustGrafana(t, 0)
+
+		calls := 0
+		mux.HandleFunc("/api/datasources", func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if calls == 1 {
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.Write([]byte(`[]`))
+		})
+
+		if _, err := gf.DataSources(); err != nil {
+			t.Fatal(err)
+		}
+
+		if want, got := 2, calls; want != got {
+			t.Fatalf("want %d calls, got %d", want, got)
+		}
+	})
+}
+
+func TestNormalizeGrafanaURL(t *testing.T) {
+	for _, in := range []string{
+		"https://grafana.example.com/sub",
+		"https://grafana.example.com/sub/",
+		"https://grafana.example.com/sub/api",
+		"https://grafana.example.com/sub/api/",
+	} {
+		if want, got := "https://grafana.example.com/sub", normalizeGrafanaURL(in); want != got {
+			t.Errorf("%s: want %s, got %s", in, want, got)
+		}
+	}
+}
+
+func TestGrafanaCheckAccess(t *testing.T) {
+	gf, mux := MustGrafana(t, 0)
+	if err := gf.checkAccess(); err == nil || !strings.Contains(err.Error(), gf.baseURL.String()+"/api/search") {
+		t.Fatalf("expected an error naming the URL, got %v", err)
+	}
+
+	mux.HandleFunc("/api/search", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	})
+	if err := gf.checkAccess(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTimeoutTransport(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hung", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	mux.HandleFunc("/ok", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	client := &http.Client{Transport: &timeoutTransport{timeout: 50 * time.Millisecond, next: http.DefaultTransport}}
+
+	if _, err := client.Get(server.URL + "/hung"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	resp, err := client.Get(server.URL + "/ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if b, err := io.ReadAll(resp.Body); err != nil || string(b) != "ok" {
+		t.Fatalf("expected the body to be readable, got %q, %v", b, err)
+	}
+}
+
+func TestLatestVersions(t *testing.T) {
+	gf, mux := MustGrafana(t, 0)
+	for i := 1; i <= 20; i++ {
+		v := i
+		mux.HandleFunc(fmt.Sprintf("/api/dashboards/uid/go%d/versions", i), func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `[{"version":%d}]`, v)
+		})
+	}
+
+	uids := []string{"missing"}
+	want := make(map[string]int64)
+	for i := 1; i <= 20; i++ {
+		uid := fmt.Sprintf("go%d", i)
+		uids = append(uids, uid)
+		want[uid] = int64(i)
+	}
+
+	versions, errs := gf.LatestVersions(uids)
+	if !reflect.DeepEqual(versions, want) {
+		t.Fatalf("want %v, got %v", want, versions)
+	}
+	if len(errs) != 1 || errs["missing"] == nil {
+		t.Fatalf("expected an error for the missing dashboard, got %v", errs)
+	}
+}
+
+func TestOrgTransport(t *testing.T) {
+	var got []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, r.Header.Get(orgHeader))
+	}))
+	t.Cleanup(server.Close)
+
+	opt := &Options{GrafanaOrgID: 2}
+	client := &http.Client{Transport: opt.grafanaTransport(http.DefaultTransport)}
+
+	req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	if want := []string{"2", "2"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("want org headers %v, got %v", want, got)
+	}
+	if h := req.Header.Get(orgHeader); h != "" {
+		t.Fatalf("expected the original request to be unchanged, got header %q", h)
+	}
+}
+
+func TestGrafanaCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/datasources", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	gf, err := NewGrafana(ctx, server.URL, "token", "", "", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+
+	if _, err := gf.DataSources(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestGrafanaBasicAuth(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/datasources", func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != "admin" || p != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`[]`))
+	})
+	mux.HandleFunc("/api/search", func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != "admin" || p != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`[]`))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	if _, err := NewGrafana(context.Background(), server.URL, "", "", "", 0, nil); err == nil {
+		t.Fatal("expected an error without authentication")
+	}
+
+	gf, err := NewGrafana(context.Background(), server.URL, "", "admin", "secret", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := gf.DataSources(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := gf.Dashboards(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func MustGrafana(t *testing.T, rps float64) (*Grafana, *http.ServeMux) {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	gf, err := NewGrafana(context.Background(), server.URL, "token", "", "", rps, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return gf, mux
+}
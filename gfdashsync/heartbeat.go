@@ -0,0 +1,30 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"fmt"
+	"time"
+)
+
+// heartbeatKey is the history key of the heartbeat file. It is never
+// deleted, even if the heartbeat is disabled.
+const heartbeatKey = "heartbeat"
+
+// heartbeatPath is the path of the heartbeat file.
+const heartbeatPath = "/last-sync.txt"
+
+// heartbeatFile returns the heartbeat file of a run at the given time. Since
+// its content changes on every run, every run creates a commit.
+func heartbeatFile(t time.Time) *File {
+	data := []byte(fmt.Sprintf("%s\ngfdashsync %s\n", t.UTC().Format(time.RFC3339), Version))
+	return &File{
+		UID:         heartbeatKey,
+		Path:        heartbeatPath,
+		SHA256:      hash(data),
+		content:     data,
+		contentType: contentTypeText,
+	}
+}
@@ -0,0 +1,27 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeartbeatFile(t *testing.T) {
+	now := time.Date(2022, 5, 1, 12, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+
+	f := heartbeatFile(now)
+	if f.UID != heartbeatKey || f.Path != heartbeatPath || f.binary() {
+		t.Fatalf("unexpected file %+v", f)
+	}
+	if !strings.HasPrefix(string(f.content), "2022-05-01T10:00:00Z\n") {
+		t.Fatalf("expected the time of the run in UTC, got %q", f.content)
+	}
+
+	if heartbeatFile(now.Add(time.Minute)).SHA256 == f.SHA256 {
+		t.Fatal("expected the file to change on every run")
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"time"
+)
+
+// The history formats. In HistoryFormatNDJSON each file is written on its own
+// line sorted by UID, so diffs of the history show the changed entries.
+const (
+	HistoryFormatJSON   = "json"
+	HistoryFormatNDJSON = "ndjson"
+)
+
+// historyFileName returns the name of the history file in the given format.
+func historyFileName(format string) string {
+	if format == HistoryFormatNDJSON {
+		return "history.ndjson"
+	}
+	return "history.json"
+}
+
+// History maps the UID of each synced file to its last committed state.
+type History map[string]*File
+
+// historyVersion is the version of the compact history format. The original
+// format has no version and maps each UID to a full File.
+const historyVersion = 2
+
+// compactHistory is the compact history format, which stores only the path and
+// hash of each file using short keys.
+type compactHistory struct {
+	Version int                     `json:"version"`
+	Files   map[string]*compactFile `json:"files"`
+}
+
+type compactFile struct {
+	Path         string     `json:"p"`
+	SHA256       string     `json:"s"`
+	Version      int64      `json:"v,omitempty"`
+	MissingSince *time.Time `json:"m,omitempty"`
+}
+
+// isCompactHistory reports whether the history file data is in the compact
+// format. In the original format a "version" key would be an object
+// describing the dashboard with that UID, never a number.
+func isCompactHistory(data []byte) bool {
+	var probe struct {
+		Version json.RawMessage `json:"version"`
+	}
+	if err := json.Unmarshal(data, &probe); err != nil {
+		return false
+	}
+
+	var v int
+	return probe.Version != nil && json.Unmarshal(probe.Version, &v) == nil
+}
+
+// decodeHistory decodes a history file in either the original or the compact
+// format.
+func decodeHistory(data []byte) (History, error) {
+	h := make(History)
+	if !isCompactHistory(data) {
+		if err := json.Unmarshal(data, &h); err != nil {
+			return nil, err
+		}
+		return h, nil
+	}
+
+	var c compactHistory
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+
+	for uid, f := range c.Files {
+		h[uid] = &File{
+			UID:          uid,
+			Path:         f.Path,
+			SHA256:       f.SHA256,
+			Version:      f.Version,
+			MissingSince: f.MissingSince,
+		}
+	}
+
+	return h, nil
+}
+
+// decodeHistoryFile decodes the history file with the given name, whose
+// format is selected by its extension.
+func decodeHistoryFile(name string, data []byte) (History, error) {
+	if path.Ext(name) == ".ndjson" {
+		return decodeNDJSONHistory(data)
+	}
+	return decodeHistory(data)
+}
+
+// decodeNDJSONHistory decodes a history with one file per line.
+func decodeNDJSONHistory(data []byte) (History, error) {
+	h := make(History)
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	s.Buffer(nil, 1<<20)
+	for n := 1; s.Scan(); n++ {
+		line := bytes.TrimSpace(s.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		f := &File{}
+		if err := json.Unmarshal(line, f); err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		h[f.UID] = f
+	}
+
+	return h, s.Err()
+}
+
+// encodeNDJSON encodes the history with one file per line sorted by UID.
+func (h History) encodeNDJSON() ([]byte, error) {
+	uids := make([]string, 0, len(h))
+	for uid := range h {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+
+	var buf bytes.Buffer
+	for _, uid := range uids {
+		b, err := json.Marshal(h[uid])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+
+	return buf.Bytes(), nil
+}
+
+// encode encodes the history in the original format or, if compact is set, in
+// the compact format.
+func (h History) encode(compact bool) ([]byte, error) {
+	if !compact {
+		return json.Marshal(h)
+	}
+
+	c := compactHistory{
+		Version: historyVersion,
+		Files:   make(map[string]*compactFile, len(h)),
+	}
+	for uid, f := range h {
+		c.Files[uid] = &compactFile{
+			Path:         f.Path,
+			SHA256:       f.SHA256,
+			Version:      f.Version,
+			MissingSince: f.MissingSince,
+		}
+	}
+
+	return json.Marshal(c)
+}
@@ -0,0 +1,87 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"testing"
+)
+
+func TestDecodeHistory(t *testing.T) {
+	testCases := map[string]string{
+		"original": `{"go1":{"uid":"go1","path":"/dev/null.json","sha256":"12345"}}`,
+		"compact":  `{"version":2,"files":{"go1":{"p":"/dev/null.json","s":"12345"}}}`,
+	}
+
+	for name, in := range testCases {
+		t.Run(name, func(t *testing.T) {
+			h, err := decodeHistory([]byte(in))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			f, ok := h["go1"]
+			if !ok {
+				t.Fatal("expected go1 in history")
+			}
+
+			if f.UID != "go1" || f.Path != "/dev/null.json" || f.SHA256 != "12345" {
+				t.Fatalf("unexpected file %+v", f)
+			}
+		})
+	}
+}
+
+func TestHistoryEncode(t *testing.T) {
+	h := History{
+		"go1": {UID: "go1", Path: "/dev/null.json", SHA256: "12345", Version: 3},
+	}
+
+	for _, compact := range []bool{false, true} {
+		data, err := h.encode(compact)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := decodeHistory(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if f := got["go1"]; f == nil || f.Path != "/dev/null.json" || f.SHA256 != "12345" || f.Version != 3 {
+			t.Fatalf("compact=%v: want %+v, got %+v", compact, h["go1"], f)
+		}
+	}
+}
+
+func TestHistoryNDJSON(t *testing.T) {
+	h := History{
+		"go2": {UID: "go2", Path: "/b.json", SHA256: "67890"},
+		"go1": {UID: "go1", Path: "/a.json", SHA256: "12345", Version: 3},
+	}
+
+	data, err := h.encodeNDJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"uid":"go1","path":"/a.json","sha256":"12345","version":3}
+{"uid":"go2","path":"/b.json","sha256":"67890"}
+`
+	if got := string(data); want != got {
+		t.Fatalf("want\n%s\ngot\n%s", want, got)
+	}
+
+	got, err := decodeHistoryFile("history.ndjson", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got["go1"].Version != 3 || got["go2"].Path != "/b.json" {
+		t.Fatalf("unexpected history %+v", got)
+	}
+
+	if _, err := decodeHistoryFile("history.ndjson", []byte("{\"uid\":\"go1\"}\nnot json\n")); err == nil {
+		t.Fatal("expected an error")
+	}
+}
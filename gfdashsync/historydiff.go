@@ -0,0 +1,123 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// History changes between two commits.
+const (
+	HistoryAdded    = "added"
+	HistoryRemoved  = "removed"
+	HistoryModified = "modified"
+	HistoryMoved    = "moved" // moved without being modified
+)
+
+// HistoryChange is the change of a synced file between two commits.
+type HistoryChange struct {
+	Change string `json:"change"`
+	UID    string `json:"uid"`
+	// Path is the path of the file, or the old path if it was removed.
+	Path string `json:"path"`
+	// PreviousPath is the old path of a moved file.
+	PreviousPath string `json:"previousPath,omitempty"`
+	// Version and PreviousVersion are the Grafana versions of the dashboard,
+	// if they are known.
+	Version         int64 `json:"version,omitempty"`
+	PreviousVersion int64 `json:"previousVersion,omitempty"`
+}
+
+// historyAt returns the history in the given commit, branch or tag. A
+// missing history is empty.
+func (g *Gitlab) historyAt(ref string) (History, error) {
+	for _, format := range []string{HistoryFormatJSON, HistoryFormatNDJSON} {
+		name := g.historyPath(format)
+		data, err := g.readFileAt(name, ref)
+		if errors.Is(err, errNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("gitlab: error reading history at %s: %w", ref, err)
+		}
+
+		h, err := decodeHistoryFile(name, data)
+		if err != nil {
+			return nil, fmt.Errorf("gitlab: error parsing history at %s: %w", ref, err)
+		}
+		return h, nil
+	}
+
+	return make(History), nil
+}
+
+// diffHistories returns the changes from the history old to the history cur
+// sorted by UID.
+func diffHistories(old, cur History) []HistoryChange {
+	var changes []HistoryChange
+	for uid, f := range cur {
+		c := HistoryChange{UID: uid, Path: f.Path, Version: f.Version}
+
+		prev, ok := old[uid]
+		switch {
+		case !ok:
+			c.Change = HistoryAdded
+		case prev.SHA256 != f.SHA256:
+			c.Change = HistoryModified
+		case prev.Path != f.Path:
+			c.Change = HistoryMoved
+		default:
+			continue
+		}
+
+		if ok {
+			c.PreviousVersion = prev.Version
+			if prev.Path != f.Path {
+				c.PreviousPath = prev.Path
+			}
+		}
+		changes = append(changes, c)
+	}
+
+	for uid, f := range old {
+		if _, ok := cur[uid]; !ok {
+			changes = append(changes, HistoryChange{
+				Change:          HistoryRemoved,
+				UID:             uid,
+				Path:            f.Path,
+				PreviousVersion: f.Version,
+			})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool { return changes[i].UID < changes[j].UID })
+	return changes
+}
+
+// runHistoryDiff compares the history in the commit opt.HistoryRef with the
+// history at the head of the branch without accessing Grafana.
+func runHistoryDiff(ctx context.Context, opt *Options, transport http.RoundTripper) (*Result, error) {
+	branch := opt.gitBranches()[0]
+	repo, err := NewGitlab(ctx, opt.GitAPI, opt.GitAuth, opt.GitToken, branch, "", opt.GitPIDs[0], transport)
+	if err != nil {
+		return nil, err
+	}
+	repo.instance = opt.Instance
+
+	old, err := repo.historyAt(opt.HistoryRef)
+	if err != nil {
+		return nil, err
+	}
+	cur, err := repo.historyAt(branch)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{HistoryChanges: diffHistories(old, cur)}, nil
+}
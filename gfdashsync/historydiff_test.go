@@ -0,0 +1,69 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestGitlabHistoryAt(t *testing.T) {
+	old := MustHistoryHandler(t, `{"go1":{"uid":"go1","path":"/Ops/Overview.json","sha256":"a","version":1}}`)
+	cur := MustHistoryHandler(t, `{"go1":{"uid":"go1","path":"/Ops/Overview.json","sha256":"b","version":2}}`)
+
+	git, _ := MustGitlab(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("ref") {
+		case "abc":
+			old(w, r)
+		case "test":
+			cur(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	h, err := git.historyAt("abc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h["go1"].SHA256 != "a" {
+		t.Fatalf("expected the history at the ref, got %+v", h["go1"])
+	}
+
+	h, err = git.historyAt("missing")
+	if err != nil || len(h) != 0 {
+		t.Fatalf("expected an empty history, got %v, %v", h, err)
+	}
+}
+
+func TestDiffHistories(t *testing.T) {
+	old := History{
+		"go1": {Path: "/Ops/Overview.json", SHA256: "a", Version: 1},
+		"go2": {Path: "/Ops/Moved.json", SHA256: "b", Version: 4},
+		"go3": {Path: "/Ops/Removed.json", SHA256: "c", Version: 2},
+		"go4": {Path: "/Ops/Same.json", SHA256: "d", Version: 7},
+		"go5": {Path: "/Ops/Both.json", SHA256: "e", Version: 1},
+	}
+	cur := History{
+		"go1": {Path: "/Ops/Overview.json", SHA256: "a2", Version: 3},
+		"go2": {Path: "/Dev/Moved.json", SHA256: "b", Version: 4},
+		"go4": {Path: "/Ops/Same.json", SHA256: "d", Version: 7},
+		"go5": {Path: "/Dev/Both.json", SHA256: "e2", Version: 2},
+		"go6": {Path: "/Ops/New.json", SHA256: "f", Version: 1},
+	}
+
+	want := []HistoryChange{
+		{Change: HistoryModified, UID: "go1", Path: "/Ops/Overview.json", Version: 3, PreviousVersion: 1},
+		{Change: HistoryMoved, UID: "go2", Path: "/Dev/Moved.json", PreviousPath: "/Ops/Moved.json", Version: 4, PreviousVersion: 4},
+		{Change: HistoryRemoved, UID: "go3", Path: "/Ops/Removed.json", PreviousVersion: 2},
+		{Change: HistoryModified, UID: "go5", Path: "/Dev/Both.json", PreviousPath: "/Ops/Both.json", Version: 2, PreviousVersion: 1},
+		{Change: HistoryAdded, UID: "go6", Path: "/Ops/New.json", Version: 1},
+	}
+
+	if got := diffHistories(old, cur); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %+v, got %+v", want, got)
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// Summary is the summary of a run passed to the post commit hook.
+type Summary struct {
+	Dashboards int `json:"dashboards"`
+	Fetched    int `json:"fetched"`
+	Created    int `json:"created"`
+	Updated    int `json:"updated"`
+	Moved      int `json:"moved"`
+	Deleted    int `json:"deleted"`
+
+	// DanglingRefs is the number of dangling references found with
+	// CheckRefs.
+	DanglingRefs int `json:"danglingRefs,omitempty"`
+
+	// Commit and CommitURL are the ID and the web URL of the created
+	// commit, if any.
+	Commit    string `json:"commit,omitempty"`
+	CommitURL string `json:"commitURL,omitempty"`
+}
+
+// summary returns the summary of the run.
+func (r *Result) summary() *Summary {
+	c := countActions(r.Drift)
+	return &Summary{
+		Dashboards:   r.Dashboards,
+		Fetched:      r.Fetched,
+		Created:      c[gitlab.FileCreate],
+		Updated:      c[gitlab.FileUpdate],
+		Moved:        c[gitlab.FileMove],
+		Deleted:      c[gitlab.FileDelete],
+		DanglingRefs: len(r.DanglingRefs),
+		Commit:       r.CommitID,
+		CommitURL:    r.CommitURL,
+	}
+}
+
+// runPostCommit runs the post commit hook with the JSON encoded summary. A
+// hook starting with http:// or https:// is a URL the summary is POSTed to,
+// otherwise it is a command run with "sh -c" receiving the summary on stdin.
+func runPostCommit(ctx context.Context, client *http.Client, hook string, s *Summary) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(hook, "http://") || strings.HasPrefix(hook, "https://") {
+		if err := postJSON(ctx, client, hook, b); err != nil {
+			return fmt.Errorf("post commit hook %q failed: %w", hook, err)
+		}
+		return nil
+	}
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", hook)
+	cmd.Stdin = bytes.NewReader(b)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("post commit hook %q failed: %w", hook, err)
+	}
+
+	return nil
+}
+
+// postJSON POSTs the JSON body to the given URL with the client.
+func postJSON(ctx context.Context, client *http.Client, u string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("status: %d", resp.StatusCode)
+	}
+
+	return nil
+}
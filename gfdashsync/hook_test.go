@@ -0,0 +1,71 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunPostCommit(t *testing.T) {
+	s := &Summary{Dashboards: 2, Fetched: 2, Created: 1}
+
+	t.Run("command", func(t *testing.T) {
+		out := filepath.Join(t.TempDir(), "summary.json")
+		if err := runPostCommit(context.Background(), http.DefaultClient, "cat > "+out, s); err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got Summary
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got != *s {
+			t.Fatalf("want %+v, got %+v", *s, got)
+		}
+	})
+
+	t.Run("commandFails", func(t *testing.T) {
+		if err := runPostCommit(context.Background(), http.DefaultClient, "exit 1", s); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+
+	t.Run("url", func(t *testing.T) {
+		var got Summary
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewDecoder(r.Body).Decode(&got)
+		}))
+		t.Cleanup(server.Close)
+
+		if err := runPostCommit(context.Background(), http.DefaultClient, server.URL, s); err != nil {
+			t.Fatal(err)
+		}
+		if got != *s {
+			t.Fatalf("want %+v, got %+v", *s, got)
+		}
+	})
+
+	t.Run("urlFails", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+		t.Cleanup(server.Close)
+
+		if err := runPostCommit(context.Background(), http.DefaultClient, server.URL, s); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+}
@@ -0,0 +1,102 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+)
+
+// indexKey is the history key of the index file.
+const indexKey = "index"
+
+// uidIndexKey and uidIndexPath are the history key and the path of the
+// index of LayoutUID.
+const (
+	uidIndexKey  = "uid-index"
+	uidIndexPath = "/index.json"
+)
+
+// uidIndexEntry is the folder and title of a dashboard in the index of
+// LayoutUID.
+type uidIndexEntry struct {
+	Folder    string `json:"folder"`
+	FolderUID string `json:"folderUid,omitempty"`
+	Title     string `json:"title"`
+}
+
+// uidIndexFile returns the index of LayoutUID, mapping the history key of
+// each dashboard, usually its UID, to its folder and title. Renames only
+// change the index instead of moving the dashboard files.
+func uidIndexFile(dashboards []gapi.FolderDashboardSearchResponse) (*File, error) {
+	m := make(map[string]uidIndexEntry, len(dashboards))
+	for _, d := range dashboards {
+		m[dashboardKey(d)] = uidIndexEntry{
+			Folder:    d.FolderTitle,
+			FolderUID: d.FolderUID,
+			Title:     d.Title,
+		}
+	}
+	return newFile(uidIndexKey, uidIndexPath, m)
+}
+
+// indexFile returns a Markdown file with the given name listing the
+// dashboards sorted by folder and title. The titles link to the dashboards
+// in the Grafana instance at grafanaURL.
+func indexFile(name, grafanaURL string, dashboards []gapi.FolderDashboardSearchResponse) (*File, error) {
+	u, err := url.Parse(grafanaURL)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing Grafana URL: %w", err)
+	}
+
+	sorted := make([]gapi.FolderDashboardSearchResponse, len(dashboards))
+	copy(sorted, dashboards)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].FolderTitle != sorted[j].FolderTitle {
+			return sorted[i].FolderTitle < sorted[j].FolderTitle
+		}
+		return sorted[i].Title < sorted[j].Title
+	})
+
+	var buf bytes.Buffer
+	buf.WriteString("# Dashboards\n\n")
+	buf.WriteString("| Folder | Title | UID |\n")
+	buf.WriteString("| --- | --- | --- |\n")
+	for _, d := range sorted {
+		title := markdownCell(d.Title)
+		if d.URL != "" {
+			title = fmt.Sprintf("[%s](%s)", title, dashboardURL(u, d))
+		}
+		fmt.Fprintf(&buf, "| %s | %s | %s |\n", markdownCell(d.FolderTitle), title, markdownCell(d.UID))
+	}
+
+	data := buf.Bytes()
+	return &File{
+		UID:         indexKey,
+		Path:        "/" + strings.TrimPrefix(name, "/"),
+		SHA256:      hash(data),
+		content:     data,
+		contentType: contentTypeMarkdown,
+	}, nil
+}
+
+// dashboardURL returns the URL of the dashboard in the Grafana instance at
+// the URL u. The dashboard URL already contains the sub path of the
+// instance, if any.
+func dashboardURL(u *url.URL, d gapi.FolderDashboardSearchResponse) string {
+	link := url.URL{Scheme: u.Scheme, Host: u.Host, Path: d.URL}
+	return link.String()
+}
+
+// markdownCell escapes s for use in a Markdown table cell.
+func markdownCell(s string) string {
+	s = strings.ReplaceAll(s, "|", `\|`)
+	return strings.ReplaceAll(s, "\n", " ")
+}
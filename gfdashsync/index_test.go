@@ -0,0 +1,92 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"encoding/json"
+	"testing"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+)
+
+func TestIndexFile(t *testing.T) {
+	dashboards := []gapi.FolderDashboardSearchResponse{
+		{UID: "b", Title: "Traffic | Edge", FolderTitle: "Ops", URL: "/grafana/d/b/traffic"},
+		{UID: "a", Title: "Overview", FolderTitle: "Ops", URL: "/grafana/d/a/overview"},
+		{UID: "c", Title: "Home", FolderTitle: "General"},
+	}
+
+	f, err := indexFile("INDEX.md", "https://example.com/grafana/api", dashboards)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# Dashboards
+
+| Folder | Title | UID |
+| --- | --- | --- |
+| General | Home | c |
+| Ops | [Overview](https://example.com/grafana/d/a/overview) | a |
+| Ops | [Traffic \| Edge](https://example.com/grafana/d/b/traffic) | b |
+`
+	if got := string(f.content); want != got {
+		t.Fatalf("want\n%s\ngot\n%s", want, got)
+	}
+
+	if f.Path != "/INDEX.md" || f.UID != indexKey {
+		t.Fatalf("unexpected file %q with key %q", f.Path, f.UID)
+	}
+
+	// The index is only modified if the dashboards change.
+	g, err := indexFile("INDEX.md", "https://example.com/grafana/api", dashboards[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.SHA256 == g.SHA256 {
+		t.Fatal("expected a different hash")
+	}
+}
+
+func TestUIDIndexFile(t *testing.T) {
+	dashboards := []gapi.FolderDashboardSearchResponse{
+		{UID: "a", Title: "Overview", FolderTitle: "Ops", FolderUID: "f1"},
+		{Title: "Imported", FolderTitle: "Ops", FolderUID: "f1"},
+	}
+
+	f, err := uidIndexFile(dashboards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Path != uidIndexPath || f.UID != uidIndexKey {
+		t.Fatalf("unexpected file %q with key %q", f.Path, f.UID)
+	}
+
+	var got map[string]uidIndexEntry
+	if err := json.Unmarshal(f.content, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]uidIndexEntry{
+		"a":                  {Folder: "Ops", FolderUID: "f1", Title: "Overview"},
+		"title:Ops/Imported": {Folder: "Ops", FolderUID: "f1", Title: "Imported"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("want %d entries, got %d", len(want), len(got))
+	}
+	for k, e := range want {
+		if got[k] != e {
+			t.Fatalf("%s: want %+v, got %+v", k, e, got[k])
+		}
+	}
+
+	// A renamed dashboard only changes the index.
+	dashboards[0].Title = "Renamed"
+	g, err := uidIndexFile(dashboards)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.SHA256 == g.SHA256 {
+		t.Fatal("expected a different hash")
+	}
+}
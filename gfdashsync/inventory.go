@@ -0,0 +1,78 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+)
+
+// inventoryKey and inventoryPath are the history key and the path of the
+// inventory file.
+const (
+	inventoryKey  = "inventory"
+	inventoryPath = "/inventory.json"
+)
+
+// inventoryEntry is a dashboard in the inventory.
+type inventoryEntry struct {
+	UID       string     `json:"uid"`
+	Title     string     `json:"title"`
+	Folder    string     `json:"folder"`
+	FolderUID string     `json:"folderUid,omitempty"`
+	Tags      []string   `json:"tags"`
+	URL       string     `json:"url,omitempty"`
+	Version   int64      `json:"version,omitempty"`
+	UpdatedBy string     `json:"updatedBy,omitempty"`
+	Updated   *time.Time `json:"updated,omitempty"`
+}
+
+// inventoryFile returns the inventory of the dashboards sorted by folder and
+// title. Only the latest version of each dashboard is requested, with
+// versionInfo, not the dashboard itself. Dashboards whose version cannot be
+// requested are listed without it.
+func inventoryFile(dashboards []gapi.FolderDashboardSearchResponse, versionInfo func(uid string) (*VersionInfo, error)) (*File, error) {
+	entries := make([]*inventoryEntry, 0, len(dashboards))
+	for _, d := range dashboards {
+		e := &inventoryEntry{
+			UID:       d.UID,
+			Title:     d.Title,
+			Folder:    d.FolderTitle,
+			FolderUID: d.FolderUID,
+			Tags:      d.Tags,
+			URL:       d.URL,
+		}
+		if e.Tags == nil {
+			e.Tags = []string{}
+		}
+
+		if d.UID != "" {
+			v, err := versionInfo(d.UID)
+			if err != nil {
+				log.Printf("warning cannot get version of dashboard %q with ID %d: %v", d.Title, d.ID, err)
+			} else {
+				e.Version = v.Version
+				e.UpdatedBy = v.CreatedBy
+				if !v.Created.IsZero() {
+					e.Updated = &v.Created
+				}
+			}
+		}
+
+		entries = append(entries, e)
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Folder != entries[j].Folder {
+			return entries[i].Folder < entries[j].Folder
+		}
+		return entries[i].Title < entries[j].Title
+	})
+
+	return newFile(inventoryKey, inventoryPath, entries)
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+)
+
+func TestInventoryFile(t *testing.T) {
+	updated := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	versions := func(uid string) (*VersionInfo, error) {
+		if uid == "go2" {
+			return nil, errors.New("forbidden")
+		}
+		return &VersionInfo{Version: 3, CreatedBy: "admin", Created: updated}, nil
+	}
+
+	f, err := inventoryFile([]gapi.FolderDashboardSearchResponse{
+		{UID: "go2", Title: "Zoo", FolderTitle: "Ops"},
+		{UID: "go1", Title: "Overview", FolderTitle: "Ops", Tags: []string{"prod"}},
+		{UID: "go3", Title: "Home", FolderTitle: "Dev"},
+	}, versions)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []*inventoryEntry
+	if err := json.Unmarshal(f.content, &entries); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 3 || entries[0].UID != "go3" || entries[1].UID != "go1" || entries[2].UID != "go2" {
+		t.Fatalf("expected the entries sorted by folder and title, got %+v", entries)
+	}
+	if e := entries[1]; e.Version != 3 || e.UpdatedBy != "admin" || !e.Updated.Equal(updated) || e.Tags[0] != "prod" {
+		t.Fatalf("unexpected entry %+v", e)
+	}
+	if e := entries[2]; e.Version != 0 || e.UpdatedBy != "" {
+		t.Fatalf("expected no version if it cannot be requested, got %+v", e)
+	}
+	if f.Path != inventoryPath || f.UID != inventoryKey {
+		t.Fatalf("unexpected file %s with key %s", f.Path, f.UID)
+	}
+}
+
+func TestRunInventory(t *testing.T) {
+	_, mux := MustRunServer(t)
+	mux.HandleFunc("/api/v4/projects/1/repository/files/history.json", MustHistoryHandler(t, `{"go1":{"uid":"go1","path":"/Ops/Overview.json","sha256":"abc"}}`))
+	mux.HandleFunc("/api/dashboards/uid/go1/versions", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"version":3,"createdBy":"admin"}]`))
+	})
+	commits := mustCommits(t, mux)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/dashboards/uid/go1" {
+			t.Error("expected the dashboard not to be fetched")
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	res, err := Run(context.Background(), Options{
+		GrafanaAPI:   server.URL,
+		GrafanaToken: "token",
+		GitAPI:       server.URL,
+		GitToken:     "token",
+		GitPIDs:      []int{1},
+		Mode:         ModeInventory,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.Drift) != 1 || *res.Drift[0].FilePath != inventoryPath {
+		t.Fatalf("expected only the inventory to be committed and the dashboard to be kept, got %v", res.Drift)
+	}
+	if len(*commits) != 1 {
+		t.Fatalf("expected a commit, got %d", len(*commits))
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// DefaultLockTTL is the default duration after which a lock is stale and
+// can be stolen.
+const DefaultLockTTL = time.Hour
+
+// lockFileName is the name of the lock file, which is next to the history.
+const lockFileName = "history.lock"
+
+// unlockTimeout is the time the release of a lock may take. The lock is
+// released even if the run was cancelled.
+const unlockTimeout = 30 * time.Second
+
+// lockInfo is the content of the lock file.
+type lockInfo struct {
+	Owner    string    `json:"owner"`
+	LockedAt time.Time `json:"lockedAt"`
+}
+
+// locker is implemented by backends which hold a lock on their history.
+type locker interface {
+	unlock() error
+}
+
+// lock serializes runs against the branch by committing the lock file before
+// the history is read. It fails if another run holds the lock, unless the
+// lock is older than ttl, in which case it is stolen. Two runs racing for
+// the lock cannot both succeed, since Gitlab rejects creating an existing
+// file and updating a file which changed since it was read.
+func (g *Gitlab) lock(ttl time.Duration) error {
+	name := path.Join(g.instance, lockFileName)
+
+	lockedAt := time.Now().UTC()
+	info, err := json.Marshal(lockInfo{Owner: lockOwner(), LockedAt: lockedAt})
+	if err != nil {
+		return err
+	}
+
+	a := &gitlab.CommitActionOptions{
+		Action:   gitlab.FileAction(gitlab.FileCreate),
+		FilePath: gitlab.String(name),
+		Content:  gitlab.String(string(info) + "\n"),
+	}
+
+	f, resp, err := g.client.RepositoryFiles.GetFile(g.pid, name, &gitlab.GetFileOptions{
+		Ref: gitlab.String(g.branch),
+	}, gitlab.WithContext(g.ctx))
+	switch {
+	case err == nil:
+		var held lockInfo
+		if data, err := base64.StdEncoding.DecodeString(f.Content); err == nil {
+			json.Unmarshal(data, &held)
+		}
+		if age := time.Since(held.LockedAt); age < ttl {
+			return fmt.Errorf("gitlab: history of project %d is locked by %s since %s, the lock expires in %v",
+				g.pid, held.Owner, held.LockedAt.Format(time.RFC3339), (ttl - age).Round(time.Second))
+		}
+		log.Printf("warning stealing stale lock of project %d held by %s since %s", g.pid, held.Owner, held.LockedAt.Format(time.RFC3339))
+		a.Action = gitlab.FileAction(gitlab.FileUpdate)
+		a.LastCommitID = gitlab.String(f.LastCommitID)
+
+	case resp != nil && resp.StatusCode == http.StatusNotFound:
+
+	default:
+		return fmt.Errorf("gitlab: error reading lock: %w", err)
+	}
+
+	_, _, err = g.client.Commits.CreateCommit(g.pid, &gitlab.CreateCommitOptions{
+		Branch:        gitlab.String(g.branch),
+		CommitMessage: gitlab.String("ʕ◔ϖ◔ʔ: lock history"),
+		Actions:       []*gitlab.CommitActionOptions{a},
+	}, gitlab.WithContext(g.ctx))
+	if err != nil {
+		return fmt.Errorf("gitlab: error acquiring lock of project %d, another run may hold it: %w", g.pid, err)
+	}
+	g.lockFile = name
+	g.lockedAt = lockedAt
+
+	return nil
+}
+
+// unlock deletes the lock file, if the lock is held. A lock which was stolen
+// by another run in the meantime is left untouched. The lock file is deleted
+// based on its last commit, so the deletion fails if the lock changed since
+// it was read.
+func (g *Gitlab) unlock() error {
+	if g.lockFile == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), unlockTimeout)
+	defer cancel()
+
+	f, resp, err := g.client.RepositoryFiles.GetFile(g.pid, g.lockFile, &gitlab.GetFileOptions{
+		Ref: gitlab.String(g.branch),
+	}, gitlab.WithContext(ctx))
+	switch {
+	case resp != nil && resp.StatusCode == http.StatusNotFound:
+		log.Printf("warning lock of project %d was already released", g.pid)
+		g.lockFile = ""
+		return nil
+	case err != nil:
+		return fmt.Errorf("gitlab: error reading lock of project %d: %w", g.pid, err)
+	}
+
+	var held lockInfo
+	if data, err := base64.StdEncoding.DecodeString(f.Content); err == nil {
+		json.Unmarshal(data, &held)
+	}
+	if held.Owner != lockOwner() || !held.LockedAt.Equal(g.lockedAt) {
+		log.Printf("warning not releasing lock of project %d, which was taken over by %s since %s", g.pid, held.Owner, held.LockedAt.Format(time.RFC3339))
+		g.lockFile = ""
+		return nil
+	}
+
+	_, _, err = g.client.Commits.CreateCommit(g.pid, &gitlab.CreateCommitOptions{
+		Branch:        gitlab.String(g.branch),
+		CommitMessage: gitlab.String("ʕ◔ϖ◔ʔ: unlock history"),
+		Actions: []*gitlab.CommitActionOptions{{
+			Action:       gitlab.FileAction(gitlab.FileDelete),
+			FilePath:     gitlab.String(g.lockFile),
+			LastCommitID: gitlab.String(f.LastCommitID),
+		}},
+	}, gitlab.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("gitlab: error releasing lock of project %d: %w", g.pid, err)
+	}
+	g.lockFile = ""
+
+	return nil
+}
+
+// unlock releases the locks of all backends.
+func (fo fanout) unlock() error {
+	var err error
+	for _, t := range fo {
+		if l, ok := t.Backend.(locker); ok {
+			if e := l.unlock(); e != nil && err == nil {
+				err = e
+			}
+		}
+	}
+	return err
+}
+
+// lockOwner returns the host name and process ID of this run.
+func lockOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s (pid %d)", host, os.Getpid())
+}
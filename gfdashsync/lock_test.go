@@ -0,0 +1,149 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestGitlabLock(t *testing.T) {
+	t.Run("free", func(t *testing.T) {
+		git, mux := MustGitlab(t, http.NotFound)
+		commits := mustCommits(t, mux)
+		mux.HandleFunc("/api/v4/projects/1/repository/files/history.lock", committedLockHandler(commits))
+
+		if err := git.lock(time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		if len(*commits) != 1 || *(*commits)[0].Actions[0].Action != gitlab.FileCreate || git.lockFile != "history.lock" {
+			t.Fatal("expected the lock file to be created")
+		}
+
+		if err := git.unlock(); err != nil {
+			t.Fatal(err)
+		}
+		if len(*commits) != 2 || *(*commits)[1].Actions[0].Action != gitlab.FileDelete {
+			t.Fatal("expected the lock file to be deleted")
+		}
+		if a := (*commits)[1].Actions[0]; a.LastCommitID == nil || *a.LastCommitID != "c1" {
+			t.Fatal("expected the lock file to be deleted based on its last commit")
+		}
+
+		if err := git.unlock(); err != nil || len(*commits) != 2 {
+			t.Fatal("expected a released lock not to be released again")
+		}
+	})
+
+	t.Run("held", func(t *testing.T) {
+		git, mux := MustGitlab(t, http.NotFound)
+		commits := mustCommits(t, mux)
+		mux.HandleFunc("/api/v4/projects/1/repository/files/history.lock", lockHandler(t, time.Now().Add(-time.Minute)))
+
+		err := git.lock(time.Hour)
+		if err == nil || !strings.Contains(err.Error(), "locked by other") {
+			t.Fatalf("expected the lock to be held, got %v", err)
+		}
+		if len(*commits) != 0 {
+			t.Fatal("expected nothing to be committed")
+		}
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		git, mux := MustGitlab(t, http.NotFound)
+		commits := mustCommits(t, mux)
+		mux.HandleFunc("/api/v4/projects/1/repository/files/history.lock", lockHandler(t, time.Now().Add(-2*time.Hour)))
+
+		if err := git.lock(time.Hour); err != nil {
+			t.Fatal(err)
+		}
+
+		a := (*commits)[0].Actions[0]
+		if *a.Action != gitlab.FileUpdate || a.LastCommitID == nil || *a.LastCommitID != "abc" {
+			t.Fatal("expected the stale lock to be stolen based on its last commit")
+		}
+	})
+
+	t.Run("stolen", func(t *testing.T) {
+		git, mux := MustGitlab(t, http.NotFound)
+		commits := mustCommits(t, mux)
+		stolen := false
+		committed := committedLockHandler(commits)
+		other := lockHandler(t, time.Now())
+		mux.HandleFunc("/api/v4/projects/1/repository/files/history.lock", func(w http.ResponseWriter, r *http.Request) {
+			if stolen {
+				other(w, r)
+				return
+			}
+			committed(w, r)
+		})
+
+		if err := git.lock(time.Hour); err != nil {
+			t.Fatal(err)
+		}
+
+		// Another run stole the lock, which is stale for it.
+		stolen = true
+		if err := git.unlock(); err != nil {
+			t.Fatal(err)
+		}
+		if len(*commits) != 1 {
+			t.Fatal("expected the lock of the other run not to be deleted")
+		}
+	})
+}
+
+// committedLockHandler serves the lock file of the last of the commits.
+func committedLockHandler(commits *[]gitlab.CreateCommitOptions) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(*commits) == 0 || *(*commits)[len(*commits)-1].Actions[0].Action == gitlab.FileDelete {
+			http.NotFound(w, r)
+			return
+		}
+		a := (*commits)[len(*commits)-1].Actions[0]
+		json.NewEncoder(w).Encode(gitlab.File{
+			FileName:     "history.lock",
+			Content:      base64.StdEncoding.EncodeToString([]byte(*a.Content)),
+			LastCommitID: fmt.Sprintf("c%d", len(*commits)),
+		})
+	}
+}
+
+func lockHandler(t *testing.T, lockedAt time.Time) http.HandlerFunc {
+	t.Helper()
+
+	info, err := json.Marshal(lockInfo{Owner: "other", LockedAt: lockedAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(gitlab.File{
+			FileName:     "history.lock",
+			Content:      base64.StdEncoding.EncodeToString(info),
+			LastCommitID: "abc",
+		})
+	}
+}
+
+func mustCommits(t *testing.T, mux *http.ServeMux) *[]gitlab.CreateCommitOptions {
+	t.Helper()
+
+	var commits []gitlab.CreateCommitOptions
+	mux.HandleFunc("/api/v4/projects/1/repository/commits", func(w http.ResponseWriter, r *http.Request) {
+		var opt gitlab.CreateCommitOptions
+		json.NewDecoder(r.Body).Decode(&opt)
+		commits = append(commits, opt)
+		fmt.Fprintf(w, `{"id":"c%d"}`, len(commits))
+	})
+	return &commits
+}
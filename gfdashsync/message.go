@@ -0,0 +1,221 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// messageData is the data passed to the commit message template.
+type messageData struct {
+	Version string
+	Time    time.Time
+
+	// Diff are the diffs of the modified files, if enabled.
+	Diff string
+	// TriggerUser is the user who triggered the run as "Name <email>" or
+	// empty.
+	TriggerUser string
+}
+
+// parseMessageFile reads and parses the commit message template in the given
+// file.
+func parseMessageFile(filename string) (*template.Template, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading commit message template: %w", err)
+	}
+
+	tmpl, err := template.New("message").Option("missingkey=error").Parse(string(b))
+	if err != nil {
+		return nil, fmt.Errorf("error parsing commit message template: %w", err)
+	}
+
+	return tmpl, nil
+}
+
+// fileMessageData is the data passed to the per file commit message
+// template.
+type fileMessageData struct {
+	Version string
+	Time    time.Time
+
+	// Title and Folder are the title and the folder title of the dashboard
+	// of the file. For other and deleted files they are derived from the
+	// path.
+	Title  string
+	Folder string
+	// Action is created, updated, moved or deleted.
+	Action string
+	Path   string
+}
+
+// fileActionNames are the names of the actions passed to the per file commit
+// message template.
+var fileActionNames = map[gitlab.FileActionValue]string{
+	gitlab.FileCreate: "created",
+	gitlab.FileUpdate: "updated",
+	gitlab.FileMove:   "moved",
+	gitlab.FileDelete: "deleted",
+}
+
+// parseFileMessage parses the per file commit message template. It is
+// executed with sample data, so errors are found at startup.
+func parseFileMessage(text string) (*template.Template, error) {
+	tmpl, err := template.New("file-message").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing file commit message template: %w", err)
+	}
+
+	sample := fileMessageData{Version: Version, Time: time.Now(), Title: "title", Folder: "Folder", Action: "updated", Path: "Folder/title.json"}
+	if err := tmpl.Execute(io.Discard, sample); err != nil {
+		return nil, fmt.Errorf("error executing file commit message template: %w", err)
+	}
+
+	return tmpl, nil
+}
+
+// commitMessage returns the commit message of a commit at the given time. The
+// default message has the diffs of the modified files as body, if enabled, and
+// trailers identifying the tool version and the time of the run.
+func (g *Gitlab) commitMessage(t time.Time) (string, error) {
+	data := messageData{Version: Version, Time: t, Diff: strings.Join(g.diffs, "\n"), TriggerUser: g.triggerUser}
+
+	body := ""
+	if data.Diff != "" {
+		body = data.Diff + "\n"
+	}
+	msg := fmt.Sprintf("ʕ◔ϖ◔ʔ: backup done.\n\n%sSynced-By: gfdashsync %s\nSynced-At: %s", body, Version, t.Format(time.RFC3339))
+
+	if g.message != nil {
+		var buf bytes.Buffer
+		if err := g.message.Execute(&buf, data); err != nil {
+			return "", fmt.Errorf("gitlab: error executing commit message template: %w", err)
+		}
+		msg = strings.TrimRight(buf.String(), "\n")
+	}
+
+	return g.appendTrailers(msg), nil
+}
+
+// fileCommitMessage returns the commit message of a commit changing only the
+// file of the given action in CommitPerFile mode. The subject is rendered by
+// the file message template, if any, falling back to the default subject if
+// it fails or is empty.
+func (g *Gitlab) fileCommitMessage(a *gitlab.CommitActionOptions, t time.Time) string {
+	subject := fmt.Sprintf("ʕ◔ϖ◔ʔ: %s %s", *a.Action, strings.TrimPrefix(*a.FilePath, "/"))
+	if a.PreviousPath != nil {
+		subject = fmt.Sprintf("ʕ◔ϖ◔ʔ: move %s to %s", strings.TrimPrefix(*a.PreviousPath, "/"), strings.TrimPrefix(*a.FilePath, "/"))
+	}
+
+	if g.fileMessage != nil {
+		var buf bytes.Buffer
+		if err := g.fileMessage.Execute(&buf, g.fileMessageData(a, t)); err != nil {
+			log.Printf("gitlab: error executing file commit message template for %q, using the default: %v", *a.FilePath, err)
+		} else if s := strings.TrimRight(buf.String(), "\n"); strings.TrimSpace(s) != "" {
+			subject = s
+		}
+	}
+
+	return g.subjectMessage(subject, t)
+}
+
+// fileMessageData returns the data of the per file commit message template
+// for the action.
+func (g *Gitlab) fileMessageData(a *gitlab.CommitActionOptions, t time.Time) fileMessageData {
+	p := *a.FilePath
+	data := fileMessageData{
+		Version: Version,
+		Time:    t,
+		Action:  fileActionNames[*a.Action],
+		Path:    strings.TrimPrefix(p, "/"),
+	}
+
+	for _, f := range g.history {
+		if f.Path == p && f.title != "" {
+			data.Title, data.Folder = f.title, f.folder
+			return data
+		}
+	}
+
+	name := path.Base(strings.TrimSuffix(p, ".gz"))
+	data.Title = strings.TrimSuffix(name, path.Ext(name))
+	if dir := path.Dir(p); dir != "/" && dir != "." {
+		data.Folder = path.Base(dir)
+	}
+	return data
+}
+
+// historyCommitMessage returns the commit message of a commit changing only
+// the history.
+func (g *Gitlab) historyCommitMessage(t time.Time) string {
+	return g.subjectMessage("ʕ◔ϖ◔ʔ: update history", t)
+}
+
+// subjectMessage returns a commit message with the given subject and the
+// trailers of the run.
+func (g *Gitlab) subjectMessage(subject string, t time.Time) string {
+	msg := fmt.Sprintf("%s\n\nSynced-By: gfdashsync %s\nSynced-At: %s", subject, Version, t.Format(time.RFC3339))
+	return g.appendTrailers(msg)
+}
+
+// appendTrailers appends the Co-authored-by trailer of the user who
+// triggered the run and the Signed-off-by trailer of the author, if enabled.
+func (g *Gitlab) appendTrailers(msg string) string {
+	if g.triggerUser != "" {
+		msg = appendTrailer(msg, "Co-authored-by: "+g.triggerUser)
+	}
+	if g.signoff {
+		msg = appendTrailer(msg, fmt.Sprintf("Signed-off-by: %s <%s>", g.authorName, g.authorEmail))
+	}
+	return msg
+}
+
+// userRe matches a user like "Jane Doe <jane@example.com>".
+var userRe = regexp.MustCompile(`^\s*([^<>]*[^<>\s])\s*<([^<>\s]+@[^<>\s]+)>\s*$`)
+
+// parseUser returns the user "Name <email>" in canonical form.
+func parseUser(s string) (string, error) {
+	m := userRe.FindStringSubmatch(s)
+	if m == nil {
+		return "", fmt.Errorf("invalid user %q, must be \"Name <email>\"", s)
+	}
+	return fmt.Sprintf("%s <%s>", m[1], m[2]), nil
+}
+
+// trailerRe matches a Git trailer line like "Signed-off-by: Name".
+var trailerRe = regexp.MustCompile(`^[A-Za-z0-9-]+: `)
+
+// appendTrailer appends the trailer to the message. If the last paragraph of
+// the message already consists of trailers it is added to them, otherwise it
+// starts a new paragraph.
+func appendTrailer(msg, trailer string) string {
+	paragraphs := strings.Split(msg, "\n\n")
+	last := paragraphs[len(paragraphs)-1]
+
+	// The subject is never a trailer block.
+	isTrailers := len(paragraphs) > 1
+	for _, l := range strings.Split(last, "\n") {
+		if !trailerRe.MatchString(l) {
+			isTrailers = false
+		}
+	}
+
+	if isTrailers {
+		return msg + "\n" + trailer
+	}
+	return msg + "\n\n" + trailer
+}
@@ -0,0 +1,170 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestAppendTrailer(t *testing.T) {
+	testCases := []struct {
+		in   string
+		want string
+	}{
+		{"subject", "subject\n\nSigned-off-by: a <b>"},
+		{"Subject: with colon", "Subject: with colon\n\nSigned-off-by: a <b>"},
+		{"subject\n\nbody text", "subject\n\nbody text\n\nSigned-off-by: a <b>"},
+		{"subject\n\nSynced-By: gfdashsync", "subject\n\nSynced-By: gfdashsync\nSigned-off-by: a <b>"},
+	}
+
+	for _, tc := range testCases {
+		if got := appendTrailer(tc.in, "Signed-off-by: a <b>"); got != tc.want {
+			t.Errorf("%q: want %q, got %q", tc.in, tc.want, got)
+		}
+	}
+}
+
+func TestCommitMessage(t *testing.T) {
+	now := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	t.Run("default", func(t *testing.T) {
+		g := &Gitlab{signoff: true, authorName: "Gopher", authorEmail: "gopher@example.com"}
+
+		msg, err := g.commitMessage(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.HasSuffix(msg, "Synced-At: 2022-01-02T03:04:05Z\nSigned-off-by: Gopher <gopher@example.com>") {
+			t.Fatalf("unexpected message %q", msg)
+		}
+	})
+
+	t.Run("trailer", func(t *testing.T) {
+		defer func(v string) { Version = v }(Version)
+		Version = "v1.2.3"
+
+		msg, err := (&Gitlab{}).commitMessage(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := "\n\nSynced-By: gfdashsync v1.2.3\nSynced-At: 2022-01-02T03:04:05Z"; !strings.HasSuffix(msg, want) {
+			t.Fatalf("want trailer %q, got %q", want, msg)
+		}
+	})
+
+	t.Run("template", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "message.tmpl")
+		if err := os.WriteFile(filename, []byte("Backup of {{.Time.Format \"2006-01-02\"}}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		tmpl, err := parseMessageFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := &Gitlab{message: tmpl, signoff: true, authorName: "Gopher", authorEmail: "gopher@example.com"}
+
+		msg, err := g.commitMessage(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := "Backup of 2022-01-02\n\nSigned-off-by: Gopher <gopher@example.com>"; msg != want {
+			t.Fatalf("want %q, got %q", want, msg)
+		}
+	})
+
+	t.Run("triggerUser", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "message.tmpl")
+		if err := os.WriteFile(filename, []byte("Backup requested by {{.TriggerUser}}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		tmpl, err := parseMessageFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := &Gitlab{message: tmpl, triggerUser: "Jane Doe <jane@example.com>", signoff: true, authorName: "Gopher", authorEmail: "gopher@example.com"}
+
+		msg, err := g.commitMessage(now)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := "Backup requested by Jane Doe <jane@example.com>\n\nCo-authored-by: Jane Doe <jane@example.com>\nSigned-off-by: Gopher <gopher@example.com>"
+		if msg != want {
+			t.Fatalf("want %q, got %q", want, msg)
+		}
+
+		if msg := (&Gitlab{}).historyCommitMessage(now); strings.Contains(msg, "Co-authored-by") {
+			t.Fatalf("expected no trailer without trigger user, got %q", msg)
+		}
+	})
+
+	t.Run("missingFile", func(t *testing.T) {
+		if _, err := parseMessageFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+			t.Fatal("expected an error")
+		}
+	})
+}
+
+func TestParseUser(t *testing.T) {
+	for in, want := range map[string]string{
+		"Jane Doe <jane@example.com>":    "Jane Doe <jane@example.com>",
+		"  Jane Doe<jane@example.com>  ": "Jane Doe <jane@example.com>",
+	} {
+		got, err := parseUser(in)
+		if err != nil || got != want {
+			t.Errorf("%q: want %q, got %q, %v", in, want, got, err)
+		}
+	}
+
+	for _, in := range []string{"jane@example.com", "<jane@example.com>", "Jane <jane>", "Jane <a@b> <c@d>"} {
+		if _, err := parseUser(in); err == nil {
+			t.Errorf("%q: expected an error", in)
+		}
+	}
+}
+
+func TestFileCommitMessage(t *testing.T) {
+	now := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tmpl, err := parseFileMessage(`chore(grafana): {{.Action}} "{{.Title}}" in {{.Folder}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := &Gitlab{fileMessage: tmpl, history: History{
+		"go1": {UID: "go1", Path: "/Ops/overview.json", title: "Overview", folder: "Ops"},
+	}}
+
+	testCases := []struct {
+		action gitlab.FileActionValue
+		path   string
+		want   string
+	}{
+		{gitlab.FileUpdate, "/Ops/overview.json", `chore(grafana): updated "Overview" in Ops`},
+		// Deleted files are no longer in the history.
+		{gitlab.FileDelete, "/Alerts/CPU.json.gz", `chore(grafana): deleted "CPU" in Alerts`},
+	}
+	for _, tc := range testCases {
+		a := &gitlab.CommitActionOptions{Action: gitlab.FileAction(tc.action), FilePath: gitlab.String(tc.path)}
+		want := tc.want + "\n\nSynced-By: gfdashsync " + Version + "\nSynced-At: 2022-01-02T03:04:05Z"
+		if got := g.fileCommitMessage(a, now); got != want {
+			t.Errorf("%s %s: want %q, got %q", tc.action, tc.path, want, got)
+		}
+	}
+
+	if _, err := parseFileMessage(`{{.Unknown}}`); err == nil {
+		t.Fatal("expected an error for an unknown field")
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"bytes"
+	"errors"
+	"time"
+)
+
+// metaKey is the top level field of the metadata injected into the committed
+// dashboard files.
+const metaKey = "_meta"
+
+// fileMeta is the metadata injected into the dashboard files with
+// InjectMeta, so reviewers can navigate from the file to the dashboard.
+type fileMeta struct {
+	GrafanaURL string    `json:"grafanaURL,omitempty"`
+	SyncedAt   time.Time `json:"syncedAt"`
+	UID        string    `json:"uid,omitempty"`
+}
+
+// injectMeta adds m as _meta field to the content of the file f, whose
+// content is the encoding of v. The hash of f is kept, so the metadata,
+// which changes on every run, never modifies a file on its own.
+func injectMeta(f *File, v interface{}, m fileMeta) error {
+	c, err := genericJSON(v)
+	if err != nil {
+		return err
+	}
+	obj, ok := c.(map[string]interface{})
+	if !ok {
+		return errors.New("not a JSON object")
+	}
+	obj[metaKey] = m
+
+	data, err := fileJSON(obj)
+	if err != nil {
+		return err
+	}
+	f.content = data
+	f.meta = true
+	return nil
+}
+
+// stripMeta returns the JSON data without the injected metadata, encoded like
+// the synced files, so its hash is the hash of the synced file. Data without
+// metadata is returned unchanged.
+func stripMeta(data []byte) []byte {
+	if !bytes.Contains(data, []byte(`"`+metaKey+`"`)) {
+		return data
+	}
+
+	var v interface{}
+	if err := decodeJSON(data, &v); err != nil {
+		return data
+	}
+	m, ok := v.(map[string]interface{})
+	if _, found := m[metaKey]; !ok || !found {
+		return data
+	}
+	delete(m, metaKey)
+
+	b, err := fileJSON(m)
+	if err != nil {
+		return data
+	}
+	return b
+}
@@ -0,0 +1,81 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestInjectMeta(t *testing.T) {
+	v := map[string]interface{}{
+		"dashboard": map[string]interface{}{"uid": "go1", "title": "Overview", "version": 3, "value": 0.1},
+	}
+
+	var files []*File
+	for _, day := range []int{1, 2} {
+		f, err := newFile("go1", "/Ops/Overview.json", v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := f.SHA256
+
+		m := fileMeta{GrafanaURL: "https://grafana.example.com/d/go1/overview", SyncedAt: time.Date(2024, 1, day, 0, 0, 0, 0, time.UTC), UID: "go1"}
+		if err := injectMeta(f, v, m); err != nil {
+			t.Fatal(err)
+		}
+
+		if f.SHA256 != want {
+			t.Fatalf("expected the hash to be kept, got %s, want %s", f.SHA256, want)
+		}
+		if !bytes.Contains(f.content, []byte(`"grafanaURL": "https://grafana.example.com/d/go1/overview"`)) {
+			t.Fatalf("expected the metadata in the content, got %s", f.content)
+		}
+		if got := hash(stripMeta(f.content)); got != want {
+			t.Fatalf("expected the hash of the stripped content to be the hash of the file, got %s, want %s", got, want)
+		}
+		if _, err := semanticHash(f.content); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, f)
+	}
+
+	if bytes.Equal(files[0].content, files[1].content) {
+		t.Fatal("expected the content to differ by the time of the sync")
+	}
+	a, _ := semanticHash(files[0].content)
+	b, _ := semanticHash(files[1].content)
+	if a != b {
+		t.Fatal("expected the semantic hash to ignore the metadata")
+	}
+
+	// Files without metadata are unchanged.
+	data := []byte(`{"dashboard": {"title": "_meta"}}`)
+	if got := stripMeta(data); !bytes.Equal(got, data) {
+		t.Fatalf("got %s, want %s", got, data)
+	}
+}
+
+func TestGitlabInjectMetaUnchanged(t *testing.T) {
+	v := map[string]interface{}{"dashboard": map[string]interface{}{"uid": "go1", "title": "Overview"}}
+	f, err := newFile("go1", "/Ops/Overview.json", v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	git, _ := MustGitlab(t, MustHistoryHandler(t, fmt.Sprintf(`{"go1":{"uid":"go1","path":"/Ops/Overview.json","sha256":%q}}`, f.SHA256)))
+	git.conflict = ConflictSkip
+
+	if err := injectMeta(f, v, fileMeta{SyncedAt: time.Now(), UID: "go1"}); err != nil {
+		t.Fatal(err)
+	}
+	git.Add(f)
+
+	if len(git.actions) != 0 {
+		t.Fatalf("expected the metadata not to modify the file, got %d actions", len(git.actions))
+	}
+}
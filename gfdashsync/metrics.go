@@ -0,0 +1,85 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// slowestDashboards is the number of dashboards listed in the summary of the
+// fetch metrics.
+const slowestDashboards = 10
+
+// fetchBuckets are the upper bounds of the duration buckets of the summary.
+var fetchBuckets = []time.Duration{100 * time.Millisecond, time.Second, 10 * time.Second}
+
+// fetchMetric is the fetch duration and serialized size of a dashboard.
+type fetchMetric struct {
+	key      string
+	title    string
+	duration time.Duration
+	size     int
+}
+
+// fetchMetrics records the fetch metrics of all dashboards of a run. If it is
+// nil nothing is recorded.
+type fetchMetrics struct {
+	metrics []fetchMetric
+}
+
+// add records and logs the metric of a dashboard.
+func (m *fetchMetrics) add(key, title string, d time.Duration, size int) {
+	if m == nil {
+		return
+	}
+
+	m.metrics = append(m.metrics, fetchMetric{key: key, title: title, duration: d, size: size})
+	log.Printf("dashboard %q (%s): fetched in %v, %d bytes", title, key, d.Round(time.Millisecond), size)
+}
+
+// summary returns the lines of the summary: the total size and duration, the
+// number of dashboards per duration bucket and the slowest dashboards.
+func (m *fetchMetrics) summary() []string {
+	if m == nil || len(m.metrics) == 0 {
+		return nil
+	}
+
+	var (
+		size     int
+		duration time.Duration
+		buckets  = make([]int, len(fetchBuckets)+1)
+	)
+	for _, f := range m.metrics {
+		size += f.size
+		duration += f.duration
+		buckets[sort.Search(len(fetchBuckets), func(i int) bool { return f.duration < fetchBuckets[i] })]++
+	}
+
+	lines := []string{fmt.Sprintf("fetched %d dashboards in %v, %d bytes in total", len(m.metrics), duration.Round(time.Millisecond), size)}
+	for i, n := range buckets {
+		if i < len(fetchBuckets) {
+			lines = append(lines, fmt.Sprintf("  < %-6v %d", fetchBuckets[i], n))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("  >= %-5v %d", fetchBuckets[i-1], n))
+	}
+
+	sorted := make([]fetchMetric, len(m.metrics))
+	copy(sorted, m.metrics)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].duration > sorted[j].duration })
+	if len(sorted) > slowestDashboards {
+		sorted = sorted[:slowestDashboards]
+	}
+
+	lines = append(lines, fmt.Sprintf("slowest %d dashboards:", len(sorted)))
+	for _, f := range sorted {
+		lines = append(lines, fmt.Sprintf("  %v\t%d bytes\t%s (%s)", f.duration.Round(time.Millisecond), f.size, f.title, f.key))
+	}
+
+	return lines
+}
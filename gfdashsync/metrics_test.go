@@ -0,0 +1,42 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetchMetricsSummary(t *testing.T) {
+	var disabled *fetchMetrics
+	disabled.add("go1", "Overview", time.Second, 10)
+	if s := disabled.summary(); s != nil {
+		t.Fatalf("expected no summary if disabled, got %v", s)
+	}
+
+	m := &fetchMetrics{}
+	for i := 1; i <= 12; i++ {
+		m.add(fmt.Sprintf("go%d", i), fmt.Sprintf("Dashboard %d", i), time.Duration(i)*time.Second, 100)
+	}
+
+	s := m.summary()
+	if want := "fetched 12 dashboards in 1m18s, 1200 bytes in total"; s[0] != want {
+		t.Fatalf("want %q, got %q", want, s[0])
+	}
+
+	if want := "  >= 10s   3"; s[4] != want {
+		t.Fatalf("want bucket %q, got %q", want, s[4])
+	}
+
+	slowest := s[6:]
+	if len(slowest) != slowestDashboards {
+		t.Fatalf("want %d slowest dashboards, got %d", slowestDashboards, len(slowest))
+	}
+	if !strings.Contains(slowest[0], "(go12)") || !strings.Contains(slowest[9], "(go3)") {
+		t.Fatalf("expected the dashboards sorted by duration, got %v", slowest)
+	}
+}
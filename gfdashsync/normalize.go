@@ -0,0 +1,268 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// normalizeRule removes or resets the fields of a JSON document matched by a
+// path like "$.dashboard.templating.list[*].current". A path is a dot
+// separated list of object keys, where "*" matches all keys, each optionally
+// followed by an array index or "[*]" for all elements.
+type normalizeRule struct {
+	path []string
+
+	// value is the JSON value the matched fields are reset to. If nil the
+	// fields are removed.
+	value json.RawMessage
+}
+
+// normalizer is a list of rules applied to the files before they are hashed.
+type normalizer []*normalizeRule
+
+// loadNormalizer returns the normalizer of the comma separated list of
+// paths s and the rules file with the given name, which has one path per
+// line, so values can contain commas.
+func loadNormalizer(s, filename string) (normalizer, error) {
+	rules, err := readRules(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading normalize rules: %w", err)
+	}
+	return newNormalizer(append(strings.Split(s, ","), rules...))
+}
+
+// parseNormalizer parses a comma separated list of paths.
+func parseNormalizer(s string) (normalizer, error) {
+	return newNormalizer(strings.Split(s, ","))
+}
+
+// newNormalizer parses the rules, each a path. A path followed by "=" and a
+// JSON value resets the matched fields to the value instead of removing
+// them.
+func newNormalizer(rules []string) (normalizer, error) {
+	var n normalizer
+	for _, e := range rules {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+
+		r := &normalizeRule{}
+		if i := strings.Index(e, "="); i >= 0 {
+			r.value = json.RawMessage(strings.TrimSpace(e[i+1:]))
+			if !json.Valid(r.value) {
+				return nil, fmt.Errorf("invalid normalize value in %q", e)
+			}
+			e = strings.TrimSpace(e[:i])
+		}
+
+		p, err := parseNormalizePath(e)
+		if err != nil {
+			return nil, err
+		}
+		r.path = p
+
+		n = append(n, r)
+	}
+
+	return n, nil
+}
+
+// readRules returns the rules of the file with the given name, one per line.
+// Empty lines and lines starting with "#" are skipped. An empty name returns
+// no rules.
+func readRules(filename string) ([]string, error) {
+	if filename == "" {
+		return nil, nil
+	}
+
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []string
+	for _, l := range strings.Split(string(b), "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		rules = append(rules, l)
+	}
+	return rules, nil
+}
+
+// parseNormalizePath splits the path into its keys and array indexes.
+func parseNormalizePath(s string) ([]string, error) {
+	p := strings.TrimPrefix(strings.TrimPrefix(s, "$"), ".")
+	if p == "" {
+		return nil, fmt.Errorf("invalid normalize path %q", s)
+	}
+
+	var segs []string
+	for _, k := range strings.Split(p, ".") {
+		var idx []string
+		if i := strings.Index(k, "["); i >= 0 {
+			for _, ix := range strings.Split(k[i:], "]") {
+				if ix == "" {
+					continue
+				}
+				if !strings.HasPrefix(ix, "[") || !validIndex(ix[1:]) {
+					return nil, fmt.Errorf("invalid normalize path %q", s)
+				}
+				idx = append(idx, ix+"]")
+			}
+			k = k[:i]
+		}
+
+		if k == "" {
+			return nil, fmt.Errorf("invalid normalize path %q", s)
+		}
+		segs = append(segs, k)
+		segs = append(segs, idx...)
+	}
+
+	return segs, nil
+}
+
+func validIndex(s string) bool {
+	if s == "*" {
+		return true
+	}
+	i, err := strconv.Atoi(s)
+	return err == nil && i >= 0
+}
+
+// apply returns v converted to a generic JSON value with all rules applied.
+// Without rules v is returned unchanged.
+func (n normalizer) apply(v interface{}) (interface{}, error) {
+	if len(n) == 0 {
+		return v, nil
+	}
+
+	c, err := genericJSON(v)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range n {
+		if c, err = r.walk(c, r.path); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// genericJSON returns v converted to maps, slices and scalar JSON values.
+// Numbers are kept as json.Number, so they are encoded unchanged.
+func genericJSON(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+
+	var c interface{}
+	if err := d.Decode(&c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// walk applies the rule to the fields of v matched by segs and returns the
+// resulting value.
+func (r *normalizeRule) walk(v interface{}, segs []string) (interface{}, error) {
+	seg, rest := segs[0], segs[1:]
+
+	switch x := v.(type) {
+	case map[string]interface{}:
+		if strings.HasPrefix(seg, "[") {
+			return v, nil
+		}
+
+		for k, e := range x {
+			if seg != "*" && seg != k {
+				continue
+			}
+
+			if len(rest) > 0 {
+				c, err := r.walk(e, rest)
+				if err != nil {
+					return nil, err
+				}
+				x[k] = c
+				continue
+			}
+
+			if r.value == nil {
+				delete(x, k)
+				continue
+			}
+
+			c, err := r.newValue()
+			if err != nil {
+				return nil, err
+			}
+			x[k] = c
+		}
+
+	case []interface{}:
+		if !strings.HasPrefix(seg, "[") {
+			return v, nil
+		}
+		idx := strings.Trim(seg, "[]")
+
+		out := make([]interface{}, 0, len(x))
+		for i, e := range x {
+			if idx != "*" && idx != strconv.Itoa(i) {
+				out = append(out, e)
+				continue
+			}
+
+			if len(rest) > 0 {
+				c, err := r.walk(e, rest)
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, c)
+				continue
+			}
+
+			// Removed elements are dropped from the array.
+			if r.value == nil {
+				continue
+			}
+
+			c, err := r.newValue()
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, c)
+		}
+		return out, nil
+	}
+
+	return v, nil
+}
+
+// newValue returns a new copy of the reset value, so it is not shared between
+// the matched fields.
+func (r *normalizeRule) newValue() (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(r.value))
+	d.UseNumber()
+
+	var c interface{}
+	err := d.Decode(&c)
+	return c, err
+}
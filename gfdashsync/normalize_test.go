@@ -0,0 +1,93 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNormalizer(t *testing.T) {
+	in := json.RawMessage(`{
+		"dashboard": {
+			"__inputs": [{"name": "DS"}],
+			"time": {"from": "now-1h", "to": "now"},
+			"templating": {"list": [
+				{"name": "a", "current": {"text": "x"}},
+				{"name": "b", "current": {"text": "y"}}
+			]},
+			"panels": [{"id": 1}, {"id": 2}, {"id": 3}]
+		},
+		"meta": {"version": 3, "updated": "2022-01-01"}
+	}`)
+
+	testCases := map[string]string{
+		"$.dashboard.__inputs":                        `{"dashboard":{"panels":[{"id":1},{"id":2},{"id":3}],"templating":{"list":[{"current":{"text":"x"},"name":"a"},{"current":{"text":"y"},"name":"b"}]},"time":{"from":"now-1h","to":"now"}},"meta":{"updated":"2022-01-01","version":3}}`,
+		"dashboard.time.from, dashboard.time.to=\"\"": `{"dashboard":{"__inputs":[{"name":"DS"}],"panels":[{"id":1},{"id":2},{"id":3}],"templating":{"list":[{"current":{"text":"x"},"name":"a"},{"current":{"text":"y"},"name":"b"}]},"time":{"to":""}},"meta":{"updated":"2022-01-01","version":3}}`,
+		"$.dashboard.templating.list[*].current={}":   `{"dashboard":{"__inputs":[{"name":"DS"}],"panels":[{"id":1},{"id":2},{"id":3}],"templating":{"list":[{"current":{},"name":"a"},{"current":{},"name":"b"}]},"time":{"from":"now-1h","to":"now"}},"meta":{"updated":"2022-01-01","version":3}}`,
+		"$.dashboard.panels[1]":                       `{"dashboard":{"__inputs":[{"name":"DS"}],"panels":[{"id":1},{"id":3}],"templating":{"list":[{"current":{"text":"x"},"name":"a"},{"current":{"text":"y"},"name":"b"}]},"time":{"from":"now-1h","to":"now"}},"meta":{"updated":"2022-01-01","version":3}}`,
+		"$.*.version, $.*.updated":                    `{"dashboard":{"__inputs":[{"name":"DS"}],"panels":[{"id":1},{"id":2},{"id":3}],"templating":{"list":[{"current":{"text":"x"},"name":"a"},{"current":{"text":"y"},"name":"b"}]},"time":{"from":"now-1h","to":"now"}},"meta":{}}`,
+		"$.dashboard.missing.field, $.meta[0]":        `{"dashboard":{"__inputs":[{"name":"DS"}],"panels":[{"id":1},{"id":2},{"id":3}],"templating":{"list":[{"current":{"text":"x"},"name":"a"},{"current":{"text":"y"},"name":"b"}]},"time":{"from":"now-1h","to":"now"}},"meta":{"updated":"2022-01-01","version":3}}`,
+	}
+
+	for rules, want := range testCases {
+		n, err := parseNormalizer(rules)
+		if err != nil {
+			t.Fatalf("%q: %v", rules, err)
+		}
+
+		v, err := n.apply(in)
+		if err != nil {
+			t.Fatalf("%q: %v", rules, err)
+		}
+
+		got, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(got) != want {
+			t.Errorf("%q: want %s, got %s", rules, want, got)
+		}
+	}
+}
+
+func TestNormalizerInvalid(t *testing.T) {
+	for _, s := range []string{"$", "$.a..b", "$.a[x]", "$.a[-1]", "$.a=nope"} {
+		if _, err := parseNormalizer(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestLoadNormalizer(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "normalize")
+	rules := "# reset the time range\n$.dashboard.time={\"from\":\"now-6h\",\"to\":\"now\"}\n\n$.meta\n"
+	if err := os.WriteFile(name, []byte(rules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := loadNormalizer("$.dashboard.panels", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := n.apply(json.RawMessage(`{"dashboard":{"panels":[],"time":{"from":"now-1h","to":"now"}},"meta":{}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"dashboard":{"time":{"from":"now-6h","to":"now"}}}`; string(got) != want {
+		t.Fatalf("want %s, got %s", want, got)
+	}
+
+	if _, err := loadNormalizer("", filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+}
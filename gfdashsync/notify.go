@@ -0,0 +1,45 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// notification is the payload of a webhook notification. The text is shown
+// by Slack compatible webhooks, the summary fields are for other consumers.
+type notification struct {
+	Text string `json:"text"`
+	*Summary
+}
+
+// text returns the human readable text of the summary.
+func (s *Summary) text() string {
+	if s.Created+s.Updated+s.Moved+s.Deleted == 0 {
+		return "gfdashsync: no changes"
+	}
+
+	t := fmt.Sprintf("gfdashsync: %d created, %d updated, %d moved, %d deleted", s.Created, s.Updated, s.Moved, s.Deleted)
+	if s.CommitURL != "" {
+		t += fmt.Sprintf(" (%s)", s.CommitURL)
+	}
+	return t
+}
+
+// notify POSTs the summary to the webhook with the given URL.
+func notify(ctx context.Context, client *http.Client, webhook string, s *Summary) error {
+	b, err := json.Marshal(notification{Text: s.text(), Summary: s})
+	if err != nil {
+		return err
+	}
+
+	if err := postJSON(ctx, client, webhook, b); err != nil {
+		return fmt.Errorf("notify: error posting to webhook: %w", err)
+	}
+	return nil
+}
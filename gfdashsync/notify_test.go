@@ -0,0 +1,61 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestNotify(t *testing.T) {
+	server, mux := MustRunServer(t)
+	mux.HandleFunc("/api/v4/projects/1/repository/commits", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"abc123","web_url":"https://gitlab.example.com/commit/abc123"}`))
+	})
+
+	var got map[string]interface{}
+	var userAgent string
+	mux.HandleFunc("/webhook", func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.UserAgent()
+		json.NewDecoder(r.Body).Decode(&got)
+	})
+
+	_, err := Run(context.Background(), Options{
+		GrafanaAPI:    server.URL,
+		GrafanaToken:  "token",
+		GitAPI:        server.URL,
+		GitToken:      "token",
+		GitPIDs:       []int{1},
+		NotifyWebhook: server.URL + "/webhook",
+		UserAgent:     "gfdashsync-test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userAgent != "gfdashsync-test" {
+		t.Errorf("want the webhook requested with the user agent, got %q", userAgent)
+	}
+
+	want := map[string]interface{}{
+		"text":      "gfdashsync: 1 created, 0 updated, 0 moved, 0 deleted (https://gitlab.example.com/commit/abc123)",
+		"created":   1.0,
+		"commit":    "abc123",
+		"commitURL": "https://gitlab.example.com/commit/abc123",
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s: want %v, got %v", k, v, got[k])
+		}
+	}
+}
+
+func TestNotifyNoChanges(t *testing.T) {
+	s := &Summary{Dashboards: 1, Fetched: 1}
+	if want, got := "gfdashsync: no changes", s.text(); want != got {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Orphan is a file of the history which is no longer found in Grafana, so it
+// is deleted by the next sync.
+type Orphan struct {
+	UID  string `json:"uid"`
+	Path string `json:"path"`
+	// MissingSince is the time the file was first found missing, if a prune
+	// grace period is used.
+	MissingSince *time.Time `json:"missingSince,omitempty"`
+	// Due is set if the file is deleted by the next sync. It is not set if
+	// the prune grace period has not passed yet.
+	Due bool `json:"due"`
+}
+
+// orphaner is implemented by backends which can list the orphans of their
+// history.
+type orphaner interface {
+	// orphans returns the files of the history which were not processed,
+	// without changing the history.
+	orphans() []Orphan
+}
+
+func (g *Gitlab) orphans() []Orphan { return g.history.orphans(time.Now(), g.pruneGrace) }
+func (g *Gitea) orphans() []Orphan  { return g.history.orphans(time.Now(), g.pruneGrace) }
+func (w *Wiki) orphans() []Orphan   { return w.history.orphans(time.Now(), w.pruneGrace) }
+
+// orphans returns the files which were not processed sorted by path. Archived
+// files are never deleted, so they are not orphans.
+func (h History) orphans(now time.Time, grace time.Duration) []Orphan {
+	var orphans []Orphan
+	for _, f := range h {
+		if f.processed || strings.HasPrefix(f.UID, archivePrefix) {
+			continue
+		}
+		o := Orphan{
+			UID:          f.UID,
+			Path:         f.Path,
+			MissingSince: f.MissingSince,
+			Due:          grace <= 0,
+		}
+		if f.MissingSince != nil && now.Sub(*f.MissingSince) >= grace {
+			o.Due = true
+		}
+		orphans = append(orphans, o)
+	}
+
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].Path < orphans[j].Path })
+	return orphans
+}
+
+// keepGenerated keeps the files which a sync with the options creates from
+// other Grafana objects than the dashboards, which are not listed in
+// ModeListOrphans. They are assumed to be still found in Grafana.
+func keepGenerated(opt *Options, git Backend) {
+	git.Keep(heartbeatKey)
+
+	prefixes := []struct {
+		enabled bool
+		prefix  string
+	}{
+		{opt.IncludePermissions, permissionsKey("folders", "")},
+		{opt.IncludeFolders, "folders/"},
+		{opt.IncludeLibraryPanels, "library-panels/"},
+		{opt.IncludeSnapshots, "snapshots/"},
+		{opt.IncludePlaylists, "playlists/"},
+		{opt.IncludeDataSources, "datasources/"},
+	}
+	for _, p := range prefixes {
+		if p.enabled {
+			git.KeepPrefix(p.prefix)
+		}
+	}
+
+	if opt.Index != "" {
+		git.Keep(indexKey)
+	}
+	if opt.Layout == LayoutUID {
+		git.Keep(uidIndexKey)
+	}
+	if opt.Codeowners {
+		git.Keep(codeownersKey)
+	}
+}
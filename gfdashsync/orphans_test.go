@@ -0,0 +1,81 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestHistoryOrphans(t *testing.T) {
+	now := time.Now()
+	old, recent := now.Add(-48*time.Hour), now.Add(-time.Hour)
+	h := History{
+		"go1":                &File{UID: "go1", Path: "/go1.json", processed: true},
+		"go2":                &File{UID: "go2", Path: "/go2.json", MissingSince: &old},
+		"go3":                &File{UID: "go3", Path: "/go3.json", MissingSince: &recent},
+		"go4":                &File{UID: "go4", Path: "/go4.json"},
+		archivePrefix + "go": &File{UID: archivePrefix + "go", Path: "/_archive/go.json"},
+	}
+
+	want := []Orphan{
+		{UID: "go2", Path: "/go2.json", MissingSince: &old, Due: true},
+		{UID: "go3", Path: "/go3.json", MissingSince: &recent},
+		{UID: "go4", Path: "/go4.json"},
+	}
+	if got := h.orphans(now, 24*time.Hour); !reflect.DeepEqual(got, want) {
+		t.Fatalf("want %+v, got %+v", want, got)
+	}
+
+	for _, o := range h.orphans(now, 0) {
+		if !o.Due {
+			t.Fatalf("expected %q to be due without grace period", o.UID)
+		}
+	}
+}
+
+func TestRunListOrphans(t *testing.T) {
+	var bump int
+	mux := mustFixedDashboards(t, &bump)
+	mux.HandleFunc("/api/v4/projects/1/repository/files/", MustHistoryHandler(t, `{
+		"go1":{"uid":"go1","path":"/Ops/Overview.json","sha256":"a"},
+		"gone":{"uid":"gone","path":"/Ops/Gone.json","sha256":"b"},
+		"folders/ops":{"uid":"folders/ops","path":"/folders/ops.json","sha256":"c"},
+		"heartbeat":{"uid":"heartbeat","path":"/last-sync.txt","sha256":"d"}
+	}`))
+	mux.HandleFunc("/api/v4/projects/1/repository/commits", func(w http.ResponseWriter, r *http.Request) {
+		t.Error("unexpected commit")
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	for _, folders := range []bool{false, true} {
+		res, err := Run(context.Background(), Options{
+			GrafanaAPI:     server.URL,
+			GrafanaToken:   "token",
+			GitAPI:         server.URL,
+			GitToken:       "token",
+			GitPIDs:        []int{1},
+			Mode:           ModeListOrphans,
+			IncludeFolders: folders,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []Orphan{{UID: "gone", Path: "/Ops/Gone.json", Due: true}}
+		if !folders {
+			want = append(want, Orphan{UID: "folders/ops", Path: "/folders/ops.json", Due: true})
+		}
+		if !reflect.DeepEqual(res.Orphans, want) {
+			t.Fatalf("include folders %v: want %+v, got %+v", folders, want, res.Orphans)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"text/template"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+)
+
+// DefaultPathTemplate is the template of the original repository layout.
+const DefaultPathTemplate = "/{{.FolderTitle}}/{{.Title}}.json"
+
+// Repository layouts.
+const (
+	LayoutPath = "path" // files named by the path template, the default
+	LayoutUID  = "uid"  // files named by UID with the titles in index.json
+)
+
+// uidPathTemplate is the path template of LayoutUID, which keeps the path of
+// a dashboard when it is renamed or moved to another folder.
+const uidPathTemplate = "/{{.UID}}.json"
+
+// pathData is the data passed to the path template.
+type pathData struct {
+	UID         string
+	Title       string
+	FolderTitle string
+	FolderUID   string
+	FolderPath  string
+	Tags        []string
+}
+
+// pathSegment returns s with path separators replaced, so a value like the
+// title "CPU / Memory" does not create directories.
+func pathSegment(s string) string {
+	return strings.NewReplacer("/", "-", `\`, "-").Replace(s)
+}
+
+// Tag returns the value of the first tag starting with prefix, e.g. "ops" of
+// "team:ops" for the prefix "team:", or an empty string if there is none.
+func (d pathData) Tag(prefix string) string {
+	for _, t := range d.Tags {
+		if strings.HasPrefix(t, prefix) {
+			return strings.TrimSpace(strings.TrimPrefix(t, prefix))
+		}
+	}
+	return ""
+}
+
+// tagPathTemplate returns the path template using the value of the tag with
+// the given prefix as directory, falling back to the folder title.
+func tagPathTemplate(prefix string) string {
+	return fmt.Sprintf("/{{or (.Tag %q) .FolderTitle}}/{{.Title}}.json", prefix)
+}
+
+// pathTemplate renders the repository paths of dashboards and ensures they
+// are unique within a run.
+type pathTemplate struct {
+	tmpl *template.Template
+	seen map[string]string
+
+	// folderPath resolves the path of nested folders. If it is nil the
+	// folder title is used.
+	folderPath func(uid string) (string, error)
+	folders    map[string]string
+
+	// ambiguous maps the folder titles shared by several folders, e.g.
+	// "Alerts" in different parent folders, to the UID of the oldest of
+	// them, which keeps the plain title.
+	ambiguous map[string]string
+}
+
+// newPathTemplate parses and validates the given path template.
+func newPathTemplate(text string) (*pathTemplate, error) {
+	tmpl, err := template.New("path").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid path template: %w", err)
+	}
+
+	p := &pathTemplate{
+		tmpl:    tmpl,
+		seen:    make(map[string]string),
+		folders: make(map[string]string),
+	}
+
+	// Render a sample dashboard so errors are found at startup.
+	if _, err := p.render(gapi.FolderDashboardSearchResponse{
+		UID:         "uid",
+		Title:       "title",
+		FolderUID:   "folder",
+		FolderTitle: "Folder",
+		Tags:        []string{"tag"},
+	}, "uid"); err != nil {
+		return nil, fmt.Errorf("invalid path template: %w", err)
+	}
+
+	return p, nil
+}
+
+// render executes the template for the given dashboard with the given
+// history key, which is used as UID of dashboards without one. All values
+// except the folder path are single path segments.
+func (p *pathTemplate) render(d gapi.FolderDashboardSearchResponse, key string) (string, error) {
+	tags := make([]string, len(d.Tags))
+	for i, t := range d.Tags {
+		tags[i] = pathSegment(t)
+	}
+
+	var buf bytes.Buffer
+	err := p.tmpl.Execute(&buf, pathData{
+		UID:         pathSegment(key),
+		Title:       pathSegment(d.Title),
+		FolderTitle: pathSegment(p.folderTitle(d)),
+		FolderUID:   pathSegment(d.FolderUID),
+		FolderPath:  p.resolveFolder(d),
+		Tags:        tags,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// Empty values like a missing tag result in empty segments, which are
+	// dropped.
+	s := "/" + strings.TrimPrefix(strings.TrimSpace(buf.String()), "/")
+	for strings.Contains(s, "//") {
+		s = strings.ReplaceAll(s, "//", "/")
+	}
+	if err := validPath(s); err != nil {
+		return "", err
+	}
+	return s, nil
+}
+
+// validPath checks that the rendered path s is a clean path of a JSON file,
+// without "." or ".." segments.
+func validPath(s string) error {
+	if path.Clean(s) != s || path.Ext(s) != ".json" || path.Base(s) == ".json" {
+		return fmt.Errorf("template results in invalid path %q", s)
+	}
+	return nil
+}
+
+// setDashboards records the folders of all dashboards of the run, so that
+// folders sharing a title get distinct paths.
+func (p *pathTemplate) setDashboards(dashboards []gapi.FolderDashboardSearchResponse) {
+	type folder struct {
+		id  uint
+		uid string
+	}
+	oldest := make(map[string]folder)
+	shared := make(map[string]bool)
+	for _, d := range dashboards {
+		f, ok := oldest[d.FolderTitle]
+		if ok && f.uid != d.FolderUID {
+			shared[d.FolderTitle] = true
+		}
+		if !ok || d.FolderID < f.id {
+			oldest[d.FolderTitle] = folder{id: d.FolderID, uid: d.FolderUID}
+		}
+	}
+
+	p.ambiguous = make(map[string]string)
+	for title := range shared {
+		log.Printf("warning folder title %q is used by several folders, appending the folder UID to the paths of all but the oldest", title)
+		p.ambiguous[title] = oldest[title].uid
+	}
+}
+
+// folderTitle returns the folder title of the dashboard. The folder UID is
+// appended to titles shared by several folders, e.g. "Alerts-f2", so their
+// dashboards are not merged into one directory. The oldest folder, which
+// has the lowest ID, keeps the plain title, so the paths of its dashboards
+// do not change when a folder with the same title is created.
+func (p *pathTemplate) folderTitle(d gapi.FolderDashboardSearchResponse) string {
+	if oldest, ok := p.ambiguous[d.FolderTitle]; ok && d.FolderUID != "" && d.FolderUID != oldest {
+		return d.FolderTitle + "-" + d.FolderUID
+	}
+	return d.FolderTitle
+}
+
+// usesFolderPath reports whether the template uses the folder path, which
+// requires a request per folder.
+func (p *pathTemplate) usesFolderPath() bool {
+	return strings.Contains(p.tmpl.Root.String(), ".FolderPath")
+}
+
+// resolveFolder returns the path of the folder of the dashboard. If it cannot
+// be resolved, e.g. because the token has no access to a parent folder, a
+// warning is logged and the folder title is used instead.
+func (p *pathTemplate) resolveFolder(d gapi.FolderDashboardSearchResponse) string {
+	if p.folderPath == nil || d.FolderUID == "" {
+		return pathSegment(p.folderTitle(d))
+	}
+
+	if s, ok := p.folders[d.FolderUID]; ok {
+		return s
+	}
+
+	s, err := p.folderPath(d.FolderUID)
+	if err != nil || s == "" {
+		log.Printf("warning cannot resolve path of folder %q, using its title: %v", d.FolderTitle, err)
+		s = pathSegment(p.folderTitle(d))
+	}
+	p.folders[d.FolderUID] = s
+
+	return s
+}
+
+// path returns the repository path of the dashboard with the given history
+// key. If the path was already returned for another dashboard during this run
+// the key is appended to the file name to keep it unique, followed by a
+// counter if that path is taken as well.
+func (p *pathTemplate) path(d gapi.FolderDashboardSearchResponse, key string) (string, error) {
+	s, err := p.render(d, key)
+	if err != nil {
+		return "", err
+	}
+
+	if k, ok := p.seen[s]; ok && k != key {
+		ext := path.Ext(s)
+		base := strings.TrimSuffix(s, ext) + "-" + pathSegment(key)
+		u := base + ext
+		for i := 2; p.seen[u] != "" && p.seen[u] != key; i++ {
+			u = fmt.Sprintf("%s-%d%s", base, i, ext)
+		}
+		log.Printf("warning path %q of dashboard %q is already used by %q, using %q", s, key, k, u)
+		s = u
+	}
+	p.seen[s] = key
+
+	return s, nil
+}
@@ -0,0 +1,219 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+)
+
+func TestPathTemplate(t *testing.T) {
+	d := gapi.FolderDashboardSearchResponse{
+		UID:         "go1",
+		Title:       "Overview",
+		FolderUID:   "f1",
+		FolderTitle: "Ops",
+		Tags:        []string{"team"},
+	}
+
+	testCases := map[string]string{
+		DefaultPathTemplate:                       "/Ops/Overview.json",
+		"{{.UID}}.json":                           "/go1.json",
+		"{{.FolderUID}}/{{.Title}}-{{.UID}}.json": "/f1/Overview-go1.json",
+		"{{index .Tags 0}}/{{.Title}}.json":       "/team/Overview.json",
+	}
+
+	for text, want := range testCases {
+		p, err := newPathTemplate(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := p.path(d, d.UID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want != got {
+			t.Errorf("%s: want %s, got %s", text, want, got)
+		}
+	}
+}
+
+func TestPathTemplateFolderPath(t *testing.T) {
+	p, err := newPathTemplate("{{.FolderPath}}/{{.Title}}.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.usesFolderPath() {
+		t.Fatal("expected the template to use the folder path")
+	}
+
+	p.folderPath = func(uid string) (string, error) {
+		if uid == "secret" {
+			return "", errors.New("status: 403")
+		}
+		return "Ops/" + uid, nil
+	}
+
+	testCases := map[string]gapi.FolderDashboardSearchResponse{
+		"/Ops/Databases/Overview.json": {UID: "a", Title: "Overview", FolderUID: "Databases", FolderTitle: "Databases"},
+		"/Secret/Overview.json":        {UID: "b", Title: "Overview", FolderUID: "secret", FolderTitle: "Secret"},
+		"/General/Overview.json":       {UID: "c", Title: "Overview", FolderTitle: "General"},
+	}
+
+	for want, d := range testCases {
+		got, err := p.path(d, d.UID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want != got {
+			t.Errorf("%s: want %s, got %s", d.UID, want, got)
+		}
+	}
+}
+
+func TestPathTemplateTag(t *testing.T) {
+	p, err := newPathTemplate(tagPathTemplate("team:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := map[string]gapi.FolderDashboardSearchResponse{
+		"/ops/Overview.json":  {UID: "a", Title: "Overview", FolderTitle: "General", Tags: []string{"prod", "team:ops"}},
+		"/General/Home.json":  {UID: "b", Title: "Home", FolderTitle: "General", Tags: []string{"prod"}},
+		"/General/Empty.json": {UID: "c", Title: "Empty", FolderTitle: "General", Tags: []string{"team:"}},
+	}
+
+	for want, d := range testCases {
+		got, err := p.path(d, d.UID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want != got {
+			t.Errorf("%s: want %s, got %s", d.UID, want, got)
+		}
+	}
+}
+
+func TestPathTemplateInvalid(t *testing.T) {
+	for _, text := range []string{
+		"{{.Title",
+		"{{.Unknown}}.json",
+		"{{.FolderTitle}}/",
+		"",
+		"{{.Title}}",
+		"{{.FolderTitle}}/../{{.Title}}.json",
+	} {
+		if _, err := newPathTemplate(text); err == nil {
+			t.Errorf("%q: expected an error", text)
+		}
+	}
+}
+
+func TestPathTemplateUnique(t *testing.T) {
+	p, err := newPathTemplate("{{.Title}}.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := p.path(gapi.FolderDashboardSearchResponse{UID: "a", Title: "Overview", FolderTitle: "Ops"}, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := p.path(gapi.FolderDashboardSearchResponse{UID: "b", Title: "Overview", FolderTitle: "Dev"}, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := "/Overview.json", a; want != got {
+		t.Fatalf("want %s, got %s", want, got)
+	}
+
+	if want, got := "/Overview-b.json", b; want != got {
+		t.Fatalf("want %s, got %s", want, got)
+	}
+
+	// The path with the key appended is taken by a dashboard titled like it.
+	p, err = newPathTemplate("{{.Title}}.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, d := range []gapi.FolderDashboardSearchResponse{
+		{UID: "a", Title: "Overview-b"},
+		{UID: "c", Title: "Overview"},
+		{UID: "b", Title: "Overview"},
+	} {
+		s, err := p.path(d, d.UID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, s)
+	}
+	if want := []string{"/Overview-b.json", "/Overview.json", "/Overview-b-2.json"}; !reflect.DeepEqual(want, got) {
+		t.Fatalf("want %v, got %v", want, got)
+	}
+}
+
+func TestPathTemplateSeparators(t *testing.T) {
+	p, err := newPathTemplate("{{.FolderTitle}}/{{.Tag \"team:\"}}/{{.UID}}-{{.Title}}.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Dashboards without a UID use their key, which contains a slash.
+	d := gapi.FolderDashboardSearchResponse{Title: "CPU / Memory", FolderTitle: "Ops/Dev", Tags: []string{"team:a/b"}}
+	got, err := p.path(d, dashboardKey(d))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "/Ops-Dev/a-b/title:Ops-Dev-CPU - Memory-CPU - Memory.json"; want != got {
+		t.Fatalf("want %s, got %s", want, got)
+	}
+
+	// A missing tag does not result in an empty directory name.
+	d = gapi.FolderDashboardSearchResponse{UID: "go1", Title: "CPU", FolderTitle: "Ops"}
+	if got, err := p.path(d, d.UID); err != nil || got != "/Ops/go1-CPU.json" {
+		t.Fatalf("want /Ops/go1-CPU.json, got %s (%v)", got, err)
+	}
+
+	if _, err := p.path(gapi.FolderDashboardSearchResponse{UID: "go1", Title: "x", FolderTitle: ".."}, "go1"); err == nil {
+		t.Fatal("expected an error for a path outside of the repository")
+	}
+}
+
+func TestPathTemplateSameFolderTitle(t *testing.T) {
+	dashboards := []gapi.FolderDashboardSearchResponse{
+		{UID: "go1", Title: "CPU", FolderID: 7, FolderUID: "f1", FolderTitle: "Alerts"},
+		{UID: "go2", Title: "CPU", FolderID: 3, FolderUID: "f2", FolderTitle: "Alerts"},
+		{UID: "go3", Title: "Disk", FolderID: 3, FolderUID: "f2", FolderTitle: "Alerts"},
+		{UID: "go4", Title: "Overview", FolderID: 9, FolderUID: "f3", FolderTitle: "Ops"},
+	}
+
+	for _, text := range []string{DefaultPathTemplate, "{{.FolderPath}}/{{.Title}}.json"} {
+		p, err := newPathTemplate(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.setDashboards(dashboards)
+
+		// The oldest folder f2 keeps its paths.
+		want := []string{"/Alerts-f1/CPU.json", "/Alerts/CPU.json", "/Alerts/Disk.json", "/Ops/Overview.json"}
+		for i, d := range dashboards {
+			got, err := p.path(d, d.UID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want[i] {
+				t.Errorf("%s: %s: want %s, got %s", text, d.UID, want[i], got)
+			}
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// newProxyTransport returns a transport sending all requests through the
+// proxy with the given URL. Credentials in the URL are used for proxy
+// authentication. If the URL is empty nil is returned, so the default
+// transport is used.
+func newProxyTransport(proxy string) (http.RoundTripper, error) {
+	if proxy == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q", proxy)
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = http.ProxyURL(u)
+	return t, nil
+}
+
+// userAgentTransport is a http.RoundTripper which sets the User-Agent header
+// of all requests, so the API traffic can be attributed to gfdashsync.
+type userAgentTransport struct {
+	userAgent string
+
+	// next is the transport sending the requests. If nil
+	// http.DefaultTransport is used.
+	next http.RoundTripper
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	// A RoundTripper must not modify the request.
+	r := req.Clone(req.Context())
+	r.Header.Set("User-Agent", t.userAgent)
+	return next.RoundTrip(r)
+}
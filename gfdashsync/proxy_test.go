@@ -0,0 +1,72 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestProxy(t *testing.T) {
+	wantAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))
+
+	// The stub proxy answers all requests itself, so the targets do not
+	// have to exist.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/datasources", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[]`))
+	})
+	mux.HandleFunc("/api/v4/projects/1", projectHandler)
+	mux.HandleFunc("/api/v4/projects/1/repository/files/", http.NotFound)
+	mux.HandleFunc("/api/v4/projects/1/repository/branches/main", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"name":"main"}`))
+	})
+
+	var hosts []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Proxy-Authorization"); got != wantAuth {
+			t.Errorf("want proxy authorization %q, got %q", wantAuth, got)
+		}
+		hosts = append(hosts, r.URL.Host)
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(proxy.Close)
+
+	transport, err := newProxyTransport(strings.Replace(proxy.URL, "http://", "http://user:secret@", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gf, err := NewGrafana(context.Background(), "http://grafana.invalid", "token", "", "", 0, transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gf.DataSources(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewGitlab(context.Background(), "http://gitlab.invalid", AuthPAT, "token", "main", "", 1, transport); err != nil {
+		t.Fatal(err)
+	}
+
+	var grafana, gitlab bool
+	for _, h := range hosts {
+		grafana = grafana || h == "grafana.invalid"
+		gitlab = gitlab || h == "gitlab.invalid"
+	}
+	if !grafana || !gitlab {
+		t.Fatalf("expected requests to both services through the proxy, got %v", hosts)
+	}
+}
+
+func TestProxyInvalid(t *testing.T) {
+	if _, err := newProxyTransport("not a url"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// Git transports of the commits.
+const (
+	TransportAPI   = "api"   // commits API, the default
+	TransportSSH   = "ssh"   // git push over SSH with the keys of the user
+	TransportHTTPS = "https" // git push over HTTPS with the token
+)
+
+// defaultCommitterName and defaultCommitterEmail are the committer of pushed
+// commits if no author is given.
+const (
+	defaultCommitterName  = "gfdashsync"
+	defaultCommitterEmail = "gfdashsync@localhost"
+)
+
+// gitPush creates commits by shallow cloning the branch, applying the
+// actions to the working tree and pushing the commit with the git command,
+// which is much faster than the commits API for large changes.
+type gitPush struct {
+	// url is the clone URL of the project.
+	url string
+	// env is added to the environment of the git commands, e.g. the
+	// authorization header.
+	env []string
+	// webURL is the web URL of the project, used for the commit links.
+	webURL string
+}
+
+// gitInstalled reports whether the git command used by the SSH and HTTPS
+// transports is found in the PATH.
+func gitInstalled() bool {
+	_, err := exec.LookPath("git")
+	return err == nil
+}
+
+// newGitPush returns a gitPush for the project of g using the given
+// transport, TransportSSH or TransportHTTPS. Over HTTPS the token of the
+// given authentication mode is used.
+func newGitPush(g *Gitlab, transport, auth, token string) (*gitPush, error) {
+	p, _, err := g.client.Projects.GetProject(g.pid, nil, gitlab.WithContext(g.ctx))
+	if err != nil {
+		return nil, fmt.Errorf("gitlab: error getting clone URL of project %d: %w", g.pid, err)
+	}
+
+	push := &gitPush{webURL: p.WebURL}
+	switch transport {
+	case TransportSSH:
+		push.url = p.SSHURLToRepo
+	case TransportHTTPS:
+		push.url = p.HTTPURLToRepo
+		push.env = gitAuthEnv(auth, token)
+	default:
+		return nil, fmt.Errorf("unknown Git transport %q", transport)
+	}
+
+	if push.url == "" {
+		return nil, fmt.Errorf("gitlab: project %d has no %s clone URL", g.pid, transport)
+	}
+	return push, nil
+}
+
+// gitAuthEnv returns the environment passing the token as basic auth header
+// to git. Unlike credentials in the URL it does not show up in the process
+// list or in error messages.
+func gitAuthEnv(auth, token string) []string {
+	user := "gfdashsync" // any user name is accepted with access tokens
+	switch auth {
+	case AuthOAuth:
+		user = "oauth2"
+	case AuthJob:
+		user = "gitlab-ci-token"
+	}
+
+	cred := base64.StdEncoding.EncodeToString([]byte(user + ":" + token))
+	return []string{
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=http.extraHeader",
+		"GIT_CONFIG_VALUE_0=Authorization: Basic " + cred,
+	}
+}
+
+// commit clones the branch of opt into a temporary directory, applies the
+// actions, commits them with the message and author of opt and pushes the
+// commit.
+func (p *gitPush) commit(ctx context.Context, opt *gitlab.CreateCommitOptions) (*gitlab.Commit, error) {
+	dir, err := os.MkdirTemp("", "gfdashsync-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	git := func(args ...string) (string, error) {
+		cmd := exec.CommandContext(ctx, "git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), p.env...)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			return "", fmt.Errorf("git %s: %w: %s", args[0], err, bytes.TrimSpace(out))
+		}
+		return strings.TrimSpace(string(out)), nil
+	}
+
+	branch := *opt.Branch
+	if _, err := git("clone", "--quiet", "--depth", "1", "--branch", branch, p.url, "."); err != nil {
+		return nil, err
+	}
+
+	for _, a := range opt.Actions {
+		if err := applyAction(dir, a); err != nil {
+			return nil, err
+		}
+	}
+
+	name, email := defaultCommitterName, defaultCommitterEmail
+	if opt.AuthorName != nil {
+		name = *opt.AuthorName
+	}
+	if opt.AuthorEmail != nil {
+		email = *opt.AuthorEmail
+	}
+
+	if _, err := git("add", "--all"); err != nil {
+		return nil, err
+	}
+	if _, err := git("-c", "user.name="+name, "-c", "user.email="+email, "commit", "--quiet", "-m", *opt.CommitMessage); err != nil {
+		return nil, err
+	}
+	if _, err := git("push", "--quiet", "origin", "HEAD:refs/heads/"+branch); err != nil {
+		return nil, err
+	}
+
+	sha, err := git("rev-parse", "HEAD")
+	if err != nil {
+		return nil, err
+	}
+
+	c := &gitlab.Commit{
+		ID:      sha,
+		ShortID: sha[:8],
+		Title:   strings.SplitN(*opt.CommitMessage, "\n", 2)[0],
+		Message: *opt.CommitMessage,
+	}
+	if p.webURL != "" {
+		c.WebURL = p.webURL + "/-/commit/" + sha
+	}
+	return c, nil
+}
+
+// applyAction applies the commit action to the working tree in dir.
+func applyAction(dir string, a *gitlab.CommitActionOptions) error {
+	file, err := worktreePath(dir, *a.FilePath)
+	if err != nil {
+		return err
+	}
+
+	switch *a.Action {
+	case gitlab.FileDelete:
+		return os.Remove(file)
+
+	case gitlab.FileChmod:
+		mode := os.FileMode(0o644)
+		if a.ExecuteFilemode != nil && *a.ExecuteFilemode {
+			mode = 0o755
+		}
+		return os.Chmod(file, mode)
+
+	case gitlab.FileMove:
+		prev, err := worktreePath(dir, *a.PreviousPath)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			return err
+		}
+		if err := os.Rename(prev, file); err != nil {
+			return err
+		}
+		if a.Content == nil {
+			return nil
+		}
+	}
+
+	if a.Content == nil {
+		return fmt.Errorf("missing content of %s", *a.FilePath)
+	}
+	content := []byte(*a.Content)
+	if a.Encoding != nil && *a.Encoding == "base64" {
+		if content, err = base64.StdEncoding.DecodeString(*a.Content); err != nil {
+			return fmt.Errorf("error decoding %s: %w", *a.FilePath, err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(file, content, 0o644)
+}
+
+// worktreePath returns the path of the repository file p in the working tree
+// in dir. Paths outside of the working tree or in the .git directory are an
+// error.
+func worktreePath(dir, p string) (string, error) {
+	rel := filepath.Clean(filepath.FromSlash(strings.TrimPrefix(p, "/")))
+	first := strings.SplitN(rel, string(filepath.Separator), 2)[0]
+	if first == "." || first == ".." || first == ".git" || filepath.IsAbs(rel) {
+		return "", fmt.Errorf("invalid repository path %q", p)
+	}
+	return filepath.Join(dir, rel), nil
+}
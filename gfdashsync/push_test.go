@@ -0,0 +1,142 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"context"
+	"encoding/base64"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestGitPushCommit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+
+	remote := MustBareRepo(t, map[string]string{
+		"Ops/Overview.json": `{"a":1}`,
+		"Ops/Old.json":      `{"b":2}`,
+		"Dev/Moved.json":    `{"c":3}`,
+	})
+
+	p := &gitPush{url: remote, webURL: "https://gitlab.example.com/ops/dashboards"}
+	c, err := p.commit(context.Background(), &gitlab.CreateCommitOptions{
+		Branch:        gitlab.String("main"),
+		CommitMessage: gitlab.String("sync\n\nbody"),
+		AuthorName:    gitlab.String("Sync Bot"),
+		AuthorEmail:   gitlab.String("bot@example.com"),
+		Actions: []*gitlab.CommitActionOptions{
+			{Action: gitlab.FileAction(gitlab.FileCreate), FilePath: gitlab.String("/Ops/New.json"), Content: gitlab.String(`{"d":4}`)},
+			{Action: gitlab.FileAction(gitlab.FileUpdate), FilePath: gitlab.String("/Ops/Overview.json"), Content: gitlab.String(base64.StdEncoding.EncodeToString([]byte(`{"a":2}`))), Encoding: gitlab.String("base64")},
+			{Action: gitlab.FileAction(gitlab.FileDelete), FilePath: gitlab.String("/Ops/Old.json")},
+			{Action: gitlab.FileAction(gitlab.FileMove), FilePath: gitlab.String("/Archive/Moved.json"), PreviousPath: gitlab.String("/Dev/Moved.json")},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Title != "sync" || !strings.HasSuffix(c.WebURL, "/-/commit/"+c.ID) {
+		t.Fatalf("unexpected commit %+v", c)
+	}
+
+	want := map[string]string{
+		"Ops/New.json":       `{"d":4}`,
+		"Ops/Overview.json":  `{"a":2}`,
+		"Archive/Moved.json": `{"c":3}`,
+	}
+	for path, content := range want {
+		if got := mustGit(t, remote, "show", "main:"+path); got != content {
+			t.Errorf("%s: want %s, got %s", path, content, got)
+		}
+	}
+	if files := mustGit(t, remote, "ls-tree", "-r", "--name-only", "main"); len(strings.Fields(files)) != len(want) {
+		t.Errorf("expected the deleted and moved files to be removed, got %s", files)
+	}
+	if got := mustGit(t, remote, "log", "-1", "--format=%an <%ae> %H", "main"); got != "Sync Bot <bot@example.com> "+c.ID {
+		t.Errorf("unexpected author or commit: %s", got)
+	}
+}
+
+func TestGitTransportRequiresGit(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+
+	opt := Options{
+		GrafanaAPI:   "http://localhost",
+		GrafanaToken: "token",
+		GitAPI:       "http://localhost",
+		GitToken:     "token",
+		GitPIDs:      []int{1},
+		GitTransport: TransportSSH,
+	}
+	if err := opt.setDefaults(); err == nil || !strings.Contains(err.Error(), "git command") {
+		t.Fatalf("expected an error for the missing git command, got %v", err)
+	}
+}
+
+func TestWorktreePath(t *testing.T) {
+	for _, p := range []string{"/Ops/a.json", "Ops/../b.json"} {
+		if _, err := worktreePath("/tmp/repo", p); err != nil {
+			t.Errorf("%s: unexpected error: %v", p, err)
+		}
+	}
+	for _, p := range []string{"/../a.json", "/.git/config", "/", "Ops/../../b.json"} {
+		if _, err := worktreePath("/tmp/repo", p); err == nil {
+			t.Errorf("%s: expected an error", p)
+		}
+	}
+}
+
+func TestGitAuthEnv(t *testing.T) {
+	env := gitAuthEnv(AuthOAuth, "secret")
+	want := "GIT_CONFIG_VALUE_0=Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("oauth2:secret"))
+	if env[len(env)-1] != want {
+		t.Fatalf("want %s, got %s", want, env[len(env)-1])
+	}
+}
+
+// MustBareRepo returns the path of a bare repository with a main branch
+// containing the given files.
+func MustBareRepo(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	remote := filepath.Join(dir, "remote.git")
+	work := filepath.Join(dir, "work")
+
+	mustGit(t, dir, "init", "--quiet", "--bare", "--initial-branch=main", remote)
+	mustGit(t, dir, "init", "--quiet", "--initial-branch=main", work)
+	for path, content := range files {
+		if err := applyAction(work, &gitlab.CommitActionOptions{
+			Action:   gitlab.FileAction(gitlab.FileCreate),
+			FilePath: gitlab.String(path),
+			Content:  gitlab.String(content),
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustGit(t, work, "add", "--all")
+	mustGit(t, work, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--quiet", "-m", "initial")
+	mustGit(t, work, "push", "--quiet", remote, "main")
+
+	return remote
+}
+
+func mustGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v: %s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
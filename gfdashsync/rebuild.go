@@ -0,0 +1,167 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// RebuildHistory builds the history from the files in the repository if the
+// history file does not exist, so a repository which lost its history is not
+// treated as empty. The history key of each file is derived from its path and
+// content the same way it is when syncing.
+func (g *Gitlab) RebuildHistory() error {
+	if g.historyAction != gitlab.FileCreate {
+		return nil
+	}
+
+	tree, err := g.listTree()
+	if err != nil {
+		return fmt.Errorf("gitlab: error listing repository: %w", err)
+	}
+
+	// The panels of exploded dashboards are keyed by the dashboard in the
+	// parent directory, which may be listed after them.
+	dirs := make(map[string]string)
+	panels := make(map[string][]byte)
+
+	for _, n := range tree {
+		isJSON := strings.HasSuffix(n.Path, ".json") || strings.HasSuffix(n.Path, ".json.gz")
+		if n.Type != "blob" || !isJSON || n.Path == g.historyFile || isSnapshotPath(n.Path, g.instance) {
+			continue
+		}
+
+		data, err := g.readFile(n.Path)
+		if err != nil {
+			return fmt.Errorf("gitlab: error reading %q: %w", n.Path, err)
+		}
+
+		if strings.HasSuffix(n.Path, ".gz") {
+			if data, err = gunzip(data); err != nil {
+				log.Printf("gitlab: skipping %q while rebuilding the history: %v", n.Path, err)
+				continue
+			}
+		}
+
+		if _, _, ok := explodedPanel(n.Path); ok {
+			panels[n.Path] = data
+			continue
+		}
+
+		g.rebuildFile(n.Path, data, dirs)
+	}
+
+	// Files in a panels directory without exploded dashboard are ordinary
+	// files, e.g. dashboards in a folder named panels.
+	for p, data := range panels {
+		dir, name, _ := explodedPanel(p)
+		key, ok := dirs[dir]
+		if !ok {
+			g.rebuildFile(p, data, dirs)
+			continue
+		}
+		g.history[panelsKey(key)+name] = &File{
+			UID:    panelsKey(key) + name,
+			Path:   "/" + p,
+			SHA256: hash(data),
+		}
+	}
+
+	log.Printf("gitlab: rebuilt history with %d files", len(g.history))
+	return nil
+}
+
+// rebuildFile adds the file with the given path and content to the history
+// and records the directories of exploded dashboards in dirs.
+func (g *Gitlab) rebuildFile(p string, data []byte, dirs map[string]string) {
+	key, err := historyKey(strings.TrimPrefix(p, g.instance+"/"), data)
+	if err != nil {
+		log.Printf("gitlab: skipping %q while rebuilding the history: %v", p, err)
+		return
+	}
+	if path.Base(p) == explodedDashboard {
+		dirs[path.Dir(p)] = key
+	}
+
+	g.history[key] = &File{
+		UID:    key,
+		Path:   "/" + p,
+		SHA256: hash(stripMeta(data)),
+	}
+}
+
+// historyKey returns the history key of the synced file with the given path
+// and content.
+func historyKey(p string, data []byte) (string, error) {
+	p = strings.TrimSuffix(p, ".gz")
+
+	if strings.HasPrefix(p, "permissions/") {
+		return strings.TrimSuffix(p, ".json"), nil
+	}
+
+	var v struct {
+		UID string `json:"uid"`
+		// ID is raw, since only data sources are known to have a numeric ID.
+		ID        json.RawMessage `json:"id"`
+		Dashboard *struct {
+			UID   string `json:"uid"`
+			Title string `json:"title"`
+		} `json:"dashboard"`
+		Meta struct {
+			FolderTitle string `json:"folderTitle"`
+		} `json:"meta"`
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return "", err
+	}
+
+	switch {
+	case strings.HasPrefix(p, "datasources/") && v.UID != "":
+		return "datasources/" + v.UID, nil
+	case strings.HasPrefix(p, "datasources/") && len(v.ID) > 0 && v.ID[0] != '"' && string(v.ID) != "null":
+		return "datasources/" + string(v.ID), nil
+	case strings.HasPrefix(p, "folders/") && v.UID != "":
+		return "folders/" + v.UID, nil
+	case strings.HasPrefix(p, "snapshots/"), strings.HasPrefix(p, "playlists/"), strings.HasPrefix(p, "library-panels/"):
+		return strings.TrimSuffix(p, ".json"), nil
+	case p == strings.TrimPrefix(uidIndexPath, "/") && v.Dashboard == nil:
+		return uidIndexKey, nil
+	case v.Dashboard == nil:
+		return "", fmt.Errorf("unknown file")
+	case v.Dashboard.UID != "":
+		return v.Dashboard.UID, nil
+	}
+
+	return fmt.Sprintf("title:%s/%s", v.Meta.FolderTitle, v.Dashboard.Title), nil
+}
+
+// explodedPanel returns the directory of the exploded dashboard and the name
+// of the panel if p is the path of an exploded panel.
+func explodedPanel(p string) (dir, name string, ok bool) {
+	p = strings.TrimSuffix(p, ".gz")
+	d, f := path.Split(p)
+	if path.Base(d) != explodedPanels || !strings.HasSuffix(f, ".json") {
+		return "", "", false
+	}
+	return path.Dir(path.Dir(d)), strings.TrimSuffix(f, ".json"), true
+}
+
+func gunzip(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
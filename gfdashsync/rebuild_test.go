@@ -0,0 +1,94 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestGitlabRebuildHistory(t *testing.T) {
+	files := map[string]string{
+		"Ops/Overview.json":               `{"dashboard":{"uid":"go1","title":"Overview"},"meta":{"folderTitle":"Ops"}}`,
+		"Ops/Imported.json":               `{"dashboard":{"title":"Imported"},"meta":{"folderTitle":"Ops"}}`,
+		"datasources/influx.json":         `{"uid":"ds1","name":"influx"}`,
+		"datasources/old-5.json":          `{"id":5,"name":"old"}`,
+		"permissions/dashboards/go1.json": `[]`,
+		"library-panels/lp1.json":         `{"uid":"lp1","name":"CPU"}`,
+		"Ops/Big/panels/2.json":           `{"id":2,"type":"graph"}`,
+		"Ops/Big/dashboard.json":          `{"dashboard":{"uid":"go2","title":"Big","panels":["panels/2.json"]}}`,
+		"panels/Stray.json":               `{"dashboard":{"uid":"go3","title":"Stray"},"meta":{"folderTitle":"panels"}}`,
+		"unknown.json":                    `{"foo":"bar"}`,
+		"index.json":                      `{"go1":{"folder":"Ops","title":"Overview"}}`,
+	}
+
+	hf := func(w http.ResponseWriter, r *http.Request) {
+		for p, content := range files {
+			if strings.HasSuffix(r.URL.Path, "/"+p) {
+				MustHistoryHandler(t, content)(w, r)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	}
+
+	git, mux := MustGitlab(t, hf)
+	mux.HandleFunc("/api/v4/projects/1/repository/tree", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[
+			{"type": "tree", "path": "Ops"},
+			{"type": "blob", "path": "Ops/Overview.json"},
+			{"type": "blob", "path": "Ops/Imported.json"},
+			{"type": "blob", "path": "datasources/influx.json"},
+			{"type": "blob", "path": "datasources/old-5.json"},
+			{"type": "blob", "path": "permissions/dashboards/go1.json"},
+			{"type": "blob", "path": "library-panels/lp1.json"},
+			{"type": "blob", "path": "Ops/Big/panels/2.json"},
+			{"type": "blob", "path": "Ops/Big/dashboard.json"},
+			{"type": "blob", "path": "panels/Stray.json"},
+			{"type": "blob", "path": "unknown.json"},
+			{"type": "blob", "path": "index.json"},
+			{"type": "blob", "path": "README.md"}
+		]`))
+	})
+
+	if err := git.RebuildHistory(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"go1":                        "/Ops/Overview.json",
+		"title:Ops/Imported":         "/Ops/Imported.json",
+		"datasources/ds1":            "/datasources/influx.json",
+		"datasources/5":              "/datasources/old-5.json",
+		"permissions/dashboards/go1": "/permissions/dashboards/go1.json",
+		"library-panels/lp1":         "/library-panels/lp1.json",
+		"go2":                        "/Ops/Big/dashboard.json",
+		"go2/panels/2":               "/Ops/Big/panels/2.json",
+		"go3":                        "/panels/Stray.json",
+		uidIndexKey:                  "/index.json",
+	}
+
+	if len(git.history) != len(want) {
+		t.Fatalf("want %d files in history, got %d", len(want), len(git.history))
+	}
+
+	for key, p := range want {
+		f, ok := git.history[key]
+		if !ok || f.Path != p {
+			t.Fatalf("%s: want path %q, got %+v", key, p, f)
+		}
+	}
+
+	// An unchanged dashboard is not committed again.
+	git.Add(&File{
+		UID:    "go1",
+		Path:   "/Ops/Overview.json",
+		SHA256: hash([]byte(files["Ops/Overview.json"])),
+	})
+	if !git.history["go1"].processed || len(git.actions) != 0 {
+		t.Fatal("expected the dashboard to be unchanged")
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// redacted replaces the secrets matched by the redact patterns.
+const redacted = "***REDACTED***"
+
+// redactDefault selects the default redact patterns.
+const redactDefault = "default"
+
+// defaultRedactPatterns match common shapes of secrets. Only the first group
+// of patterns with groups is replaced, so the surrounding text like the name
+// of a query parameter stays readable.
+var defaultRedactPatterns = []string{
+	// password of a URL with credentials
+	`://[^/\s:@]+:([^/\s@]+)@`,
+	// secrets in query strings and key value pairs
+	`(?i)(?:api[_-]?key|access[_-]?token|token|secret|password|passwd)=([^&\s"']+)`,
+	// bearer tokens of authorization headers
+	`(?i)bearer\s+([A-Za-z0-9._~+/-]+=*)`,
+	// Grafana service account and Gitlab access tokens
+	`glsa_[A-Za-z0-9]{32}_[A-Fa-f0-9]{8}`,
+	`glpat-[A-Za-z0-9_-]{20}`,
+	// AWS access key IDs
+	`AKIA[0-9A-Z]{16}`,
+}
+
+// redactor is a list of patterns whose matches are replaced in all string
+// values of the files before they are hashed. The replacement only depends
+// on the content, so the redacted files are stable across runs.
+type redactor []*regexp.Regexp
+
+// loadRedactor returns the redactor of the comma separated list of regular
+// expressions s and the patterns file with the given name, which has one
+// regular expression per line, so patterns can contain commas.
+func loadRedactor(s, filename string) (redactor, error) {
+	patterns, err := readRules(filename)
+	if err != nil {
+		return nil, fmt.Errorf("error reading redact patterns: %w", err)
+	}
+	return newRedactor(append(strings.Split(s, ","), patterns...))
+}
+
+// parseRedactor parses a comma separated list of regular expressions.
+func parseRedactor(s string) (redactor, error) {
+	return newRedactor(strings.Split(s, ","))
+}
+
+// newRedactor compiles the regular expressions, where "default" selects the
+// default patterns.
+func newRedactor(exprs []string) (redactor, error) {
+	var r redactor
+	for _, e := range exprs {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+
+		patterns := []string{e}
+		if e == redactDefault {
+			patterns = defaultRedactPatterns
+		}
+
+		for _, p := range patterns {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return nil, fmt.Errorf("invalid redact pattern %q: %w", p, err)
+			}
+			r = append(r, re)
+		}
+	}
+
+	return r, nil
+}
+
+// apply returns v converted to a generic JSON value with all matches
+// replaced. Without patterns v is returned unchanged.
+func (r redactor) apply(v interface{}) (interface{}, error) {
+	if len(r) == 0 {
+		return v, nil
+	}
+
+	c, err := genericJSON(v)
+	if err != nil {
+		return nil, err
+	}
+	return r.walk(c), nil
+}
+
+// walk replaces the matches in all string values of v.
+func (r redactor) walk(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for k, e := range x {
+			x[k] = r.walk(e)
+		}
+	case []interface{}:
+		for i, e := range x {
+			x[i] = r.walk(e)
+		}
+	case string:
+		for _, re := range r {
+			x = r.replace(re, x)
+		}
+		return x
+	}
+	return v
+}
+
+// replace replaces the matches of re in s, or only their first group if re
+// has groups.
+func (r redactor) replace(re *regexp.Regexp, s string) string {
+	if re.NumSubexp() == 0 {
+		return re.ReplaceAllLiteralString(s, redacted)
+	}
+
+	var b strings.Builder
+	last := 0
+	for _, m := range re.FindAllStringSubmatchIndex(s, -1) {
+		// The group did not participate in the match.
+		if m[2] < 0 {
+			continue
+		}
+		b.WriteString(s[last:m[2]])
+		b.WriteString(redacted)
+		last = m[3]
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
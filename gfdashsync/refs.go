@@ -0,0 +1,125 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+)
+
+// dashboardURLRe matches the dashboard UID in the path of a dashboard URL,
+// also if Grafana is served from a sub path.
+var dashboardURLRe = regexp.MustCompile(`(?:^|/)d/([^/]+)`)
+
+// refChecker finds the references of a dashboard to datasources and other
+// dashboards which do not exist in Grafana.
+type refChecker struct {
+	// datasources are the UIDs and names of the datasources, since old
+	// dashboards reference datasources by name.
+	datasources map[string]bool
+	dashboards  map[string]bool
+	// host is the host of Grafana. Links to other hosts are not checked.
+	host string
+}
+
+// newRefChecker returns a checker for the given datasources and dashboards
+// of the Grafana at grafanaURL.
+func newRefChecker(datasources []map[string]interface{}, dashboards []gapi.FolderDashboardSearchResponse, grafanaURL string) *refChecker {
+	c := &refChecker{
+		datasources: make(map[string]bool),
+		dashboards:  make(map[string]bool),
+	}
+	for _, d := range datasources {
+		for _, k := range []string{"uid", "name"} {
+			if s, ok := d[k].(string); ok && s != "" {
+				c.datasources[s] = true
+			}
+		}
+	}
+	for _, d := range dashboards {
+		c.dashboards[d.UID] = true
+	}
+	if u, err := url.Parse(grafanaURL); err == nil {
+		c.host = u.Host
+	}
+	return c
+}
+
+// check returns the dangling references of the dashboard model, sorted and
+// without duplicates. Builtin datasources and references using variables
+// are not checked.
+func (c *refChecker) check(model map[string]interface{}) []string {
+	found := make(map[string]bool)
+	c.walk(model, found)
+
+	refs := make([]string, 0, len(found))
+	for r := range found {
+		refs = append(refs, r)
+	}
+	sort.Strings(refs)
+	return refs
+}
+
+// walk adds the dangling datasource references and dashboard links in v to
+// found.
+func (c *refChecker) walk(v interface{}, found map[string]bool) {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for k, e := range x {
+			switch k {
+			case "datasource":
+				ref := ""
+				switch ds := e.(type) {
+				case string:
+					ref = ds
+				case map[string]interface{}:
+					ref, _ = ds["uid"].(string)
+				}
+				if ref != "" && !builtinDatasources[ref] && !strings.HasPrefix(ref, "$") && !c.datasources[ref] {
+					found[fmt.Sprintf("datasource %q", ref)] = true
+				}
+				continue
+
+			case "links":
+				if links, ok := e.([]interface{}); ok {
+					for _, l := range links {
+						if m, ok := l.(map[string]interface{}); ok {
+							c.checkLink(m, found)
+						}
+					}
+				}
+			}
+			c.walk(e, found)
+		}
+	case []interface{}:
+		for _, e := range x {
+			c.walk(e, found)
+		}
+	}
+}
+
+// checkLink adds the link to found if its URL points to a dashboard of
+// Grafana which does not exist.
+func (c *refChecker) checkLink(link map[string]interface{}, found map[string]bool) {
+	s, _ := link["url"].(string)
+	if s == "" || strings.Contains(s, "$") {
+		return
+	}
+	u, err := url.Parse(s)
+	if err != nil || (u.Host != "" && u.Host != c.host) {
+		return
+	}
+
+	m := dashboardURLRe.FindStringSubmatch(u.Path)
+	if m == nil || c.dashboards[m[1]] {
+		return
+	}
+	found[fmt.Sprintf("link to dashboard %q", m[1])] = true
+}
@@ -0,0 +1,57 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+)
+
+func TestRefCheckerCheck(t *testing.T) {
+	c := newRefChecker(
+		[]map[string]interface{}{{"uid": "influx1", "name": "InfluxDB"}},
+		[]gapi.FolderDashboardSearchResponse{{UID: "go1"}},
+		"https://grafana.example.com/api",
+	)
+
+	in := `{
+		"links": [
+			{"type": "link", "url": "/d/go1/overview"},
+			{"type": "link", "url": "/grafana/d/gone/old?orgId=1"},
+			{"type": "link", "url": "https://grafana.example.com/d/moved"},
+			{"type": "link", "url": "https://other.example.com/d/elsewhere"},
+			{"type": "link", "url": "/d/${dashboard}"},
+			{"type": "dashboards", "tags": ["ops"]}
+		],
+		"panels": [
+			{"datasource": {"type": "influxdb", "uid": "influx1"}},
+			{"datasource": "InfluxDB"},
+			{"datasource": "Prometheus"},
+			{"datasource": "$ds"},
+			{"datasource": {"type": "datasource", "uid": "-- Mixed --"}, "targets": [
+				{"datasource": {"type": "loki", "uid": "loki1"}}
+			]},
+			{"links": [{"url": "d/gone"}], "datasource": {"uid": "loki1"}}
+		]
+	}`
+
+	var model map[string]interface{}
+	if err := json.Unmarshal([]byte(in), &model); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		`datasource "Prometheus"`,
+		`datasource "loki1"`,
+		`link to dashboard "gone"`,
+		`link to dashboard "moved"`,
+	}
+	if got := c.check(model); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,100 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// commitRetries is the maximum number of retries of a failed commit.
+const commitRetries = 3
+
+// commitRetryWait is the wait before the first retry of a failed commit. It
+// doubles with each retry up to commitRetryMaxWait.
+var (
+	commitRetryWait    = 2 * time.Second
+	commitRetryMaxWait = 30 * time.Second
+)
+
+// createCommit creates the commit and retries it if Gitlab responds with a
+// server error or is rate limiting. Since a failed request may still have
+// created the commit, the branch is checked for a commit with the same
+// message before each retry. If the commit is pushed with git it is not
+// retried.
+func (g *Gitlab) createCommit(opt *gitlab.CreateCommitOptions) (*gitlab.Commit, error) {
+	if g.push != nil {
+		return g.push.commit(g.ctx, opt)
+	}
+
+	since := time.Now().Add(-time.Minute)
+	wait := commitRetryWait
+
+	for retry := 0; ; retry++ {
+		c, resp, err := g.commitClient.Commits.CreateCommit(g.pid, opt, gitlab.WithContext(g.ctx))
+		if err == nil || retry == commitRetries || !retryable(resp) {
+			return c, err
+		}
+
+		d, ok := retryAfter(resp.Header.Get("Retry-After"))
+		if !ok {
+			d = wait
+		}
+		log.Printf("warning commit to project %d failed with status %d, retrying in %v: %v", g.pid, resp.StatusCode, d, err)
+
+		t := time.NewTimer(d)
+		select {
+		case <-g.ctx.Done():
+			t.Stop()
+			return nil, g.ctx.Err()
+		case <-t.C:
+		}
+
+		if wait *= 2; wait > commitRetryMaxWait {
+			wait = commitRetryMaxWait
+		}
+
+		landed, lerr := g.findCommit(*opt.CommitMessage, since)
+		if lerr != nil {
+			log.Printf("warning cannot check whether the commit to project %d landed: %v", g.pid, lerr)
+		}
+		if landed != nil {
+			log.Printf("gitlab: commit %s in project %d landed despite the error", landed.ID, g.pid)
+			return landed, nil
+		}
+	}
+}
+
+// retryable reports whether a request failed with a transient error.
+func retryable(resp *gitlab.Response) bool {
+	if resp == nil {
+		return false
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// findCommit returns the most recent commit on the branch created since the
+// given time with the given message or nil if there is none.
+func (g *Gitlab) findCommit(msg string, since time.Time) (*gitlab.Commit, error) {
+	commits, _, err := g.client.Commits.ListCommits(g.pid, &gitlab.ListCommitsOptions{
+		ListOptions: gitlab.ListOptions{PerPage: 20},
+		RefName:     gitlab.String(g.branch),
+		Since:       gitlab.Time(since),
+	}, gitlab.WithContext(g.ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, c := range commits {
+		if strings.TrimSpace(c.Message) == strings.TrimSpace(msg) {
+			return c, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestGitlabCommitRetry(t *testing.T) {
+	defer func(d time.Duration) { commitRetryWait = d }(commitRetryWait)
+	commitRetryWait = time.Millisecond
+
+	testCases := map[string]struct {
+		status  []int  // status of each commit request
+		landed  string // commits found when checking whether it landed
+		posts   int
+		wantID  string
+		wantErr bool
+	}{
+		"transient": {
+			status: []int{http.StatusServiceUnavailable, http.StatusOK},
+			landed: `[]`,
+			posts:  2,
+			wantID: "abc",
+		},
+		"landed": {
+			status: []int{http.StatusBadGateway},
+			landed: `[{"id":"other","message":"other"},{"id":"def","message":"sync\n"}]`,
+			posts:  1,
+			wantID: "def",
+		},
+		"client error": {
+			status:  []int{http.StatusBadRequest},
+			posts:   1,
+			wantErr: true,
+		},
+		"exhausted": {
+			status:  []int{500, 500, 500, 500},
+			landed:  `[]`,
+			posts:   commitRetries + 1,
+			wantErr: true,
+		},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			git, mux := MustGitlab(t, http.NotFound)
+
+			posts := 0
+			mux.HandleFunc("/api/v4/projects/1/repository/commits", func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodGet {
+					w.Write([]byte(tc.landed))
+					return
+				}
+
+				status := tc.status[posts]
+				posts++
+				if status != http.StatusOK {
+					w.Header().Set("Retry-After", "0")
+					http.Error(w, `{"message":"error"}`, status)
+					return
+				}
+				w.Write([]byte(`{"id":"abc"}`))
+			})
+
+			c, err := git.createCommit(&gitlab.CreateCommitOptions{
+				Branch:        gitlab.String("test"),
+				CommitMessage: gitlab.String("sync"),
+			})
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if c.ID != tc.wantID {
+					t.Fatalf("want commit %s, got %s", tc.wantID, c.ID)
+				}
+			}
+
+			if tc.posts != posts {
+				t.Fatalf("want %d commit requests, got %d", tc.posts, posts)
+			}
+		})
+	}
+}
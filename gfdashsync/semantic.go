@@ -0,0 +1,48 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"encoding/json"
+	"log"
+)
+
+// semanticHash returns the hash of the semantic form of the JSON data, which
+// is equal for documents differing only in formatting, key order or number
+// representation like 1 and 1.0.
+func semanticHash(data []byte) (string, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return "", err
+	}
+	// The injected metadata changes on every run.
+	if m, ok := v.(map[string]interface{}); ok {
+		delete(m, metaKey)
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	return hash(b), nil
+}
+
+// semanticBackend is a backend which hashes the added files semantically, so
+// files are only modified if their content changed beyond formatting.
+type semanticBackend struct {
+	Backend
+}
+
+func (b semanticBackend) Add(f *File) {
+	h, err := semanticHash(f.content)
+	if err != nil {
+		log.Printf("warning cannot hash %q semantically: %v", f.Path, err)
+	} else {
+		f.SHA256 = h
+		f.semantic = true
+	}
+	b.Backend.Add(f)
+}
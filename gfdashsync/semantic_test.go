@@ -0,0 +1,57 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"testing"
+)
+
+func TestSemanticHash(t *testing.T) {
+	testCases := []struct {
+		a, b  string
+		equal bool
+	}{
+		{`{"a": 1, "b": [1, 2]}`, `{"b":[1,2],"a":1}`, true},
+		{`{"a": 1.0}`, `{"a": 1}`, true},
+		{`{"a": 1e2}`, "{\n\t\"a\": 100\n}", true},
+		{`{"a": "1"}`, `{"a": 1}`, false},
+		{`{"a": [1, 2]}`, `{"a": [2, 1]}`, false},
+	}
+
+	for _, tc := range testCases {
+		ha, err := semanticHash([]byte(tc.a))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hb, err := semanticHash([]byte(tc.b))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if (ha == hb) != tc.equal {
+			t.Errorf("%s and %s: want equal %v", tc.a, tc.b, tc.equal)
+		}
+	}
+}
+
+func TestSemanticBackend(t *testing.T) {
+	h, err := semanticHash([]byte(`{"a": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	git, _ := MustGitlab(t, MustHistoryHandler(t, `{"go1":{"uid":"go1","path":"/dev/null.json","sha256":"`+h+`"}}`))
+
+	semanticBackend{git}.Add(&File{
+		UID:     "go1",
+		Path:    "/dev/null.json",
+		SHA256:  hash([]byte(`{"a": 1.0}`)),
+		content: []byte(`{"a": 1.0}`),
+	})
+
+	if len(git.actions) != 0 {
+		t.Fatal("expected the semantically equal file to be unchanged")
+	}
+}
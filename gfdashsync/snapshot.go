@@ -0,0 +1,128 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// snapshotPrefix is the directory of the point-in-time snapshots. It is
+// neither tracked in the history nor cleaned.
+const snapshotPrefix = "_snapshots/"
+
+// Snapshot periods.
+const (
+	PeriodQuarter = "quarter" // e.g. 2024-Q1
+	PeriodMonth   = "month"   // e.g. 2024-01
+	PeriodDay     = "day"     // e.g. 2024-01-31
+)
+
+// snapshotLabel returns the name of the snapshot directory of the period
+// containing t.
+func snapshotLabel(t time.Time, period string) string {
+	switch period {
+	case PeriodMonth:
+		return t.Format("2006-01")
+	case PeriodDay:
+		return t.Format("2006-01-02")
+	}
+	return fmt.Sprintf("%d-Q%d", t.Year(), (int(t.Month())+2)/3)
+}
+
+// isSnapshotPath reports whether the repository path p is part of a snapshot
+// of the instance.
+func isSnapshotPath(p, instance string) bool {
+	return strings.HasPrefix(strings.TrimPrefix(p, "/"), path.Join(instance, snapshotPrefix)+"/")
+}
+
+// snapshot is a backend committing all files once to a dated directory of
+// the repository in a single commit. It neither reads nor writes the
+// history and never deletes files, and files of an existing snapshot are
+// never overwritten, so the commit fails if the snapshot of the period was
+// already taken.
+type snapshot struct {
+	repo  *Gitlab
+	label string
+	files []*File
+}
+
+// newSnapshot returns a backend committing a snapshot of the period
+// containing t to repo.
+func newSnapshot(repo *Gitlab, t time.Time, period string) *snapshot {
+	return &snapshot{repo: repo, label: snapshotLabel(t, period)}
+}
+
+// Add adds the file to the snapshot.
+func (s *snapshot) Add(in *File) {
+	in.Path = "/" + path.Join(s.repo.instance, snapshotPrefix, s.label, in.Path)
+
+	if s.repo.gzip && path.Ext(in.Path) == ".json" {
+		c, err := in.compressed()
+		if err != nil {
+			log.Printf("gitlab: error compressing %q: %v", in.Path, err)
+			return
+		}
+		in = c
+	}
+
+	s.files = append(s.files, in)
+}
+
+// Keep does nothing, since files are never deleted.
+func (s *snapshot) Keep(uid string) {}
+
+// KeepPrefix does nothing, since files are never deleted.
+func (s *snapshot) KeepPrefix(prefix string) {}
+
+// Drift returns an action creating each file.
+func (s *snapshot) Drift() []*gitlab.CommitActionOptions {
+	var actions []*gitlab.CommitActionOptions
+	for _, f := range s.files {
+		actions = append(actions, &gitlab.CommitActionOptions{
+			Action:   gitlab.FileAction(gitlab.FileCreate),
+			FilePath: gitlab.String(f.Path),
+		})
+	}
+	return actions
+}
+
+// Commit commits all files in a single commit.
+func (s *snapshot) Commit() error {
+	var actions []*gitlab.CommitActionOptions
+	for _, f := range s.files {
+		if f.content == nil && f.load != nil {
+			data, err := f.load()
+			if err != nil {
+				log.Printf("gitlab: error loading %q, skipping it: %v", f.Path, err)
+				continue
+			}
+			f.content = data
+		}
+		actions = append(actions, fileAction(f, gitlab.FileCreate))
+	}
+	if len(actions) == 0 {
+		return nil
+	}
+
+	msg := s.repo.subjectMessage(fmt.Sprintf("ʕ◔ϖ◔ʔ: snapshot %s", s.label), time.Now())
+	err := s.repo.commitActions(msg, actions)
+	if err != nil && alreadyExists(err) {
+		return fmt.Errorf("gitlab: snapshot %s already exists in project %d: %w", s.label, s.repo.pid, err)
+	}
+	if err != nil {
+		return err
+	}
+	return s.repo.createTag()
+}
+
+func (s *snapshot) lastCommit() *gitlab.Commit {
+	return s.repo.lastCommit()
+}
@@ -0,0 +1,135 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSnapshotLabel(t *testing.T) {
+	tests := []struct {
+		time   string
+		period string
+		want   string
+	}{
+		{"2024-01-01", PeriodQuarter, "2024-Q1"},
+		{"2024-03-31", PeriodQuarter, "2024-Q1"},
+		{"2024-04-01", PeriodQuarter, "2024-Q2"},
+		{"2024-12-31", PeriodQuarter, "2024-Q4"},
+		{"2024-02-15", PeriodMonth, "2024-02"},
+		{"2024-02-15", PeriodDay, "2024-02-15"},
+	}
+	for _, tt := range tests {
+		d, _ := time.Parse("2006-01-02", tt.time)
+		if got := snapshotLabel(d, tt.period); got != tt.want {
+			t.Errorf("%s %s: want %q, got %q", tt.time, tt.period, tt.want, got)
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	d := time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)
+
+	t.Run("commit", func(t *testing.T) {
+		git, mux := MustGitlab(t, MustHistoryHandler(t, `{"go1":{"uid":"go1","path":"/Ops/Overview.json","sha256":"a"}}`))
+		commits := mustCommits(t, mux)
+
+		s := newSnapshot(git, d, PeriodQuarter)
+		s.Add(&File{UID: "go1", Path: "/Ops/Overview.json", SHA256: "a", content: []byte("{}")})
+		s.Keep("go2")
+		if err := s.Commit(); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(*commits) != 1 {
+			t.Fatalf("want 1 commit, got %d", len(*commits))
+		}
+		c := (*commits)[0]
+		if len(c.Actions) != 1 || *c.Actions[0].FilePath != "/_snapshots/2024-Q1/Ops/Overview.json" || *c.Actions[0].Action != "create" {
+			t.Fatalf("expected only the snapshot file to be created, got %+v", c.Actions)
+		}
+		if !strings.HasPrefix(*c.CommitMessage, "ʕ◔ϖ◔ʔ: snapshot 2024-Q1") {
+			t.Fatalf("unexpected commit message %q", *c.CommitMessage)
+		}
+		if s.lastCommit() == nil {
+			t.Fatal("expected the commit to be reported")
+		}
+	})
+
+	t.Run("exists", func(t *testing.T) {
+		git, mux := MustGitlab(t, http.NotFound)
+		mux.HandleFunc("/api/v4/projects/1/repository/commits", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"message":"A file with this name already exists"}`))
+		})
+		mux.HandleFunc("/api/v4/projects/1/repository/tree", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`[{"type":"blob","path":"_snapshots/2024-Q1/Ops/Overview.json"}]`))
+		})
+
+		s := newSnapshot(git, d, PeriodQuarter)
+		s.Add(&File{UID: "go1", Path: "/Ops/Overview.json", SHA256: "a", content: []byte("{}")})
+		err := s.Commit()
+		if err == nil || !strings.Contains(err.Error(), "snapshot 2024-Q1 already exists") {
+			t.Fatalf("expected the snapshot to exist, got %v", err)
+		}
+	})
+}
+
+func TestGitlabCleanRepoKeepsSnapshots(t *testing.T) {
+	git, mux := MustGitlab(t, http.NotFound)
+	mux.HandleFunc("/api/v4/projects/1/repository/tree", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `[{"type":"blob","path":"_snapshots/2024-Q1/Ops/Overview.json"},{"type":"blob","path":"Ops/Stale.json"}]`)
+	})
+
+	if err := git.cleanRepo(); err != nil {
+		t.Fatal(err)
+	}
+	if len(git.actions) != 1 || *git.actions[0].FilePath != "Ops/Stale.json" {
+		t.Fatalf("expected only the untracked file to be deleted, got %d actions", len(git.actions))
+	}
+}
+
+func TestRunSnapshot(t *testing.T) {
+	server, mux := MustRunServer(t)
+	commits := mustCommits(t, mux)
+
+	res, err := Run(context.Background(), Options{
+		GrafanaAPI:   server.URL,
+		GrafanaToken: "token",
+		GitAPI:       server.URL,
+		GitToken:     "token",
+		GitPIDs:      []int{1},
+		Mode:         ModeSnapshot,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "/_snapshots/" + snapshotLabel(time.Now().UTC(), PeriodQuarter) + "/Ops/Overview.json"
+	if !res.Committed || len(*commits) != 1 {
+		t.Fatalf("expected a single commit, got %d", len(*commits))
+	}
+	for _, a := range (*commits)[0].Actions {
+		if *a.FilePath != want {
+			t.Fatalf("expected only %s to be committed, got %s", want, *a.FilePath)
+		}
+	}
+
+	if _, err := Run(context.Background(), Options{
+		GrafanaAPI:     server.URL,
+		GrafanaToken:   "token",
+		GitAPI:         server.URL,
+		GitToken:       "token",
+		GitPIDs:        []int{1},
+		SnapshotPeriod: PeriodMonth,
+	}); err == nil {
+		t.Fatal("expected an error for a snapshot period without snapshot mode")
+	}
+}
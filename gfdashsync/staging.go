@@ -0,0 +1,116 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// stage writes the commit to the staging file before it is sent to Gitlab, so
+// it can be resumed if the run is interrupted.
+func (g *Gitlab) stage(opt *gitlab.CreateCommitOptions) error {
+	if g.stagingFile == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(opt)
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(g.stagingFile, data, 0600); err != nil {
+		return fmt.Errorf("gitlab: error writing staging file: %w", err)
+	}
+	return nil
+}
+
+// unstage removes the staging file after the commit has landed.
+func (g *Gitlab) unstage() error {
+	if g.stagingFile == "" {
+		return nil
+	}
+
+	err := os.Remove(g.stagingFile)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("gitlab: error removing staging file: %w", err)
+	}
+	return nil
+}
+
+// Resume replays the commit left in the staging file by an interrupted run.
+// Since Gitlab commits are atomic the commit either landed completely or not
+// at all. It is considered landed if the history file in the repository
+// matches the staged one, otherwise it is committed again. Afterwards the
+// history is read again from the repository.
+func (g *Gitlab) Resume() error {
+	data, err := os.ReadFile(g.stagingFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("gitlab: error reading staging file: %w", err)
+	}
+
+	opt := new(gitlab.CreateCommitOptions)
+	if err := json.Unmarshal(data, opt); err != nil {
+		return fmt.Errorf("gitlab: error parsing staging file: %w", err)
+	}
+
+	landed, err := g.landed(opt)
+	if err != nil {
+		return err
+	}
+
+	if landed {
+		log.Printf("gitlab: staged commit has already landed")
+	} else {
+		log.Printf("gitlab: resuming staged commit with %d actions", len(opt.Actions))
+		if _, _, err := g.client.Commits.CreateCommit(g.pid, opt, gitlab.WithContext(g.ctx)); err != nil {
+			return fmt.Errorf("gitlab: error resuming commit: %w", err)
+		}
+	}
+
+	if err := g.unstage(); err != nil {
+		return err
+	}
+
+	g.history = make(History)
+	g.historyAction = gitlab.FileUpdate
+	if err := g.parseHistory(); err != nil {
+		return fmt.Errorf("gitlab: error parsing history: %w", err)
+	}
+
+	return nil
+}
+
+// landed reports whether the staged commit is already in the repository, by
+// comparing the staged history file with the one in the repository.
+func (g *Gitlab) landed(opt *gitlab.CreateCommitOptions) (bool, error) {
+	var staged *gitlab.CommitActionOptions
+	for _, a := range opt.Actions {
+		if *a.FilePath == g.historyFile {
+			staged = a
+		}
+	}
+	if staged == nil || staged.Content == nil {
+		return false, nil
+	}
+
+	current, err := g.readFile(g.historyFile)
+	if errors.Is(err, errNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("gitlab: error reading history: %w", err)
+	}
+
+	return string(current) == *staged.Content, nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestGitlabResume(t *testing.T) {
+	current := `{"go1":{"uid":"go1","path":"/dev/null.json","sha256":"12345"}}`
+
+	testCases := map[string]struct {
+		staged     string
+		wantCommit bool
+	}{
+		"landed":   {current, false},
+		"replayed": {`{"go1":{"uid":"go1","path":"/dev/null.json","sha256":"54321"}}`, true},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			git, mux := MustGitlab(t, MustHistoryHandler(t, current))
+
+			committed := false
+			mux.HandleFunc("/api/v4/projects/1/", func(w http.ResponseWriter, r *http.Request) {
+				committed = true
+				w.Write([]byte("{}"))
+			})
+
+			git.stagingFile = filepath.Join(t.TempDir(), "staging.json")
+			err := git.stage(&gitlab.CreateCommitOptions{
+				Branch: gitlab.String("test"),
+				Actions: []*gitlab.CommitActionOptions{
+					{
+						Action:   gitlab.FileAction(gitlab.FileUpdate),
+						FilePath: gitlab.String("/dev/null.json"),
+						Content:  gitlab.String("{}"),
+					},
+					{
+						Action:   gitlab.FileAction(gitlab.FileUpdate),
+						FilePath: gitlab.String("history.json"),
+						Content:  gitlab.String(tc.staged),
+					},
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := git.Resume(); err != nil {
+				t.Fatal(err)
+			}
+
+			if committed != tc.wantCommit {
+				t.Fatalf("want commit %v, got %v", tc.wantCommit, committed)
+			}
+
+			if _, err := os.Stat(git.stagingFile); !errors.Is(err, os.ErrNotExist) {
+				t.Fatal("expected staging file to be removed")
+			}
+		})
+	}
+}
+
+func TestGitlabResumeNothingStaged(t *testing.T) {
+	git, _ := MustGitlab(t, http.NotFound)
+	git.stagingFile = filepath.Join(t.TempDir(), "staging.json")
+
+	if err := git.Resume(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,1971 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+// Package gfdashsync syncs Grafana dashboards to a Gitlab repository or wiki.
+// It is used by the gfdashsync command and can be embedded in other programs
+// using Run.
+package gfdashsync
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+	"github.com/xanzy/go-gitlab"
+)
+
+// Version is the version of gfdashsync written to the commit message. The
+// command sets it to its build version.
+var Version = "dev"
+
+// Run modes.
+const (
+	ModeSync   = "sync"   // commit all changes
+	ModeVerify = "verify" // only report the pending changes
+	ModeList   = "list"   // only list the dashboards
+	ModeCheck  = "check"  // only check the access to Grafana and the Git service
+	ModeExport = "export" // only write the files to a local directory
+
+	// ModeInventory only commits an inventory of the dashboards without
+	// fetching them.
+	ModeInventory = "inventory"
+
+	// ModeHistoryDiff only reports the changes of the history since a
+	// commit.
+	ModeHistoryDiff = "history-diff"
+
+	// ModeSnapshot commits all files once to a directory named after the
+	// current period, without touching the history.
+	ModeSnapshot = "snapshot"
+
+	// ModeListOrphans only lists the files of the history which are no
+	// longer found in Grafana and would be deleted, without fetching the
+	// dashboards.
+	ModeListOrphans = "list-orphans"
+)
+
+// Git service targets.
+const (
+	TargetRepo = "repo" // the repository of the project
+	TargetWiki = "wiki" // the wiki of the project
+)
+
+// Options configure a run. Zero values of optional fields select the same
+// defaults as the command line flags.
+type Options struct {
+	// UserAgent is the User-Agent header of all requests to Grafana, the
+	// Git service and the webhooks, "gfdashsync/<Version>" by default.
+	UserAgent string
+	// Proxy is the URL of a HTTP proxy used for all requests. Credentials
+	// in the URL are used for proxy authentication.
+	Proxy string
+
+	// Instance is the name of the Grafana instance. If set all files and the
+	// history are kept in a directory of that name, so several instances
+	// can be synced to the same repository independently.
+	Instance string
+
+	// GrafanaAPI is the Grafana API URL.
+	GrafanaAPI string
+	// GrafanaToken is the Grafana API token.
+	GrafanaToken string
+	// GrafanaUser and GrafanaPassword are the basic auth credentials used if
+	// no GrafanaToken is given.
+	GrafanaUser     string
+	GrafanaPassword string
+	// GrafanaVersion is the version of the dashboard synced instead of the
+	// latest. It requires a single UID in Only.
+	GrafanaVersion int64
+	// GrafanaRPS is the maximum of Grafana API requests per second. Zero
+	// means unlimited.
+	GrafanaRPS float64
+	// GrafanaTimeout is the timeout of each Grafana API request,
+	// DefaultGrafanaTimeout if zero. A dashboard whose request times out is
+	// skipped and kept as it is. Negative values disable the timeout. It
+	// also applies to the post commit hook and notification requests.
+	GrafanaTimeout time.Duration
+	// GrafanaOrgID is the ID of the organization whose dashboards are
+	// synced. It is sent with the X-Grafana-Org-Id header of each request,
+	// so the current organization of the user is not switched. Zero uses
+	// the organization of the token or the current one of the user.
+	GrafanaOrgID int64
+
+	// GitProvider is the Git service: ProviderGitlab (default) or
+	// ProviderGitea.
+	GitProvider string
+	// GitAPI is the Git service API URL.
+	GitAPI string
+	// GitToken is the Git service API token.
+	GitToken string
+	// GitAuth is the token type: AuthPAT (default), AuthOAuth or AuthJob.
+	GitAuth string
+	// GitTarget is the target: TargetRepo (default) or TargetWiki.
+	GitTarget string
+	// GitPIDs are the IDs of the projects to which the same changes are
+	// committed.
+	GitPIDs []int
+	// GitRepo is the repository "owner/name" of ProviderGitea, which has no
+	// project IDs.
+	GitRepo string
+	// GitStartSHA is the SHA of the commit on which the commit is based
+	// instead of the head of the branch, e.g. to detect concurrent runs.
+	GitStartSHA string
+	// GitForce resets the branch to the commit based on GitStartSHA, even if
+	// it is not a descendant of the head of the branch.
+	GitForce bool
+	// GitTransport is how commits are sent: TransportAPI (default) uses the
+	// commits API, TransportSSH and TransportHTTPS clone the branch and push
+	// the commit with the git command, which is faster for large changes.
+	GitTransport string
+	// RepoTreeCache lists the tree of the branch once and serves the reads of
+	// repository files from it, e.g. for the conflict detection, the diffs
+	// and the history rebuild. Each file is read only once.
+	RepoTreeCache bool
+	// SeparateHistory commits the history in a commit of its own after the
+	// commit of the dashboards, so the latter only changes dashboards.
+	SeparateHistory bool
+	// Lock serializes runs against the same branch with a lock file, which
+	// is committed before the history is read and deleted at the end of
+	// the run. It only applies to ModeSync.
+	Lock bool
+	// LockTTL is the age after which a lock is stale and stolen,
+	// DefaultLockTTL by default.
+	LockTTL time.Duration
+	// GitBranch is the repository branch, "main" by default. A comma
+	// separated list of branches commits the same changes to each branch,
+	// which keeps its own history.
+	GitBranch string
+	// GitCreateBranch creates the branch from GitStartBranch if it does not
+	// exist.
+	GitCreateBranch bool
+	// GitStartBranch is the branch from which a missing branch is created,
+	// "main" by default.
+	GitStartBranch string
+
+	// GitAuthorName and GitAuthorEmail are the commit author. If empty the
+	// owner of the token is the author.
+	GitAuthorName  string
+	GitAuthorEmail string
+	// GitSignoff appends a Signed-off-by trailer of the author to the commit
+	// message.
+	GitSignoff bool
+	// GitLastCommitID sends the last commit ID of each changed file, so the
+	// commit fails instead of overwriting changes pushed to the branch
+	// during the run.
+	GitLastCommitID bool
+	// TriggerUser is the user who triggered the run as "Name <email>". If
+	// set it is added as Co-authored-by trailer to the commit messages.
+	TriggerUser string
+	// GitCommitMode is CommitSingle to commit all changes at once, the
+	// default, or CommitPerFile to commit each changed file on its own
+	// followed by a commit of the history. The latter needs an API request
+	// per file.
+	GitCommitMode string
+	// GitMessageFile is a file with a Go template of the commit message with
+	// .Version and .Time.
+	GitMessageFile string
+	// GitFileMessage is a Go template of the commit subject of each file in
+	// CommitPerFile mode with .Title, .Folder, .Action (created, updated,
+	// moved or deleted), .Path, .Version and .Time, e.g.
+	// chore(grafana): {{.Action}} "{{.Title}}" in {{.Folder}}.
+	GitFileMessage string
+	// GitTag is a Go template of the name of an annotated tag created for
+	// the commit of a run with .Version, .Time and .Branch, e.g.
+	// backup-{{.Time.Format "2006-01-02"}}. No tag is created if nothing was
+	// committed.
+	GitTag string
+	// GitTagForce replaces an existing tag of the same name. Otherwise the
+	// run fails after committing.
+	GitTagForce bool
+
+	// Mode is the run mode: ModeSync (default) or ModeVerify.
+	Mode string
+	// OutputDir is the directory to which the files are written in
+	// ModeExport.
+	OutputDir string
+	// HistoryRef is the commit, branch or tag whose history is compared
+	// with the history at the head of the branch in ModeHistoryDiff.
+	HistoryRef string
+	// SnapshotPeriod is the period naming the directory of the snapshot in
+	// ModeSnapshot: PeriodQuarter (default), PeriodMonth or PeriodDay.
+	SnapshotPeriod string
+
+	// IncludeDataSources also syncs the data source definitions.
+	IncludeDataSources bool
+	// IncludeFolders also syncs the folder definitions.
+	IncludeFolders bool
+	// IncludeLibraryPanels also syncs the library panels.
+	IncludeLibraryPanels bool
+	// Thumbnails also commits each dashboard rendered as PNG. It requires
+	// the image renderer plugin in Grafana. A thumbnail is only rendered if
+	// its dashboard changed.
+	Thumbnails bool
+	// IncludeSnapshots also syncs the dashboard snapshots.
+	IncludeSnapshots bool
+	// SnapshotsKeepExpired keeps snapshots which expired or were deleted in
+	// Grafana in the repository instead of deleting them.
+	SnapshotsKeepExpired bool
+	// IncludePlaylists also syncs the playlists.
+	IncludePlaylists bool
+	// IncludePermissions also syncs the dashboard and folder permissions.
+	IncludePermissions bool
+	// MaxChanges aborts the commit if more changes are pending. Zero means
+	// unlimited.
+	MaxChanges int
+	// HistoryRebuild builds the history from the files in the repository if
+	// the history file does not exist.
+	HistoryRebuild bool
+	// CompactHistory writes the history file in the compact format.
+	CompactHistory bool
+	// HistoryKeep is the number of previous history files kept in the
+	// repository as history.json.1 to history.json.N, the newest first,
+	// to recover from a bad run. Zero keeps none.
+	HistoryKeep int
+	// CommitHistoryChanges commits the history if its content differs from
+	// the history file in the repository, even if no file changed, e.g. to
+	// record the versions of unchanged dashboards.
+	CommitHistoryChanges bool
+	// HistoryFormat is the format of the history file: HistoryFormatJSON or
+	// HistoryFormatNDJSON. If it is empty the format of the existing history
+	// file is kept.
+	HistoryFormat string
+	// Only is a comma separated list of dashboard UIDs to sync. All other
+	// dashboards found in Grafana are left untouched.
+	Only string
+	// Folders is a comma separated list of folder titles and UIDs to
+	// sync. All dashboards in other folders are left untouched.
+	Folders string
+	// FoldersRecursive also syncs the dashboards in the descendant
+	// folders of Folders, which requires a request per folder.
+	FoldersRecursive bool
+	// Ignore is a comma separated list of dashboard UIDs and title patterns
+	// prefixed with "glob:" to ignore.
+	Ignore string
+	// RepoClean deletes all JSON files from the repository which are not
+	// tracked in the history.
+	RepoClean bool
+	// StagingFile is the local file where the commit is staged before it is
+	// sent. It requires a single project.
+	StagingFile string
+	// Resume resumes the commit of an interrupted run from StagingFile.
+	Resume bool
+	// PruneGrace is the duration a dashboard must be missing before it is
+	// deleted.
+	PruneGrace time.Duration
+	// ArchiveDeleted moves deleted files to "_archive/<date>/" instead of
+	// deleting them. The archived files are kept in the history, so they
+	// are never deleted.
+	ArchiveDeleted bool
+	// Gzip stores the files gzip compressed.
+	Gzip bool
+	// PathTemplate is the Go template of the dashboard file paths,
+	// DefaultPathTemplate by default. Besides the dashboard fields it may use
+	// .FolderPath, the titles of nested folders joined by "/", and
+	// .Tag "prefix", the value of the first tag with the prefix.
+	PathTemplate string
+	// PathByTag is a tag prefix like "team:". If set the value of the
+	// dashboard's tag with this prefix is used as directory instead of the
+	// folder title, if it has one. It cannot be combined with PathTemplate.
+	PathByTag string
+	// Normalize is a comma separated list of JSON paths like
+	// "$.dashboard.time" of dashboard fields to remove before hashing. A path
+	// followed by "=" and a JSON value resets the fields instead.
+	Normalize string
+	// NormalizeFile is a file with one path of Normalize per line, so the
+	// values can contain commas. Empty lines and lines starting with "#"
+	// are skipped.
+	NormalizeFile string
+	// DatasourceRewrite is a JSON file mapping the UIDs or names of the
+	// datasources referenced by the dashboards and library panels to those
+	// of another Grafana, with "*" mapping all others, so the exported files
+	// can be restored there. It requires ModeExport.
+	DatasourceRewrite string
+	// Redact is a comma separated list of regular expressions replaced with
+	// "***REDACTED***" in all string values of the dashboards, snapshots
+	// and library panels before hashing. "default" selects patterns for
+	// common secrets like URL credentials and access tokens. If a pattern
+	// has groups, only the first group is replaced.
+	Redact string
+	// RedactFile is a file with one regular expression of Redact per line,
+	// so the patterns can contain commas like in "\d{2,5}". Empty lines and
+	// lines starting with "#" are skipped.
+	RedactFile string
+	// PostCommit is a command run with "sh -c" or a HTTP URL which is
+	// POSTed to after a commit. It receives the JSON summary of the run.
+	PostCommit string
+	// PostCommitRequired fails the run if the post commit hook fails,
+	// otherwise the failure is only logged.
+	PostCommitRequired bool
+	// NotifyWebhook is the URL of a Slack compatible incoming webhook which
+	// is notified with a summary of the changes after a commit.
+	NotifyWebhook string
+	// NotifyAlways also notifies the webhook if nothing was committed.
+	NotifyAlways bool
+	// Diff records the diffs of modified files, which are returned in the
+	// Result and added to the commit message.
+	Diff bool
+	// Provisioning writes the dashboards in the envelope of the Grafana
+	// dashboard API with the folder UID instead of the raw model.
+	Provisioning bool
+	// SemanticDiff hashes the files semantically, so changes of the
+	// formatting or the number representation are not committed.
+	SemanticDiff bool
+	// Conflict is the handling of files changed in the repository:
+	// ConflictSkip, ConflictOverwrite or empty to disable the detection.
+	Conflict string
+	// Codeowners commits a CODEOWNERS file assigning the file of each
+	// dashboard to the owners named by its tags with the prefix
+	// CodeownersTag. It is regenerated on every run and committed if it
+	// changed.
+	Codeowners bool
+	// CodeownersTag is the prefix of the owner tags, DefaultCodeownersTag
+	// if empty.
+	CodeownersTag string
+	// Layout is the repository layout: LayoutPath (default) names the files
+	// by PathTemplate, LayoutUID names them <uid>.json and maps the UIDs to
+	// their folder and title in index.json, so renames do not move files.
+	Layout string
+	// Index is the name of a Markdown file listing all synced dashboards
+	// with a link to Grafana. It is regenerated on every run and committed
+	// if it changed. Empty disables the index.
+	Index string
+	// Heartbeat updates the last-sync.txt file with the time of the run on
+	// every sync, so even a run without changes creates a commit proving
+	// that it ran.
+	Heartbeat bool
+	// CommitEmpty creates a commit updating the heartbeat file if a run has
+	// no changes, e.g. to advance the timestamp of a mirror. Unlike
+	// Heartbeat the file is left untouched by runs with changes.
+	CommitEmpty bool
+	// MaxFetchErrors aborts the run before anything is committed if more
+	// dashboards could not be fetched. It is a number like "5" or a
+	// percentage of all dashboards like "10%". Empty is unlimited.
+	MaxFetchErrors string
+	// SkipTag is the tag of dashboards which are neither synced nor deleted,
+	// like those of Ignore, e.g. DefaultSkipTag. Empty disables it.
+	SkipTag string
+	// Fast does not fetch dashboards whose latest version in Grafana equals
+	// the version in the history and keeps them instead. Changes of the
+	// options affecting the files, like the path template, are only applied
+	// to these dashboards by a run without Fast.
+	// The versions are looked up concurrently with a small request per
+	// dashboard, since Grafana cannot list the versions of all dashboards.
+	Fast bool
+	// Explode writes each dashboard as a directory with the dashboard
+	// without its panels in dashboard.json and each panel in
+	// panels/<id>.json. It is experimental.
+	Explode bool
+	// InjectMeta adds a _meta field with the Grafana URL of the dashboard,
+	// its UID and the time of the sync to each dashboard file. It is not
+	// part of the hash, so it only changes along with the dashboard.
+	InjectMeta bool
+	// Validate skips dashboards which do not have a title, UID and panels,
+	// e.g. partial models returned on transient errors, and keeps their
+	// committed version.
+	Validate bool
+	// CheckRefs logs the references of the fetched dashboards to
+	// datasources and dashboards which do not exist in Grafana as warnings
+	// and reports them in Result.DanglingRefs.
+	CheckRefs bool
+	// CheckRefsStrict fails the run before committing if dangling
+	// references were found. It implies CheckRefs.
+	CheckRefsStrict bool
+	// Verbose logs the fetch duration and size of each dashboard and a
+	// summary with the slowest dashboards at the end of the run.
+	Verbose bool
+}
+
+// Result is the outcome of a run.
+type Result struct {
+	// Dashboards is the number of dashboards found in Grafana.
+	Dashboards int
+	// Fetched is the number of dashboards fetched from Grafana.
+	Fetched int
+	// FetchErrors is the number of dashboards which could not be fetched.
+	FetchErrors int
+	// Unchanged is the number of dashboards not fetched with Fast, since
+	// their version was already synced.
+	Unchanged int
+	// Checks are the outcomes of the checks. They are only set in
+	// ModeCheck.
+	Checks []Check
+	// List are all dashboards found in Grafana. It is only set in ModeList.
+	List []gapi.FolderDashboardSearchResponse
+	// HistoryChanges are the changes of the history since the HistoryRef.
+	// They are only set in ModeHistoryDiff.
+	HistoryChanges []HistoryChange
+	// Orphans are the files of the history no longer found in Grafana.
+	// They are only set in ModeListOrphans.
+	Orphans []Orphan
+	// DanglingRefs are the references of the dashboards to datasources and
+	// dashboards which do not exist in Grafana. They are only set with
+	// CheckRefs.
+	DanglingRefs []string
+	// Committed is set if a commit was made.
+	Committed bool
+	// Diffs are the unified diffs of the modified files, if enabled.
+	Diffs []string
+	// CommitID and CommitURL are the ID and the web URL of the created
+	// commit. They are empty if the target does not create commits.
+	CommitID  string
+	CommitURL string
+	// Drift are the changes needed to bring the Git service in sync. In
+	// ModeSync they were committed.
+	Drift []*gitlab.CommitActionOptions
+}
+
+// instanceRe matches valid instance names, which are used as directory.
+var instanceRe = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9._-]*$`)
+
+// shaRe matches full SHA-1 and SHA-256 commit SHAs. Gitlab does not accept
+// abbreviated SHAs as start_sha.
+var shaRe = regexp.MustCompile(`^([0-9a-f]{40}|[0-9a-f]{64})$`)
+
+// setDefaults sets the defaults of all optional fields and validates the
+// options.
+func (o *Options) setDefaults() error {
+	if o.GitAuth == "" {
+		o.GitAuth = AuthPAT
+	}
+	if o.GitTarget == "" {
+		o.GitTarget = TargetRepo
+	}
+	if o.GitProvider == "" {
+		o.GitProvider = ProviderGitlab
+	}
+	if o.GitBranch == "" {
+		o.GitBranch = "main"
+	}
+	if o.GitStartBranch == "" {
+		o.GitStartBranch = "main"
+	}
+	if o.Mode == "" {
+		o.Mode = ModeSync
+	}
+	if o.GitCommitMode == "" {
+		o.GitCommitMode = CommitSingle
+	}
+	if o.GitTransport == "" {
+		o.GitTransport = TransportAPI
+	}
+	if o.LockTTL == 0 {
+		o.LockTTL = DefaultLockTTL
+	}
+	if o.Codeowners && o.CodeownersTag == "" {
+		o.CodeownersTag = DefaultCodeownersTag
+	}
+	if o.CheckRefsStrict {
+		o.CheckRefs = true
+	}
+	if o.GrafanaTimeout == 0 {
+		o.GrafanaTimeout = DefaultGrafanaTimeout
+	}
+	if o.SnapshotPeriod == "" && o.Mode == ModeSnapshot {
+		o.SnapshotPeriod = PeriodQuarter
+	}
+	if o.Layout == "" {
+		o.Layout = LayoutPath
+	}
+	if o.Layout == LayoutUID {
+		if o.PathByTag != "" || (o.PathTemplate != "" && o.PathTemplate != DefaultPathTemplate) {
+			return errors.New("layout uid cannot be combined with a path template")
+		}
+		o.PathTemplate = uidPathTemplate
+	}
+	if o.PathByTag != "" {
+		if o.PathTemplate != "" && o.PathTemplate != DefaultPathTemplate {
+			return errors.New("path by tag cannot be combined with a path template")
+		}
+		o.PathTemplate = tagPathTemplate(o.PathByTag)
+	}
+	if o.PathTemplate == "" {
+		o.PathTemplate = DefaultPathTemplate
+	}
+	if o.UserAgent == "" {
+		o.UserAgent = "gfdashsync/" + Version
+	}
+	if o.TriggerUser != "" {
+		u, err := parseUser(o.TriggerUser)
+		if err != nil {
+			return err
+		}
+		o.TriggerUser = u
+	}
+
+	switch {
+	case o.GrafanaAPI == "" && o.Mode != ModeHistoryDiff:
+		return errors.New("missing Grafana API URL")
+	case o.GrafanaToken == "" && o.GrafanaUser == "" && o.Mode != ModeHistoryDiff:
+		return errors.New("missing Grafana API token or basic auth user")
+	case o.GrafanaOrgID < 0:
+		return errors.New("grafana org ID must not be negative")
+	case o.FoldersRecursive && o.Folders == "":
+		return errors.New("folders recursive requires folders")
+	case o.GrafanaVersion > 0 && (o.Only == "" || strings.Contains(o.Only, ",")):
+		return errors.New("a dashboard version requires a single dashboard UID in only")
+	case o.Mode == ModeList:
+		// Listing does not access the Git service.
+		return nil
+	case o.OutputDir != "" && o.Mode != ModeExport:
+		return errors.New("output dir requires the export mode")
+	case o.DatasourceRewrite != "" && o.Mode != ModeExport:
+		return errors.New("datasource rewrite requires the export mode")
+	case o.Mode == ModeExport && o.OutputDir == "":
+		return errors.New("missing output dir")
+	case o.Mode == ModeExport && o.Instance != "" && !instanceRe.MatchString(o.Instance):
+		return fmt.Errorf("invalid instance name %q", o.Instance)
+	case o.Mode == ModeExport && o.usesRepo():
+		return errors.New("export mode cannot be combined with Git service, history, conflict or lock options")
+	case o.Mode == ModeExport:
+		// Exporting does not access the Git service.
+		return nil
+	case o.GitAPI == "":
+		return errors.New("missing Git service API URL")
+	case o.GitToken == "":
+		return errors.New("missing Git service API token")
+	case o.GitAuth != AuthPAT && o.GitAuth != AuthOAuth && o.GitAuth != AuthJob:
+		return fmt.Errorf("unknown Git authentication %q", o.GitAuth)
+	case o.GitProvider != ProviderGitlab && o.GitProvider != ProviderGitea:
+		return fmt.Errorf("unknown Git provider %q", o.GitProvider)
+	case o.GitProvider == ProviderGitea && (o.GitRepo == "" || len(o.GitPIDs) > 0):
+		return errors.New("gitea requires a repository owner/name instead of project IDs")
+	case o.GitProvider == ProviderGitea && (o.GitTarget != TargetRepo || o.GitTransport != TransportAPI || strings.Contains(o.GitBranch, ",")):
+		return errors.New("gitea requires the repo target, the api transport and a single branch")
+	case o.GitProvider == ProviderGitea && (o.Mode == ModeCheck || o.Mode == ModeHistoryDiff || o.Mode == ModeSnapshot):
+		return fmt.Errorf("mode %s is not supported with gitea", o.Mode)
+	case o.GitProvider == ProviderGitea && (o.Instance != "" || o.GitCreateBranch || o.GitStartSHA != "" || o.GitLastCommitID || o.Lock ||
+		o.StagingFile != "" || o.RepoTreeCache || o.RepoClean || o.Conflict != "" || o.HistoryRebuild || o.HistoryFormat != "" ||
+		o.ArchiveDeleted || o.Diff || o.Gzip || o.GitMessageFile != "" || o.GitTag != "" || o.TriggerUser != "" || o.CommitHistoryChanges || o.HistoryKeep > 0 ||
+		o.SeparateHistory || o.GitCommitMode != CommitSingle):
+		return errors.New("gitea only supports syncing the files, the history and the commit author")
+	case o.GitRepo != "" && o.GitProvider != ProviderGitea:
+		return errors.New("repository owner/name requires gitea, use project IDs with gitlab")
+	case o.GitProvider == ProviderGitlab && len(o.GitPIDs) == 0:
+		return errors.New("missing Git project ID")
+	case o.Mode != ModeSync && o.Mode != ModeVerify && o.Mode != ModeList && o.Mode != ModeCheck && o.Mode != ModeExport && o.Mode != ModeHistoryDiff && o.Mode != ModeInventory && o.Mode != ModeSnapshot &&
+		o.Mode != ModeListOrphans:
+		return fmt.Errorf("unknown mode %q", o.Mode)
+	case o.GitTarget != TargetRepo && o.GitTarget != TargetWiki:
+		return fmt.Errorf("unknown Git target %q", o.GitTarget)
+	case o.Mode == ModeHistoryDiff && o.HistoryRef == "":
+		return errors.New("history diff requires a ref")
+	case o.Mode == ModeHistoryDiff && (o.GitTarget != TargetRepo || len(o.GitPIDs) > 1 || strings.Contains(o.GitBranch, ",")):
+		return errors.New("history diff requires the repo target and a single project and branch")
+	case o.Mode == ModeListOrphans && (len(o.GitPIDs) > 1 || strings.Contains(o.GitBranch, ",")):
+		return errors.New("list orphans requires a single project and branch")
+	case o.SnapshotPeriod != "" && o.Mode != ModeSnapshot:
+		return errors.New("snapshot period requires the snapshot mode")
+	case o.SnapshotPeriod != PeriodQuarter && o.SnapshotPeriod != PeriodMonth && o.SnapshotPeriod != PeriodDay && o.Mode == ModeSnapshot:
+		return fmt.Errorf("unknown snapshot period %q", o.SnapshotPeriod)
+	case o.Mode == ModeSnapshot && o.GitTarget != TargetRepo:
+		return errors.New("snapshot requires the repo target")
+	case o.Gzip && o.GitTarget != TargetRepo:
+		return errors.New("gzip requires the repo target")
+	case o.Resume && o.GitTarget != TargetRepo:
+		return errors.New("resume requires the repo target")
+	case o.Resume && o.StagingFile == "":
+		return errors.New("resume requires a staging file")
+	case len(o.GitPIDs) > 1 && o.StagingFile != "":
+		return errors.New("staging file requires a single project")
+	case o.GitTransport != TransportAPI && o.GitTransport != TransportSSH && o.GitTransport != TransportHTTPS:
+		return fmt.Errorf("unknown Git transport %q", o.GitTransport)
+	case o.GitTransport != TransportAPI && !gitInstalled():
+		return fmt.Errorf("git transport %q requires the git command, which is not installed", o.GitTransport)
+	case o.GitTransport != TransportAPI && o.GitTarget != TargetRepo:
+		return errors.New("git transport requires the repo target")
+	case o.GitTransport != TransportAPI && (o.GitCommitMode == CommitPerFile || o.GitStartSHA != "" || o.GitLastCommitID):
+		return errors.New("git transport cannot be combined with per-file commits, a start SHA or last commit IDs")
+	case o.GitLastCommitID && o.GitTarget != TargetRepo:
+		return errors.New("last commit IDs require the repo target")
+	case o.RepoTreeCache && o.GitTarget != TargetRepo:
+		return errors.New("repo tree cache requires the repo target")
+	case o.SeparateHistory && o.GitTarget != TargetRepo:
+		return errors.New("separate history commit requires the repo target")
+	case o.Lock && o.GitTarget != TargetRepo:
+		return errors.New("lock requires the repo target")
+	case o.LockTTL < 0:
+		return errors.New("lock TTL must not be negative")
+	case o.GitStartSHA != "" && !shaRe.MatchString(o.GitStartSHA):
+		return fmt.Errorf("invalid start SHA %q, must be a full commit SHA", o.GitStartSHA)
+	case (o.GitStartSHA != "" || o.GitForce) && o.GitTarget != TargetRepo:
+		return errors.New("start SHA and force require the repo target")
+	case o.GitForce && o.GitStartSHA == "":
+		return errors.New("force requires a start SHA")
+	case len(o.gitBranches()) == 0:
+		return errors.New("missing Git branch")
+	case len(o.gitBranches()) > 1 && o.GitTarget != TargetRepo:
+		return errors.New("multiple branches require the repo target")
+	case len(o.gitBranches()) > 1 && o.StagingFile != "":
+		return errors.New("staging file requires a single branch")
+	case o.GitSignoff && (o.GitAuthorName == "" || o.GitAuthorEmail == ""):
+		return errors.New("signoff requires the author name and email")
+	case o.GitFileMessage != "" && o.GitCommitMode != CommitPerFile:
+		return errors.New("file message requires the per file commit mode")
+	case o.GitTag != "" && o.GitTarget != TargetRepo:
+		return errors.New("git tag requires the repo target")
+	case o.GitTagForce && o.GitTag == "":
+		return errors.New("git tag force requires a git tag")
+	case (o.GitSignoff || o.GitMessageFile != "") && o.GitTarget != TargetRepo:
+		return errors.New("signoff and message file require the repo target")
+	case o.TriggerUser != "" && o.GitTarget != TargetRepo:
+		return errors.New("trigger user requires the repo target")
+	case o.HistoryRebuild && o.GitTarget != TargetRepo:
+		return errors.New("history rebuild requires the repo target")
+	case o.HistoryFormat != "" && o.HistoryFormat != HistoryFormatJSON && o.HistoryFormat != HistoryFormatNDJSON:
+		return fmt.Errorf("unknown history format %q", o.HistoryFormat)
+	case o.HistoryKeep < 0:
+		return errors.New("history keep must not be negative")
+	case o.HistoryKeep > 0 && o.GitTarget != TargetRepo:
+		return errors.New("history keep requires the repo target")
+	case o.InjectMeta && o.Explode:
+		return errors.New("inject meta cannot be combined with explode")
+	case o.CheckRefs && o.Mode == ModeInventory:
+		return errors.New("check refs is not supported with mode inventory")
+	case o.CommitHistoryChanges && o.GitTarget != TargetRepo:
+		return errors.New("commit history changes requires the repo target")
+	case o.HistoryFormat == HistoryFormatNDJSON && (o.CompactHistory || o.GitTarget != TargetRepo):
+		return errors.New("ndjson history requires the repo target and cannot be compact")
+	case o.Diff && o.GitTarget != TargetRepo:
+		return errors.New("diff requires the repo target")
+	case o.CodeownersTag != "" && !o.Codeowners:
+		return errors.New("codeowners tag requires codeowners")
+	case o.Codeowners && (o.GitTarget != TargetRepo || o.Instance != ""):
+		return errors.New("codeowners requires the repo target and no instance, since it must be at the root of the repository")
+	case o.Layout != LayoutPath && o.Layout != LayoutUID:
+		return fmt.Errorf("unknown layout %q", o.Layout)
+	case o.Layout == LayoutUID && o.GitTarget != TargetRepo:
+		return errors.New("layout uid requires the repo target")
+	case o.Layout == LayoutUID && "/"+strings.TrimPrefix(o.Index, "/") == uidIndexPath:
+		return fmt.Errorf("index %q is used by layout uid", o.Index)
+	case o.Index != "" && o.GitTarget != TargetRepo:
+		return errors.New("index requires the repo target")
+	case o.Heartbeat && o.GitTarget != TargetRepo:
+		return errors.New("heartbeat requires the repo target")
+	case o.CommitEmpty && (o.GitTarget != TargetRepo || o.Mode == ModeSnapshot):
+		return errors.New("commit empty requires the repo target and is not supported with mode snapshot")
+	case o.ArchiveDeleted && o.GitTarget != TargetRepo:
+		return errors.New("archive requires the repo target")
+	case o.Explode && o.GitTarget != TargetRepo:
+		return errors.New("explode requires the repo target")
+	case o.Thumbnails && o.GitTarget != TargetRepo:
+		return errors.New("thumbnails require the repo target")
+	case o.GitCommitMode != CommitSingle && o.GitCommitMode != CommitPerFile:
+		return fmt.Errorf("unknown commit mode %q", o.GitCommitMode)
+	case o.GitCommitMode == CommitPerFile && (o.GitTarget != TargetRepo || o.StagingFile != ""):
+		return errors.New("per file commits require the repo target and no staging file")
+	case o.Instance != "" && !instanceRe.MatchString(o.Instance):
+		return fmt.Errorf("invalid instance name %q", o.Instance)
+	case o.Instance != "" && o.GitTarget != TargetRepo:
+		return errors.New("instance requires the repo target")
+	case o.Conflict != "" && o.Conflict != ConflictSkip && o.Conflict != ConflictOverwrite:
+		return fmt.Errorf("unknown conflict mode %q", o.Conflict)
+	}
+
+	return nil
+}
+
+// usesRepo reports whether options are set which only apply to a Git
+// repository. Options with a default are only set if they differ from it.
+func (o *Options) usesRepo() bool {
+	return o.GitAPI != "" || o.GitToken != "" || len(o.GitPIDs) > 0 || o.GitRepo != "" ||
+		o.GitProvider != ProviderGitlab || o.GitAuth != AuthPAT || o.GitTarget != TargetRepo || o.GitTransport != TransportAPI ||
+		o.GitBranch != "main" || o.GitCreateBranch || o.GitStartBranch != "main" || o.GitStartSHA != "" || o.GitForce ||
+		o.GitAuthorName != "" || o.GitAuthorEmail != "" || o.GitSignoff || o.GitLastCommitID || o.GitCommitMode != CommitSingle ||
+		o.GitMessageFile != "" || o.GitFileMessage != "" || o.GitTag != "" || o.GitTagForce ||
+		o.HistoryRebuild || o.CompactHistory || o.HistoryKeep > 0 || o.CommitHistoryChanges || o.HistoryFormat != "" || o.SeparateHistory ||
+		o.RepoTreeCache || o.RepoClean || o.StagingFile != "" || o.Resume || o.Conflict != "" || o.Lock
+}
+
+// grafanaTransport returns the transport of the Grafana requests, which
+// selects the organization and applies the request timeout.
+func (o *Options) grafanaTransport(next http.RoundTripper) http.RoundTripper {
+	if o.GrafanaOrgID > 0 {
+		next = &orgTransport{orgID: o.GrafanaOrgID, next: next}
+	}
+	if o.GrafanaTimeout <= 0 {
+		return next
+	}
+	return &timeoutTransport{timeout: o.GrafanaTimeout, next: next}
+}
+
+// hookClient returns the client of the post commit hook and notification
+// requests, which uses the proxy and user agent of the transport and the
+// Grafana request timeout.
+func (o *Options) hookClient(transport http.RoundTripper) *http.Client {
+	c := &http.Client{Transport: transport}
+	if o.GrafanaTimeout > 0 {
+		c.Timeout = o.GrafanaTimeout
+	}
+	return c
+}
+
+// gitBranches returns the branches of the comma separated GitBranch.
+func (o *Options) gitBranches() []string {
+	var branches []string
+	for _, b := range strings.Split(o.GitBranch, ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			branches = append(branches, b)
+		}
+	}
+	return branches
+}
+
+// newBackend returns the backend of all projects and branches.
+func newBackend(ctx context.Context, opt *Options, transport http.RoundTripper) (Backend, error) {
+	if opt.GitProvider == ProviderGitea {
+		g, err := NewGitea(ctx, opt.GitAPI, opt.GitToken, opt.GitRepo, opt.GitBranch, transport)
+		if err != nil {
+			return nil, err
+		}
+		g.setCompactHistory(opt.CompactHistory)
+		g.maxChanges = opt.MaxChanges
+		g.pruneGrace = opt.PruneGrace
+		g.authorName = opt.GitAuthorName
+		g.authorEmail = opt.GitAuthorEmail
+		g.signoff = opt.GitSignoff
+		return g, nil
+	}
+
+	var message *template.Template
+	if opt.GitMessageFile != "" {
+		var err error
+		if message, err = parseMessageFile(opt.GitMessageFile); err != nil {
+			return nil, err
+		}
+	}
+
+	var targets fanout
+	branches := opt.gitBranches()
+	for _, pid := range opt.GitPIDs {
+		for _, branch := range branches {
+			b, err := newProjectBackend(ctx, opt, pid, branch, message, transport)
+			if err != nil {
+				if uerr := targets.unlock(); uerr != nil {
+					log.Print(uerr)
+				}
+				return nil, err
+			}
+
+			t := fanoutTarget{pid: pid, Backend: b}
+			if len(branches) > 1 {
+				t.branch = branch
+			}
+			targets = append(targets, t)
+		}
+	}
+
+	// A single project and branch is used directly.
+	if len(targets) == 1 {
+		return targets[0].Backend, nil
+	}
+	return targets, nil
+}
+
+// newProjectBackend returns the backend of the branch of a single project.
+func newProjectBackend(ctx context.Context, opt *Options, pid int, branch string, message *template.Template, transport http.RoundTripper) (Backend, error) {
+	if opt.GitTarget == TargetWiki {
+		wiki, err := NewWiki(ctx, opt.GitAPI, opt.GitAuth, opt.GitToken, pid, transport)
+		if err != nil {
+			return nil, err
+		}
+		wiki.pruneGrace = opt.PruneGrace
+		return wiki, nil
+	}
+
+	startBranch := ""
+	if opt.GitCreateBranch {
+		startBranch = opt.GitStartBranch
+	}
+
+	repo, err := NewGitlab(ctx, opt.GitAPI, opt.GitAuth, opt.GitToken, branch, startBranch, pid, transport)
+	if err != nil {
+		return nil, err
+	}
+
+	// The lock is taken before the history is read, so it is read again.
+	if opt.Lock && (opt.Mode == ModeSync || opt.Mode == ModeInventory) {
+		repo.instance = opt.Instance
+		if err := repo.lock(opt.LockTTL); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := configureGitlab(repo, opt, message); err != nil {
+		if uerr := repo.unlock(); uerr != nil {
+			log.Print(uerr)
+		}
+		return nil, err
+	}
+	if opt.Mode == ModeSnapshot {
+		return newSnapshot(repo, time.Now().UTC(), opt.SnapshotPeriod), nil
+	}
+	return repo, nil
+}
+
+// configureGitlab applies the options to the repository backend.
+func configureGitlab(repo *Gitlab, opt *Options, message *template.Template) (err error) {
+	repo.maxChanges = opt.MaxChanges
+	repo.setCompactHistory(opt.CompactHistory)
+	repo.commitHistory = opt.CommitHistoryChanges
+	repo.historyKeep = opt.HistoryKeep
+	// The head is read before the history is read again, so a change in
+	// between makes the commit fail instead of being overwritten.
+	if opt.GitLastCommitID {
+		repo.lastCommitIDs = true
+		if err := repo.readHead(); err != nil {
+			return err
+		}
+	}
+	if opt.Instance != "" || repo.lockFile != "" || opt.GitLastCommitID {
+		if err := repo.setInstance(opt.Instance); err != nil {
+			return err
+		}
+	}
+	if opt.RepoTreeCache {
+		if err := repo.loadTree(); err != nil {
+			return err
+		}
+	}
+	repo.setHistoryFormat(opt.HistoryFormat)
+	repo.conflict = opt.Conflict
+	repo.repoClean = opt.RepoClean
+	repo.stagingFile = opt.StagingFile
+	repo.gzip = opt.Gzip
+	repo.pruneGrace = opt.PruneGrace
+	repo.archiveDeleted = opt.ArchiveDeleted
+	repo.authorName = opt.GitAuthorName
+	repo.authorEmail = opt.GitAuthorEmail
+	repo.signoff = opt.GitSignoff
+	repo.triggerUser = opt.TriggerUser
+	repo.message = message
+	if opt.GitFileMessage != "" {
+		if repo.fileMessage, err = parseFileMessage(opt.GitFileMessage); err != nil {
+			return err
+		}
+	}
+	if opt.GitTag != "" {
+		if repo.tag, err = parseTagTemplate(opt.GitTag); err != nil {
+			return err
+		}
+	}
+	repo.tagForce = opt.GitTagForce
+	repo.diff = opt.Diff
+	repo.commitMode = opt.GitCommitMode
+	repo.separateHistory = opt.SeparateHistory
+	repo.startSHA = opt.GitStartSHA
+	repo.force = opt.GitForce
+	if opt.GitTransport != TransportAPI {
+		if repo.push, err = newGitPush(repo, opt.GitTransport, opt.GitAuth, opt.GitToken); err != nil {
+			return err
+		}
+	}
+
+	if opt.Resume {
+		if err := repo.Resume(); err != nil {
+			return err
+		}
+	}
+	if opt.HistoryRebuild {
+		if err := repo.RebuildHistory(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run syncs the Grafana dashboards to the Git service as configured by opt.
+// A cancelled run returns an error without committing anything.
+func Run(ctx context.Context, opt Options) (*Result, error) {
+	if err := opt.setDefaults(); err != nil {
+		return nil, err
+	}
+
+	ignored, err := parseIgnoreList(opt.Ignore)
+	if err != nil {
+		return nil, err
+	}
+	ignored.skipTag = opt.SkipTag
+
+	only := make(map[string]bool)
+	for _, uid := range strings.Split(opt.Only, ",") {
+		if uid = strings.TrimSpace(uid); uid != "" {
+			only[uid] = true
+		}
+	}
+
+	fetchLimit, err := parseErrorLimit(opt.MaxFetchErrors)
+	if err != nil {
+		return nil, err
+	}
+
+	norm, err := loadNormalizer(opt.Normalize, opt.NormalizeFile)
+	if err != nil {
+		return nil, err
+	}
+
+	redact, err := loadRedactor(opt.Redact, opt.RedactFile)
+	if err != nil {
+		return nil, err
+	}
+
+	dsRewrite, err := loadDSRewriter(opt.DatasourceRewrite)
+	if err != nil {
+		return nil, err
+	}
+
+	paths, err := newPathTemplate(opt.PathTemplate)
+	if err != nil {
+		return nil, err
+	}
+
+	proxy, err := newProxyTransport(opt.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	transport := &userAgentTransport{userAgent: opt.UserAgent, next: proxy}
+
+	if opt.Mode == ModeCheck {
+		return &Result{Checks: runChecks(ctx, &opt, transport)}, nil
+	}
+	if opt.Mode == ModeHistoryDiff {
+		return runHistoryDiff(ctx, &opt, transport)
+	}
+
+	gf, err := NewGrafana(ctx, opt.GrafanaAPI, opt.GrafanaToken, opt.GrafanaUser, opt.GrafanaPassword, opt.GrafanaRPS, opt.grafanaTransport(transport))
+	if err != nil {
+		return nil, err
+	}
+	if err := gf.checkAccess(); err != nil {
+		return nil, err
+	}
+
+	if paths.usesFolderPath() {
+		paths.folderPath = gf.FolderPath
+	}
+
+	folders := parseFolderFilter(opt.Folders, opt.FoldersRecursive)
+	if folders != nil {
+		folders.parents = gf.FolderParents
+	}
+
+	if opt.Mode == ModeList {
+		dashboards, err := gf.Dashboards()
+		if err != nil {
+			return nil, fmt.Errorf("grafana: error listing dashboards: %w", err)
+		}
+		dashboards = uniqueDashboards(dashboards)
+		return &Result{Dashboards: len(dashboards), List: dashboards}, nil
+	}
+
+	var backend Backend
+	if opt.Mode == ModeExport {
+		backend = NewExport(opt.OutputDir, opt.Instance, opt.Gzip)
+	} else if backend, err = newBackend(ctx, &opt, transport); err != nil {
+		return nil, err
+	}
+	if l, ok := backend.(locker); ok {
+		defer func() {
+			if err := l.unlock(); err != nil {
+				log.Print(err)
+			}
+		}()
+	}
+
+	git := backend
+	if opt.SemanticDiff {
+		git = semanticBackend{backend}
+	}
+
+	dashboards, err := gf.Dashboards()
+	if err != nil {
+		return nil, fmt.Errorf("grafana: error listing dashboards: %w", err)
+	}
+
+	dashboards = uniqueDashboards(dashboards)
+	res := &Result{Dashboards: len(dashboards)}
+	paths.setDashboards(dashboards)
+
+	// Ignored dashboards are kept as they are, even if they were removed from
+	// Grafana.
+	for uid := range ignored.uids {
+		git.Keep(uid)
+	}
+
+	cancelled := func() error {
+		if ctx.Err() != nil {
+			return fmt.Errorf("run cancelled after fetching %d of %d dashboards, nothing was committed: %w", res.Fetched, res.Dashboards, ctx.Err())
+		}
+		return nil
+	}
+
+	// The inventory is tracked instead of the dashboards, so the files of a
+	// full backup in the same repository are kept.
+	if opt.Mode == ModeInventory {
+		var listed []gapi.FolderDashboardSearchResponse
+		for _, d := range dashboards {
+			if !ignored.match(d.UID, d.Title) && !ignored.tagged(d.Tags) && folders.match(d) {
+				listed = append(listed, d)
+			}
+		}
+
+		f, err := inventoryFile(listed, gf.LatestVersionInfo)
+		if err != nil {
+			return res, err
+		}
+		if err := cancelled(); err != nil {
+			return res, err
+		}
+
+		git.KeepPrefix("")
+		git.Add(f)
+		return commitRun(ctx, &opt, res, backend, git, opt.hookClient(transport))
+	}
+
+	var metrics *fetchMetrics
+	if opt.Verbose {
+		metrics = &fetchMetrics{}
+	}
+
+	// syncPermissions adds the permissions of the dashboard, if enabled.
+	syncPermissions := func(d gapi.FolderDashboardSearchResponse, key string) {
+		if !opt.IncludePermissions {
+			return
+		}
+
+		k := permissionsKey("dashboards", key)
+		p, err := gf.SortedDashboardPermissions(int64(d.ID))
+		if err != nil {
+			log.Printf("error getting permissions of dashboard %q with ID %d: %v", d.Title, d.ID, err)
+			git.Keep(k)
+			return
+		}
+		addPermissions(git, k, p)
+	}
+
+	// keep keeps the committed files of the dashboard.
+	keep := func(key string) {
+		git.Keep(key)
+		git.KeepPrefix(panelsKey(key))
+		git.Keep(permissionsKey("dashboards", key))
+		git.Keep(thumbnailKey(key))
+	}
+
+	// keepOnError logs the error of the step of the dashboard which failed
+	// and keeps its committed files, so it is not deleted as missing.
+	keepOnError := func(d gapi.FolderDashboardSearchResponse, key, step string, err error) {
+		log.Printf("error %s dashboard %q with ID %d, keeping it: %v", step, d.Title, d.ID, err)
+		keep(key)
+	}
+
+	if opt.Mode == ModeListOrphans {
+		for _, d := range dashboards {
+			keep(dashboardKey(d))
+		}
+		keepGenerated(&opt, git)
+
+		o, ok := backend.(orphaner)
+		if !ok {
+			return res, fmt.Errorf("mode %s is not supported by the backend", opt.Mode)
+		}
+		res.Orphans = o.orphans()
+		return res, nil
+	}
+
+	synced, _ := backend.(versioner)
+
+	// The metadata of all dashboards of a run has the same time.
+	syncedAt := time.Now().UTC().Truncate(time.Second)
+	grafanaURL, _ := url.Parse(opt.GrafanaAPI)
+
+	var refs *refChecker
+	if opt.CheckRefs {
+		ds, err := gf.DataSources()
+		if err != nil {
+			return res, fmt.Errorf("grafana: error listing data sources: %w", err)
+		}
+		refs = newRefChecker(ds, dashboards, opt.GrafanaAPI)
+	}
+
+	// The fast path looks up the latest versions of all synced dashboards
+	// at once.
+	var (
+		latest     map[string]int64
+		latestErrs map[string]error
+	)
+	if opt.Fast && opt.GrafanaVersion == 0 && synced != nil {
+		var uids []string
+		for _, d := range dashboards {
+			if d.UID != "" && (len(only) == 0 || only[d.UID]) && synced.syncedVersion(dashboardKey(d)) > 0 {
+				uids = append(uids, d.UID)
+			}
+		}
+		latest, latestErrs = gf.LatestVersions(uids)
+	}
+
+	var indexed []gapi.FolderDashboardSearchResponse
+	for _, d := range dashboards {
+		if err := cancelled(); err != nil {
+			return res, err
+		}
+
+		key := dashboardKey(d)
+		// Dashboards outside of the folders are kept like ignored ones, so
+		// they are not deleted.
+		ignore := ignored.match(d.UID, d.Title) || ignored.tagged(d.Tags) || !folders.match(d)
+		if !ignore {
+			indexed = append(indexed, d)
+		}
+		if ignore || (len(only) > 0 && !only[d.UID]) {
+			keep(key)
+			continue
+		}
+
+		if d.UID == "" {
+			log.Printf("warning dashboard %q with ID %d has no UID, using %q", d.Title, d.ID, key)
+		}
+
+		// The path is allocated before the dashboard is fetched, so the path
+		// of a kept dashboard is never given to another one.
+		p, err := paths.path(d, key)
+		if err != nil {
+			keepOnError(d, key, "building path of", err)
+			continue
+		}
+
+		// The fast path keeps dashboards whose latest version was already
+		// synced without fetching them.
+		if opt.Fast && opt.GrafanaVersion == 0 && synced != nil && d.UID != "" {
+			if v := synced.syncedVersion(key); v > 0 {
+				if err := latestErrs[d.UID]; err != nil {
+					log.Printf("warning cannot get version of dashboard %q with ID %d, fetching it: %v", d.Title, d.ID, err)
+				}
+				if l, ok := latest[d.UID]; ok && l == v {
+					git.Keep(key)
+					git.KeepPrefix(panelsKey(key))
+					git.Keep(thumbnailKey(key))
+					res.Unchanged++
+					syncPermissions(d, key)
+					continue
+				}
+			}
+		}
+
+		start := time.Now()
+		var b *gapi.Dashboard
+		if opt.GrafanaVersion > 0 {
+			b, err = gf.DashboardVersion(d.UID, opt.GrafanaVersion)
+		} else {
+			b, err = gf.Dashboard(d)
+		}
+		fetched := time.Since(start)
+		if err != nil {
+			log.Printf("error getting dashboard %q with ID %d, keeping it: %v", d.Title, d.ID, err)
+			res.FetchErrors++
+			keep(key)
+			continue
+		}
+
+		// An invalid dashboard is counted as fetch error, but the committed
+		// version is kept.
+		if opt.Validate {
+			if err := validateDashboard(b.Model); err != nil {
+				log.Printf("error validating dashboard %q with ID %d, skipping it: %v", d.Title, d.ID, err)
+				res.FetchErrors++
+				keep(key)
+				continue
+			}
+		}
+		res.Fetched++
+
+		if refs != nil {
+			for _, r := range refs.check(b.Model) {
+				log.Printf("warning dashboard %q with ID %d has a dangling reference: %s", d.Title, d.ID, r)
+				res.DanglingRefs = append(res.DanglingRefs, fmt.Sprintf("dashboard %q: %s", key, r))
+			}
+		}
+
+		var v interface{} = b
+		if opt.Provisioning {
+			v = provisioningEnvelope(d, b)
+		}
+
+		v, err = norm.apply(v)
+		if err != nil {
+			keepOnError(d, key, "normalizing", err)
+			continue
+		}
+
+		v, err = redact.apply(v)
+		if err != nil {
+			keepOnError(d, key, "redacting", err)
+			continue
+		}
+
+		v, err = dsRewrite.apply(v)
+		if err != nil {
+			keepOnError(d, key, "rewriting datasources of", err)
+			continue
+		}
+
+		f, err := newFile(key, p, v)
+		if err != nil {
+			keepOnError(d, key, "converting", err)
+			continue
+		}
+
+		f.Version = dashboardVersion(b)
+		f.withVersion = withVersion(v)
+		f.title, f.folder = d.Title, d.FolderTitle
+		if opt.InjectMeta {
+			m := fileMeta{SyncedAt: syncedAt, UID: d.UID}
+			if d.URL != "" && grafanaURL != nil {
+				m.GrafanaURL = dashboardURL(grafanaURL, d)
+			}
+			if err := injectMeta(f, v, m); err != nil {
+				keepOnError(d, key, "injecting metadata into", err)
+				continue
+			}
+		}
+		metrics.add(key, d.Title, fetched, len(f.content))
+		if opt.Explode {
+			files, err := explodeFiles(f, v)
+			if err != nil {
+				keepOnError(d, key, "exploding", err)
+				continue
+			}
+			for _, e := range files {
+				e.title, e.folder = f.title, f.folder
+				git.Add(e)
+			}
+		} else {
+			git.Add(f)
+		}
+
+		// The thumbnail is not JSON, so it bypasses the semantic hashing.
+		if opt.Thumbnails && d.UID != "" {
+			backend.Add(thumbnailFile(gf, d.UID, f.SHA256))
+		}
+
+		syncPermissions(d, key)
+	}
+
+	if err := cancelled(); err != nil {
+		return res, err
+	}
+
+	for _, l := range metrics.summary() {
+		log.Print(l)
+	}
+
+	if fetchLimit.exceeded(res.FetchErrors, res.Dashboards) {
+		return res, fmt.Errorf("grafana: %d of %d dashboards could not be fetched, exceeding the limit of %s, nothing was committed", res.FetchErrors, res.Dashboards, opt.MaxFetchErrors)
+	}
+
+	if opt.CheckRefsStrict && len(res.DanglingRefs) > 0 {
+		return res, fmt.Errorf("grafana: %d dangling references found, nothing was committed", len(res.DanglingRefs))
+	}
+
+	if opt.Index != "" {
+		f, err := indexFile(opt.Index, opt.GrafanaAPI, indexed)
+		if err != nil {
+			return res, err
+		}
+		// The index is not JSON, so it bypasses the semantic hashing.
+		backend.Add(f)
+	}
+
+	if opt.Layout == LayoutUID {
+		f, err := uidIndexFile(indexed)
+		if err != nil {
+			return res, err
+		}
+		git.Add(f)
+	}
+
+	if opt.Codeowners {
+		f, err := codeownersFile(indexed, opt.CodeownersTag, func(d gapi.FolderDashboardSearchResponse) (string, error) {
+			p, err := paths.path(d, dashboardKey(d))
+			switch {
+			case err != nil:
+				return "", err
+			case opt.Explode:
+				return strings.TrimSuffix(p, path.Ext(p)) + "/", nil
+			case opt.Gzip:
+				return p + ".gz", nil
+			}
+			return p, nil
+		})
+		if err != nil {
+			return res, err
+		}
+		// The CODEOWNERS file is not JSON, so it bypasses the semantic
+		// hashing.
+		backend.Add(f)
+	}
+
+	if opt.IncludePermissions {
+		folders, err := gf.Folders()
+		if err != nil {
+			return res, fmt.Errorf("grafana: error listing folders: %w", err)
+		}
+
+		for _, fo := range folders {
+			k := permissionsKey("folders", fo.UID)
+			p, err := gf.SortedFolderPermissions(fo.UID)
+			if err != nil {
+				log.Printf("error getting permissions of folder %q: %v", fo.Title, err)
+				git.Keep(k)
+				continue
+			}
+			addPermissions(git, k, p)
+		}
+	}
+
+	if opt.IncludeFolders {
+		folders, err := gf.FolderDefinitions()
+		if err != nil {
+			return res, fmt.Errorf("grafana: error listing folders: %w", err)
+		}
+
+		for _, fo := range folders {
+			f, err := newFile("folders/"+fo.UID, fmt.Sprintf("/folders/%s.json", fo.UID), fo)
+			if err != nil {
+				log.Printf("error converting folder %q: %v", fo.Title, err)
+				git.Keep("folders/" + fo.UID)
+				continue
+			}
+
+			git.Add(f)
+		}
+	}
+
+	if opt.IncludeLibraryPanels {
+		panels, err := gf.LibraryPanels()
+		if err != nil {
+			return res, fmt.Errorf("grafana: error listing library panels: %w", err)
+		}
+
+		for _, p := range panels {
+			uid, _ := p["uid"].(string)
+			name, _ := p["name"].(string)
+			if uid == "" {
+				log.Printf("warning library panel %q has no UID, skipping it", name)
+				continue
+			}
+
+			v, err := redact.apply(p)
+			if err != nil {
+				log.Printf("error redacting library panel %q: %v", name, err)
+				git.Keep("library-panels/" + uid)
+				continue
+			}
+			if v, err = dsRewrite.apply(v); err != nil {
+				log.Printf("error rewriting datasources of library panel %q: %v", name, err)
+				git.Keep("library-panels/" + uid)
+				continue
+			}
+
+			f, err := newFile("library-panels/"+uid, fmt.Sprintf("/library-panels/%s.json", uid), v)
+			if err != nil {
+				log.Printf("error converting library panel %q: %v", name, err)
+				git.Keep("library-panels/" + uid)
+				continue
+			}
+
+			git.Add(f)
+		}
+	}
+
+	if opt.IncludeSnapshots {
+		snapshots, err := gf.Snapshots()
+		if err != nil {
+			return res, fmt.Errorf("grafana: error listing snapshots: %w", err)
+		}
+
+		// Snapshots which are gone from Grafana are archived in the
+		// repository.
+		if opt.SnapshotsKeepExpired {
+			git.KeepPrefix("snapshots/")
+		}
+
+		for _, s := range snapshots {
+			k := "snapshots/" + s.Key
+			v, err := gf.Snapshot(s.Key)
+			if err != nil {
+				log.Printf("error getting snapshot %q: %v", s.Name, err)
+				git.Keep(k)
+				continue
+			}
+
+			r, err := redact.apply(v)
+			if err != nil {
+				log.Printf("error redacting snapshot %q: %v", s.Name, err)
+				git.Keep(k)
+				continue
+			}
+
+			f, err := newFile(k, fmt.Sprintf("/snapshots/%s.json", s.Key), r)
+			if err != nil {
+				log.Printf("error converting snapshot %q: %v", s.Name, err)
+				git.Keep(k)
+				continue
+			}
+
+			git.Add(f)
+		}
+	}
+
+	if opt.IncludePlaylists {
+		playlists, err := gf.Playlists()
+		if err != nil {
+			return res, fmt.Errorf("grafana: error listing playlists: %w", err)
+		}
+
+		for _, pl := range playlists {
+			k := "playlists/" + pl.Key()
+			v, err := gf.Playlist(pl.Key())
+			if err != nil {
+				log.Printf("error getting playlist %q: %v", pl.Name, err)
+				git.Keep(k)
+				continue
+			}
+
+			f, err := newFile(k, fmt.Sprintf("/playlists/%s.json", pl.Key()), v)
+			if err != nil {
+				log.Printf("error converting playlist %q: %v", pl.Name, err)
+				git.Keep(k)
+				continue
+			}
+
+			git.Add(f)
+		}
+	}
+
+	if opt.IncludeDataSources {
+		ds, err := gf.DataSources()
+		if err != nil {
+			return res, fmt.Errorf("grafana: error listing data sources: %w", err)
+		}
+
+		for _, d := range ds {
+			id := dataSourceID(d)
+			name, _ := d["name"].(string)
+			if id == "" {
+				log.Printf("warning data source %q has neither UID nor ID, skipping it", name)
+				continue
+			}
+
+			k := "datasources/" + id
+			f, err := newFile(k, dataSourcePath(name, id), d)
+			if err != nil {
+				log.Printf("error converting data source %q: %v", name, err)
+				git.Keep(k)
+				continue
+			}
+
+			git.Add(f)
+		}
+	}
+
+	if err := cancelled(); err != nil {
+		return res, err
+	}
+
+	return commitRun(ctx, &opt, res, backend, git, opt.hookClient(transport))
+}
+
+// commitRun commits the pending changes of git, which is backend or wraps
+// it, and reports them in res. In ModeVerify nothing is committed.
+func commitRun(ctx context.Context, opt *Options, res *Result, backend, git Backend, client *http.Client) (*Result, error) {
+	// The heartbeat is not a change of the dashboards, so it is not part of
+	// the drift.
+	git.Keep(heartbeatKey)
+
+	res.Drift = git.Drift()
+	if d, ok := backend.(differ); ok {
+		res.Diffs = d.Diffs()
+	}
+	if opt.Mode == ModeVerify {
+		return res, nil
+	}
+
+	// The heartbeat is not JSON, so it bypasses the semantic hashing.
+	empty := opt.CommitEmpty && len(res.Drift) == 0
+	if opt.Heartbeat || empty {
+		backend.Add(heartbeatFile(time.Now()))
+	}
+
+	if err := git.Commit(); err != nil {
+		return res, err
+	}
+	// The heartbeat is not part of the drift, so a backend creating commits
+	// reports whether it created one.
+	res.Committed = len(res.Drift) > 0 || empty || opt.Heartbeat
+	if c, ok := backend.(committer); ok {
+		res.Committed = c.lastCommit() != nil
+	}
+
+	if c, ok := backend.(committer); ok && c.lastCommit() != nil {
+		res.CommitID = c.lastCommit().ID
+		res.CommitURL = c.lastCommit().WebURL
+	}
+	summary := res.summary()
+
+	if res.Committed && opt.PostCommit != "" {
+		if err := runPostCommit(ctx, client, opt.PostCommit, summary); err != nil {
+			if opt.PostCommitRequired {
+				return res, err
+			}
+			log.Printf("warning %v", err)
+		}
+	}
+
+	if opt.NotifyWebhook != "" && (res.Committed || opt.NotifyAlways) {
+		if err := notify(ctx, client, opt.NotifyWebhook, summary); err != nil {
+			log.Printf("warning %v", err)
+		}
+	}
+
+	return res, nil
+}
+
+// committer is implemented by backends which create a commit.
+type committer interface {
+	// lastCommit returns the created commit or nil.
+	lastCommit() *gitlab.Commit
+}
+
+// versioner is implemented by backends which record the dashboard versions
+// in their history.
+type versioner interface {
+	// syncedVersion returns the version of the file with the given key or
+	// zero if it is unknown.
+	syncedVersion(key string) int64
+}
+
+// differ is implemented by backends which record the diffs of modified
+// files.
+type differ interface {
+	Diffs() []string
+}
+
+// Backend is a target to which the files are synced.
+type Backend interface {
+	// Add adds the file to be committed.
+	Add(f *File)
+
+	// Keep marks the file with the given UID to be left untouched.
+	Keep(uid string)
+
+	// KeepPrefix marks all files whose UID starts with prefix to be left
+	// untouched.
+	KeepPrefix(prefix string)
+
+	// Drift returns the pending actions without committing them.
+	Drift() []*gitlab.CommitActionOptions
+
+	// Commit commits all pending actions.
+	Commit() error
+}
+
+// errorLimit is the maximum number of errors, either absolute or as a
+// percentage of the total.
+type errorLimit struct {
+	n       float64
+	percent bool
+}
+
+// parseErrorLimit parses a limit like "5" or "10%". An empty string returns
+// nil, which is unlimited.
+func parseErrorLimit(s string) (*errorLimit, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	l := &errorLimit{}
+	v := strings.TrimSpace(s)
+	if strings.HasSuffix(v, "%") {
+		l.percent = true
+		v = strings.TrimSuffix(v, "%")
+	}
+
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 || (l.percent && n > 100) {
+		return nil, fmt.Errorf("invalid error limit %q", s)
+	}
+	l.n = n
+
+	return l, nil
+}
+
+// exceeded reports whether errs of total exceed the limit.
+func (l *errorLimit) exceeded(errs, total int) bool {
+	if l == nil {
+		return false
+	}
+	if l.percent {
+		return total > 0 && float64(errs)*100/float64(total) > l.n
+	}
+	return float64(errs) > l.n
+}
+
+func hash(data []byte) string {
+	h := sha256.New()
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// uniqueDashboards returns the dashboards without repeated UIDs, which
+// Grafana may return for provisioned dashboards. The duplicates are logged.
+func uniqueDashboards(dashboards []gapi.FolderDashboardSearchResponse) []gapi.FolderDashboardSearchResponse {
+	seen := make(map[string]bool)
+	var dup []string
+	unique := dashboards[:0:0]
+	for _, d := range dashboards {
+		if d.UID != "" && seen[d.UID] {
+			dup = append(dup, d.UID)
+			continue
+		}
+		seen[d.UID] = true
+		unique = append(unique, d)
+	}
+
+	if len(dup) > 0 {
+		log.Printf("warning Grafana returned duplicate dashboard UIDs, syncing them once: %s", strings.Join(dup, ", "))
+	}
+	return unique
+}
+
+// dashboardKey returns the history key of the dashboard, which is its UID.
+// Some imported dashboards have no UID, in which case a stable key is derived
+// from the folder and title.
+func dashboardKey(d gapi.FolderDashboardSearchResponse) string {
+	if d.UID != "" {
+		return d.UID
+	}
+	return fmt.Sprintf("title:%s/%s", d.FolderTitle, d.Title)
+}
+
+// dashboardVersion returns the version of the dashboard, which Grafana
+// increments on every save, or zero if it has none.
+func dashboardVersion(d *gapi.Dashboard) int64 {
+	v, _ := d.Model["version"].(float64)
+	return int64(v)
+}
+
+// withVersion returns a function returning the content of the dashboard file
+// encoded from v, a dashboard or its provisioning envelope, with the version
+// set to the given one. It fails if the dashboard has no version, e.g. since
+// it was removed by the normalization.
+func withVersion(v interface{}) func(version int64) ([]byte, error) {
+	return func(version int64) ([]byte, error) {
+		c, err := genericJSON(v)
+		if err != nil {
+			return nil, err
+		}
+		obj, _ := c.(map[string]interface{})
+		m, _ := obj["dashboard"].(map[string]interface{})
+		if _, ok := m["version"]; !ok {
+			return nil, errors.New("dashboard has no version")
+		}
+		m["version"] = version
+		return fileJSON(c)
+	}
+}
+
+// provisioningEnvelope returns the dashboard in the envelope expected by
+// provisioning and apply tools.
+func provisioningEnvelope(d gapi.FolderDashboardSearchResponse, b *gapi.Dashboard) map[string]interface{} {
+	return map[string]interface{}{
+		"dashboard": b.Model,
+		"folderUid": d.FolderUID,
+		"overwrite": true,
+	}
+}
+
+// thumbnailKey returns the history key of the thumbnail of the dashboard with
+// the given key.
+func thumbnailKey(key string) string {
+	return "thumbnails/" + key
+}
+
+// thumbnailFile returns the thumbnail of the dashboard with the given UID.
+// Its hash is the hash of the dashboard, so it is only rendered if the
+// dashboard changed. The image is rendered once, even if it is committed to
+// several projects.
+func thumbnailFile(gf *Grafana, uid, dashboardHash string) *File {
+	var (
+		data []byte
+		err  error
+		done bool
+	)
+	return &File{
+		UID:         thumbnailKey(uid),
+		Path:        fmt.Sprintf("/thumbnails/%s.png", uid),
+		SHA256:      dashboardHash,
+		contentType: contentTypePNG,
+		load: func() ([]byte, error) {
+			if !done {
+				data, err = gf.RenderDashboard(uid)
+				done = true
+			}
+			return data, err
+		},
+	}
+}
+
+// permissionsKey returns the history key of the permissions of the dashboard
+// or folder with the given UID. The key is also used as path.
+func permissionsKey(kind, uid string) string {
+	return fmt.Sprintf("permissions/%s/%s", kind, uid)
+}
+
+// dataSourceID returns the UID of the data source or, if it has none, its
+// numeric ID, which identifies its file.
+func dataSourceID(d map[string]interface{}) string {
+	if uid, _ := d["uid"].(string); uid != "" {
+		return uid
+	}
+	if id, ok := d["id"].(float64); ok && id > 0 {
+		return strconv.FormatInt(int64(id), 10)
+	}
+	return ""
+}
+
+// dataSourcePath returns the path of the file of the data source with the
+// given name and ID. The name is sanitized, so it does not create
+// directories, and the ID keeps data sources with the same name apart.
+func dataSourcePath(name, id string) string {
+	name = strings.TrimSpace(pathSegment(name))
+	if name == "" {
+		return fmt.Sprintf("/datasources/%s.json", id)
+	}
+	return fmt.Sprintf("/datasources/%s-%s.json", name, id)
+}
+
+// addPermissions adds the permissions with the given history key.
+func addPermissions(git Backend, key string, p interface{}) {
+	f, err := newFile(key, "/"+key+".json", p)
+	if err != nil {
+		log.Printf("error converting %q: %v", key, err)
+		git.Keep(key)
+		return
+	}
+	git.Add(f)
+}
+
+// newFile returns a new file for the given history key and path with v
+// converted to JSON as its content.
+func newFile(uid, path string, v interface{}) (*File, error) {
+	data, err := fileJSON(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return &File{
+		UID:         uid,
+		Path:        path,
+		SHA256:      hash(data),
+		content:     data,
+		contentType: contentTypeJSON,
+	}, nil
+}
+
+// fileJSON returns the indented JSON encoding of v with the keys of all
+// objects sorted recursively and all numbers in canonical form, so the same
+// logical value always results in the same output and hash, even if Grafana
+// formats its numbers differently.
+func fileJSON(v interface{}) ([]byte, error) {
+	c, err := genericJSON(v)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(canonicalNumbers(c), "", "	")
+}
+
+// canonicalNumbers returns the generic JSON value v with all numbers in the
+// form Go encodes a float64, e.g. 80 for both 80 and 80.0, since Grafana
+// formats the same number differently. Integers are kept as they are, so
+// large IDs do not lose precision.
+func canonicalNumbers(v interface{}) interface{} {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for k, e := range x {
+			x[k] = canonicalNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range x {
+			x[i] = canonicalNumbers(e)
+		}
+	case json.Number:
+		if !strings.ContainsAny(x.String(), ".eE") {
+			return x
+		}
+		f, err := x.Float64()
+		if err != nil {
+			return x
+		}
+		b, err := json.Marshal(f)
+		if err != nil {
+			return x
+		}
+		return json.Number(b)
+	}
+	return v
+}
+
+// File is a synced file. Its history key is UID, which for dashboards is the
+// dashboard UID. The SHA256 hash of the content is used to detect changes.
+type File struct {
+	UID    string `json:"uid"`
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+
+	// Version is the Grafana version of the dashboard when it was synced.
+	Version int64 `json:"version,omitempty"`
+
+	// MissingSince is the time the file was first found missing in Grafana,
+	// if it is within the prune grace period.
+	MissingSince *time.Time `json:"missingSince,omitempty"`
+
+	content   []byte
+	processed bool
+
+	// title and folder are the title and the folder title of the dashboard
+	// of the file, if any.
+	title  string
+	folder string
+
+	// meta is set if metadata was injected into the content, which is not
+	// part of the hash.
+	meta bool
+
+	// withVersion returns the content of a dashboard file with the given
+	// version, so a file whose only change is the version Grafana bumps on
+	// every save is not modified. It is nil for other files.
+	withVersion func(version int64) ([]byte, error)
+
+	// semantic is set if the hash is the semantic hash of the content.
+	semantic bool
+
+	// load returns the content if it is nil. It is only called if the file
+	// must be committed, so expensive content like rendered images is only
+	// created if needed. The hash of such files is the hash of their source.
+	load func() ([]byte, error)
+
+	// contentType is the media type of the content. Files which are
+	// neither JSON nor text are committed base64 encoded. Empty is JSON.
+	contentType string
+}
+
+// Content types of the synced files.
+const (
+	contentTypeJSON     = "application/json"
+	contentTypeMarkdown = "text/markdown"
+	contentTypeText     = "text/plain"
+	contentTypeGzip     = "application/gzip"
+	contentTypePNG      = "image/png"
+)
+
+// binary reports whether the content is not text and must be committed
+// base64 encoded.
+func (f *File) binary() bool {
+	ct := f.contentType
+	return ct != "" && ct != contentTypeJSON && !strings.HasPrefix(ct, "text/")
+}
+
+// compressed returns a copy of the file with gzip compressed content and the
+// ".gz" extension. The hash is kept, since it is computed on the uncompressed
+// content.
+func (f *File) compressed() (*File, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(f.content); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	c := *f
+	c.Path += ".gz"
+	c.content = buf.Bytes()
+	c.contentType = contentTypeGzip
+	return &c, nil
+}
+
+// pruneDue reports whether the missing file should be deleted given the grace
+// period. The first time the file is found missing the time is recorded.
+func (f *File) pruneDue(now time.Time, grace time.Duration) bool {
+	if grace <= 0 {
+		return true
+	}
+
+	if f.MissingSince == nil {
+		f.MissingSince = &now
+		return false
+	}
+
+	return now.Sub(*f.MissingSince) >= grace
+}
+
+// logVersion logs the version transition of a dashboard changed in Grafana
+// since it was synced as hf.
+func (f *File) logVersion(hf *File) {
+	if f.Version == 0 || hf.Version == 0 || f.Version == hf.Version {
+		return
+	}
+	log.Printf("dashboard %q changed in Grafana from version %d to %d", f.UID, hf.Version, f.Version)
+}
+
+// moved reports whether the file was moved since it was synced as hf. Its
+// content may have changed too, in which case the move action carries the
+// new content, so the move and the modification are committed and recorded
+// in the history at once.
+func (f *File) moved(hf *File) bool {
+	return (f.Path != hf.Path) && (f.UID == hf.UID)
+}
+
+// modified reports whether the content of the file changed since it was
+// synced as hf. A dashboard whose only change is its version is not
+// modified.
+func (f *File) modified(hf *File) bool {
+	return (f.Path == hf.Path) && (f.UID == hf.UID) && (f.SHA256 != hf.SHA256) && !f.versionChanged(hf)
+}
+
+// versionChanged reports whether the file differs from hf only in the
+// dashboard version, i.e. whether the file with the synced version has the
+// synced hash.
+func (f *File) versionChanged(hf *File) bool {
+	if f.withVersion == nil || f.Version == 0 || hf.Version == 0 || f.Version == hf.Version {
+		return false
+	}
+
+	data, err := f.withVersion(hf.Version)
+	if err != nil {
+		return false
+	}
+	h := hash(data)
+	if f.semantic {
+		if h, err = semanticHash(data); err != nil {
+			return false
+		}
+	}
+	return h == hf.SHA256
+}
@@ -0,0 +1,1037 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	gapi "github.com/grafana/grafana-api-golang-client"
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestFileJSON(t *testing.T) {
+	a := json.RawMessage(`{"title":"go","panels":[{"id":1,"type":"graph"}],"meta":{"b":2,"a":1}}`)
+	b := json.RawMessage(`{"meta":{"a":1,"b":2},"panels":[{"type":"graph","id":1}],"title":"go"}`)
+
+	ca, err := fileJSON(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cb, err := fileJSON(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(ca) != string(cb) {
+		t.Fatalf("want identical output, got:\n%s\n%s", ca, cb)
+	}
+
+	if hash(ca) != hash(cb) {
+		t.Fatal("want identical hashes")
+	}
+}
+
+func TestFileJSONNumbers(t *testing.T) {
+	a := json.RawMessage(`{"thresholds":[80,0.5,1e3],"id":9007199254740993}`)
+	b := json.RawMessage(`{"thresholds":[80.0,0.50,1000.0],"id":9007199254740993}`)
+
+	ca, err := fileJSON(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cb, err := fileJSON(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(ca) != string(cb) || hash(ca) != hash(cb) {
+		t.Fatalf("want identical output, got:\n%s\n%s", ca, cb)
+	}
+
+	if !strings.Contains(string(ca), "9007199254740993") {
+		t.Fatalf("expected integers to be kept, got:\n%s", ca)
+	}
+}
+
+func TestDashboardKeyEmptyUID(t *testing.T) {
+	git, _ := MustGitlab(t, http.NotFound)
+
+	for _, d := range []gapi.FolderDashboardSearchResponse{
+		{Title: "A", FolderTitle: "Imported"},
+		{Title: "B", FolderTitle: "Imported"},
+	} {
+		git.Add(&File{
+			UID:    dashboardKey(d),
+			Path:   fmt.Sprintf("/%s/%s.json", d.FolderTitle, d.Title),
+			SHA256: "12345",
+		})
+	}
+
+	if len(git.history) != 2 {
+		t.Fatalf("expected both dashboards in history, got %d", len(git.history))
+	}
+
+	if len(git.actions) != 2 {
+		t.Fatalf("expected two actions, got %d", len(git.actions))
+	}
+}
+
+func TestDashboardVersion(t *testing.T) {
+	git, _ := MustGitlab(t, MustHistoryHandler(t, `{"go1":{"uid":"go1","path":"/dev/null.json","sha256":"12345","version":3}}`))
+
+	var d gapi.Dashboard
+	if err := json.Unmarshal([]byte(`{"dashboard":{"uid":"go1","version":5}}`), &d); err != nil {
+		t.Fatal(err)
+	}
+
+	if want, got := int64(5), dashboardVersion(&d); want != got {
+		t.Fatalf("want version %d, got %d", want, got)
+	}
+
+	git.Add(&File{
+		UID:     "go1",
+		Path:    "/dev/null.json",
+		SHA256:  "67890",
+		Version: dashboardVersion(&d),
+	})
+
+	if want, got := int64(5), git.history["go1"].Version; want != got {
+		t.Fatalf("want version %d in history, got %d", want, got)
+	}
+}
+
+func TestFileVersionChanged(t *testing.T) {
+	file := func(title string, version int64) *File {
+		v := &gapi.Dashboard{Model: map[string]interface{}{"uid": "go1", "title": title, "version": float64(version)}}
+		f, err := newFile("go1", "/go1.json", v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Version = version
+		f.withVersion = withVersion(v)
+		return f
+	}
+
+	synced := file("Overview", 1)
+	if f := file("Overview", 2); f.modified(synced) {
+		t.Fatal("expected a version bump not to modify the file")
+	}
+	if f := file("Changed", 2); !f.modified(synced) {
+		t.Fatal("expected a changed title to modify the file")
+	}
+}
+
+func TestDataSourcePath(t *testing.T) {
+	for _, tc := range []struct {
+		ds   map[string]interface{}
+		want string
+	}{
+		{map[string]interface{}{"uid": "ds1", "id": 1.0, "name": "influx"}, "/datasources/influx-ds1.json"},
+		{map[string]interface{}{"id": 5.0, "name": "prod/influx"}, "/datasources/prod-influx-5.json"},
+		{map[string]interface{}{"uid": "ds2", "name": " "}, "/datasources/ds2.json"},
+	} {
+		if got := dataSourcePath(tc.ds["name"].(string), dataSourceID(tc.ds)); got != tc.want {
+			t.Errorf("want %q, got %q", tc.want, got)
+		}
+	}
+
+	if id := dataSourceID(map[string]interface{}{"name": "x"}); id != "" {
+		t.Fatalf("expected no ID, got %q", id)
+	}
+}
+
+func TestProvisioningEnvelope(t *testing.T) {
+	d := gapi.FolderDashboardSearchResponse{UID: "go1", FolderUID: "ops"}
+	b := &gapi.Dashboard{
+		Model: map[string]interface{}{"uid": "go1", "title": "Overview"},
+		Meta:  gapi.DashboardMeta{Slug: "overview"},
+	}
+
+	f, err := newFile("go1", "/ops/Overview.json", provisioningEnvelope(d, b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "{\n\t\"dashboard\": {\n\t\t\"title\": \"Overview\",\n\t\t\"uid\": \"go1\"\n\t},\n\t\"folderUid\": \"ops\",\n\t\"overwrite\": true\n}"
+	if got := string(f.content); got != want {
+		t.Fatalf("want:\n%s\ngot:\n%s", want, got)
+	}
+
+	if f.SHA256 != hash([]byte(want)) {
+		t.Fatal("expected the hash of the wrapped content")
+	}
+}
+
+func TestRunVerify(t *testing.T) {
+	server, _ := MustRunServer(t)
+
+	res, err := Run(context.Background(), Options{
+		GrafanaAPI:   server.URL,
+		GrafanaToken: "token",
+		GitAPI:       server.URL,
+		GitToken:     "token",
+		GitPIDs:      []int{1},
+		Mode:         ModeVerify,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Dashboards != 1 || res.Fetched != 1 {
+		t.Fatalf("want 1 dashboard fetched, got %d of %d", res.Fetched, res.Dashboards)
+	}
+
+	if len(res.Drift) != 1 || *res.Drift[0].Action != gitlab.FileCreate || *res.Drift[0].FilePath != "/Ops/Overview.json" {
+		t.Fatalf("unexpected drift %v", res.Drift)
+	}
+}
+
+func TestRunSync(t *testing.T) {
+	server, mux := MustRunServer(t)
+
+	committed := false
+	mux.HandleFunc("/api/v4/projects/1/repository/commits", func(w http.ResponseWriter, r *http.Request) {
+		committed = true
+		w.Write([]byte(`{"id":"abc123","web_url":"https://gitlab.example.com/commit/abc123"}`))
+	})
+
+	res, err := Run(context.Background(), Options{
+		GrafanaAPI:   server.URL,
+		GrafanaToken: "token",
+		GitAPI:       server.URL,
+		GitToken:     "token",
+		GitPIDs:      []int{1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !committed {
+		t.Fatal("expected a commit")
+	}
+
+	if len(res.Drift) != 1 {
+		t.Fatalf("expected the committed drift, got %v", res.Drift)
+	}
+
+	if res.CommitID != "abc123" || res.CommitURL != "https://gitlab.example.com/commit/abc123" {
+		t.Fatalf("unexpected commit %q %q", res.CommitID, res.CommitURL)
+	}
+}
+
+func TestRunList(t *testing.T) {
+	server, _ := MustRunServer(t)
+
+	// The Git service is not needed.
+	res, err := Run(context.Background(), Options{
+		GrafanaAPI:   server.URL,
+		GrafanaToken: "token",
+		Mode:         ModeList,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.List) != 1 || res.List[0].UID != "go1" || res.List[0].FolderTitle != "Ops" {
+		t.Fatalf("unexpected list %+v", res.List)
+	}
+}
+
+func TestRunVersion(t *testing.T) {
+	server, mux := MustRunServer(t)
+	mux.HandleFunc("/api/dashboards/uid/go1/versions/2", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":12,"version":2,"data":{"uid":"go1","title":"Overview","version":2}}`))
+	})
+
+	var opt gitlab.CreateCommitOptions
+	mux.HandleFunc("/api/v4/projects/1/repository/commits", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&opt)
+		w.Write([]byte(`{}`))
+	})
+
+	_, err := Run(context.Background(), Options{
+		GrafanaAPI:     server.URL,
+		GrafanaToken:   "token",
+		GitAPI:         server.URL,
+		GitToken:       "token",
+		GitPIDs:        []int{1},
+		Only:           "go1",
+		GrafanaVersion: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(opt.Actions) != 2 {
+		t.Fatalf("expected the dashboard and the history to be committed, got %d actions", len(opt.Actions))
+	}
+
+	h, err := decodeHistory([]byte(*opt.Actions[1].Content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := int64(2), h["go1"].Version; want != got {
+		t.Fatalf("want version %d in history, got %d", want, got)
+	}
+}
+
+func TestErrorLimit(t *testing.T) {
+	testCases := []struct {
+		limit       string
+		errs, total int
+		want        bool
+	}{
+		{"", 100, 100, false},
+		{"0", 0, 10, false},
+		{"0", 1, 10, true},
+		{"2", 2, 10, false},
+		{"2", 3, 10, true},
+		{"50%", 5, 10, false},
+		{"50%", 6, 10, true},
+		{"10%", 0, 0, false},
+	}
+
+	for _, tc := range testCases {
+		l, err := parseErrorLimit(tc.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := l.exceeded(tc.errs, tc.total); tc.want != got {
+			t.Errorf("%q with %d of %d: want %t, got %t", tc.limit, tc.errs, tc.total, tc.want, got)
+		}
+	}
+
+	for _, s := range []string{"a", "-1", "101%", "%"} {
+		if _, err := parseErrorLimit(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestRunMaxFetchErrors(t *testing.T) {
+	_, mux := MustRunServer(t)
+
+	// The dashboard cannot be fetched.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/dashboards/uid/go1" {
+			http.Error(w, `{"message":"bad request"}`, http.StatusBadRequest)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	committed := false
+	mux.HandleFunc("/api/v4/projects/1/repository/commits", func(w http.ResponseWriter, r *http.Request) {
+		committed = true
+		w.Write([]byte(`{}`))
+	})
+
+	opt := Options{
+		GrafanaAPI:     server.URL,
+		GrafanaToken:   "token",
+		GitAPI:         server.URL,
+		GitToken:       "token",
+		GitPIDs:        []int{1},
+		MaxFetchErrors: "50%",
+	}
+
+	res, err := Run(context.Background(), opt)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if committed {
+		t.Fatal("expected no commit")
+	}
+	if res.FetchErrors != 1 {
+		t.Fatalf("want 1 fetch error, got %d", res.FetchErrors)
+	}
+
+	// Without a limit the run continues.
+	opt.MaxFetchErrors = ""
+	if _, err := Run(context.Background(), opt); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunUserAgent(t *testing.T) {
+	_, mux := MustRunServer(t)
+
+	agents := make(map[string]bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		agents[r.UserAgent()] = true
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	opt := Options{
+		GrafanaAPI:   server.URL,
+		GrafanaToken: "token",
+		GitAPI:       server.URL,
+		GitToken:     "token",
+		GitPIDs:      []int{1},
+		Mode:         ModeVerify,
+	}
+
+	testCases := map[string]string{
+		"":           "gfdashsync/" + Version,
+		"backup/1.0": "backup/1.0",
+	}
+
+	for userAgent, want := range testCases {
+		opt.UserAgent = userAgent
+		agents = make(map[string]bool)
+
+		if _, err := Run(context.Background(), opt); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(agents) != 1 || !agents[want] {
+			t.Fatalf("want all requests with user agent %q, got %v", want, agents)
+		}
+	}
+}
+
+func TestRunSnapshots(t *testing.T) {
+	server, mux := MustRunServer(t)
+	mux.HandleFunc("/api/dashboard/snapshots", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"key":"abc","name":"Incident"}]`))
+	})
+	mux.HandleFunc("/api/snapshots/abc", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"dashboard":{"title":"Incident"},"meta":{"isSnapshot":true}}`))
+	})
+
+	res, err := Run(context.Background(), Options{
+		GrafanaAPI:       server.URL,
+		GrafanaToken:     "token",
+		GitAPI:           server.URL,
+		GitToken:         "token",
+		GitPIDs:          []int{1},
+		Mode:             ModeVerify,
+		IncludeSnapshots: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found bool
+	for _, a := range res.Drift {
+		found = found || *a.FilePath == "/snapshots/abc.json"
+	}
+	if !found {
+		t.Fatalf("expected the snapshot to be created, got %v", res.Drift)
+	}
+}
+
+func TestRunGrafanaTimeout(t *testing.T) {
+	_, mux := MustRunServer(t)
+	mux.HandleFunc("/api/v4/projects/1/repository/files/history.json", MustHistoryHandler(t, `{"go1":{"uid":"go1","path":"/Ops/Overview.json","sha256":"abc"}}`))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api/dashboards/uid/go1" {
+			<-r.Context().Done()
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	res, err := Run(context.Background(), Options{
+		GrafanaAPI:     server.URL,
+		GrafanaToken:   "token",
+		GrafanaTimeout: 50 * time.Millisecond,
+		GitAPI:         server.URL,
+		GitToken:       "token",
+		GitPIDs:        []int{1},
+		Mode:           ModeVerify,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.FetchErrors != 1 || len(res.Drift) != 0 {
+		t.Fatalf("expected the hung dashboard to be skipped and kept, got %d errors and drift %v", res.FetchErrors, res.Drift)
+	}
+}
+
+func TestRunPlaylists(t *testing.T) {
+	server, mux := MustRunServer(t)
+	mux.HandleFunc("/api/playlists", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id":1,"uid":"pl1","name":"Wall"}]`))
+	})
+	mux.HandleFunc("/api/playlists/pl1", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"uid":"pl1","name":"Wall","interval":"5m","items":[]}`))
+	})
+
+	res, err := Run(context.Background(), Options{
+		GrafanaAPI:       server.URL,
+		GrafanaToken:     "token",
+		GitAPI:           server.URL,
+		GitToken:         "token",
+		GitPIDs:          []int{1},
+		Mode:             ModeVerify,
+		IncludePlaylists: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var found bool
+	for _, a := range res.Drift {
+		found = found || *a.FilePath == "/playlists/pl1.json"
+	}
+	if !found {
+		t.Fatalf("expected the playlist to be created, got %v", res.Drift)
+	}
+}
+
+func TestRunDuplicateUIDs(t *testing.T) {
+	_, mux := MustRunServer(t)
+
+	fetched := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/search":
+			w.Write([]byte(`[{"uid":"go1","title":"Overview","folderTitle":"Ops"},{"uid":"go1","title":"Overview","folderTitle":"Ops"}]`))
+			return
+		case "/api/dashboards/uid/go1":
+			fetched++
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	res, err := Run(context.Background(), Options{
+		GrafanaAPI:   server.URL,
+		GrafanaToken: "token",
+		GitAPI:       server.URL,
+		GitToken:     "token",
+		GitPIDs:      []int{1},
+		Mode:         ModeVerify,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fetched != 1 || res.Dashboards != 1 {
+		t.Fatalf("expected the dashboard to be fetched once, got %d fetches of %d dashboards", fetched, res.Dashboards)
+	}
+	if len(res.Drift) != 1 {
+		t.Fatalf("expected a single action, got %d", len(res.Drift))
+	}
+}
+
+func TestRunThumbnails(t *testing.T) {
+	server, mux := MustRunServer(t)
+	mux.HandleFunc("/render/d/go1", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("\x89PNG\r\n\x1a\n\x00"))
+	})
+
+	res, err := Run(context.Background(), Options{
+		GrafanaAPI:   server.URL,
+		GrafanaToken: "token",
+		GitAPI:       server.URL,
+		GitToken:     "token",
+		GitPIDs:      []int{1},
+		Mode:         ModeVerify,
+		Thumbnails:   true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.Drift) != 2 {
+		t.Fatalf("expected the dashboard and its thumbnail, got %d actions", len(res.Drift))
+	}
+	a := res.Drift[1]
+	if *a.FilePath != "/thumbnails/go1.png" || a.Encoding == nil || *a.Encoding != "base64" {
+		t.Fatalf("expected the base64 encoded thumbnail, got %s", *a.FilePath)
+	}
+}
+
+func TestRunFast(t *testing.T) {
+	_, mux := MustRunServer(t)
+	history := MustHistoryHandler(t, `{"go1":{"uid":"go1","path":"/Ops/Overview.json","sha256":"12345","version":3}}`)
+
+	fetched := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v4/projects/1/repository/files/history.json":
+			history(w, r)
+			return
+		case "/api/dashboards/uid/go1/versions":
+			w.Write([]byte(`[{"id":13,"version":3}]`))
+			return
+		case "/api/dashboards/uid/go1":
+			fetched++
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	res, err := Run(context.Background(), Options{
+		GrafanaAPI:   server.URL,
+		GrafanaToken: "token",
+		GitAPI:       server.URL,
+		GitToken:     "token",
+		GitPIDs:      []int{1},
+		Mode:         ModeVerify,
+		Fast:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fetched != 0 || res.Unchanged != 1 {
+		t.Fatalf("expected the synced dashboard not to be fetched, got %d fetches", fetched)
+	}
+	if len(res.Drift) != 0 {
+		t.Fatalf("expected the dashboard to be kept, got %d changes", len(res.Drift))
+	}
+}
+
+func TestRunFastPath(t *testing.T) {
+	_, mux := MustRunServer(t)
+	history := MustHistoryHandler(t, `{"go1":{"uid":"go1","path":"/Ops/Overview.json","sha256":"12345","version":3}}`)
+
+	// A new dashboard has the title and folder of the kept one.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/search":
+			w.Write([]byte(`[{"uid":"go1","title":"Overview","folderTitle":"Ops"},{"uid":"go9","title":"Overview","folderTitle":"Ops"}]`))
+			return
+		case "/api/v4/projects/1/repository/files/history.json":
+			history(w, r)
+			return
+		case "/api/dashboards/uid/go1/versions":
+			w.Write([]byte(`[{"id":13,"version":3}]`))
+			return
+		case "/api/dashboards/uid/go9":
+			w.Write([]byte(`{"dashboard":{"uid":"go9","title":"Overview"}}`))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	res, err := Run(context.Background(), Options{
+		GrafanaAPI:   server.URL,
+		GrafanaToken: "token",
+		GitAPI:       server.URL,
+		GitToken:     "token",
+		GitPIDs:      []int{1},
+		Mode:         ModeVerify,
+		Fast:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.Drift) != 1 || *res.Drift[0].FilePath == "/Ops/Overview.json" {
+		t.Fatalf("expected the new dashboard to get its own path, got %v", res.Drift)
+	}
+}
+
+func TestRunValidate(t *testing.T) {
+	// The dashboard of the server has no panels.
+	server, _ := MustRunServer(t)
+
+	res, err := Run(context.Background(), Options{
+		GrafanaAPI:   server.URL,
+		GrafanaToken: "token",
+		GitAPI:       server.URL,
+		GitToken:     "token",
+		GitPIDs:      []int{1},
+		Mode:         ModeVerify,
+		Validate:     true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.FetchErrors != 1 || res.Fetched != 0 {
+		t.Fatalf("expected the invalid dashboard to be counted as fetch error, got %d errors", res.FetchErrors)
+	}
+	if len(res.Drift) != 0 {
+		t.Fatalf("expected the invalid dashboard to be skipped, got %d changes", len(res.Drift))
+	}
+}
+
+func TestRunCheckRefs(t *testing.T) {
+	_, mux := MustRunServer(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/datasources":
+			w.Write([]byte(`[{"uid":"influx1","name":"InfluxDB"}]`))
+			return
+		case "/api/dashboards/uid/go1":
+			w.Write([]byte(`{"dashboard":{"uid":"go1","title":"Overview","panels":[{"datasource":{"uid":"gone"}}]}}`))
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	for _, strict := range []bool{false, true} {
+		res, err := Run(context.Background(), Options{
+			GrafanaAPI:      server.URL,
+			GrafanaToken:    "token",
+			GitAPI:          server.URL,
+			GitToken:        "token",
+			GitPIDs:         []int{1},
+			Mode:            ModeVerify,
+			CheckRefs:       true,
+			CheckRefsStrict: strict,
+		})
+		if strict {
+			if err == nil {
+				t.Fatal("expected the dangling reference to fail the strict check")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{`dashboard "go1": datasource "gone"`}
+		if !reflect.DeepEqual(res.DanglingRefs, want) {
+			t.Fatalf("got %q, want %q", res.DanglingRefs, want)
+		}
+		if len(res.Drift) != 1 {
+			t.Fatalf("expected the dashboard to be synced anyway, got %d changes", len(res.Drift))
+		}
+	}
+}
+
+func TestRunLayoutUID(t *testing.T) {
+	server, _ := MustRunServer(t)
+
+	res, err := Run(context.Background(), Options{
+		GrafanaAPI:   server.URL,
+		GrafanaToken: "token",
+		GitAPI:       server.URL,
+		GitToken:     "token",
+		GitPIDs:      []int{1},
+		Mode:         ModeVerify,
+		Layout:       LayoutUID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var paths []string
+	for _, a := range res.Drift {
+		paths = append(paths, *a.FilePath)
+	}
+	want := []string{"/go1.json", "/index.json"}
+	if !reflect.DeepEqual(paths, want) {
+		t.Fatalf("want paths %q, got %q", want, paths)
+	}
+
+	if _, err := Run(context.Background(), Options{GrafanaAPI: "http://localhost", GrafanaToken: "token", Layout: LayoutUID, PathTemplate: "/{{.Title}}.json"}); err == nil {
+		t.Fatal("expected an error for layout uid with a path template")
+	}
+}
+
+func TestRunCommitEmpty(t *testing.T) {
+	for _, empty := range []bool{false, true} {
+		server, mux := MustRunServer(t)
+		commits := mustCommits(t, mux)
+
+		// The only dashboard is left untouched, so there are no changes.
+		res, err := Run(context.Background(), Options{
+			GrafanaAPI:   server.URL,
+			GrafanaToken: "token",
+			GitAPI:       server.URL,
+			GitToken:     "token",
+			GitPIDs:      []int{1},
+			Only:         "other",
+			CommitEmpty:  empty,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := 0
+		if empty {
+			want = 1
+		}
+		if len(*commits) != want || res.Committed != empty {
+			t.Fatalf("commit empty %v: want %d commits, got %d", empty, want, len(*commits))
+		}
+		if empty && *(*commits)[0].Actions[0].FilePath != heartbeatPath {
+			t.Fatalf("expected the heartbeat to be committed, got %s", *(*commits)[0].Actions[0].FilePath)
+		}
+	}
+}
+
+func TestRunIdempotent(t *testing.T) {
+	for name, set := range map[string]func(*Options){
+		"default":       func(o *Options) {},
+		"compact":       func(o *Options) { o.CompactHistory = true; o.CommitHistoryChanges = true },
+		"ndjson":        func(o *Options) { o.HistoryFormat = HistoryFormatNDJSON; o.CommitHistoryChanges = true },
+		"semantic diff": func(o *Options) { o.SemanticDiff = true },
+		"fast":          func(o *Options) { o.Fast = true },
+		"inject meta":   func(o *Options) { o.InjectMeta = true },
+		"provisioning":  func(o *Options) { o.Provisioning = true },
+		"per file":      func(o *Options) { o.GitCommitMode = CommitPerFile },
+		"gzip":          func(o *Options) { o.Gzip = true; o.Index = "README.md"; o.Codeowners = true },
+		"uid layout":    func(o *Options) { o.Layout = LayoutUID },
+	} {
+		t.Run(name, func(t *testing.T) {
+			// The dashboards are saved without changes between the runs,
+			// which only bumps their versions.
+			var bump int
+			mux := mustFixedDashboards(t, &bump)
+			repo := mustRepo(t, mux)
+			server := httptest.NewServer(mux)
+			t.Cleanup(server.Close)
+
+			opt := Options{
+				GrafanaAPI:   server.URL,
+				GrafanaToken: "token",
+				GitAPI:       server.URL,
+				GitToken:     "token",
+				GitPIDs:      []int{1},
+			}
+			set(&opt)
+
+			res, err := Run(context.Background(), opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !res.Committed || len(repo) == 0 {
+				t.Fatalf("expected the first run to commit, got %v", res.Drift)
+			}
+
+			for bump = 0; bump < 2; bump++ {
+				res, err = Run(context.Background(), opt)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(res.Drift) != 0 || res.Committed {
+					t.Fatalf("version bump %d: expected no actions, got %d", bump, len(res.Drift))
+				}
+			}
+		})
+	}
+}
+
+func TestRunCompactHistoryMigration(t *testing.T) {
+	var bump int
+	mux := mustFixedDashboards(t, &bump)
+	repo := mustRepo(t, mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	opt := Options{
+		GrafanaAPI:   server.URL,
+		GrafanaToken: "token",
+		GitAPI:       server.URL,
+		GitToken:     "token",
+		GitPIDs:      []int{1},
+	}
+	if _, err := Run(context.Background(), opt); err != nil {
+		t.Fatal(err)
+	}
+	if isCompactHistory(repo["history.json"]) {
+		t.Fatal("expected the history in the original format")
+	}
+
+	// Nothing changed in Grafana, the history is migrated on its own.
+	opt.CompactHistory = true
+	res, err := Run(context.Background(), opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Committed || !isCompactHistory(repo["history.json"]) {
+		t.Fatalf("expected the history to be rewritten in the compact format, got %s", repo["history.json"])
+	}
+
+	res, err = Run(context.Background(), opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Committed {
+		t.Fatal("expected no commit once the history is compact")
+	}
+}
+
+func TestRunKeepOnError(t *testing.T) {
+	var bump int
+	mux := mustFixedDashboards(t, &bump)
+	mux.HandleFunc("/api/v4/projects/1/repository/files/", MustHistoryHandler(t, `{
+		"go2":{"uid":"go2","path":"/Latency.json","sha256":"a"},
+		"go3":{"uid":"go3","path":"/Home.json","sha256":"b"}
+	}`))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	// The path of the dashboards without tags cannot be built.
+	res, err := Run(context.Background(), Options{
+		GrafanaAPI:   server.URL,
+		GrafanaToken: "token",
+		GitAPI:       server.URL,
+		GitToken:     "token",
+		GitPIDs:      []int{1},
+		Mode:         ModeVerify,
+		PathTemplate: "{{if .Tags}}/{{.Title}}.json{{end}}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.Drift) != 1 || *res.Drift[0].Action != gitlab.FileCreate {
+		for _, a := range res.Drift {
+			t.Logf("%s %s", *a.Action, *a.FilePath)
+		}
+		t.Fatal("expected only the dashboard with tags to be created and the others to be kept")
+	}
+}
+
+func TestRunHeartbeatCommitted(t *testing.T) {
+	server, mux := MustRunServer(t)
+	commits := mustCommits(t, mux)
+
+	// The only dashboard is left untouched, so only the heartbeat changes.
+	res, err := Run(context.Background(), Options{
+		GrafanaAPI:   server.URL,
+		GrafanaToken: "token",
+		GitAPI:       server.URL,
+		GitToken:     "token",
+		GitPIDs:      []int{1},
+		Only:         "other",
+		Heartbeat:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*commits) != 1 || !res.Committed || res.CommitID != "c1" {
+		t.Fatalf("expected the heartbeat commit to be reported, got %d commits, committed %v", len(*commits), res.Committed)
+	}
+}
+
+func TestRunInvalidOptions(t *testing.T) {
+	if _, err := Run(context.Background(), Options{}); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	if _, err := Run(context.Background(), Options{GrafanaAPI: "http://localhost", GrafanaToken: "token", Only: "a,b", GrafanaVersion: 2}); err == nil {
+		t.Fatal("expected an error for a version with several dashboards")
+	}
+}
+
+// MustRunServer returns a server serving both the Grafana and the Gitlab API
+// with a single dashboard and an empty repository.
+func MustRunServer(t *testing.T) (*httptest.Server, *http.ServeMux) {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/search", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"uid":"go1","title":"Overview","folderTitle":"Ops"}]`))
+	})
+	mux.HandleFunc("/api/dashboards/uid/go1", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"dashboard":{"uid":"go1","title":"Overview"}}`))
+	})
+	mux.HandleFunc("/api/v4/projects/1", projectHandler)
+	mux.HandleFunc("/api/v4/projects/1/repository/files/", http.NotFound)
+	mux.HandleFunc("/api/v4/projects/1/repository/branches/main", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"name":"main"}`))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	return server, mux
+}
+
+// mustRepo serves the files of an in-memory repository of project 1, which
+// are changed by the commits, and returns its files by path.
+func mustRepo(t *testing.T, mux *http.ServeMux) map[string][]byte {
+	t.Helper()
+
+	files := make(map[string][]byte)
+	mux.HandleFunc("/api/v4/projects/1/repository/files/", func(w http.ResponseWriter, r *http.Request) {
+		p := strings.TrimPrefix(r.URL.Path, "/api/v4/projects/1/repository/files/")
+		data, ok := files[p]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(&gitlab.File{FilePath: p, Content: base64.StdEncoding.EncodeToString(data)})
+	})
+	mux.HandleFunc("/api/v4/projects/1/repository/commits", func(w http.ResponseWriter, r *http.Request) {
+		var opt gitlab.CreateCommitOptions
+		if err := json.NewDecoder(r.Body).Decode(&opt); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		for _, a := range opt.Actions {
+			p := strings.TrimPrefix(*a.FilePath, "/")
+			if a.PreviousPath != nil {
+				delete(files, strings.TrimPrefix(*a.PreviousPath, "/"))
+			}
+			if *a.Action == gitlab.FileDelete {
+				delete(files, p)
+				continue
+			}
+			if a.Content == nil {
+				continue
+			}
+			data := []byte(*a.Content)
+			if a.Encoding != nil && *a.Encoding == "base64" {
+				data, _ = base64.StdEncoding.DecodeString(*a.Content)
+			}
+			files[p] = data
+		}
+		w.Write([]byte(`{"id":"c1"}`))
+	})
+	return files
+}
+
+// mustFixedDashboards serves the Grafana API with a fixed set of dashboards,
+// whose versions are increased by bump, and the Gitlab project 1.
+func mustFixedDashboards(t *testing.T, bump *int) *http.ServeMux {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/search", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[
+			{"id":1,"uid":"go1","title":"Overview","folderTitle":"Ops","url":"/d/go1/overview","tags":["owner:ops"]},
+			{"id":2,"uid":"go2","title":"Latency","folderTitle":"Ops","url":"/d/go2/latency"},
+			{"id":3,"uid":"go3","title":"Home","url":"/d/go3/home"}
+		]`))
+	})
+	for uid, version := range map[string]int{"go1": 7, "go2": 12, "go3": 1} {
+		uid, version := uid, version
+		mux.HandleFunc("/api/dashboards/uid/"+uid, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `{
+				"meta":{"slug":"%[1]s","folderId":1,"url":"/d/%[1]s/%[1]s"},
+				"dashboard":{"uid":"%[1]s","title":"%[1]s","version":%[2]d,"refresh":"30s","panels":[
+					{"id":1,"type":"timeseries","fieldConfig":{"defaults":{"thresholds":{"steps":[{"color":"green","value":null},{"color":"red","value":80.5}]}}}}
+				]}
+			}`, uid, version+*bump)
+		})
+		mux.HandleFunc("/api/dashboards/uid/"+uid+"/versions", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, `[{"id":%[1]d,"version":%[1]d}]`, version+*bump)
+		})
+	}
+	mux.HandleFunc("/api/v4/projects/1", projectHandler)
+	mux.HandleFunc("/api/v4/projects/1/repository/branches/main", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"name":"main"}`))
+	})
+	return mux
+}
@@ -0,0 +1,83 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// tagData is the data passed to the tag name template.
+type tagData struct {
+	Version string
+	Time    time.Time
+	Branch  string
+}
+
+// parseTagTemplate parses the template of the tag name.
+func parseTagTemplate(s string) (*template.Template, error) {
+	tmpl, err := template.New("tag").Option("missingkey=error").Parse(s)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing tag template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// tagName returns the name of the tag of a commit at the given time.
+func (g *Gitlab) tagName(t time.Time) (string, error) {
+	var buf bytes.Buffer
+	if err := g.tag.Execute(&buf, tagData{Version: Version, Time: t, Branch: g.branch}); err != nil {
+		return "", fmt.Errorf("gitlab: error executing tag template: %w", err)
+	}
+
+	name := strings.TrimSpace(buf.String())
+	if name == "" {
+		return "", errors.New("gitlab: tag template results in an empty tag name")
+	}
+	return name, nil
+}
+
+// createTag creates an annotated tag of the commit of the run, if enabled
+// and a commit was made. An existing tag of the same name is replaced if
+// tagForce is set, otherwise it is an error.
+func (g *Gitlab) createTag() error {
+	if g.tag == nil || g.commit == nil {
+		return nil
+	}
+
+	now := time.Now()
+	name, err := g.tagName(now)
+	if err != nil {
+		return err
+	}
+
+	opt := &gitlab.CreateTagOptions{
+		TagName: gitlab.String(name),
+		Ref:     gitlab.String(g.commit.ID),
+		Message: gitlab.String(g.subjectMessage(fmt.Sprintf("ʕ◔ϖ◔ʔ: backup %s", name), now)),
+	}
+
+	_, _, err = g.client.Tags.CreateTag(g.pid, opt, gitlab.WithContext(g.ctx))
+	if err != nil && alreadyExists(err) && g.tagForce {
+		log.Printf("gitlab: replacing tag %q in project %d", name, g.pid)
+		if _, err := g.client.Tags.DeleteTag(g.pid, name, gitlab.WithContext(g.ctx)); err != nil {
+			return fmt.Errorf("gitlab: error deleting tag %q: %w", name, err)
+		}
+		_, _, err = g.client.Tags.CreateTag(g.pid, opt, gitlab.WithContext(g.ctx))
+	}
+	if err != nil {
+		return fmt.Errorf("gitlab: error creating tag %q of commit %s: %w", name, g.commit.ID, err)
+	}
+
+	log.Printf("gitlab: created tag %q of commit %s in project %d", name, g.commit.ID, g.pid)
+	return nil
+}
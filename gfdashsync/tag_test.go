@@ -0,0 +1,84 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+func TestGitlabCreateTag(t *testing.T) {
+	for _, force := range []bool{false, true} {
+		git, mux := MustGitlab(t, MustHistoryHandler(t, `{}`))
+		mustCommits(t, mux)
+
+		tags := map[string]string{"backup-test": "old"}
+		deleted := 0
+		mux.HandleFunc("/api/v4/projects/1/repository/tags", func(w http.ResponseWriter, r *http.Request) {
+			var opt gitlab.CreateTagOptions
+			json.NewDecoder(r.Body).Decode(&opt)
+			if _, ok := tags[*opt.TagName]; ok {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"message":"Tag backup-test already exists"}`))
+				return
+			}
+			tags[*opt.TagName] = *opt.Ref
+			w.Write([]byte(`{"name":"backup-test"}`))
+		})
+		mux.HandleFunc("/api/v4/projects/1/repository/tags/backup-test", func(w http.ResponseWriter, r *http.Request) {
+			deleted++
+			delete(tags, "backup-test")
+		})
+
+		tmpl, err := parseTagTemplate(`backup-{{.Branch}}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		git.tag = tmpl
+		git.tagForce = force
+
+		git.Add(&File{UID: "go1", Path: "/go1.json", SHA256: "12345"})
+		err = git.Commit()
+		if !force {
+			if err == nil {
+				t.Fatal("expected an error for an existing tag")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deleted != 1 || tags["backup-test"] != "c1" {
+			t.Fatalf("expected the tag to be replaced, got %d deletes and ref %q", deleted, tags["backup-test"])
+		}
+	}
+}
+
+func TestGitlabTagName(t *testing.T) {
+	git := &Gitlab{branch: "main"}
+	var err error
+	if git.tag, err = parseTagTemplate(`backup-{{.Time.Format "2006-01-02"}}-{{.Branch}}`); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := git.tagName(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "backup-2024-01-01-main"; got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	if git.tag, err = parseTagTemplate(` `); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := git.tagName(time.Now()); err == nil {
+		t.Fatal("expected an error for an empty tag name")
+	}
+}
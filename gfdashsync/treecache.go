@@ -0,0 +1,71 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// treeCache is the tree of the branch listed once per run. Files which are not
+// in the tree are known to be missing without a request and the content of
+// the files is read by blob ID only once, when it is first needed. The
+// content is not read upfront, since only the few changed files are read on
+// a typical run.
+type treeCache struct {
+	nodes []*gitlab.TreeNode
+
+	// blobs are the blob IDs of the files by path.
+	blobs map[string]string
+	// contents are the contents of the blobs read so far by blob ID.
+	contents map[string][]byte
+}
+
+// loadTree lists the tree of the branch and serves the following reads of
+// the repository from it.
+func (g *Gitlab) loadTree() error {
+	g.tree = nil
+	nodes, err := g.listTree()
+	if err != nil {
+		return fmt.Errorf("gitlab: error listing repository: %w", err)
+	}
+
+	c := &treeCache{
+		nodes:    nodes,
+		blobs:    make(map[string]string),
+		contents: make(map[string][]byte),
+	}
+	for _, n := range nodes {
+		if n.Type == "blob" {
+			c.blobs[n.Path] = n.ID
+		}
+	}
+	g.tree = c
+
+	return nil
+}
+
+// readCached returns the content of the file with the given path from the
+// tree cache.
+func (g *Gitlab) readCached(p string) ([]byte, error) {
+	id, ok := g.tree.blobs[strings.TrimPrefix(p, "/")]
+	if !ok {
+		return nil, errNotFound
+	}
+
+	if data, ok := g.tree.contents[id]; ok {
+		return data, nil
+	}
+
+	data, _, err := g.client.Repositories.RawBlobContent(g.pid, id, gitlab.WithContext(g.ctx))
+	if err != nil {
+		return nil, err
+	}
+	g.tree.contents[id] = data
+
+	return data, nil
+}
@@ -0,0 +1,51 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestGitlabTreeCache(t *testing.T) {
+	hf := MustHistoryHandler(t, `{"go1":{"uid":"go1","path":"/Ops/Overview.json","sha256":"12345"}}`)
+	git, mux := MustGitlab(t, hf)
+	git.conflict = ConflictSkip
+
+	mux.HandleFunc("/api/v4/projects/1/repository/tree", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"id":"b1","path":"Ops/Overview.json","type":"blob"},{"id":"t1","path":"Ops","type":"tree"}]`))
+	})
+	reads := 0
+	mux.HandleFunc("/api/v4/projects/1/repository/blobs/b1/raw", func(w http.ResponseWriter, r *http.Request) {
+		reads++
+		w.Write([]byte(`{"changed":"in the repository"}`))
+	})
+
+	if err := git.loadTree(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := git.readFile("/Ops/Missing.json"); !errors.Is(err, errNotFound) {
+		t.Fatalf("want %v, got %v", errNotFound, err)
+	}
+
+	git.Add(&File{UID: "go1", Path: "/Ops/Overview.json", SHA256: "6789", content: []byte("{}")})
+	if len(git.actions) != 0 {
+		t.Fatal("expected the file changed in the repository to be skipped")
+	}
+
+	data, err := git.readFile("Ops/Overview.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"changed":"in the repository"}` {
+		t.Fatalf("unexpected content %s", data)
+	}
+
+	if reads != 1 {
+		t.Fatalf("expected the file to be read once, got %d reads", reads)
+	}
+}
@@ -0,0 +1,34 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"errors"
+	"fmt"
+)
+
+// validateDashboard checks the dashboard model against a minimal schema, so
+// partial models returned on transient errors are not committed: it must
+// have a non-empty title and UID and a panels array. Dashboards of old
+// schema versions have a rows array instead.
+func validateDashboard(model map[string]interface{}) error {
+	if model == nil {
+		return errors.New("missing dashboard model")
+	}
+
+	for _, k := range []string{"title", "uid"} {
+		if s, ok := model[k].(string); !ok || s == "" {
+			return fmt.Errorf("missing %s", k)
+		}
+	}
+
+	if _, ok := model["panels"].([]interface{}); ok {
+		return nil
+	}
+	if _, ok := model["rows"].([]interface{}); ok {
+		return nil
+	}
+	return errors.New("missing panels array")
+}
@@ -0,0 +1,36 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestValidateDashboard(t *testing.T) {
+	testCases := []struct {
+		in      string
+		wantErr bool
+	}{
+		{`{"uid":"go1","title":"Overview","panels":[]}`, false},
+		{`{"uid":"go1","title":"Overview","rows":[{"panels":[]}]}`, false},
+		{`{"uid":"go1","title":"Overview"}`, true},
+		{`{"uid":"go1","title":"Overview","panels":{}}`, true},
+		{`{"uid":"","title":"Overview","panels":[]}`, true},
+		{`{"uid":"go1","panels":[]}`, true},
+		{`null`, true},
+	}
+
+	for _, tc := range testCases {
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(tc.in), &m); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := validateDashboard(m); (err != nil) != tc.wantErr {
+			t.Errorf("%s: unexpected error: %v", tc.in, err)
+		}
+	}
+}
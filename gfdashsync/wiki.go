@@ -0,0 +1,316 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/xanzy/go-gitlab"
+)
+
+// Wiki syncs the files to the wiki of a Gitlab project, one page per file.
+// Unlike a repository commit the wiki changes are not atomic, so the history
+// only records the pages which were changed successfully.
+type Wiki struct {
+	ctx    context.Context
+	client *gitlab.Client
+	pid    int
+
+	history       History
+	historyPage   string
+	historyExists bool
+
+	changes []*wikiChange
+
+	// historyChanged is set if the history changed without a page change.
+	historyChanged bool
+
+	// pruneGrace is the duration a file must be missing before its page is
+	// deleted.
+	pruneGrace time.Duration
+}
+
+// wikiChange is a pending change of a wiki page.
+type wikiChange struct {
+	action   gitlab.FileActionValue
+	uid      string
+	slug     string
+	prevSlug string
+	file     *File
+}
+
+func NewWiki(ctx context.Context, baseURL, auth, token string, pid int, transport http.RoundTripper) (*Wiki, error) {
+	c, err := newGitlabClient(baseURL, auth, token, transport)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &Wiki{
+		ctx:         ctx,
+		client:      c,
+		pid:         pid,
+		history:     make(History),
+		historyPage: "gfdashsync-history",
+	}
+
+	if err := w.parseHistory(); err != nil {
+		return nil, fmt.Errorf("wiki: error parsing history: %w", err)
+	}
+
+	return w, nil
+}
+
+// wikiSlug returns the slug of the wiki page for the given file path.
+func wikiSlug(path string) string {
+	s := strings.TrimPrefix(path, "/")
+	s = strings.TrimSuffix(s, ".json")
+	return strings.ReplaceAll(s, " ", "-")
+}
+
+// wikiContent wraps JSON content in a code block, so it is rendered
+// readable.
+func wikiContent(content []byte) string {
+	return "```json\n" + string(content) + "\n```\n"
+}
+
+// unwrapWikiContent returns the JSON content of a wiki page written with
+// wikiContent.
+func unwrapWikiContent(s string) string {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, "```json")
+	return strings.TrimSuffix(s, "```")
+}
+
+// parseHistory reads the history page from the wiki.
+func (w *Wiki) parseHistory() error {
+	p, resp, err := w.client.Wikis.GetWikiPage(w.pid, w.historyPage, nil, gitlab.WithContext(w.ctx))
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return nil
+		}
+		return err
+	}
+	w.historyExists = true
+
+	w.history, err = decodeHistory([]byte(unwrapWikiContent(p.Content)))
+	return err
+}
+
+// Add adds the file to be committed. The path of the file is mapped to the
+// slug of its wiki page, which is recorded in the history.
+func (w *Wiki) Add(in *File) {
+	f := *in
+	f.Path = wikiSlug(in.Path)
+
+	hf, ok := w.history[f.UID]
+	if !ok {
+		w.add(gitlab.FileCreate, &f, "")
+		return
+	}
+	hf.processed = true
+
+	if hf.MissingSince != nil {
+		hf.MissingSince = nil
+		w.historyChanged = true
+	}
+
+	switch {
+	case f.moved(hf):
+		f.logVersion(hf)
+		w.add(gitlab.FileMove, &f, hf.Path)
+
+	case f.modified(hf):
+		f.logVersion(hf)
+		w.add(gitlab.FileUpdate, &f, "")
+	}
+}
+
+func (w *Wiki) add(action gitlab.FileActionValue, f *File, prevSlug string) {
+	f.processed = true
+	w.changes = append(w.changes, &wikiChange{
+		action:   action,
+		uid:      f.UID,
+		slug:     f.Path,
+		prevSlug: prevSlug,
+		file:     f,
+	})
+}
+
+// Keep marks the page of the file with the given UID as processed without
+// changing it.
+func (w *Wiki) Keep(uid string) {
+	if hf, ok := w.history[uid]; ok {
+		hf.processed = true
+	}
+}
+
+// syncedVersion returns the dashboard version of the file in the history.
+func (w *Wiki) syncedVersion(uid string) int64 {
+	if hf, ok := w.history[uid]; ok {
+		return hf.Version
+	}
+	return 0
+}
+
+// KeepPrefix keeps the pages of all files whose UID starts with the given
+// prefix.
+func (w *Wiki) KeepPrefix(prefix string) {
+	for uid, hf := range w.history {
+		if strings.HasPrefix(uid, prefix) {
+			hf.processed = true
+		}
+	}
+}
+
+func (w *Wiki) deleteOrphans() {
+	now := time.Now()
+	for _, f := range w.history {
+		if f.processed {
+			continue
+		}
+		f.processed = true
+
+		if f.MissingSince == nil && w.pruneGrace > 0 {
+			w.historyChanged = true
+		}
+		if !f.pruneDue(now, w.pruneGrace) {
+			continue
+		}
+
+		w.changes = append(w.changes, &wikiChange{
+			action: gitlab.FileDelete,
+			uid:    f.UID,
+			slug:   f.Path,
+		})
+	}
+}
+
+// Drift returns the pending changes as commit actions, without applying them.
+func (w *Wiki) Drift() []*gitlab.CommitActionOptions {
+	w.deleteOrphans()
+
+	var actions []*gitlab.CommitActionOptions
+	for _, c := range w.changes {
+		a := &gitlab.CommitActionOptions{
+			Action:   gitlab.FileAction(c.action),
+			FilePath: gitlab.String(c.slug),
+		}
+		if c.prevSlug != "" {
+			a.PreviousPath = gitlab.String(c.prevSlug)
+		}
+		actions = append(actions, a)
+	}
+
+	return actions
+}
+
+// Commit applies all pending changes to the wiki. Changes which fail are
+// logged and skipped, the history is written for all successful changes.
+func (w *Wiki) Commit() error {
+	w.deleteOrphans()
+
+	// nothing to commit
+	if len(w.changes) == 0 && !w.historyChanged {
+		return nil
+	}
+
+	var errs []string
+	for _, c := range w.changes {
+		if err := w.apply(c); err != nil {
+			log.Printf("wiki: error applying %s of %q: %v", c.action, c.slug, err)
+			errs = append(errs, c.slug)
+		}
+	}
+
+	if err := w.updateHistory(); err != nil {
+		return fmt.Errorf("wiki: error writing history: %w", err)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("wiki: %d of %d changes failed: %s", len(errs), len(w.changes), strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+// apply applies a single change to the wiki and records it in the history.
+func (w *Wiki) apply(c *wikiChange) error {
+	format := gitlab.WikiFormatValue("markdown")
+
+	switch c.action {
+	case gitlab.FileCreate:
+		_, _, err := w.client.Wikis.CreateWikiPage(w.pid, &gitlab.CreateWikiPageOptions{
+			Title:   gitlab.String(c.slug),
+			Content: gitlab.String(wikiContent(c.file.content)),
+			Format:  &format,
+		}, gitlab.WithContext(w.ctx))
+		if err != nil {
+			return err
+		}
+
+	case gitlab.FileUpdate, gitlab.FileMove:
+		slug := c.slug
+		if c.prevSlug != "" {
+			slug = c.prevSlug
+		}
+
+		_, _, err := w.client.Wikis.EditWikiPage(w.pid, slug, &gitlab.EditWikiPageOptions{
+			Title:   gitlab.String(c.slug),
+			Content: gitlab.String(wikiContent(c.file.content)),
+			Format:  &format,
+		}, gitlab.WithContext(w.ctx))
+		if err != nil {
+			return err
+		}
+
+	case gitlab.FileDelete:
+		resp, err := w.client.Wikis.DeleteWikiPage(w.pid, c.slug, gitlab.WithContext(w.ctx))
+		if err != nil && (resp == nil || resp.StatusCode != http.StatusNotFound) {
+			return err
+		}
+		delete(w.history, c.uid)
+		return nil
+
+	default:
+		return errors.New("unsupported action")
+	}
+
+	// The history keeps the slug of the path rather than the slug returned
+	// by Gitlab, which may normalize it differently, so the page is not
+	// moved again by the next run.
+	w.history[c.uid] = c.file
+	return nil
+}
+
+// updateHistory writes the history page to the wiki.
+func (w *Wiki) updateHistory() error {
+	data, err := w.history.encode(false)
+	if err != nil {
+		return err
+	}
+
+	content := gitlab.String(wikiContent(data))
+	if !w.historyExists {
+		_, _, err = w.client.Wikis.CreateWikiPage(w.pid, &gitlab.CreateWikiPageOptions{
+			Title:   gitlab.String(w.historyPage),
+			Content: content,
+		}, gitlab.WithContext(w.ctx))
+		if err == nil {
+			w.historyExists = true
+		}
+		return err
+	}
+
+	_, _, err = w.client.Wikis.EditWikiPage(w.pid, w.historyPage, &gitlab.EditWikiPageOptions{
+		Content: content,
+	}, gitlab.WithContext(w.ctx))
+	return err
+}
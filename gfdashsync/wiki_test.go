@@ -0,0 +1,138 @@
+// Copyright 2022 Eurac Research. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package gfdashsync
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestWikiCommit(t *testing.T) {
+	history := wikiContent([]byte(`{
+		"go1": {"uid": "go1", "path": "Ops/Old", "sha256": "1"},
+		"go2": {"uid": "go2", "path": "Ops/Gone", "sha256": "1"}
+	}`))
+
+	var (
+		requests []string
+		written  string
+	)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/projects/1/wikis/", func(w http.ResponseWriter, r *http.Request) {
+		slug := strings.TrimPrefix(r.URL.EscapedPath(), "/api/v4/projects/1/wikis/")
+		requests = append(requests, r.Method+" "+slug)
+
+		switch {
+		case r.Method == http.MethodGet && slug == "gfdashsync-history":
+			json.NewEncoder(w).Encode(map[string]string{"slug": slug, "content": history})
+
+		case r.Method == http.MethodPut && slug == "gfdashsync-history":
+			b, _ := io.ReadAll(r.Body)
+			written = string(b)
+			w.Write([]byte(`{"slug":"gfdashsync-history"}`))
+
+		case r.Method == http.MethodPut:
+			w.Write([]byte(`{"slug":"Ops/New-Name"}`))
+
+		case r.Method == http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	mux.HandleFunc("/api/v4/projects/1/wikis", func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method)
+		w.Write([]byte(`{"slug":"Dev/Created"}`))
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	wiki, err := NewWiki(context.Background(), server.URL, AuthPAT, "", 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wiki.Add(&File{UID: "go1", Path: "/Ops/New Name.json", SHA256: "2", content: []byte("{}")})
+	wiki.Add(&File{UID: "go3", Path: "/Dev/Created.json", SHA256: "1", content: []byte("{}")})
+
+	if err := wiki.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(requests)
+	want := []string{
+		"DELETE Ops%2FGone",
+		"GET gfdashsync-history",
+		"POST",
+		"PUT Ops%2FOld",
+		"PUT gfdashsync-history",
+	}
+	if strings.Join(want, ",") != strings.Join(requests, ",") {
+		t.Fatalf("want requests %v, got %v", want, requests)
+	}
+
+	for _, s := range []string{"Ops/New-Name", "Dev/Created"} {
+		if !strings.Contains(written, s) {
+			t.Errorf("expected %q in written history", s)
+		}
+	}
+	if strings.Contains(written, "Ops/Gone") {
+		t.Error("expected deleted page to be removed from history")
+	}
+}
+
+func TestWikiRewrittenSlug(t *testing.T) {
+	history := wikiContent([]byte(`{}`))
+	var requests []string
+
+	// Gitlab returns the slugs in lower case.
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v4/projects/1/wikis/", func(w http.ResponseWriter, r *http.Request) {
+		slug := strings.TrimPrefix(r.URL.EscapedPath(), "/api/v4/projects/1/wikis/")
+		if slug != "gfdashsync-history" {
+			requests = append(requests, r.Method+" "+slug)
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(map[string]string{"slug": slug, "content": history})
+		case http.MethodPut:
+			var page struct {
+				Content string `json:"content"`
+			}
+			json.NewDecoder(r.Body).Decode(&page)
+			history = page.Content
+			json.NewEncoder(w).Encode(map[string]string{"slug": strings.ToLower(slug)})
+		}
+	})
+	mux.HandleFunc("/api/v4/projects/1/wikis", func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method)
+		w.Write([]byte(`{"slug":"ops/cpu-&-memory"}`))
+	})
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	for run := 0; run < 2; run++ {
+		wiki, err := NewWiki(context.Background(), server.URL, AuthPAT, "", 1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wiki.Add(&File{UID: "go1", Path: "/Ops/CPU & Memory.json", SHA256: "1", content: []byte("{}")})
+		if err := wiki.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if want := []string{"POST"}; strings.Join(want, ",") != strings.Join(requests, ",") {
+		t.Fatalf("want only the page to be created, got %v", requests)
+	}
+}
@@ -8,298 +8,550 @@ package main
 
 import (
 	"bufio"
-	"crypto/sha256"
-	"encoding/base64"
-	"encoding/hex"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
-	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
+	"github.com/euracresearch/gfdash2git/gfdashsync"
 	gapi "github.com/grafana/grafana-api-golang-client"
 	"github.com/xanzy/go-gitlab"
 )
 
+// version is the version of gfdashsync. It is set at build time using
+// -ldflags "-X main.version=vX.Y.Z".
+var version = "dev"
+
 func main() {
 	var (
 		gfAPI     = flag.String("grafana.api", "", "Grafana API URL")
 		gfToken   = flag.String("grafana.token", "", "Grafana API token")
+		gfTokenF  = flag.String("grafana.token-file", "", "File containing the Grafana API token, overrides -grafana.token (optional)")
+		gfUser    = flag.String("grafana.user", "", "Grafana basic auth user, if no token is given")
+		gfPass    = flag.String("grafana.password", "", "Grafana basic auth password")
+		gfVersion = flag.Int64("grafana.version", 0, "Sync this version of the dashboard given with -only instead of the latest")
+		gfRPS     = flag.Float64("grafana.rps", 0, "Maximum Grafana API requests per second (0 = unlimited)")
+		gfFolders = flag.String("grafana.folders", "", "Comma separated list of folder titles and UIDs to sync, dashboards in other folders are left untouched (optional)")
+		gfFoldRec = flag.Bool("grafana.folders-recursive", false, "Also sync the dashboards in the subfolders of -grafana.folders")
+		gfOrgID   = flag.Int64("grafana.org-id", 0, "ID of the Grafana organization to sync, sent with each request instead of switching the current organization (optional)")
+		gfTimeout = flag.Duration("grafana.timeout", gfdashsync.DefaultGrafanaTimeout, "Timeout of each Grafana API request, a dashboard timing out is skipped and kept (negative = none)")
+		gitProv   = flag.String("git.provider", gfdashsync.ProviderGitlab, "Git service: gitlab or gitea, which includes Forgejo")
 		gitAPI    = flag.String("git.api", "", "Git service API URL")
 		gitToken  = flag.String("git.token", "", "Git service API token")
-		gitPID    = flag.Int("git.pid", -1, "Git project ID")
-		gitBranch = flag.String("git.branch", "main", "Git repository branch")
-		config    = flag.String("config", "", "Config file (optional)")
+		gitTokenF = flag.String("git.token-file", "", "File containing the Git service API token, overrides -git.token (optional)")
+		gitAuth   = flag.String("git.auth", gfdashsync.AuthPAT, "Git service token type: pat, oauth or job")
+		gitTarget = flag.String("git.target", gfdashsync.TargetRepo, "Git service target: repo or wiki")
+		gitPID    = flag.String("git.pid", "", "Comma separated list of Git project IDs")
+		gitRepo   = flag.String("git.repo", "", "Repository owner/name, instead of -git.pid with -git.provider=gitea")
+		gitBranch = flag.String("git.branch", "main", "Comma separated list of Git repository branches receiving the same changes")
+		gitCreate = flag.Bool("git.create-branch", false, "Create the Git branch if it does not exist")
+		gitStart  = flag.String("git.start-branch", "main", "Git branch from which a missing branch is created")
+		gitTrans  = flag.String("git.transport", gfdashsync.TransportAPI, "How commits are sent: api, or ssh and https to clone the branch and git push, which is faster for large changes")
+		treeCache = flag.Bool("repo-tree-cache", false, "List the repository once and read each file only once, for -conflict, -diff and -history.rebuild")
+		histSep   = flag.Bool("history.separate-commit", false, "Commit the history in a commit of its own after the commit of the dashboards")
+		gitLock   = flag.Bool("lock", false, "Serialize runs against the same branch with a history.lock file committed during the run")
+		lockTTL   = flag.Duration("lock-ttl", gfdashsync.DefaultLockTTL, "Age after which a -lock is stale and stolen")
+		gitSHA    = flag.String("git.start-sha", "", "Full SHA of the commit the first commit is based on instead of the branch head, fails if the branch moved unless -git.force is set (optional)")
+		gitLastID = flag.Bool("git.last-commit-id", false, "Fail instead of overwriting files changed in the branch during the run, using the last commit ID of each file")
+		gitForce  = flag.Bool("git.force", false, "Reset the branch to the commit based on -git.start-sha, discarding newer commits")
+		gitAuthor = flag.String("git.author-name", "", "Commit author name (optional)")
+		gitEmail  = flag.String("git.author-email", "", "Commit author email (optional)")
+		gitSignof = flag.Bool("git.signoff", false, "Append a Signed-off-by trailer of the commit author to the commit message")
+		trigUser  = flag.String("trigger-user", "", "User who triggered the run as \"Name <email>\", added as Co-authored-by trailer to the commit message (optional)")
+		gitCommit = flag.String("git.commit-mode", gfdashsync.CommitSingle, "Commit all changes at once or each file on its own: single or per-file")
+		gitFMsg   = flag.String("git.file-message", "", "Go template of the commit subject of each file in per-file mode with .Title, .Folder, .Action, .Path, .Version and .Time (optional)")
+		gitMsg    = flag.String("git.message-file", "", "File with a Go template of the commit message with .Version and .Time (optional)")
+		gitTag    = flag.String("git.tag", "", "Go template of the name of an annotated tag created for the commit, e.g. backup-{{.Time.Format \"2006-01-02\"}} (optional)")
+		gitTagF   = flag.Bool("git.tag-force", false, "Replace an existing tag of the same name instead of failing")
+		config    = flag.String("config", "", "Comma separated config files, later files override earlier ones and flags on the command line override all (optional)")
+		allowEnv  = flag.Bool(allowMissingEnvFlag, false, "Expand undefined environment variables in the config file to empty strings instead of failing")
+		instance  = flag.String("instance", "", "Name of the Grafana instance, all files and the history are kept in a directory of that name (optional)")
+		userAgent = flag.String("user-agent", "", "User-Agent header of all requests (default gfdashsync/<version>)")
+		proxy     = flag.String("proxy", "", "HTTP proxy URL for all requests, credentials in the URL are used for proxy authentication (optional)")
+		mode      = flag.String("mode", gfdashsync.ModeSync, "Run mode: sync, verify, list, check, export, history-diff, inventory, snapshot or list-orphans")
+		snapPer   = flag.String("snapshot.period", "", "Period naming the directory of -mode=snapshot, e.g. _snapshots/2024-Q1: quarter, month or day (default quarter)")
+		histRef   = flag.String("ref", "", "Commit, branch or tag whose history -mode=history-diff compares with the head of the branch")
+		outputDir = flag.String("output-dir", "", "Directory to which -mode=export writes the files")
+		format    = flag.String("format", "text", "Output format of -mode=list, -mode=history-diff and -mode=list-orphans: text or json")
+
+		failOnDrift        = flag.Bool("fail-on-drift", false, "Exit with a non-zero status after committing if there were changes")
+		includeDataSources = flag.Bool("include-datasources", false, "Also sync data source definitions to datasources/<name>-<uid>.json")
+		includeFolders     = flag.Bool("include-folders", false, "Also sync folder definitions")
+		includeLibPanels   = flag.Bool("include-library-panels", false, "Also sync library panels")
+		thumbnails         = flag.Bool("thumbnails", false, "Also commit each dashboard rendered as PNG, requires the Grafana image renderer")
+		includePlaylists   = flag.Bool("include-playlists", false, "Also sync playlists")
+		includeSnapshots   = flag.Bool("include-snapshots", false, "Also sync dashboard snapshots")
+		keepSnapshots      = flag.Bool("snapshots.keep-expired", false, "Keep snapshots which expired or were deleted in Grafana instead of deleting them")
+		includePermissions = flag.Bool("include-permissions", false, "Also sync dashboard and folder permissions")
+		maxChanges         = flag.Int("max-changes", 0, "Abort if more than the given number of changes are pending (0 = unlimited)")
+		historyRebuild     = flag.Bool("history.rebuild", false, "Rebuild a missing history file from the files in the repository")
+		compactHistory     = flag.Bool("history.compact", false, "Write the history file in the compact format")
+		commitHistory      = flag.Bool("history.commit-changes", false, "Commit the history if its content changed, e.g. the versions of unchanged dashboards, even if no file changed")
+		historyKeep        = flag.Int("history.keep", 0, "Number of previous history files to keep as history.json.1 to history.json.N before overwriting it (0 keeps none)")
+		historyFormat      = flag.String("history.format", "", "Format of the history file: json or ndjson with one entry per line (default keeps the existing format)")
+		only               = flag.String("only", "", "Comma separated list of dashboard UIDs to sync, all others are left untouched")
+		ignore             = flag.String("ignore", "", "Comma separated list of dashboard UIDs and title patterns prefixed with glob: to ignore")
+		repoClean          = flag.Bool("repo-clean", false, "Delete all JSON files from the repository which are not tracked in the history")
+		stagingFile        = flag.String("staging-file", "", "Local file where the commit is staged before it is sent (optional)")
+		resume             = flag.Bool("resume", false, "Resume the commit of an interrupted run from -staging-file")
+		pruneGrace         = flag.Duration("prune-grace", 0, "Duration a dashboard must be missing before it is deleted")
+		archiveDeleted     = flag.Bool("archive-deleted", false, "Move deleted dashboards to _archive/<date>/ instead of deleting them")
+		gz                 = flag.Bool("gzip", false, "Store the files gzip compressed")
+		pathTmpl           = flag.String("path-template", gfdashsync.DefaultPathTemplate, "Go template of the dashboard file paths with .UID, .Title, .FolderTitle, .FolderUID, .FolderPath, .Tags and .Tag \"prefix\"")
+		layout             = flag.String("layout", gfdashsync.LayoutPath, "Repository layout: path names the files by -path-template, uid names them <uid>.json with the folders and titles in index.json")
+		pathByTag          = flag.String("path-by-tag", "", "Tag prefix like team: whose value is used as directory instead of the folder title, if a dashboard has such a tag (optional)")
+		normalize          = flag.String("normalize", "", "Comma separated list of JSON paths like $.dashboard.time of fields to remove before hashing, path=value resets them")
+		normalizeFile      = flag.String("normalize-file", "", "File with one -normalize path per line, for values containing commas (optional)")
+		dsRewrite          = flag.String("panels-datasource-rewrite", "", "JSON file mapping datasource UIDs or names to those of another Grafana, \"*\" for all others, applied by -mode=export and -implode for restoring (optional)")
+		redact             = flag.String("redact", "", "Comma separated list of regular expressions replaced with ***REDACTED*** in the dashboards, default for common secrets (optional)")
+		redactFile         = flag.String("redact-file", "", "File with one -redact regular expression per line, for patterns containing commas (optional)")
+		postCommit         = flag.String("post-commit", "", "Command or URL run after a commit with the JSON summary of the run (optional)")
+		postCommitRequired = flag.Bool("post-commit-required", false, "Fail the run if the -post-commit hook fails")
+		notifyWebhook      = flag.String("notify.webhook", "", "Slack compatible webhook URL notified with a summary after a commit (optional)")
+		notifyAlways       = flag.Bool("notify.always", false, "Also notify -notify.webhook if nothing was committed")
+		diff               = flag.Bool("diff", false, "Show the diffs of modified files in verify mode and add them to the commit message")
+		provisioning       = flag.Bool("provisioning", false, "Write the dashboards in the provisioning envelope with the folder UID instead of the raw model")
+		semanticDiff       = flag.Bool("semantic-diff", false, "Compare files semantically, so formatting changes are not committed")
+		conflict           = flag.String("conflict", "", "Detect files changed in the repository and skip or overwrite them: skip or overwrite")
+		heartbeat          = flag.Bool("heartbeat", false, "Update last-sync.txt with the time of every sync, so every run creates a commit")
+		commitEmpty        = flag.Bool("commit-empty", false, "Update last-sync.txt only if a sync has no changes, so every run creates a commit")
+		index              = flag.String("index", "", "Name of a Markdown file listing all dashboards with links to Grafana, e.g. INDEX.md (optional)")
+		codeowners         = flag.Bool("codeowners", false, "Commit a CODEOWNERS file assigning the dashboard files to the owners named by their -codeowners.tag tags")
+		codeownersTag      = flag.String("codeowners.tag", "", "Prefix of the tags naming the owners of a dashboard, e.g. owner:@ops (default owner:)")
+		skipTag            = flag.String("skip-tag", gfdashsync.DefaultSkipTag, "Tag of dashboards which are neither synced nor deleted, empty to disable")
+		fast               = flag.Bool("fast", false, "Do not fetch dashboards whose version was already synced, run without it after changing options affecting the files")
+		explode            = flag.Bool("explode", false, "Experimental: write each dashboard as a directory with dashboard.json and a file per panel in panels/")
+		implode            = flag.String("implode", "", "Print the dashboard exploded into the given directory reassembled for restoring, and exit")
+		injectMeta         = flag.Bool("inject-meta", false, "Add a _meta field with the Grafana URL, the UID and the sync time to the dashboard files, which is ignored when comparing them")
+		validate           = flag.Bool("validate", false, "Skip dashboards without title, UID or panels and keep their committed version")
+		checkRefs          = flag.Bool("check-refs", false, "Warn about datasources and dashboard links of the dashboards which do not exist in Grafana")
+		checkRefsStrict    = flag.Bool("check-refs-strict", false, "Like -check-refs, but fail without committing if dangling references are found")
+		showVersion        = flag.Bool("version", false, "Print the version and exit")
+		verbose            = flag.Bool("v", false, "Log the fetch duration and size of each dashboard and the slowest dashboards")
+		maxFetchErrors     = flag.String("max-fetch-errors", "", "Abort before committing if more dashboards could not be fetched, a number or a percentage like 10% (default unlimited)")
 	)
 	flag.Parse()
 
-	if err := setFlagsFromFile(*config); err != nil {
+	if *showVersion {
+		fmt.Println(version)
+		return
+	}
+
+	if err := setFlagsFromFiles(flag.CommandLine, *config, allowEnv); err != nil {
 		log.Fatal(err)
 	}
 
-	switch {
-	case *gfAPI == "":
-		log.Fatal("error missing -grafana.api")
-	case *gfToken == "":
-		log.Fatal("error missing -token.api")
-	case *gitAPI == "":
-		log.Fatal("error missing -git.api")
-	case *gitToken == "":
-		log.Fatal("error missing -git.token")
-	case *gitPID == -1:
-		log.Fatal("error missing -git.pid")
+	if *implode != "" {
+		b, err := gfdashsync.Implode(*implode)
+		if err != nil {
+			log.Fatalf("error reassembling %s: %v", *implode, err)
+		}
+		if b, err = gfdashsync.RewriteDatasources(b, *dsRewrite); err != nil {
+			log.Fatalf("error rewriting datasources of %s: %v", *implode, err)
+		}
+		// Library panels must exist before the dashboard is imported.
+		uids, err := gfdashsync.LibraryPanelRefs(b)
+		if err != nil {
+			log.Fatalf("error reading library panels of %s: %v", *implode, err)
+		}
+		for _, uid := range uids {
+			log.Printf("dashboard uses library panel %q, create it from library-panels/%s.json before importing the dashboard", uid, uid)
+		}
+		os.Stdout.Write(b)
+		return
 	}
 
-	gf, err := gapi.New(*gfAPI, gapi.Config{APIKey: *gfToken})
-	if err != nil {
-		log.Fatalf("failed to create grafana client: %v", err)
+	if err := setTokenFromFile(gfToken, *gfTokenF); err != nil {
+		log.Fatalf("error reading -grafana.token-file: %v", err)
+	}
+	if err := setTokenFromFile(gitToken, *gitTokenF); err != nil {
+		log.Fatalf("error reading -git.token-file: %v", err)
+	}
+
+	// In a Gitlab CI job the job token is used if no token is given.
+	if *gitToken == "" && *gitAuth == gfdashsync.AuthJob {
+		*gitToken = os.Getenv("CI_JOB_TOKEN")
 	}
 
-	git, err := NewGitlab(*gitAPI, *gitToken, *gitBranch, *gitPID)
+	if *format != "text" && *format != "json" {
+		log.Fatalf("error unknown -format %q", *format)
+	}
+
+	pids, err := gfdashsync.ParsePIDs(*gitPID)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatalf("error parsing -git.pid: %v", err)
 	}
 
-	dashboards, err := gf.Dashboards()
+	gfdashsync.Version = version
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	res, err := gfdashsync.Run(ctx, gfdashsync.Options{
+		Instance:             *instance,
+		UserAgent:            *userAgent,
+		Proxy:                *proxy,
+		GrafanaAPI:           *gfAPI,
+		GrafanaToken:         *gfToken,
+		GrafanaUser:          *gfUser,
+		GrafanaPassword:      *gfPass,
+		GrafanaVersion:       *gfVersion,
+		GrafanaRPS:           *gfRPS,
+		GrafanaTimeout:       *gfTimeout,
+		GrafanaOrgID:         *gfOrgID,
+		GitProvider:          *gitProv,
+		GitAPI:               *gitAPI,
+		GitToken:             *gitToken,
+		GitAuth:              *gitAuth,
+		GitTarget:            *gitTarget,
+		GitPIDs:              pids,
+		GitRepo:              *gitRepo,
+		GitBranch:            *gitBranch,
+		GitStartSHA:          *gitSHA,
+		GitTransport:         *gitTrans,
+		SeparateHistory:      *histSep,
+		RepoTreeCache:        *treeCache,
+		Lock:                 *gitLock,
+		LockTTL:              *lockTTL,
+		GitForce:             *gitForce,
+		GitLastCommitID:      *gitLastID,
+		GitCreateBranch:      *gitCreate,
+		GitStartBranch:       *gitStart,
+		GitAuthorName:        *gitAuthor,
+		GitAuthorEmail:       *gitEmail,
+		GitSignoff:           *gitSignof,
+		TriggerUser:          *trigUser,
+		GitCommitMode:        *gitCommit,
+		GitMessageFile:       *gitMsg,
+		GitFileMessage:       *gitFMsg,
+		GitTag:               *gitTag,
+		GitTagForce:          *gitTagF,
+		Mode:                 *mode,
+		OutputDir:            *outputDir,
+		SnapshotPeriod:       *snapPer,
+		HistoryRef:           *histRef,
+		IncludeDataSources:   *includeDataSources,
+		IncludeFolders:       *includeFolders,
+		IncludeLibraryPanels: *includeLibPanels,
+		IncludePermissions:   *includePermissions,
+		Thumbnails:           *thumbnails,
+		IncludeSnapshots:     *includeSnapshots,
+		IncludePlaylists:     *includePlaylists,
+		SnapshotsKeepExpired: *keepSnapshots,
+		MaxChanges:           *maxChanges,
+		HistoryRebuild:       *historyRebuild,
+		CompactHistory:       *compactHistory,
+		CommitHistoryChanges: *commitHistory,
+		HistoryKeep:          *historyKeep,
+		HistoryFormat:        *historyFormat,
+		Only:                 *only,
+		Folders:              *gfFolders,
+		FoldersRecursive:     *gfFoldRec,
+		Ignore:               *ignore,
+		RepoClean:            *repoClean,
+		StagingFile:          *stagingFile,
+		Resume:               *resume,
+		PruneGrace:           *pruneGrace,
+		ArchiveDeleted:       *archiveDeleted,
+		Gzip:                 *gz,
+		PathTemplate:         *pathTmpl,
+		PathByTag:            *pathByTag,
+		Layout:               *layout,
+		Normalize:            *normalize,
+		NormalizeFile:        *normalizeFile,
+		DatasourceRewrite:    *dsRewrite,
+		Redact:               *redact,
+		RedactFile:           *redactFile,
+		PostCommit:           *postCommit,
+		PostCommitRequired:   *postCommitRequired,
+		NotifyWebhook:        *notifyWebhook,
+		NotifyAlways:         *notifyAlways,
+		Diff:                 *diff,
+		Provisioning:         *provisioning,
+		SemanticDiff:         *semanticDiff,
+		Conflict:             *conflict,
+		Heartbeat:            *heartbeat,
+		CommitEmpty:          *commitEmpty,
+		Codeowners:           *codeowners,
+		CodeownersTag:        *codeownersTag,
+		Index:                *index,
+		MaxFetchErrors:       *maxFetchErrors,
+		SkipTag:              *skipTag,
+		Fast:                 *fast,
+		Explode:              *explode,
+		InjectMeta:           *injectMeta,
+		Validate:             *validate,
+		CheckRefs:            *checkRefs,
+		CheckRefsStrict:      *checkRefsStrict,
+		Verbose:              *verbose,
+	})
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	for _, d := range dashboards {
-		b, err := gf.DashboardByUID(d.UID)
-		if err != nil {
-			log.Printf("error getting dashboard %q with ID %d: %v", d.Title, d.ID, err)
-			continue
+	if *mode == gfdashsync.ModeList {
+		if err := printList(res.List, *format); err != nil {
+			log.Fatal(err)
 		}
+		return
+	}
 
-		data, err := json.MarshalIndent(b, "", "	")
-		if err != nil {
-			log.Printf("error converting dashboard %q with ID %d: %v", d.Title, d.ID, err)
-			continue
+	if *mode == gfdashsync.ModeHistoryDiff {
+		if err := printHistoryChanges(res.HistoryChanges, *format); err != nil {
+			log.Fatal(err)
 		}
+		return
+	}
 
-		f := &File{
-			UID:     d.UID,
-			Path:    fmt.Sprintf("/%s/%s.json", d.FolderTitle, d.Title),
-			SHA256:  hash(data),
-			content: data,
+	if *mode == gfdashsync.ModeListOrphans {
+		if err := printOrphans(res.Orphans, *format); err != nil {
+			log.Fatal(err)
 		}
-
-		git.Add(f)
+		return
 	}
 
-	if err := git.Commit(); err != nil {
-		log.Fatal(err)
+	if *mode == gfdashsync.ModeCheck {
+		failed := 0
+		for _, c := range res.Checks {
+			if c.Err != nil {
+				failed++
+				fmt.Printf("FAIL %s: %v\n", c.Name, c.Err)
+				continue
+			}
+			fmt.Printf("ok   %s: %s\n", c.Name, c.Detail)
+		}
+		if failed > 0 {
+			log.Fatalf("%d of %d checks failed", failed, len(res.Checks))
+		}
+		return
 	}
-}
-
-func hash(data []byte) string {
-	h := sha256.New()
-	h.Write(data)
-	return hex.EncodeToString(h.Sum(nil))
-}
-
-type History map[string]*File
-
-type File struct {
-	UID    string `json:"uid"`
-	Path   string `json:"path"`
-	SHA256 string `json:"sha256"`
-
-	content   []byte
-	processed bool
-}
 
-func (f *File) moved(hf *File) bool {
-	return (f.Path != hf.Path) && (f.UID == hf.UID) && (f.SHA256 != hf.SHA256)
-}
-
-func (f *File) modified(hf *File) bool {
-	return (f.Path == hf.Path) && (f.UID == hf.UID) && (f.SHA256 != hf.SHA256)
-}
+	if len(res.DanglingRefs) > 0 {
+		log.Printf("warning %d dangling references found", len(res.DanglingRefs))
+	}
 
-type Gitlab struct {
-	client *gitlab.Client
-	pid    int
-	branch string
+	if *mode == gfdashsync.ModeVerify {
+		for _, a := range res.Drift {
+			printAction(a)
+		}
+		for _, d := range res.Diffs {
+			fmt.Print(d)
+		}
+		if len(res.Drift) > 0 {
+			log.Fatalf("repository is out of sync: %d pending changes", len(res.Drift))
+		}
+		return
+	}
 
-	history       History
-	historyFile   string
-	historyAction gitlab.FileActionValue
+	if *mode == gfdashsync.ModeExport {
+		log.Printf("exported %d files to %s", len(res.Drift), *outputDir)
+		return
+	}
 
-	actions []*gitlab.CommitActionOptions
+	// The drift is fixed, but reported to flag changes made in Grafana.
+	if *failOnDrift && len(res.Drift) > 0 {
+		for _, a := range res.Drift {
+			printAction(a)
+		}
+		log.Fatalf("repository was out of sync: %d changes committed", len(res.Drift))
+	}
 }
 
-func NewGitlab(baseURL, token, branch string, pid int) (*Gitlab, error) {
-	c, err := gitlab.NewClient(token, gitlab.WithBaseURL(baseURL))
-	if err != nil {
-		return nil, fmt.Errorf("gitlab: error creating client: %w", err)
+// printList prints the dashboards to stdout, one per line with tab separated
+// UID, title, folder and tags or as JSON.
+func printList(dashboards []gapi.FolderDashboardSearchResponse, format string) error {
+	if format == "json" {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "	")
+		return e.Encode(dashboards)
 	}
 
-	g := &Gitlab{
-		client:        c,
-		pid:           pid,
-		branch:        branch,
-		history:       make(History),
-		historyFile:   "history.json",
-		historyAction: gitlab.FileUpdate,
+	for _, d := range dashboards {
+		fmt.Printf("%s\t%s\t%s\t%s\n", d.UID, d.Title, d.FolderTitle, strings.Join(d.Tags, ","))
 	}
+	return nil
+}
 
-	if err := g.parseHistory(); err != nil {
-		return nil, fmt.Errorf("gitlab: error parsing history: %w", err)
+// printHistoryChanges prints the history changes to stdout as table or as
+// JSON.
+func printHistoryChanges(changes []gfdashsync.HistoryChange, format string) error {
+	if format == "json" {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "	")
+		return e.Encode(changes)
 	}
 
-	return g, nil
-}
-
-// parseHistory reads "history.json" from the repository.
-func (g *Gitlab) parseHistory() error {
-	f, resp, err := g.client.RepositoryFiles.GetFile(g.pid, g.historyFile, &gitlab.GetFileOptions{
-		Ref: gitlab.String(g.branch),
-	}, nil)
-	if err != nil {
-		// If the error is a 404 File Not Found we will assume there is no
-		// history and processed without error but setting the action to create
-		// a new history file. All other errors will be returned as such.
-		if resp != nil && resp.StatusCode == http.StatusNotFound {
-			g.historyAction = gitlab.FileCreate
-			return nil
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CHANGE\tUID\tPATH\tVERSION")
+	for _, c := range changes {
+		p := c.Path
+		if c.PreviousPath != "" {
+			p = c.PreviousPath + " -> " + c.Path
 		}
-
-		return err
+		v := ""
+		switch {
+		case c.PreviousVersion == c.Version:
+		case c.PreviousVersion == 0:
+			v = fmt.Sprint(c.Version)
+		case c.Version == 0:
+			v = fmt.Sprint(c.PreviousVersion)
+		default:
+			v = fmt.Sprintf("%d -> %d", c.PreviousVersion, c.Version)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", c.Change, c.UID, p, v)
 	}
+	return w.Flush()
+}
 
-	data, err := base64.StdEncoding.DecodeString(f.Content)
-	if err != nil {
-		return err
+// printOrphans prints the orphans of the history to stdout as table or JSON.
+func printOrphans(orphans []gfdashsync.Orphan, format string) error {
+	if format == "json" {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "	")
+		return e.Encode(orphans)
 	}
 
-	return json.Unmarshal([]byte(data), &g.history)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tUID\tMISSING SINCE")
+	for _, o := range orphans {
+		since := ""
+		if o.MissingSince != nil {
+			since = o.MissingSince.Format(time.RFC3339)
+			if !o.Due {
+				since += " (grace period)"
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", o.Path, o.UID, since)
+	}
+	return w.Flush()
 }
 
-// Add adds the file to be committed.
-func (g *Gitlab) Add(in *File) {
-	hf, ok := g.history[in.UID]
-	if !ok {
-		g.add(in, gitlab.FileCreate, "")
+// printAction prints a pending commit action to stdout.
+func printAction(a *gitlab.CommitActionOptions) {
+	if a.PreviousPath != nil {
+		fmt.Printf("%s %s -> %s\n", *a.Action, *a.PreviousPath, *a.FilePath)
 		return
 	}
+	fmt.Printf("%s %s\n", *a.Action, *a.FilePath)
+}
 
-	switch {
-	case in.moved(hf):
-		g.add(in, gitlab.FileMove, hf.Path)
-
-	case in.modified(hf):
-		g.add(in, gitlab.FileUpdate, "")
+// allowMissingEnvFlag is the flag allowing undefined environment variables
+// in the config files.
+const allowMissingEnvFlag = "allow-missing-env"
+
+// setFlagsFromFiles sets the flags of fs from the given comma separated config
+// files, applied in order so later files override earlier ones. Flags set on
+// the command line take precedence over all files. allowMissing is the value
+// of the allow-missing-env flag, which is applied from the files first, so
+// setting it in a config file affects the values of all files.
+func setFlagsFromFiles(fs *flag.FlagSet, files string, allowMissing *bool) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
 
-	default:
-		// If no action is preformed set the processed flag anyway.
-		hf.processed = true
+	var filenames []string
+	for _, filename := range strings.Split(files, ",") {
+		if filename = strings.TrimSpace(filename); filename != "" {
+			filenames = append(filenames, filename)
+		}
 	}
-}
-
-func (g *Gitlab) add(in *File, action gitlab.FileActionValue, prevPath string) {
-	in.processed = true
 
-	opt := &gitlab.CommitActionOptions{
-		Action:   gitlab.FileAction(action),
-		FilePath: gitlab.String(in.Path),
-		Content:  gitlab.String(string(in.content)),
+	if !set[allowMissingEnvFlag] {
+		onlyAllowMissing := func(name string) bool { return name == allowMissingEnvFlag }
+		for _, filename := range filenames {
+			if err := setFlagsFromFile(fs, filename, onlyAllowMissing, true); err != nil {
+				return err
+			}
+		}
 	}
 
-	if prevPath != "" {
-		opt.PreviousPath = gitlab.String(prevPath)
+	notSet := func(name string) bool { return !set[name] }
+	for _, filename := range filenames {
+		if err := setFlagsFromFile(fs, filename, notSet, *allowMissing); err != nil {
+			return err
+		}
 	}
 
-	g.actions = append(g.actions, opt)
-	g.history[in.UID] = in
+	return nil
 }
 
-func (g *Gitlab) updateHistory() error {
-	if len(g.history) == 0 {
-		return nil
-	}
-
-	data, err := json.Marshal(g.history)
+// setFlagsFromFile sets the flags of fs from the given config file, which has
+// a flag name and its value separated by whitespace on each line. Only the
+// flags for which use returns true are set. References to environment
+// variables like ${VAR} or $VAR in the values are expanded, "$$" is a literal
+// "$". Undefined variables are an error unless allowMissing is set, in which
+// case they expand to an empty string.
+func setFlagsFromFile(fs *flag.FlagSet, filename string, use func(name string) bool, allowMissing bool) error {
+	c, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
+	defer c.Close()
 
-	opt := &gitlab.CommitActionOptions{
-		Action:   gitlab.FileAction(g.historyAction),
-		FilePath: gitlab.String(g.historyFile),
-		Content:  gitlab.String(string(data)),
-	}
-
-	g.actions = append(g.actions, opt)
-	return nil
-}
+	s := bufio.NewScanner(c)
+	for s.Scan() {
+		f := strings.Fields(s.Text())
 
-func (g *Gitlab) deleteOrphans() {
-	for _, f := range g.history {
-		if f.processed {
+		if len(f) != 2 || !use(f[0]) {
 			continue
 		}
 
-		g.actions = append(g.actions, &gitlab.CommitActionOptions{
-			Action:   gitlab.FileAction(gitlab.FileDelete),
-			FilePath: gitlab.String(f.Path),
-		})
-
-		delete(g.history, f.UID)
+		v, err := expandEnv(f[1], allowMissing)
+		if err != nil {
+			return fmt.Errorf("config %s: %w", f[0], err)
+		}
+		fs.Set(f[0], v)
 	}
-}
 
-// Commit commits all pending commits to the repository.
-func (g *Gitlab) Commit() error {
-	g.deleteOrphans()
+	return s.Err()
+}
 
-	// nothing to commit
-	if len(g.actions) == 0 {
+// setTokenFromFile sets token to the content of the given file without
+// surrounding whitespace, e.g. of a mounted Kubernetes secret. It is a no-op
+// if no file is given.
+func setTokenFromFile(token *string, filename string) error {
+	if filename == "" {
 		return nil
 	}
 
-	if err := g.updateHistory(); err != nil {
+	b, err := os.ReadFile(filename)
+	if err != nil {
 		return err
 	}
 
-	opt := &gitlab.CreateCommitOptions{
-		Branch:        gitlab.String(g.branch),
-		CommitMessage: gitlab.String("ʕ◔ϖ◔ʔ: backup done."),
-		Actions:       g.actions,
-	}
-	_, _, err := g.client.Commits.CreateCommit(g.pid, opt, nil)
-	if err != nil {
-		return fmt.Errorf("gitlab: commit error: %w", err)
+	t := strings.TrimSpace(string(b))
+	if t == "" {
+		return fmt.Errorf("%s is empty", filename)
 	}
+	*token = t
 
 	return nil
 }
 
-func setFlagsFromFile(filename string) error {
-	// no config file given so we assume parameters are passed using the flags.
-	if filename == "" {
-		return nil
-	}
-
-	c, err := os.Open(filename)
-	if err != nil {
-		return err
-	}
-
-	flag.VisitAll(func(f *flag.Flag) {
-		s := bufio.NewScanner(c)
-		for s.Scan() {
-			f := strings.Fields(s.Text())
-
-			if len(f) != 2 {
-				continue
-			}
-			flag.Set(f[0], f[1])
+// expandEnv expands the environment variables in s.
+func expandEnv(s string, allowMissing bool) (string, error) {
+	var missing []string
+	v := os.Expand(s, func(name string) string {
+		if name == "$" {
+			return "$"
 		}
+		v, ok := os.LookupEnv(name)
+		if !ok && !allowMissing {
+			missing = append(missing, name)
+		}
+		return v
 	})
 
-	return nil
+	if len(missing) > 0 {
+		return "", fmt.Errorf("undefined environment variable %s", strings.Join(missing, ", "))
+	}
+	return v, nil
 }
@@ -5,247 +5,83 @@
 package main
 
 import (
-	"encoding/base64"
-	"encoding/json"
-	"fmt"
-	"net/http"
-	"net/http/httptest"
+	"flag"
+	"os"
+	"path/filepath"
 	"testing"
-
-	"github.com/xanzy/go-gitlab"
 )
 
-func TestGitlabAdd(t *testing.T) {
-	t.Run("create", func(t *testing.T) {
-		git, _ := MustGitlab(t, http.NotFound)
-
-		f := &File{
-			UID:    "go1",
-			Path:   "/dev/null.json",
-			SHA256: "12345",
-		}
-
-		git.Add(f)
-
-		if len(git.actions) != 1 {
-			t.Fatal("expected only one action")
-		}
-
-		if want, got := gitlab.FileCreate, *git.actions[0].Action; want != got {
-			t.Fatalf("want %v, got %v", want, got)
-		}
-	})
-
-	t.Run("move", func(t *testing.T) {
-		hf := MustHistoryHandler(t, `{"go1":{"uid":"go1","path":"/dev/null.json","sha256":"12345"}}`)
-		git, _ := MustGitlab(t, hf)
-
-		f := &File{
-			UID:    "go1",
-			Path:   "null.json",
-			SHA256: "54321",
-		}
-
-		git.Add(f)
-
-		if len(git.history) == 0 {
-			t.Fatal("expected history")
-		}
-
-		if len(git.actions) != 1 {
-			t.Fatal("expected one only action")
-		}
-
-		if want, got := gitlab.FileMove, *git.actions[0].Action; want != got {
-			t.Fatalf("want %v, got %v", want, got)
-		}
-	})
-
-	t.Run("modified", func(t *testing.T) {
-		hf := MustHistoryHandler(t, `{"go1":{"uid":"go1","path":"/dev/null.json","sha256":"12345"}}`)
-		git, _ := MustGitlab(t, hf)
-
-		f := &File{
-			UID:    "go1",
-			Path:   "/dev/null.json",
-			SHA256: "54321",
-		}
-
-		git.Add(f)
-
-		if len(git.history) == 0 {
-			t.Fatal("expected history")
-		}
-
-		if len(git.actions) != 1 {
-			t.Fatal("expected one only action")
-		}
-
-		if want, got := gitlab.FileUpdate, *git.actions[0].Action; want != got {
-			t.Fatalf("want %v, got %v", want, got)
-		}
-	})
-
-	t.Run("nothing", func(t *testing.T) {
-		hf := MustHistoryHandler(t, `{"go1":{"uid":"go1","path":"/dev/null.json","sha256":"12345"}}`)
-		git, _ := MustGitlab(t, hf)
-
-		f := &File{
-			UID:    "go1",
-			Path:   "/dev/null.json",
-			SHA256: "12345",
-		}
-
-		git.Add(f)
-
-		if len(git.history) == 0 {
-			t.Fatal("expected history")
-		}
-
-		if len(git.actions) != 0 {
-			t.Fatal("expected no action")
-		}
-	})
-
-}
-
-func TestGitlabCommit(t *testing.T) {
-	t.Run("allEmpty", func(t *testing.T) {
-		git, _ := MustGitlab(t, http.NotFound)
-		if err := git.Commit(); err != nil {
-			t.Fatal(err)
-		}
-	})
-
-	t.Run("noChangesNoCommit", func(t *testing.T) {
-		hf := MustHistoryHandler(t, `{
-			"go1": {
-				"uid": "go1",
-				"path": "/dev/null.json",
-				"sha256": "12345"
-			}
-		}`)
-
-		git, _ := MustGitlab(t, hf)
-
-		f := &File{
-			UID:    "go1",
-			Path:   "/dev/null.json",
-			SHA256: "12345",
-		}
-
-		git.Add(f)
-
-		if len(git.actions) != 0 {
-			t.Fatal("expected no action")
-		}
-
-		if err := git.Commit(); err != nil {
-			t.Fatal(err)
-		}
-	})
-
-	t.Run("oneFileChangeTwoActions", func(t *testing.T) {
-		hf := MustHistoryHandler(t, `{
-			"go1": {
-				"uid": "go1",
-				"path": "/dev/null.json",
-				"sha256": "12345"
-			}
-		}`)
-
-		git, mux := MustGitlab(t, hf)
-		mux.HandleFunc("/api/v4/projects/1/", commitHandler(t, http.StatusOK))
-
-		f := &File{
-			UID:    "go1",
-			Path:   "/dev/null.json",
-			SHA256: "54321",
-		}
-
-		git.Add(f)
-
-		if err := git.Commit(); err != nil {
-			t.Fatal(err)
-		}
-
-		if len(git.actions) != 2 {
-			t.Fatal("expected two action, one for the file one for the history.")
-		}
-	})
-
-	t.Run("multipleChanges", func(t *testing.T) {
-		hf := MustHistoryHandler(t, `{
-			"1": {
-				"uid": "1",
-				"path": "/dev/null1.json",
-				"sha256": "12345"
-			}
-		}`)
-
-		git, mux := MustGitlab(t, hf)
-		mux.HandleFunc("/api/v4/projects/1/", commitHandler(t, http.StatusOK))
-
-		inSize := 4
-		for i := 1; i <= inSize; i++ {
-			f := &File{
-				UID:    fmt.Sprintf("%d", i),
-				Path:   fmt.Sprintf("/dev/null%d.json", i),
-				SHA256: "54321",
-			}
-
-			git.Add(f)
-		}
-
-		if err := git.Commit(); err != nil {
-			t.Fatal(err)
-		}
-
-		if len(git.actions) != (inSize + 1) {
-			t.Fatal("expected five actions (4 files, 1 history).")
-		}
-	})
-}
-
-func commitHandler(t *testing.T, status int) http.HandlerFunc {
-	t.Helper()
-
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(status)
-		w.Write([]byte("{}"))
+func TestSetFlagsFromFiles(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.conf")
+	override := filepath.Join(dir, "prod.conf")
+	if err := os.WriteFile(base, []byte("a base\nb base\nc base\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(override, []byte("b prod\nc prod\n"), 0o600); err != nil {
+		t.Fatal(err)
 	}
-}
 
-func MustHistoryHandler(t *testing.T, in string) http.HandlerFunc {
-	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	allowMissing := fs.Bool(allowMissingEnvFlag, false, "")
+	a := fs.String("a", "", "")
+	b := fs.String("b", "", "")
+	c := fs.String("c", "", "")
+	if err := fs.Parse([]string{"-c", "cli"}); err != nil {
+		t.Fatal(err)
+	}
 
-	gf := &gitlab.File{
-		FileName: "history.json",
-		Content:  base64.StdEncoding.EncodeToString([]byte(in)),
+	if err := setFlagsFromFiles(fs, base+", "+override, allowMissing); err != nil {
+		t.Fatal(err)
 	}
 
-	j, err := json.Marshal(gf)
-	if err != nil {
-		panic(err)
+	// Later files override earlier ones and the command line overrides all.
+	if *a != "base" || *b != "prod" || *c != "cli" {
+		t.Fatalf("got a=%q b=%q c=%q, want a=base b=prod c=cli", *a, *b, *c)
 	}
 
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Write(j)
+	if err := setFlagsFromFiles(fs, filepath.Join(dir, "missing.conf"), allowMissing); err == nil {
+		t.Fatal("expected an error for a missing file")
 	}
 }
 
-func MustGitlab(t *testing.T, historyHandler http.HandlerFunc) (*Gitlab, *http.ServeMux) {
-	t.Helper()
+func TestSetFlagsFromFilesAllowMissingEnv(t *testing.T) {
+	dir := t.TempDir()
+	base := filepath.Join(dir, "base.conf")
+	prod := filepath.Join(dir, "prod.conf")
+	if err := os.WriteFile(base, []byte("a ${GFDASHSYNC_TEST_UNDEFINED}\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(prod, []byte("allow-missing-env true\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/api/v4/projects/1/repository/files/", historyHandler)
+	newFlagSet := func() (*flag.FlagSet, *bool) {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.String("a", "x", "")
+		return fs, fs.Bool(allowMissingEnvFlag, false, "")
+	}
 
-	server := httptest.NewServer(mux)
+	fs, allowMissing := newFlagSet()
+	if err := setFlagsFromFiles(fs, base, allowMissing); err == nil {
+		t.Fatal("expected an error for an undefined variable")
+	}
 
-	gl, err := NewGitlab(server.URL, "", "test", 1)
-	if err != nil {
+	// allow-missing-env of a later file applies to all files.
+	fs, allowMissing = newFlagSet()
+	if err := setFlagsFromFiles(fs, base+","+prod, allowMissing); err != nil {
 		t.Fatal(err)
 	}
+	if got := fs.Lookup("a").Value.String(); got != "" {
+		t.Fatalf("want a expanded to an empty string, got %q", got)
+	}
 
-	return gl, mux
+	// The command line overrides the files.
+	fs, allowMissing = newFlagSet()
+	if err := fs.Parse([]string{"-" + allowMissingEnvFlag + "=false"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := setFlagsFromFiles(fs, base+","+prod, allowMissing); err == nil {
+		t.Fatal("expected an error for an undefined variable")
+	}
 }